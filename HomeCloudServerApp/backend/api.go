@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Every route is served twice: under apiPrefix with the JSON envelope below,
+// and at its original path with the original plain-text / bare JSON bodies
+// so existing clients keep working.
+const (
+	apiVersion = "v1"
+	apiPrefix  = "/api/" + apiVersion
+)
+
+type ctxKey int
+
+const (
+	ctxRequestID ctxKey = iota
+	ctxEnvelope
+	ctxUser
+)
+
+// envelope is the body of every /api/v1 response.
+type envelope struct {
+	Version   string      `json:"version"`
+	OK        bool        `json:"ok"`
+	RequestID string      `json:"request_id"`
+	Message   string      `json:"message,omitempty"`
+	Data      interface{} `json:"data,omitempty"`
+	Error     *apiError   `json:"error,omitempty"`
+}
+
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// fileItem describes a file or folder to clients. Path is always relative
+// to the storage root; FullPath is only filled in on the legacy /list route.
+type fileItem struct {
+	Name     string    `json:"name"`
+	Path     string    `json:"path"`
+	FullPath string    `json:"full_path,omitempty"`
+	IsDir    bool      `json:"is_dir"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	// SHA256 is set for files whose checksum is already known.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// opResult is the data of a mutating call: what the conflict policy did
+// and the metadata of the resulting item.
+type opResult struct {
+	Action string    `json:"action,omitempty"`
+	Item   *fileItem `json:"item,omitempty"`
+}
+
+func statItem(abs string) *fileItem {
+	info, err := os.Stat(abs)
+	if err != nil {
+		return nil
+	}
+	item := &fileItem{
+		Name:    info.Name(),
+		Path:    relFromAbs(abs),
+		IsDir:   info.IsDir(),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+	if !info.IsDir() {
+		item.SHA256, _ = cachedHash(abs, info)
+	}
+	return item
+}
+
+func newOpResult(action, abs string) opResult {
+	return opResult{Action: action, Item: statItem(abs)}
+}
+
+// requestIDMiddleware tags every request with an ID, echoed back in the
+// X-Request-ID header and in the envelope.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 64 || strings.ContainsAny(id, "\r\n") {
+			id = newID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxRequestID, id)))
+	})
+}
+
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(ctxRequestID).(string)
+	return id
+}
+
+func wantsEnvelope(r *http.Request) bool {
+	v, _ := r.Context().Value(ctxEnvelope).(bool)
+	return v
+}
+
+// apiV1 serves h below apiPrefix. The prefix is stripped so handlers see
+// the same paths as on the legacy routes.
+func apiV1(h http.HandlerFunc) http.HandlerFunc {
+	stripped := http.StripPrefix(apiPrefix, h)
+	return func(w http.ResponseWriter, r *http.Request) {
+		stripped.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxEnvelope, true)))
+	}
+}
+
+// handle registers h at pattern and at apiPrefix+pattern.
+func handle(pattern string, h http.HandlerFunc) {
+	http.HandleFunc(pattern, h)
+	http.HandleFunc(apiPrefix+pattern, apiV1(h))
+}
+
+func writeEnvelope(w http.ResponseWriter, r *http.Request, status int, env envelope) {
+	env.Version = apiVersion
+	env.RequestID = requestID(r)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(env)
+}
+
+// reply writes a successful response. Legacy routes get legacyText as plain
+// text, or data as bare JSON when legacyText is empty; /api/v1 routes get
+// the envelope.
+func reply(w http.ResponseWriter, r *http.Request, status int, legacyText string, data interface{}) {
+	if wantsEnvelope(r) {
+		writeEnvelope(w, r, status, envelope{OK: true, Message: legacyText, Data: data})
+		return
+	}
+	if legacyText != "" {
+		w.WriteHeader(status)
+		w.Write([]byte(legacyText))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+// replyError writes an error in the format of the route it was called on.
+func replyError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	replyErrorCode(w, r, status, errorCode(status), msg)
+}
+
+func replyErrorCode(w http.ResponseWriter, r *http.Request, status int, code, msg string) {
+	if wantsEnvelope(r) {
+		writeEnvelope(w, r, status, envelope{Error: &apiError{Code: code, Message: msg}})
+		return
+	}
+	http.Error(w, msg, status)
+}
+
+// errorCode is the machine-readable code for an HTTP status.
+func errorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "bad_request"
+	case http.StatusUnauthorized:
+		return "unauthorized"
+	case http.StatusForbidden:
+		return "access_denied"
+	case http.StatusNotFound:
+		return "not_found"
+	case http.StatusMethodNotAllowed:
+		return "method_not_allowed"
+	case http.StatusConflict:
+		return "conflict"
+	case http.StatusPreconditionFailed:
+		return "precondition_failed"
+	case http.StatusRequestEntityTooLarge:
+		return "too_large"
+	case http.StatusUnsupportedMediaType:
+		return "unsupported_media"
+	case http.StatusInsufficientStorage:
+		return "quota_exceeded"
+	case http.StatusServiceUnavailable:
+		return "unavailable"
+	}
+	return "internal"
+}
+
+// legacyItems adds the absolute full_path the old /list route returned.
+func legacyItems(items []*fileItem) []*fileItem {
+	for _, it := range items {
+		clean, _ := cleanRelPath(it.Path)
+		if rt, inner, err := splitRoot(clean); err == nil && rt != nil {
+			it.FullPath = filepath.Join(rt.Dir, inner)
+		}
+	}
+	return items
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const maxBatchOps = 1000
+
+const (
+	batchOK           = "ok"
+	batchError        = "error"
+	batchSkipped      = "skipped"
+	batchRolledBack   = "rolled_back"
+	batchRollbackFail = "rollback_failed"
+)
+
+// batchOp is one entry of a /batch request. Field names follow the single
+// endpoints: move/copy use source+dest, rename uses old+new, delete and
+// mkdir use path. on_conflict overrides the batch wide policy.
+type batchOp struct {
+	Op         string `json:"op"`
+	Path       string `json:"path,omitempty"`
+	Source     string `json:"source,omitempty"`
+	Dest       string `json:"dest,omitempty"`
+	Old        string `json:"old,omitempty"`
+	New        string `json:"new,omitempty"`
+	OnConflict string `json:"on_conflict,omitempty"`
+}
+
+type batchResult struct {
+	Index     int    `json:"index"`
+	Op        string `json:"op"`
+	Status    string `json:"status"`
+	Action    string `json:"action,omitempty"`
+	Path      string `json:"path,omitempty"`
+	Code      int    `json:"code,omitempty"`
+	ErrorCode string `json:"error_code,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// batchRun executes the operations of one request. Every step returns how
+// to undo itself; in atomic mode deletions and overwritten targets are only
+// staged until the whole batch has succeeded.
+type batchRun struct {
+	atomic bool
+	id     string
+	// keep is set when something could not be put back; the staging area
+	// then holds the only copy of it and must not be cleaned up.
+	keep bool
+	// undo lists how to revert each successful step, in order.
+	undo []batchUndo
+}
+
+type batchUndo struct {
+	index int
+	fn    func() error
+}
+
+// staging is the staging area of the batch on the root full lies on, so
+// staging is always a rename.
+func (b *batchRun) staging(full string) string {
+	return internalPathFor(full, "staging", b.id)
+}
+
+// stageAside moves full into the batch staging area and returns a function
+// that puts it back.
+func (b *batchRun) stageAside(full string, index int) (func() error, error) {
+	stage := filepath.Join(b.staging(full), strconv.Itoa(index))
+	if err := os.MkdirAll(filepath.Dir(stage), 0700); err != nil {
+		return nil, err
+	}
+	if err := rootRename(full, stage); err != nil {
+		return nil, err
+	}
+	return func() error {
+		if err := rootRename(stage, full); err != nil {
+			return err
+		}
+		journalChange(changeCreate, full, "", false)
+		return nil
+	}, nil
+}
+
+// removeCreated returns an undo that removes what a step created.
+func removeCreated(full string) func() error {
+	return func() error {
+		info, statErr := os.Lstat(full)
+		if err := rootRemoveAll(full); err != nil {
+			return err
+		}
+		journalChange(changeDelete, full, "", statErr == nil && info.IsDir())
+		return nil
+	}
+}
+
+// stageOverwrite parks the entry an overwriting step would replace, so the
+// step can be undone. It returns nil when there is nothing to keep.
+func (b *batchRun) stageOverwrite(index int, policy, source, target string) (func() error, error) {
+	if !b.atomic || policy != conflictOverwrite {
+		return nil, nil
+	}
+	full, err := resolveItemPath(target)
+	if err != nil {
+		return nil, err
+	}
+	if source != "" {
+		if src, err := resolveItemPath(source); err == nil && src == full {
+			return nil, nil
+		}
+	}
+	if _, err := os.Lstat(full); err != nil {
+		return nil, nil
+	}
+	restore, err := b.stageAside(full, index)
+	if err != nil {
+		return nil, internalFail("Failed to keep overwritten target", err)
+	}
+	return restore, nil
+}
+
+func (b *batchRun) run(r *http.Request, index int, op batchOp, policy string) (string, string, func() error, error) {
+	var (
+		final, action string
+		undo          func() error
+	)
+
+	switch op.Op {
+	case "move", "rename":
+		source, target := op.Source, op.Dest
+		if op.Op == "rename" {
+			source, target = op.Old, op.New
+		}
+		src, err := resolveItemPath(source)
+		if err != nil {
+			return "", "", nil, err
+		}
+		restore, err := b.stageOverwrite(index, policy, source, target)
+		if err != nil {
+			return "", "", nil, err
+		}
+		if op.Op == "move" {
+			final, action, err = moveItem(r.Context(), source, target, policy)
+		} else {
+			final, action, err = renameItem(r.Context(), source, target, policy)
+		}
+		return b.finish(final, action, restore, err, func() error { return movePath(final, src) })
+
+	case "copy":
+		restore, err := b.stageOverwrite(index, policy, op.Source, op.Dest)
+		if err != nil {
+			return "", "", nil, err
+		}
+		final, action, err = copyItem(r.Context(), requestUser(r), op.Source, op.Dest, policy)
+		return b.finish(final, action, restore, err, removeCreated(final))
+
+	case "delete":
+		if !b.atomic {
+			return "", "", nil, deleteItem(op.Path)
+		}
+		full, err := resolveItemPath(op.Path)
+		if err != nil {
+			return "", "", nil, err
+		}
+		info, err := os.Lstat(full)
+		if os.IsNotExist(err) {
+			return "", "", nil, opFail(http.StatusNotFound, "File or folder not found")
+		}
+		undo, err = b.stageAside(full, index)
+		if err != nil {
+			return "", "", nil, opFail(http.StatusInternalServerError, "Failed to delete file/folder")
+		}
+		// Like deleteItem, record the delete here instead of leaving it to
+		// the watcher, which only sees a rename into the internal folder.
+		journalChange(changeDelete, full, "", info != nil && info.IsDir())
+		return "", "", undo, nil
+
+	case "mkdir":
+		target, err := resolveItemPath(op.Path)
+		if err != nil {
+			return "", "", nil, err
+		}
+		var restore func() error
+		if info, serr := os.Stat(target); serr == nil && !info.IsDir() {
+			if restore, err = b.stageOverwrite(index, policy, "", op.Path); err != nil {
+				return "", "", nil, err
+			}
+		}
+		created := firstMissing(target)
+		final, action, err = mkdirItem(op.Path, policy)
+		if final != target {
+			created = final
+		}
+		return b.finish(final, action, restore, err, removeCreated(created))
+	}
+
+	return "", "", nil, opFail(http.StatusBadRequest, fmt.Sprintf("Unknown operation %q", op.Op))
+}
+
+// finish combines a step's own undo with restoring the target it replaced.
+func (b *batchRun) finish(final, action string, restore func() error, err error, undo func() error) (string, string, func() error, error) {
+	if err != nil {
+		if restore != nil {
+			if rerr := restore(); rerr != nil {
+				b.keep = true
+				log.Printf("Batch %s: step failed (%v) and the replaced target could not be put back: %v", b.id, err, rerr)
+				return "", "", nil, opFail(http.StatusInternalServerError, "Step failed and the replaced target could not be put back; it is kept on the server")
+			}
+		}
+		return "", "", nil, err
+	}
+	if action == actionSkipped {
+		return final, action, nil, nil
+	}
+	if restore == nil {
+		return final, action, undo, nil
+	}
+	return final, actionOverwritten, func() error {
+		if err := undo(); err != nil {
+			return err
+		}
+		return restore()
+	}, nil
+}
+
+// firstMissing returns the topmost folder that MkdirAll(p) would create.
+func firstMissing(p string) string {
+	for {
+		parent := filepath.Dir(p)
+		if parent == p {
+			return p
+		}
+		if _, err := os.Lstat(parent); err == nil {
+			return p
+		}
+		p = parent
+	}
+}
+
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		replyError(w, r, http.StatusMethodNotAllowed, "use POST method")
+		return
+	}
+
+	type Req struct {
+		Atomic     bool      `json:"atomic"`
+		OnConflict string    `json:"on_conflict"`
+		Operations []batchOp `json:"operations"`
+	}
+	var req Req
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		replyError(w, r, http.StatusBadRequest, "Bad request")
+		return
+	}
+	batchPolicy, err := conflictPolicy(r, req.OnConflict)
+	if err != nil {
+		replyOpError(w, r, err)
+		return
+	}
+	if len(req.Operations) == 0 || len(req.Operations) > maxBatchOps {
+		replyError(w, r, http.StatusBadRequest, fmt.Sprintf("A batch needs between 1 and %d operations", maxBatchOps))
+		return
+	}
+
+	b := &batchRun{atomic: req.Atomic, id: newID()}
+	defer b.cleanup()
+
+	results := make([]batchResult, len(req.Operations))
+	failed := false
+	for i, op := range req.Operations {
+		results[i] = batchResult{Index: i, Op: op.Op}
+		if failed && req.Atomic {
+			results[i].Status = batchSkipped
+			continue
+		}
+
+		policy := batchPolicy
+		if op.OnConflict != "" {
+			if !validConflictPolicy(op.OnConflict) {
+				failed = true
+				results[i].Status = batchError
+				results[i].Code, results[i].ErrorCode, results[i].Error = errorInfo(opFail(http.StatusBadRequest, "Unknown on_conflict "+strconv.Quote(op.OnConflict)))
+				continue
+			}
+			policy = op.OnConflict
+		}
+
+		final, action, undoFn, err := b.run(r, i, op, policy)
+		if err != nil {
+			failed = true
+			results[i].Status = batchError
+			results[i].Code, results[i].ErrorCode, results[i].Error = errorInfo(err)
+			continue
+		}
+		results[i].Status = batchOK
+		results[i].Action = action
+		if final != "" {
+			results[i].Path = relFromAbs(final)
+		}
+		if undoFn != nil {
+			b.undo = append(b.undo, batchUndo{i, undoFn})
+		}
+	}
+
+	rolledBack := false
+	if failed && req.Atomic {
+		rolledBack = b.rollback(results)
+	}
+
+	status := http.StatusOK
+	if failed {
+		status = http.StatusMultiStatus
+	}
+	reply(w, r, status, "", map[string]interface{}{
+		"atomic":      req.Atomic,
+		"success":     !failed,
+		"rolled_back": rolledBack,
+		"results":     results,
+	})
+}
+
+// rollback undoes the successful steps in reverse order and reports
+// whether all of them could be undone.
+func (b *batchRun) rollback(results []batchResult) bool {
+	ok := true
+	for i := len(b.undo) - 1; i >= 0; i-- {
+		step := b.undo[i]
+		if err := step.fn(); err != nil {
+			log.Printf("Batch %s: rollback of step %d failed: %v", b.id, step.index, err)
+			b.keep = true
+			results[step.index].Status = batchRollbackFail
+			results[step.index].Error = "Rollback failed; the original data is kept on the server"
+			ok = false
+			continue
+		}
+		results[step.index].Status = batchRolledBack
+	}
+	return ok
+}
+
+// cleanup removes the staging areas of the batch unless they hold data
+// that could not be put back.
+func (b *batchRun) cleanup() {
+	for _, rt := range storageRoots {
+		dir := rt.internal("staging", b.id)
+		if !b.keep {
+			os.RemoveAll(dir)
+		} else if _, err := os.Stat(dir); err == nil {
+			log.Printf("Batch %s: restore failed, staged data kept in %s", b.id, dir)
+		}
+	}
+}
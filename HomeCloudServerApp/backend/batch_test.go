@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type batchReply struct {
+	Success    bool          `json:"success"`
+	RolledBack bool          `json:"rolled_back"`
+	Results    []batchResult `json:"results"`
+}
+
+func postBatch(t *testing.T, body string) (int, batchReply) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	batchHandler(rec, httptest.NewRequest("POST", "/batch", strings.NewReader(body)))
+	var res batchReply
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("status %d, body %s: %v", rec.Code, rec.Body, err)
+	}
+	return rec.Code, res
+}
+
+// testJournal gives the test an empty change journal of its own.
+func testJournal(t testing.TB) *changeJournal {
+	old := changes
+	changes = &changeJournal{epoch: "test", marks: map[string]journalMark{}}
+	t.Cleanup(func() { changes = old })
+	return changes
+}
+
+func hasChange(j *changeJournal, op, path string) bool {
+	for _, rec := range j.records {
+		if rec.Op == op && rec.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+func readString(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestBatchAtomicCommit(t *testing.T) {
+	root := testRoot(t)
+	j := testJournal(t)
+	os.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(root, "b.txt"), []byte("b"), 0644)
+
+	code, res := postBatch(t, `{"atomic": true, "operations": [
+		{"op": "delete", "path": "a.txt"},
+		{"op": "copy", "source": "dir/file.txt", "dest": "b.txt", "on_conflict": "overwrite"}
+	]}`)
+	if code != http.StatusOK || !res.Success {
+		t.Fatalf("status %d, results %+v", code, res.Results)
+	}
+	if res.Results[1].Action != actionOverwritten {
+		t.Errorf("copy action %q, want %q", res.Results[1].Action, actionOverwritten)
+	}
+	if _, err := os.Lstat(filepath.Join(root, "a.txt")); !os.IsNotExist(err) {
+		t.Errorf("a.txt was not deleted: %v", err)
+	}
+	if got := readString(t, filepath.Join(root, "b.txt")); got != "in" {
+		t.Errorf("b.txt = %q, want the copied file", got)
+	}
+	if !hasChange(j, changeDelete, "a.txt") {
+		t.Errorf("the staged delete is not in the journal: %+v", j.records)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(root, internalDirName, "staging")); len(entries) != 0 {
+		t.Errorf("staging area left behind: %d entries", len(entries))
+	}
+}
+
+// TestBatchAtomicRollback fails a batch midway: every earlier step,
+// including deletes and overwrites, is put back.
+func TestBatchAtomicRollback(t *testing.T) {
+	root := testRoot(t)
+	j := testJournal(t)
+	os.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(root, "b.txt"), []byte("b"), 0644)
+	os.WriteFile(filepath.Join(root, "c.txt"), []byte("c"), 0644)
+
+	code, res := postBatch(t, `{"atomic": true, "operations": [
+		{"op": "delete", "path": "a.txt"},
+		{"op": "copy", "source": "dir/file.txt", "dest": "b.txt", "on_conflict": "overwrite"},
+		{"op": "rename", "old": "c.txt", "new": "a.txt"},
+		{"op": "move", "source": "dir", "dest": "moved"},
+		{"op": "mkdir", "path": "new/sub"},
+		{"op": "delete", "path": "missing.txt"},
+		{"op": "mkdir", "path": "other"}
+	]}`)
+	if code != http.StatusMultiStatus || res.Success || !res.RolledBack {
+		t.Fatalf("status %d, success %t, rolled back %t", code, res.Success, res.RolledBack)
+	}
+	want := []string{batchRolledBack, batchRolledBack, batchRolledBack, batchRolledBack, batchRolledBack, batchError, batchSkipped}
+	for i, r := range res.Results {
+		if r.Status != want[i] {
+			t.Errorf("step %d (%s): status %q, want %q", i, r.Op, r.Status, want[i])
+		}
+	}
+	if res.Results[5].ErrorCode != "not_found" {
+		t.Errorf("failed step: error code %q, want not_found", res.Results[5].ErrorCode)
+	}
+
+	for name, content := range map[string]string{"a.txt": "a", "b.txt": "b", "c.txt": "c", "dir/file.txt": "in"} {
+		if got := readString(t, filepath.Join(root, name)); got != content {
+			t.Errorf("%s = %q after rollback, want %q", name, got, content)
+		}
+	}
+	for _, name := range []string{"moved", "new", "other"} {
+		if _, err := os.Lstat(filepath.Join(root, name)); !os.IsNotExist(err) {
+			t.Errorf("%s still exists after rollback: %v", name, err)
+		}
+	}
+	if entries, _ := os.ReadDir(filepath.Join(root, internalDirName, "staging")); len(entries) != 0 {
+		t.Errorf("staging area left behind: %d entries", len(entries))
+	}
+	if !hasChange(j, changeDelete, "a.txt") || !hasChange(j, changeCreate, "b.txt") || !hasChange(j, changeDelete, "new") {
+		t.Errorf("journal misses the batch and its rollback: %+v", j.records)
+	}
+}
+
+// TestBatchKeepsUnrestorable checks that staged data which cannot be put
+// back survives the cleanup.
+func TestBatchKeepsUnrestorable(t *testing.T) {
+	root := testRoot(t)
+	testJournal(t)
+	r := httptest.NewRequest("POST", "/batch", nil)
+
+	b := &batchRun{atomic: true, id: newID()}
+	_, _, undo, err := b.run(r, 0, batchOp{Op: "delete", Path: "dir"}, conflictRename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.undo = append(b.undo, batchUndo{0, undo})
+	// Something new took the name, so the folder cannot be renamed back.
+	os.MkdirAll(filepath.Join(root, "dir", "blocker"), 0755)
+
+	results := make([]batchResult, 1)
+	if b.rollback(results) {
+		t.Fatal("rollback reported success")
+	}
+	if !b.keep || results[0].Status != batchRollbackFail {
+		t.Errorf("keep %t, status %q; want the staged data kept", b.keep, results[0].Status)
+	}
+	b.cleanup()
+	staged := filepath.Join(b.staging(filepath.Join(root, "dir")), "0", "file.txt")
+	if got := readString(t, staged); got != "in" {
+		t.Errorf("staged file = %q, want the deleted file", got)
+	}
+
+	// A failed step whose replaced target cannot be restored is kept too.
+	b = &batchRun{atomic: true, id: newID()}
+	_, _, _, err = b.finish("", "", func() error { return errors.New("restore") }, errors.New("step"), nil)
+	if status, _, _ := errorInfo(err); status != http.StatusInternalServerError || !b.keep {
+		t.Errorf("finish: status %d, keep %t; want 500 and keep", status, b.keep)
+	}
+}
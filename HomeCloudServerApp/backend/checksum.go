@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Content checksums: the SHA-256 of a file is computed the first time it is
+// asked for and cached with the size and mtime it belongs to, so a stale
+// entry is never used. The watcher drops entries of files that changed or
+// went away. The hash doubles as the file's strong ETag, which makes
+// If-Match / If-None-Match compare content rather than timestamps.
+
+type hashEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	SHA256  string    `json:"sha256"`
+}
+
+func (e hashEntry) matches(info os.FileInfo) bool {
+	return e.Size == info.Size() && e.ModTime.Equal(info.ModTime())
+}
+
+// maxHashEntries bounds the checksum cache. Past it, a tenth of the
+// entries is dropped at random; they are recomputed when asked for again.
+var maxHashEntries = 100000
+
+var hashes = struct {
+	sync.Mutex
+	entries map[string]hashEntry // by absolute path
+	running map[string]chan struct{}
+	dirty   bool
+}{entries: map[string]hashEntry{}, running: map[string]chan struct{}{}}
+
+func hashCacheFile() string { return storageRoots[0].internal("hashes.json") }
+
+// initHashes loads the hashes of the last run and subscribes to watcher
+// changes. It must run before the watchers start.
+func initHashes() {
+	if b, err := os.ReadFile(hashCacheFile()); err == nil {
+		if err := json.Unmarshal(b, &hashes.entries); err != nil {
+			log.Printf("Checksum cache unreadable, starting empty: %v", err)
+			hashes.entries = map[string]hashEntry{}
+		}
+		trimHashesLocked()
+	}
+	onChange(hashChanged)
+	onShutdown(saveHashes)
+}
+
+func saveHashes() {
+	hashes.Lock()
+	defer hashes.Unlock()
+	if !hashes.dirty {
+		return
+	}
+	b, err := json.Marshal(hashes.entries)
+	if err != nil {
+		return
+	}
+	file := hashCacheFile()
+	os.MkdirAll(filepath.Dir(file), 0700)
+	if err := os.WriteFile(file+".tmp", b, 0600); err == nil {
+		err = os.Rename(file+".tmp", file)
+	}
+	hashes.dirty = false
+}
+
+// hashChanged drops the cached hash of abs when the file changed, and every
+// hash below abs when it is gone (a removed or renamed folder).
+func hashChanged(abs string) {
+	info, err := os.Stat(abs)
+	hashes.Lock()
+	defer hashes.Unlock()
+	if err == nil {
+		if e, ok := hashes.entries[abs]; ok && (info.IsDir() || !e.matches(info)) {
+			delete(hashes.entries, abs)
+			hashes.dirty = true
+		}
+		return
+	}
+	prefix := abs + string(filepath.Separator)
+	for p := range hashes.entries {
+		if p == abs || strings.HasPrefix(p, prefix) {
+			delete(hashes.entries, p)
+			hashes.dirty = true
+		}
+	}
+}
+
+// cachedHash returns the hash of the file abs if it is known for info.
+func cachedHash(abs string, info os.FileInfo) (string, bool) {
+	hashes.Lock()
+	defer hashes.Unlock()
+	e, ok := hashes.entries[abs]
+	if !ok || !e.matches(info) {
+		return "", false
+	}
+	return e.SHA256, true
+}
+
+// storeHash caches sum for the file abs as it is now, for writers that
+// hashed what they wrote.
+func storeHash(abs, sum string) {
+	info, err := os.Stat(abs)
+	if err != nil {
+		return
+	}
+	hashes.Lock()
+	putHashLocked(abs, hashEntry{Size: info.Size(), ModTime: info.ModTime(), SHA256: sum})
+	hashes.Unlock()
+}
+
+func putHashLocked(abs string, e hashEntry) {
+	hashes.entries[abs] = e
+	hashes.dirty = true
+	trimHashesLocked()
+}
+
+// trimHashesLocked evicts entries once the cache outgrows maxHashEntries.
+// Map iteration order is random, which makes this random eviction.
+func trimHashesLocked() {
+	if len(hashes.entries) <= maxHashEntries {
+		return
+	}
+	for p := range hashes.entries {
+		if len(hashes.entries) <= maxHashEntries*9/10 {
+			break
+		}
+		delete(hashes.entries, p)
+	}
+	hashes.dirty = true
+}
+
+// fileHash returns the SHA-256 of the file abs, hashing it unless a cached
+// hash matches. Concurrent callers for the same file share one read.
+func fileHash(abs string) (string, error) {
+	for {
+		info, err := os.Stat(abs)
+		if err != nil {
+			return "", opFail(http.StatusNotFound, "Not found")
+		}
+		if info.IsDir() {
+			return "", opFail(http.StatusBadRequest, "Folders have no checksum")
+		}
+		hashes.Lock()
+		if e, ok := hashes.entries[abs]; ok && e.matches(info) {
+			hashes.Unlock()
+			return e.SHA256, nil
+		}
+		if ch, ok := hashes.running[abs]; ok {
+			hashes.Unlock()
+			<-ch
+			continue
+		}
+		ch := make(chan struct{})
+		hashes.running[abs] = ch
+		hashes.Unlock()
+
+		sum, err := hashFile(abs)
+		after, serr := os.Stat(abs)
+
+		hashes.Lock()
+		delete(hashes.running, abs)
+		close(ch)
+		// A file written to while it was read gets no cache entry.
+		if err == nil && serr == nil && after.Size() == info.Size() && after.ModTime().Equal(info.ModTime()) {
+			putHashLocked(abs, hashEntry{Size: info.Size(), ModTime: info.ModTime(), SHA256: sum})
+		}
+		hashes.Unlock()
+		if err != nil {
+			return "", opFail(http.StatusInternalServerError, "Failed to read file")
+		}
+		return sum, nil
+	}
+}
+
+func hashFile(abs string) (string, error) {
+	f, err := os.Open(abs)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func etagOf(sum string) string { return `"` + sum + `"` }
+
+// cachedETag is the ETag of the file abs if its hash is known.
+func cachedETag(abs string) (string, bool) {
+	info, err := os.Stat(abs)
+	if err != nil {
+		return "", false
+	}
+	sum, ok := cachedHash(abs, info)
+	if !ok {
+		return "", false
+	}
+	return etagOf(sum), true
+}
+
+// etagMatch reports whether the If-Match / If-None-Match list matches the
+// entry with hash current (empty for folders). "*" matches anything that
+// exists; strong comparison ignores weak tags.
+func etagMatch(list, current string, exists, strong bool) bool {
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			if exists {
+				return true
+			}
+			continue
+		}
+		if strings.HasPrefix(tag, "W/") {
+			if strong {
+				continue
+			}
+			tag = tag[2:]
+		}
+		if current != "" && tag == etagOf(current) {
+			return true
+		}
+	}
+	return false
+}
+
+// Writes through the API hold the lock of their path from the precondition
+// check until the new content is in place, so two clients that both saw
+// the same version cannot both replace it. Changes made directly on disk
+// are not covered.
+var pathLocks = struct {
+	sync.Mutex
+	m map[string]*pathLock
+}{m: map[string]*pathLock{}}
+
+type pathLock struct {
+	// held carries a token while the path is locked.
+	held chan struct{}
+	refs int
+}
+
+// lockPath waits for the lock of abs, or until ctx is done, and returns
+// the function that releases it.
+func lockPath(ctx context.Context, abs string) (func(), error) {
+	pathLocks.Lock()
+	l := pathLocks.m[abs]
+	if l == nil {
+		l = &pathLock{held: make(chan struct{}, 1)}
+		pathLocks.m[abs] = l
+	}
+	l.refs++
+	pathLocks.Unlock()
+
+	forget := func() {
+		pathLocks.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(pathLocks.m, abs)
+		}
+		pathLocks.Unlock()
+	}
+	select {
+	case l.held <- struct{}{}:
+		return func() {
+			<-l.held
+			forget()
+		}, nil
+	case <-ctx.Done():
+		forget()
+		return nil, ctx.Err()
+	}
+}
+
+// lockForWrite locks abs for a request that changes it and then applies
+// the request's preconditions. The caller releases the lock once the
+// change is complete.
+func lockForWrite(r *http.Request, abs string) (func(), error) {
+	unlock, err := lockPath(r.Context(), abs)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPreconditions(r, abs); err != nil {
+		unlock()
+		return nil, err
+	}
+	return unlock, nil
+}
+
+// checkPreconditions applies If-Match and If-None-Match to a request that
+// changes the entry at abs.
+func checkPreconditions(r *http.Request, abs string) error {
+	ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+	if ifMatch == "" && ifNoneMatch == "" {
+		return nil
+	}
+	info, err := os.Stat(abs)
+	exists := err == nil
+	current := ""
+	if exists && !info.IsDir() && (strings.Trim(ifMatch, " *") != "" || strings.Trim(ifNoneMatch, " *") != "") {
+		if current, err = fileHash(abs); err != nil {
+			return err
+		}
+	}
+	if ifMatch != "" && !etagMatch(ifMatch, current, exists, true) {
+		return opFail(http.StatusPreconditionFailed, "If-Match failed: the file is not the expected version")
+	}
+	if ifNoneMatch != "" && etagMatch(ifNoneMatch, current, exists, false) {
+		return opFail(http.StatusPreconditionFailed, "If-None-Match failed: the file already exists in that version")
+	}
+	return nil
+}
+
+type fileHashInfo struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	SHA256  string    `json:"sha256"`
+	ETag    string    `json:"etag"`
+}
+
+func hashHandler(w http.ResponseWriter, r *http.Request) {
+	abs, err := resolveItemPath(strings.TrimPrefix(r.URL.Path, "/hash/"))
+	if err != nil {
+		replyOpError(w, r, err)
+		return
+	}
+	sum, err := fileHash(abs)
+	if err != nil {
+		replyOpError(w, r, err)
+		return
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		replyError(w, r, http.StatusNotFound, "Not found")
+		return
+	}
+	w.Header().Set("ETag", etagOf(sum))
+	reply(w, r, http.StatusOK, "", fileHashInfo{Path: relFromAbs(abs), Size: info.Size(), ModTime: info.ModTime(), SHA256: sum, ETag: etagOf(sum)})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHashCacheBounded(t *testing.T) {
+	oldMax, oldEntries := maxHashEntries, hashes.entries
+	maxHashEntries, hashes.entries = 100, map[string]hashEntry{}
+	t.Cleanup(func() {
+		hashes.Lock()
+		maxHashEntries, hashes.entries = oldMax, oldEntries
+		hashes.Unlock()
+	})
+
+	hashes.Lock()
+	for i := 0; i < 1000; i++ {
+		putHashLocked(fmt.Sprintf("/data/file%d", i), hashEntry{SHA256: "x"})
+		if len(hashes.entries) > maxHashEntries {
+			t.Fatalf("%d entries after %d inserts, limit %d", len(hashes.entries), i+1, maxHashEntries)
+		}
+	}
+	// Eviction is random, so which entries survive is not checked; only
+	// that a trim keeps nine tenths.
+	n := len(hashes.entries)
+	hashes.Unlock()
+	if n < maxHashEntries*9/10 {
+		t.Errorf("%d entries left, want at least %d", n, maxHashEntries*9/10)
+	}
+}
+
+func TestLockPath(t *testing.T) {
+	unlock, err := lockPath(context.Background(), "/data/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Other paths are independent.
+	other, err := lockPath(context.Background(), "/data/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other()
+
+	got := make(chan struct{})
+	go func() {
+		u, _ := lockPath(context.Background(), "/data/a")
+		close(got)
+		u()
+	}()
+	select {
+	case <-got:
+		t.Fatal("second lock of a held path did not wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := lockPath(ctx, "/data/a"); err == nil {
+		t.Error("lockPath on a held path ignored a cancelled context")
+	}
+
+	unlock()
+	select {
+	case <-got:
+	case <-time.After(time.Second):
+		t.Fatal("waiter did not get the lock after unlock")
+	}
+	time.Sleep(10 * time.Millisecond)
+	pathLocks.Lock()
+	n := len(pathLocks.m)
+	pathLocks.Unlock()
+	if n != 0 {
+		t.Errorf("%d path locks left behind", n)
+	}
+}
+
+// TestConditionalUploadsSerialized sends several overwrites that all
+// expect the same version: exactly one may win.
+func TestConditionalUploadsSerialized(t *testing.T) {
+	root := testRoot(t)
+	target := filepath.Join(root, "dir", "file.txt")
+	sum, err := fileHash(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upload := func(content string) int {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("file", "file.txt")
+		fw.Write([]byte(content))
+		mw.Close()
+		r := httptest.NewRequest("POST", "/upload?path=dir&on_conflict=overwrite", &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		r.Header.Set("If-Match", etagOf(sum))
+		rec := httptest.NewRecorder()
+		uploadHandler(rec, r)
+		return rec.Code
+	}
+
+	const clients = 8
+	codes := make(chan int, clients)
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- upload(fmt.Sprintf("version %d", i) + strings.Repeat(".", 1<<20))
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	won := 0
+	for code := range codes {
+		switch code {
+		case http.StatusOK:
+			won++
+		case http.StatusPreconditionFailed:
+		default:
+			t.Errorf("unexpected status %d", code)
+		}
+	}
+	if won != 1 {
+		t.Errorf("%d conditional uploads replaced the same version, want 1", won)
+	}
+	if b, _ := os.ReadFile(target); string(b) == "in" {
+		t.Error("no upload was written")
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+const (
+	copyChunkSize = 8 << 20
+
+	// Copies above either threshold run as a background job.
+	copyJobBytes = 64 << 20
+	copyJobFiles = 500
+)
+
+// measureTree returns the number of bytes and regular files under root.
+func measureTree(root string) (int64, int, error) {
+	var size int64
+	var files int
+	err := filepath.WalkDir(root, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+			files++
+		}
+		return nil
+	})
+	return size, files, err
+}
+
+// copyTree copies the file or folder at src to dst, which must not exist.
+// progress is called after every chunk with the bytes and files completed.
+func copyTree(ctx context.Context, src, dst string, progress func(int64, int)) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case d.IsDir():
+			return rootMkdir(target, info.Mode().Perm()|0700)
+		case d.Type()&fs.ModeSymlink != 0:
+			// A link copied elsewhere may resolve outside the root, so links
+			// are only reproduced when symlinks are trusted anyway.
+			if symlinkPolicy != symlinkFollow {
+				log.Printf("Copy: skipping symlink %s", path)
+				return nil
+			}
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case d.Type().IsRegular():
+			return copyFile(ctx, path, target, info, progress)
+		}
+		return nil
+	})
+}
+
+func copyFile(ctx context.Context, src, dst string, info fs.FileInfo, progress func(int64, int)) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := rootOpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if reflinkFile(out, in) == nil {
+		progress(info.Size(), 0)
+	} else {
+		// io.Copy between two *os.File uses copy_file_range where the
+		// kernel offers it, so chunking only costs a syscall per 8 MiB.
+		for {
+			if err := ctx.Err(); err != nil {
+				out.Close()
+				return err
+			}
+			n, err := io.CopyN(out, in, copyChunkSize)
+			progress(n, 0)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				out.Close()
+				return err
+			}
+		}
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+	os.Chtimes(dst, info.ModTime(), info.ModTime())
+	progress(0, 1)
+	return nil
+}
+
+func copyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		replyError(w, r, http.StatusMethodNotAllowed, "use POST method")
+		return
+	}
+
+	type Req struct {
+		Source     string `json:"source"`
+		Dest       string `json:"dest"`
+		OnConflict string `json:"on_conflict"`
+	}
+	var req Req
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		replyError(w, r, http.StatusBadRequest, "Bad request")
+		return
+	}
+	policy, err := conflictPolicy(r, req.OnConflict)
+	if err != nil {
+		replyOpError(w, r, err)
+		return
+	}
+	plan, err := prepareCopy(requestUser(r), req.Source, req.Dest, policy)
+	if err != nil {
+		replyOpError(w, r, err)
+		return
+	}
+
+	if plan.bytes < copyJobBytes && plan.files < copyJobFiles {
+		if err := plan.execute(r.Context(), func(int64, int) {}); err != nil {
+			replyOpError(w, r, internalFail("Failed to copy", err))
+			return
+		}
+		writeConflictHeaders(w, plan.action, plan.dst)
+		if plan.action == actionSkipped {
+			reply(w, r, http.StatusOK, "Copy skipped, destination already exists", newOpResult(plan.action, plan.dst))
+			return
+		}
+		reply(w, r, http.StatusOK, "File/folder copied successfully", newOpResult(plan.action, plan.dst))
+		return
+	}
+
+	job := startJob(&Job{
+		Type:       "copy",
+		Owner:      requestUser(r),
+		Source:     req.Source,
+		Dest:       relFromAbs(plan.dst),
+		Action:     plan.action,
+		TotalBytes: plan.bytes,
+		TotalFiles: plan.files,
+	}, func(ctx context.Context, job *Job) error {
+		return plan.execute(ctx, job.addProgress)
+	})
+	writeConflictHeaders(w, plan.action, plan.dst)
+
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	reply(w, r, http.StatusAccepted, "", jobSnapshot(job))
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func postCopy(t *testing.T, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/copy", strings.NewReader(body))
+	r = r.WithContext(context.WithValue(r.Context(), ctxEnvelope, true))
+	rec := httptest.NewRecorder()
+	copyHandler(rec, r)
+	return rec
+}
+
+func waitJob(t *testing.T, job *Job) Job {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if snap := jobSnapshot(job); snap.FinishedAt != nil {
+			return snap
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not finish", job.ID)
+	return Job{}
+}
+
+func TestCopySymlinkSource(t *testing.T) {
+	root := testRoot(t)
+	for _, policy := range []string{symlinkDeny, symlinkFollowInside} {
+		symlinkPolicy = policy
+		rec := postCopy(t, `{"source":"inside","dest":"copy"}`)
+		if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), `"symlink_denied"`) {
+			t.Errorf("policy %s: status %d, body %s; want 403 symlink_denied", policy, rec.Code, rec.Body)
+		}
+		if _, err := os.Lstat(filepath.Join(root, "copy")); !os.IsNotExist(err) {
+			t.Errorf("policy %s: copy of a link created something: %v", policy, err)
+		}
+	}
+
+	symlinkPolicy = symlinkFollow
+	if rec := postCopy(t, `{"source":"inside","dest":"copy"}`); rec.Code != http.StatusOK {
+		t.Fatalf("follow: status %d, body %s", rec.Code, rec.Body)
+	}
+	if target, err := os.Readlink(filepath.Join(root, "copy")); err != nil || target != "dir" {
+		t.Errorf("follow: copy is %q, %v; want a link to dir", target, err)
+	}
+}
+
+func TestCopyJob(t *testing.T) {
+	root := testRoot(t)
+	many := filepath.Join(root, "many")
+	os.Mkdir(many, 0755)
+	for i := 0; i < copyJobFiles; i++ {
+		os.WriteFile(filepath.Join(many, fmt.Sprintf("f%03d.txt", i)), []byte("data"), 0644)
+	}
+
+	rec := postCopy(t, `{"source":"many","dest":"many copy"}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status %d, want 202; body %s", rec.Code, rec.Body)
+	}
+	id := strings.TrimPrefix(rec.Header().Get("Location"), "/jobs/")
+	jobsMu.RLock()
+	job := jobs[id]
+	jobsMu.RUnlock()
+	if job == nil {
+		t.Fatalf("no job %q", id)
+	}
+
+	snap := waitJob(t, job)
+	if snap.Status != jobDone || snap.DoneFiles != copyJobFiles || snap.DoneBytes != 4*copyJobFiles {
+		t.Errorf("job finished %s with %d files, %d bytes (%s)", snap.Status, snap.DoneFiles, snap.DoneBytes, snap.Error)
+	}
+	entries, _ := os.ReadDir(filepath.Join(root, "many copy"))
+	if len(entries) != copyJobFiles {
+		t.Errorf("copied %d files, want %d", len(entries), copyJobFiles)
+	}
+}
+
+// TestCopyJobCancel cancels a copy through DELETE /jobs/<id> after its
+// first chunk.
+func TestCopyJobCancel(t *testing.T) {
+	root := testRoot(t)
+	os.WriteFile(filepath.Join(root, "dir", "second.txt"), []byte("more"), 0644)
+
+	plan, err := prepareCopy(adminUser, "dir", "copy", conflictRename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	var once sync.Once
+	job := startJob(&Job{Type: "copy"}, func(ctx context.Context, job *Job) error {
+		return plan.execute(ctx, func(bytes int64, files int) {
+			job.addProgress(bytes, files)
+			once.Do(func() {
+				close(started)
+				<-ctx.Done()
+			})
+		})
+	})
+	<-started
+
+	rec := httptest.NewRecorder()
+	jobsHandler(rec, httptest.NewRequest("DELETE", "/jobs/"+job.ID, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("DELETE: status %d", rec.Code)
+	}
+	if snap := waitJob(t, job); snap.Status != jobCancelled {
+		t.Errorf("job finished %s, want %s", snap.Status, jobCancelled)
+	}
+	if _, err := os.Stat(filepath.Join(root, "copy")); !os.IsNotExist(err) {
+		t.Errorf("cancelled copy left its target behind: %v", err)
+	}
+}
+
+// TestCopyCancelKeepsOverwrittenTarget checks that a cancelled overwrite
+// leaves the old target as it was.
+func TestCopyCancelKeepsOverwrittenTarget(t *testing.T) {
+	root := testRoot(t)
+	os.Mkdir(filepath.Join(root, "target"), 0755)
+	os.WriteFile(filepath.Join(root, "target", "old.txt"), []byte("old"), 0644)
+
+	plan, err := prepareCopy(adminUser, "dir", "target", conflictOverwrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := plan.execute(ctx, func(int64, int) {}); err == nil {
+		t.Fatal("cancelled copy succeeded")
+	}
+
+	if b, err := os.ReadFile(filepath.Join(root, "target", "old.txt")); err != nil || string(b) != "old" {
+		t.Errorf("old target changed: %q, %v", b, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "target", "file.txt")); !os.IsNotExist(err) {
+		t.Errorf("cancelled copy reached the target: %v", err)
+	}
+	leftovers, _ := filepath.Glob(filepath.Join(root, internalDirName, "copy", "*"))
+	if len(leftovers) != 0 {
+		t.Errorf("staging left behind: %v", leftovers)
+	}
+}
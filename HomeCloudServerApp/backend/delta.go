@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Delta uploads work like rsync: the client fetches the block signatures
+// of the file it has an old copy of (/signature), finds the blocks that are
+// still in its new version with the rolling checksum and sends only the
+// rest (/delta). The server rebuilds the file next to the original, checks
+// the SHA-256 the client sent and swaps it in.
+//
+// The rolling checksum of a block X[0..n) is a + b<<16 with
+// a = sum(X[i]) mod 2^16 and b = sum((n-i)*X[i]) mod 2^16, as in rsync.
+//
+// A delta body is "HCD1" followed by operations, integers big-endian:
+//
+//	'C' offset:uint64 length:uint64  copy bytes of the current file
+//	'D' length:uint32 data           literal bytes
+
+const (
+	minDeltaBlock   = 1 << 10
+	maxDeltaBlock   = 8 << 20
+	maxDeltaLiteral = 64 << 20
+	deltaMagic      = "HCD1"
+)
+
+var errDeltaFormat = opFail(http.StatusBadRequest, "Malformed delta")
+
+type blockSignature struct {
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+type fileSignature struct {
+	Path      string           `json:"path"`
+	Size      int64            `json:"size"`
+	BlockSize int              `json:"block_size"`
+	Version   string           `json:"version"`
+	Blocks    []blockSignature `json:"blocks"`
+}
+
+// weakSum is the rsync rolling checksum of b.
+func weakSum(b []byte) uint32 {
+	var a, s uint32
+	n := uint32(len(b))
+	for i, c := range b {
+		a += uint32(c)
+		s += (n - uint32(i)) * uint32(c)
+	}
+	return a&0xffff | s<<16
+}
+
+// defaultBlockSize follows rsync: about the square root of the file size,
+// so the signature and the number of blocks grow slowly.
+func defaultBlockSize(size int64) int {
+	bs := int(math.Sqrt(float64(size)))
+	bs = (bs + minDeltaBlock - 1) / minDeltaBlock * minDeltaBlock
+	return min(max(bs, 8*minDeltaBlock), maxDeltaBlock)
+}
+
+// fileVersion identifies the content of a file well enough to refuse a
+// delta computed against an older state.
+func fileVersion(info os.FileInfo) string {
+	return fmt.Sprintf("%x-%x", info.Size(), info.ModTime().UnixNano())
+}
+
+// deltaTarget resolves the file a signature or delta is for.
+func deltaTarget(r *http.Request, prefix string) (string, os.FileInfo, error) {
+	abs, err := resolveItemPath(strings.TrimPrefix(r.URL.Path, prefix))
+	if err != nil {
+		return "", nil, err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return "", nil, opFail(http.StatusNotFound, "File not found")
+	}
+	if !info.Mode().IsRegular() {
+		return "", nil, opFail(http.StatusBadRequest, "Not a file")
+	}
+	return abs, info, nil
+}
+
+func signatureHandler(w http.ResponseWriter, r *http.Request) {
+	abs, info, err := deltaTarget(r, "/signature/")
+	if err != nil {
+		replyOpError(w, r, err)
+		return
+	}
+	bs := defaultBlockSize(info.Size())
+	if v := r.URL.Query().Get("block_size"); v != "" {
+		if bs, err = strconv.Atoi(v); err != nil || bs < minDeltaBlock || bs > maxDeltaBlock {
+			replyError(w, r, http.StatusBadRequest, fmt.Sprintf("block_size must be between %d and %d", minDeltaBlock, maxDeltaBlock))
+			return
+		}
+	}
+
+	f, err := os.Open(abs)
+	if err != nil {
+		replyError(w, r, http.StatusInternalServerError, "Failed to open file")
+		return
+	}
+	defer f.Close()
+	sig := fileSignature{Path: relFromAbs(abs), Size: info.Size(), BlockSize: bs, Version: fileVersion(info), Blocks: []blockSignature{}}
+	buf := make([]byte, bs)
+	rd := bufio.NewReaderSize(f, 1<<20)
+	for {
+		n, err := io.ReadFull(rd, buf)
+		if n > 0 {
+			strong := sha256.Sum256(buf[:n])
+			sig.Blocks = append(sig.Blocks, blockSignature{Weak: weakSum(buf[:n]), Strong: hex.EncodeToString(strong[:])})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			replyError(w, r, http.StatusInternalServerError, "Failed to read file")
+			return
+		}
+		if r.Context().Err() != nil {
+			return
+		}
+	}
+	reply(w, r, http.StatusOK, "", sig)
+}
+
+// deltaHandler rebuilds a file from the delta in the body. The query names
+// the version the delta was computed against, the final size and its
+// SHA-256; nothing changes unless all three check out.
+func deltaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		replyError(w, r, http.StatusMethodNotAllowed, "use POST method")
+		return
+	}
+	abs, info, err := deltaTarget(r, "/delta/")
+	if err != nil {
+		replyOpError(w, r, err)
+		return
+	}
+	q := r.URL.Query()
+	size, err := strconv.ParseInt(q.Get("size"), 10, 64)
+	want, herr := hex.DecodeString(q.Get("sha256"))
+	if err != nil || size < 0 || herr != nil || len(want) != sha256.Size {
+		replyError(w, r, http.StatusBadRequest, "size and sha256 of the new content are required")
+		return
+	}
+	unlock, err := lockForWrite(r, abs)
+	if err != nil {
+		replyOpError(w, r, err)
+		return
+	}
+	defer unlock()
+	// Another write may have replaced the file while this one waited.
+	if info, err = os.Stat(abs); err != nil {
+		replyError(w, r, http.StatusNotFound, "File not found")
+		return
+	}
+	if q.Get("base") != fileVersion(info) {
+		replyError(w, r, http.StatusPreconditionFailed, "File changed since its signature was taken")
+		return
+	}
+
+	reservation, err := reserveQuota(size, requestUser(r), abs)
+	if err != nil {
+		replyOpError(w, r, err)
+		return
+	}
+	defer reservation.release()
+
+	tmp := internalPathFor(abs, "upload", newID())
+	os.MkdirAll(filepath.Dir(tmp), 0700)
+	err = applyDelta(abs, tmp, bufio.NewReaderSize(r.Body, 1<<20), size, want)
+	if err == nil {
+		// The original may have changed while the delta was applied.
+		if cur, serr := os.Stat(abs); serr != nil || fileVersion(cur) != fileVersion(info) {
+			err = opFail(http.StatusPreconditionFailed, "File changed while the delta was applied")
+		}
+	}
+	if err == nil {
+		os.Chmod(tmp, info.Mode().Perm())
+		if rerr := replacePath(tmp, abs); rerr != nil {
+			err = opFail(http.StatusInternalServerError, "Failed to save file")
+		}
+	}
+	if err != nil {
+		os.Remove(tmp)
+		log.Printf("Delta upload of %s failed: %v", relFromAbs(abs), err)
+		replyOpError(w, r, err)
+		return
+	}
+
+	reservation.commit(abs)
+	storeHash(abs, hex.EncodeToString(want))
+	journalChange(changeModify, abs, "", false)
+	log.Printf("Delta upload of %s applied (%d bytes)", relFromAbs(abs), size)
+	w.Header().Set("ETag", etagOf(hex.EncodeToString(want)))
+	writeConflictHeaders(w, actionOverwritten, abs)
+	reply(w, r, http.StatusOK, "", newOpResult(actionOverwritten, abs))
+}
+
+// applyDelta writes the file described by base and the delta in rd to dst
+// and checks its size and hash.
+func applyDelta(base, dst string, rd *bufio.Reader, size int64, want []byte) error {
+	src, err := os.Open(base)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	out, err := rootOpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	magic := make([]byte, len(deltaMagic))
+	if _, err := io.ReadFull(rd, magic); err != nil || string(magic) != deltaMagic {
+		return errDeltaFormat
+	}
+	sum := sha256.New()
+	dw := &deltaWriter{w: bufio.NewWriterSize(io.MultiWriter(out, sum), 1<<20), left: size}
+	for {
+		op, err := rd.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch op {
+		case 'C':
+			var hdr [16]byte
+			if _, err := io.ReadFull(rd, hdr[:]); err != nil {
+				return errDeltaFormat
+			}
+			off, n := int64(binary.BigEndian.Uint64(hdr[:8])), int64(binary.BigEndian.Uint64(hdr[8:]))
+			if off < 0 || n <= 0 {
+				return errDeltaFormat
+			}
+			if err := dw.copyN(io.NewSectionReader(src, off, n), n); err != nil {
+				return err
+			}
+		case 'D':
+			var hdr [4]byte
+			if _, err := io.ReadFull(rd, hdr[:]); err != nil {
+				return errDeltaFormat
+			}
+			n := int64(binary.BigEndian.Uint32(hdr[:]))
+			if n == 0 || n > maxDeltaLiteral {
+				return errDeltaFormat
+			}
+			if err := dw.copyN(rd, n); err != nil {
+				return err
+			}
+		default:
+			return errDeltaFormat
+		}
+	}
+	if err := dw.w.Flush(); err != nil {
+		return err
+	}
+	if dw.left != 0 {
+		return opFail(http.StatusUnprocessableEntity, "Rebuilt file has the wrong size")
+	}
+	if !bytes.Equal(sum.Sum(nil), want) {
+		return opFail(http.StatusUnprocessableEntity, "Rebuilt file does not match sha256")
+	}
+	return out.Sync()
+}
+
+// deltaWriter writes the rebuilt file, refusing to grow past its size.
+type deltaWriter struct {
+	w    *bufio.Writer
+	left int64
+}
+
+func (d *deltaWriter) copyN(r io.Reader, n int64) error {
+	if n > d.left {
+		return opFail(http.StatusUnprocessableEntity, "Delta is longer than size")
+	}
+	written, err := io.CopyN(d.w, r, n)
+	d.left -= written
+	if errors.Is(err, io.EOF) {
+		// A copy past the end of the original or a cut-off literal.
+		return errDeltaFormat
+	}
+	return err
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestWeakSum checks weakSum against rsync's get_checksum1.
+func TestWeakSum(t *testing.T) {
+	for in, want := range map[string]uint32{
+		"":          0,
+		"abc":       0x024a0126,
+		"Wikipedia": 0x11dd0397,
+		"The quick brown fox jumps over the lazy dog": 0x5ba20fd9,
+		strings.Repeat("homecloud", 1000):             0x1838a600,
+	} {
+		if got := weakSum([]byte(in)); got != want {
+			t.Errorf("weakSum(%.20q) = %#08x, want %#08x", in, got, want)
+		}
+	}
+}
+
+func copyOp(off, n uint64) []byte {
+	b := []byte{'C'}
+	b = binary.BigEndian.AppendUint64(b, off)
+	return binary.BigEndian.AppendUint64(b, n)
+}
+
+func dataOp(data string) []byte {
+	return append(binary.BigEndian.AppendUint32([]byte{'D'}, uint32(len(data))), data...)
+}
+
+func deltaBody(ops ...[]byte) []byte {
+	return bytes.Join(append([][]byte{[]byte(deltaMagic)}, ops...), nil)
+}
+
+func TestApplyDelta(t *testing.T) {
+	root := testRoot(t)
+	base := filepath.Join(root, "dir", "base.txt")
+	os.WriteFile(base, []byte("0123456789"), 0644)
+	const rebuilt = "01234abc789"
+	sum := sha256.Sum256([]byte(rebuilt))
+
+	for _, c := range []struct {
+		name   string
+		body   []byte
+		size   int64
+		want   []byte
+		status int // 0 for success
+	}{
+		{"copy and data", deltaBody(copyOp(0, 5), dataOp("abc"), copyOp(7, 3)), 11, sum[:], 0},
+		{"copy past the end", deltaBody(copyOp(5, 10)), 10, sum[:], http.StatusBadRequest},
+		{"literal longer than size", deltaBody(dataOp(strings.Repeat("x", 20))), 10, sum[:], http.StatusUnprocessableEntity},
+		{"cut-off literal", deltaBody(dataOp("abc"))[:10], 11, sum[:], http.StatusBadRequest},
+		{"bad magic", append([]byte("HCD2"), copyOp(0, 10)...), 10, sum[:], http.StatusBadRequest},
+		{"no magic", []byte("HC"), 10, sum[:], http.StatusBadRequest},
+		{"truncated copy header", deltaBody(copyOp(0, 10)[:9]), 10, sum[:], http.StatusBadRequest},
+		{"truncated data header", deltaBody([]byte{'D', 0, 0}), 10, sum[:], http.StatusBadRequest},
+		{"empty literal", deltaBody(dataOp("")), 10, sum[:], http.StatusBadRequest},
+		{"unknown op", deltaBody([]byte{'X'}), 10, sum[:], http.StatusBadRequest},
+		{"short", deltaBody(copyOp(0, 5)), 11, sum[:], http.StatusUnprocessableEntity},
+		{"sha256 mismatch", deltaBody(copyOp(0, 5), dataOp("abd"), copyOp(7, 3)), 11, sum[:], http.StatusUnprocessableEntity},
+	} {
+		dst := filepath.Join(root, internalDirName, "out-"+strings.ReplaceAll(c.name, " ", "-"))
+		err := applyDelta(base, dst, bufio.NewReader(bytes.NewReader(c.body)), c.size, c.want)
+		if c.status == 0 {
+			if err != nil {
+				t.Errorf("%s: %v", c.name, err)
+			} else if got := readString(t, dst); got != rebuilt {
+				t.Errorf("%s: rebuilt %q, want %q", c.name, got, rebuilt)
+			}
+			continue
+		}
+		if status, _, _ := errorInfo(err); err == nil || status != c.status {
+			t.Errorf("%s: %v (status %d), want status %d", c.name, err, status, c.status)
+		}
+	}
+}
+
+func postDelta(rel, base string, size int, sum []byte, body []byte) *httptest.ResponseRecorder {
+	url := fmt.Sprintf("/delta/%s?base=%s&size=%d&sha256=%s", rel, base, size, hex.EncodeToString(sum))
+	r := httptest.NewRequest("POST", url, bytes.NewReader(body))
+	r = r.WithContext(context.WithValue(r.Context(), ctxUser, adminUser))
+	rec := httptest.NewRecorder()
+	deltaHandler(rec, r)
+	return rec
+}
+
+func TestDeltaHandler(t *testing.T) {
+	root := testRoot(t)
+	testJournal(t)
+	abs := filepath.Join(root, "dir", "file.txt")
+	info, _ := os.Stat(abs)
+	version := fileVersion(info)
+	body := deltaBody(copyOp(0, 2), dataOp(" out"))
+	sum := sha256.Sum256([]byte("in out"))
+
+	// A delta against an older version changes nothing.
+	if rec := postDelta("dir/file.txt", "0-0", 6, sum[:], body); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("stale base: status %d, want 412", rec.Code)
+	}
+	if got := readString(t, abs); got != "in" {
+		t.Errorf("stale base changed the file to %q", got)
+	}
+
+	bad := sha256.Sum256([]byte("other"))
+	if rec := postDelta("dir/file.txt", version, 6, bad[:], body); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("sha256 mismatch: status %d, want 422", rec.Code)
+	}
+	if got := readString(t, abs); got != "in" {
+		t.Errorf("sha256 mismatch changed the file to %q", got)
+	}
+
+	if rec := postDelta("dir/file.txt", version, 6, sum[:], body); rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if got := readString(t, abs); got != "in out" {
+		t.Errorf("file = %q, want %q", got, "in out")
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(root, internalDirName, "upload", "*")); len(leftovers) != 0 {
+		t.Errorf("staging left behind: %v", leftovers)
+	}
+}
@@ -0,0 +1,612 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// DLNA/UPnP AV MediaServer for TVs and players on the LAN. It is off unless
+// DLNA_FOLDERS names the folders to share; only media in those folders is
+// listed and served. Devices find the server through SSDP (ssdp.go) and
+// browse it with the ContentDirectory service below. They cannot log in, so
+// the server has its own port, DLNA_PORT, bound to the private addresses of
+// the host only: a tunnel or reverse proxy forwarding the API port never
+// reaches it, and every /dlna/ URL still checks that the client is on a
+// private network.
+
+var (
+	dlnaFolderPaths []string
+	dlnaName        string
+	dlnaInterface   string
+	dlnaPort        = "8200"
+
+	// dlnaIPs are the addresses the DLNA server listens on.
+	dlnaIPs []net.IP
+
+	// dlnaFolders are the shared folders, absolute.
+	dlnaFolders []string
+	// dlnaUpdateID is the ContentDirectory SystemUpdateID; it changes with
+	// every change in the shared folders.
+	dlnaUpdateID atomic.Uint32
+)
+
+const (
+	upnpDeviceType = "urn:schemas-upnp-org:device:MediaServer:1"
+	upnpCDS        = "urn:schemas-upnp-org:service:ContentDirectory:1"
+	upnpCMS        = "urn:schemas-upnp-org:service:ConnectionManager:1"
+)
+
+// initDLNA resolves DLNA_FOLDERS. It runs after initRoots.
+func initDLNA() {
+	for _, p := range dlnaFolderPaths {
+		abs, err := resolvePath(p)
+		if err != nil {
+			log.Printf("Warning: DLNA_FOLDERS entry %q: %v", p, err)
+			continue
+		}
+		if info, err := os.Stat(abs); err != nil || !info.IsDir() {
+			log.Printf("Warning: DLNA_FOLDERS entry %q is not a folder", p)
+			continue
+		}
+		dlnaFolders = append(dlnaFolders, abs)
+	}
+	if len(dlnaFolders) == 0 {
+		return
+	}
+	if dlnaName == "" {
+		host, _ := os.Hostname()
+		dlnaName = "HomeCloud on " + host
+	}
+	dlnaUpdateID.Store(1)
+	onChange(func(abs string) {
+		if dlnaShared(abs) {
+			dlnaUpdateID.Add(1)
+		}
+	})
+}
+
+func dlnaShared(abs string) bool {
+	for _, f := range dlnaFolders {
+		if isWithin(f, abs) {
+			return true
+		}
+	}
+	return false
+}
+
+// dlnaUDN is the device's unique name, stable across restarts.
+func dlnaUDN() string {
+	host, _ := os.Hostname()
+	sum := sha256.Sum256([]byte("homecloud-dlna\x00" + host + "\x00" + storageRoots[0].Dir))
+	return fmt.Sprintf("uuid:%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// proxyHeaders mark requests that a proxy or tunnel forwarded, whatever
+// address they arrive from.
+var proxyHeaders = []string{"Cf-Connecting-Ip", "X-Forwarded-For", "X-Real-Ip", "Forwarded"}
+
+// fromLAN reports whether the client is on a private network. Loopback is
+// not: tunnels such as cloudflared connect from there.
+func fromLAN(r *http.Request) bool {
+	for _, h := range proxyHeaders {
+		if r.Header.Get(h) != "" {
+			return false
+		}
+	}
+	return lanIP(net.ParseIP(remoteIP(r)))
+}
+
+func lanIP(ip net.IP) bool {
+	return ip != nil && !ip.IsLoopback() && (ip.IsPrivate() || ip.IsLinkLocalUnicast())
+}
+
+// dlnaServer serves /dlna/ on DLNA_PORT of the private IPv4 addresses of
+// DLNA_INTERFACE, or of every interface, and announces it through SSDP.
+func dlnaServer(ctx context.Context) {
+	if len(dlnaFolders) == 0 {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dlna/", dlnaHandler)
+	srv := &http.Server{Handler: requestIDMiddleware(trackRequests(mux))}
+	for _, ip := range dlnaListenIPs() {
+		ln, err := net.Listen("tcp4", net.JoinHostPort(ip.String(), dlnaPort))
+		if err != nil {
+			log.Printf("Warning: DLNA: cannot listen on %s: %v", ip, err)
+			continue
+		}
+		dlnaIPs = append(dlnaIPs, ip)
+		go srv.Serve(ln)
+	}
+	if len(dlnaIPs) == 0 {
+		log.Printf("Warning: DLNA disabled, no private network address to listen on")
+		return
+	}
+	log.Printf("DLNA: listening on port %s of %v", dlnaPort, dlnaIPs)
+
+	ssdpServer(ctx)
+	<-ctx.Done()
+	stop, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(stop); err != nil {
+		srv.Close()
+	}
+}
+
+// dlnaListenIPs are the private IPv4 addresses the DLNA server binds to.
+func dlnaListenIPs() []net.IP {
+	var ifaces []net.Interface
+	if dlnaInterface != "" {
+		ifi, err := net.InterfaceByName(dlnaInterface)
+		if err != nil {
+			log.Printf("Warning: DLNA_INTERFACE %q: %v; using every interface", dlnaInterface, err)
+		} else {
+			ifaces = []net.Interface{*ifi}
+		}
+	}
+	if ifaces == nil {
+		ifaces, _ = net.Interfaces()
+	}
+	var ips []net.IP
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, _ := ifi.Addrs()
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil && lanIP(n.IP) {
+				ips = append(ips, n.IP.To4())
+			}
+		}
+	}
+	return ips
+}
+
+func dlnaHandler(w http.ResponseWriter, r *http.Request) {
+	if !fromLAN(r) {
+		replyError(w, r, http.StatusForbidden, "DLNA is only available on the local network")
+		return
+	}
+	res := strings.TrimPrefix(r.URL.Path, "/dlna/")
+	switch {
+	case res == "description.xml":
+		writeXML(w, dlnaDescription())
+	case res == "cds.xml":
+		writeXML(w, cdsSCPD)
+	case res == "cms.xml":
+		writeXML(w, cmsSCPD)
+	case res == "control/cds":
+		cdsControl(w, r)
+	case res == "control/cms":
+		cmsControl(w, r)
+	case strings.HasPrefix(res, "event/"):
+		dlnaEvent(w, r)
+	case strings.HasPrefix(res, "media/"):
+		dlnaMedia(w, r, strings.TrimPrefix(res, "media/"))
+	default:
+		replyError(w, r, http.StatusNotFound, "Not found")
+	}
+}
+
+func writeXML(w http.ResponseWriter, body string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.Write([]byte(body))
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func dlnaDescription() string {
+	return `<?xml version="1.0" encoding="utf-8"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0" xmlns:dlna="urn:schemas-dlna-org:device-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<device>
+<deviceType>` + upnpDeviceType + `</deviceType>
+<friendlyName>` + xmlEscape(dlnaName) + `</friendlyName>
+<manufacturer>HomeCloud</manufacturer>
+<modelName>HomeCloud Server</modelName>
+<modelNumber>` + xmlEscape(version) + `</modelNumber>
+<UDN>` + dlnaUDN() + `</UDN>
+<dlna:X_DLNADOC>DMS-1.50</dlna:X_DLNADOC>
+<serviceList>
+<service><serviceType>` + upnpCDS + `</serviceType><serviceId>urn:upnp-org:serviceId:ContentDirectory</serviceId><SCPDURL>/dlna/cds.xml</SCPDURL><controlURL>/dlna/control/cds</controlURL><eventSubURL>/dlna/event/cds</eventSubURL></service>
+<service><serviceType>` + upnpCMS + `</serviceType><serviceId>urn:upnp-org:serviceId:ConnectionManager</serviceId><SCPDURL>/dlna/cms.xml</SCPDURL><controlURL>/dlna/control/cms</controlURL><eventSubURL>/dlna/event/cms</eventSubURL></service>
+</serviceList>
+</device>
+</root>`
+}
+
+// soapAction reads the action name and arguments of a SOAP request.
+func soapAction(r *http.Request) (string, map[string]string, error) {
+	d := xml.NewDecoder(io.LimitReader(r.Body, 64<<10))
+	var action string
+	args := map[string]string{}
+	inBody := false
+	var arg string
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch {
+			case t.Name.Local == "Body":
+				inBody = true
+			case inBody && action == "":
+				action = t.Name.Local
+			case action != "":
+				arg = t.Name.Local
+			}
+		case xml.CharData:
+			if arg != "" {
+				args[arg] += string(t)
+			}
+		case xml.EndElement:
+			arg = ""
+		}
+	}
+	// The SOAPACTION header names it too: "urn:...:1#Browse".
+	if h := strings.Trim(r.Header.Get("SOAPACTION"), `"`); action == "" && strings.Contains(h, "#") {
+		action = h[strings.LastIndex(h, "#")+1:]
+	}
+	return action, args, nil
+}
+
+func soapReply(w http.ResponseWriter, service, action string, out [][2]string) {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&b, `<u:%sResponse xmlns:u="%s">`, action, service)
+	for _, kv := range out {
+		fmt.Fprintf(&b, "<%s>%s</%s>", kv[0], xmlEscape(kv[1]), kv[0])
+	}
+	fmt.Fprintf(&b, `</u:%sResponse></s:Body></s:Envelope>`, action)
+	writeXML(w, b.String())
+}
+
+// UPnP error codes.
+const (
+	upnpInvalidAction = 401
+	upnpInvalidArgs   = 402
+	upnpNoSuchObject  = 701
+)
+
+func soapFault(w http.ResponseWriter, code int, desc string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>`+
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`+
+		`<s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>`+
+		`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode><errorDescription>%s</errorDescription></UPnPError>`+
+		`</detail></s:Fault></s:Body></s:Envelope>`, code, xmlEscape(desc))
+}
+
+func cdsControl(w http.ResponseWriter, r *http.Request) {
+	action, args, err := soapAction(r)
+	if err != nil {
+		soapFault(w, upnpInvalidAction, "Invalid request")
+		return
+	}
+	updateID := strconv.FormatUint(uint64(dlnaUpdateID.Load()), 10)
+	switch action {
+	case "Browse":
+		cdsBrowse(w, r, args, updateID)
+	case "GetSystemUpdateID":
+		soapReply(w, upnpCDS, action, [][2]string{{"Id", updateID}})
+	case "GetSearchCapabilities":
+		soapReply(w, upnpCDS, action, [][2]string{{"SearchCaps", ""}})
+	case "GetSortCapabilities":
+		soapReply(w, upnpCDS, action, [][2]string{{"SortCaps", ""}})
+	default:
+		soapFault(w, upnpInvalidAction, "Invalid action")
+	}
+}
+
+func cmsControl(w http.ResponseWriter, r *http.Request) {
+	action, _, err := soapAction(r)
+	if err != nil {
+		soapFault(w, upnpInvalidAction, "Invalid request")
+		return
+	}
+	switch action {
+	case "GetProtocolInfo":
+		soapReply(w, upnpCMS, action, [][2]string{{"Source", "http-get:*:*:*"}, {"Sink", ""}})
+	case "GetCurrentConnectionIDs":
+		soapReply(w, upnpCMS, action, [][2]string{{"ConnectionIDs", "0"}})
+	case "GetCurrentConnectionInfo":
+		soapReply(w, upnpCMS, action, [][2]string{
+			{"RcsID", "-1"}, {"AVTransportID", "-1"}, {"ProtocolInfo", ""},
+			{"PeerConnectionManager", ""}, {"PeerConnectionID", "-1"},
+			{"Direction", "Output"}, {"Status", "OK"},
+		})
+	default:
+		soapFault(w, upnpInvalidAction, "Invalid action")
+	}
+}
+
+// dlnaEvent accepts event subscriptions, which some TVs insist on, without
+// ever sending events; they poll SystemUpdateID instead.
+func dlnaEvent(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "SUBSCRIBE":
+		sid := r.Header.Get("SID")
+		if sid == "" {
+			sid = "uuid:" + newID()
+		}
+		w.Header().Set("SID", sid)
+		w.Header().Set("TIMEOUT", "Second-1800")
+	case "UNSUBSCRIBE":
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// dlnaObject is a folder or media file in the ContentDirectory. Its ID is
+// the client path; "0" is the root listing the shared folders.
+type dlnaObject struct {
+	id, parent string
+	abs        string
+	info       os.FileInfo
+}
+
+// dlnaLookup resolves an object ID to a shared folder or file.
+func dlnaLookup(id string) (dlnaObject, bool) {
+	if id == "0" {
+		return dlnaObject{id: "0", parent: "-1"}, true
+	}
+	abs, err := resolvePath(id)
+	if err != nil || !dlnaShared(abs) {
+		return dlnaObject{}, false
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return dlnaObject{}, false
+	}
+	o := dlnaObject{id: relFromAbs(abs), abs: abs, info: info, parent: path.Dir(relFromAbs(abs))}
+	for _, f := range dlnaFolders {
+		if f == abs {
+			o.parent = "0"
+		}
+	}
+	return o, true
+}
+
+// dlnaChildren lists the folders and media files of o, folders first.
+func dlnaChildren(o dlnaObject) []dlnaObject {
+	var out []dlnaObject
+	if o.id == "0" {
+		for _, f := range dlnaFolders {
+			if c, ok := dlnaLookup(relFromAbs(f)); ok {
+				out = append(out, c)
+			}
+		}
+		return out
+	}
+	entries, err := os.ReadDir(o.abs)
+	if err != nil {
+		return nil
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		abs := filepath.Join(o.abs, e.Name())
+		info, err := os.Stat(abs)
+		if err != nil || !(info.IsDir() || dlnaClass(abs) != "") {
+			continue
+		}
+		rel := relFromAbs(abs)
+		// Same rules as every other path, including the symlink policy.
+		if _, err := resolvePath(rel); err != nil {
+			continue
+		}
+		out = append(out, dlnaObject{id: rel, parent: o.id, abs: abs, info: info})
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].info.IsDir() != out[j].info.IsDir() {
+			return out[i].info.IsDir()
+		}
+		return strings.ToLower(out[i].info.Name()) < strings.ToLower(out[j].info.Name())
+	})
+	return out
+}
+
+// dlnaClass is the UPnP class of a media file, or "" for other files.
+func dlnaClass(abs string) string {
+	switch mt := mediaType(filepath.Ext(abs)); {
+	case strings.HasPrefix(mt, "video/"):
+		return "object.item.videoItem"
+	case strings.HasPrefix(mt, "audio/"):
+		return "object.item.audioItem.musicTrack"
+	case strings.HasPrefix(mt, "image/"):
+		return "object.item.imageItem.photo"
+	}
+	return ""
+}
+
+func cdsBrowse(w http.ResponseWriter, r *http.Request, args map[string]string, updateID string) {
+	o, ok := dlnaLookup(args["ObjectID"])
+	if !ok {
+		soapFault(w, upnpNoSuchObject, "No such object")
+		return
+	}
+	var objects []dlnaObject
+	total := 1
+	switch args["BrowseFlag"] {
+	case "BrowseMetadata":
+		objects = []dlnaObject{o}
+	case "BrowseDirectChildren":
+		if o.id != "0" && !o.info.IsDir() {
+			soapFault(w, upnpInvalidArgs, "Not a container")
+			return
+		}
+		objects = dlnaChildren(o)
+		total = len(objects)
+		start, _ := strconv.Atoi(args["StartingIndex"])
+		count, _ := strconv.Atoi(args["RequestedCount"])
+		start = min(max(start, 0), total)
+		end := total
+		if count > 0 {
+			end = min(start+count, total)
+		}
+		objects = objects[start:end]
+	default:
+		soapFault(w, upnpInvalidArgs, "Invalid BrowseFlag")
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(`<DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/" xmlns:dlna="urn:schemas-dlna-org:metadata-1-0/">`)
+	for _, c := range objects {
+		writeDIDL(&b, r, c)
+	}
+	b.WriteString(`</DIDL-Lite>`)
+	soapReply(w, upnpCDS, "Browse", [][2]string{
+		{"Result", b.String()},
+		{"NumberReturned", strconv.Itoa(len(objects))},
+		{"TotalMatches", strconv.Itoa(total)},
+		{"UpdateID", updateID},
+	})
+}
+
+func writeDIDL(b *strings.Builder, r *http.Request, o dlnaObject) {
+	if o.id == "0" || o.info.IsDir() {
+		title := dlnaName
+		if o.id != "0" {
+			title = o.info.Name()
+		}
+		fmt.Fprintf(b, `<container id="%s" parentID="%s" restricted="1" childCount="%d"><dc:title>%s</dc:title><upnp:class>object.container.storageFolder</upnp:class></container>`,
+			xmlEscape(o.id), xmlEscape(o.parent), len(dlnaChildren(o)), xmlEscape(title))
+		return
+	}
+
+	class := dlnaClass(o.abs)
+	mt := mediaType(filepath.Ext(o.abs))
+	title := strings.TrimSuffix(o.info.Name(), filepath.Ext(o.info.Name()))
+	var extra, duration string
+	library.mu.RLock()
+	if t := library.tracks[o.abs]; t != nil {
+		title = t.Title
+		extra = "<upnp:artist>" + xmlEscape(t.Artist) + "</upnp:artist><upnp:album>" + xmlEscape(t.Album) + "</upnp:album>"
+		if t.Track > 0 {
+			extra += "<upnp:originalTrackNumber>" + strconv.Itoa(t.Track) + "</upnp:originalTrackNumber>"
+		}
+		if t.Duration > 0 {
+			ms := int64(t.Duration * 1000)
+			duration = fmt.Sprintf(` duration="%d:%02d:%02d.%03d"`, ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+		}
+	}
+	library.mu.RUnlock()
+
+	url := "http://" + r.Host + "/dlna/media/" + escapePath(o.id)
+	fmt.Fprintf(b, `<item id="%s" parentID="%s" restricted="1"><dc:title>%s</dc:title><upnp:class>%s</upnp:class>%s<res protocolInfo="http-get:*:%s:%s" size="%d"%s>%s</res></item>`,
+		xmlEscape(o.id), xmlEscape(o.parent), xmlEscape(title), class, extra,
+		mt, dlnaFeatures, o.info.Size(), duration, xmlEscape(url))
+}
+
+// dlnaFeatures says the files support byte range seeking.
+const dlnaFeatures = "DLNA.ORG_OP=01;DLNA.ORG_CI=0;DLNA.ORG_FLAGS=01700000000000000000000000000000"
+
+// dlnaMedia serves a shared media file like /stream does.
+func dlnaMedia(w http.ResponseWriter, r *http.Request, rel string) {
+	o, ok := dlnaLookup(rel)
+	if !ok || o.id == "0" || o.info.IsDir() || dlnaClass(o.abs) == "" {
+		replyError(w, r, http.StatusNotFound, "Not found")
+		return
+	}
+	// Some TVs match these names case-sensitively, so skip canonicalization.
+	w.Header()["transferMode.dlna.org"] = []string{"Streaming"}
+	w.Header()["contentFeatures.dlna.org"] = []string{dlnaFeatures}
+	serveStream(w, r, o.id)
+}
+
+const cdsSCPD = `<?xml version="1.0" encoding="utf-8"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<actionList>
+<action><name>Browse</name><argumentList>
+<argument><name>ObjectID</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_ObjectID</relatedStateVariable></argument>
+<argument><name>BrowseFlag</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_BrowseFlag</relatedStateVariable></argument>
+<argument><name>Filter</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Filter</relatedStateVariable></argument>
+<argument><name>StartingIndex</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Index</relatedStateVariable></argument>
+<argument><name>RequestedCount</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+<argument><name>SortCriteria</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_SortCriteria</relatedStateVariable></argument>
+<argument><name>Result</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Result</relatedStateVariable></argument>
+<argument><name>NumberReturned</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+<argument><name>TotalMatches</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+<argument><name>UpdateID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_UpdateID</relatedStateVariable></argument>
+</argumentList></action>
+<action><name>GetSearchCapabilities</name><argumentList><argument><name>SearchCaps</name><direction>out</direction><relatedStateVariable>SearchCapabilities</relatedStateVariable></argument></argumentList></action>
+<action><name>GetSortCapabilities</name><argumentList><argument><name>SortCaps</name><direction>out</direction><relatedStateVariable>SortCapabilities</relatedStateVariable></argument></argumentList></action>
+<action><name>GetSystemUpdateID</name><argumentList><argument><name>Id</name><direction>out</direction><relatedStateVariable>SystemUpdateID</relatedStateVariable></argument></argumentList></action>
+</actionList>
+<serviceStateTable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_ObjectID</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_BrowseFlag</name><dataType>string</dataType><allowedValueList><allowedValue>BrowseMetadata</allowedValue><allowedValue>BrowseDirectChildren</allowedValue></allowedValueList></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_Filter</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_Index</name><dataType>ui4</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_Count</name><dataType>ui4</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_SortCriteria</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_Result</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_UpdateID</name><dataType>ui4</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>SearchCapabilities</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>SortCapabilities</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="yes"><name>SystemUpdateID</name><dataType>ui4</dataType></stateVariable>
+</serviceStateTable>
+</scpd>`
+
+const cmsSCPD = `<?xml version="1.0" encoding="utf-8"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<actionList>
+<action><name>GetProtocolInfo</name><argumentList>
+<argument><name>Source</name><direction>out</direction><relatedStateVariable>SourceProtocolInfo</relatedStateVariable></argument>
+<argument><name>Sink</name><direction>out</direction><relatedStateVariable>SinkProtocolInfo</relatedStateVariable></argument>
+</argumentList></action>
+<action><name>GetCurrentConnectionIDs</name><argumentList>
+<argument><name>ConnectionIDs</name><direction>out</direction><relatedStateVariable>CurrentConnectionIDs</relatedStateVariable></argument>
+</argumentList></action>
+<action><name>GetCurrentConnectionInfo</name><argumentList>
+<argument><name>ConnectionID</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_ConnectionID</relatedStateVariable></argument>
+<argument><name>RcsID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_RcsID</relatedStateVariable></argument>
+<argument><name>AVTransportID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_AVTransportID</relatedStateVariable></argument>
+<argument><name>ProtocolInfo</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_ProtocolInfo</relatedStateVariable></argument>
+<argument><name>PeerConnectionManager</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_ConnectionManager</relatedStateVariable></argument>
+<argument><name>PeerConnectionID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_ConnectionID</relatedStateVariable></argument>
+<argument><name>Direction</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Direction</relatedStateVariable></argument>
+<argument><name>Status</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_ConnectionStatus</relatedStateVariable></argument>
+</argumentList></action>
+</actionList>
+<serviceStateTable>
+<stateVariable sendEvents="yes"><name>SourceProtocolInfo</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="yes"><name>SinkProtocolInfo</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="yes"><name>CurrentConnectionIDs</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_ConnectionStatus</name><dataType>string</dataType><allowedValueList><allowedValue>OK</allowedValue><allowedValue>ContentFormatMismatch</allowedValue><allowedValue>InsufficientBandwidth</allowedValue><allowedValue>UnreliableChannel</allowedValue><allowedValue>Unknown</allowedValue></allowedValueList></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_ConnectionManager</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_Direction</name><dataType>string</dataType><allowedValueList><allowedValue>Input</allowedValue><allowedValue>Output</allowedValue></allowedValueList></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_ProtocolInfo</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_ConnectionID</name><dataType>i4</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_AVTransportID</name><dataType>i4</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_RcsID</name><dataType>i4</dataType></stateVariable>
+</serviceStateTable>
+</scpd>`
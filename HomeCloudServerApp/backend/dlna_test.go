@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFromLAN(t *testing.T) {
+	for _, c := range []struct {
+		remote string
+		header string
+		lan    bool
+	}{
+		{"192.168.1.20:50000", "", true},
+		{"10.0.0.5:50000", "", true},
+		{"172.16.3.4:50000", "", true},
+		{"169.254.10.1:50000", "", true},
+		{"[fd00::1]:50000", "", true},
+		{"[fe80::1]:50000", "", true},
+		// cloudflared and local reverse proxies connect from loopback.
+		{"127.0.0.1:50000", "", false},
+		{"[::1]:50000", "", false},
+		{"8.8.8.8:50000", "", false},
+		{"[2001:db8::1]:50000", "", false},
+		{"garbage", "", false},
+		{"192.168.1.20:50000", "Cf-Connecting-Ip", false},
+		{"192.168.1.20:50000", "X-Forwarded-For", false},
+		{"192.168.1.20:50000", "X-Real-Ip", false},
+		{"192.168.1.20:50000", "Forwarded", false},
+	} {
+		r := httptest.NewRequest("GET", "/dlna/description.xml", nil)
+		r.RemoteAddr = c.remote
+		if c.header != "" {
+			r.Header.Set(c.header, "192.168.1.30")
+		}
+		if got := fromLAN(r); got != c.lan {
+			t.Errorf("fromLAN(%s, %q) = %t, want %t", c.remote, c.header, got, c.lan)
+		}
+	}
+}
+
+func TestDLNANotOnAPIPort(t *testing.T) {
+	root := testRoot(t)
+	old := dlnaFolders
+	dlnaFolders = []string{filepath.Join(root, "dir")}
+	t.Cleanup(func() { dlnaFolders = old })
+	for _, rt := range appRoutes() {
+		if strings.HasPrefix(rt.Pattern, "/dlna") {
+			t.Errorf("%s is in the API route table", rt.Pattern)
+		}
+	}
+}
+
+func TestSSDPAnswer(t *testing.T) {
+	testRoot(t)
+	oldIPs, oldPort := dlnaIPs, dlnaPort
+	dlnaIPs, dlnaPort = []net.IP{net.IPv4(192, 168, 1, 2).To4()}, "8200"
+	t.Cleanup(func() { dlnaIPs, dlnaPort = oldIPs, oldPort })
+
+	search := func(st string) []byte {
+		return []byte("M-SEARCH * HTTP/1.1\r\n" +
+			"HOST: 239.255.255.250:1900\r\n" +
+			"MAN: \"ssdp:discover\"\r\n" +
+			"MX: 2\r\n" +
+			"ST: " + st + "\r\n\r\n")
+	}
+	tv := net.IPv4(192, 168, 1, 50)
+
+	replies, mx := ssdpAnswer(search("ssdp:all"), tv)
+	if len(replies) != len(ssdpTargets()) || mx != 2 {
+		t.Fatalf("ssdp:all: %d replies, MX %d; want %d, 2", len(replies), mx, len(ssdpTargets()))
+	}
+	for _, msg := range replies {
+		if !strings.HasPrefix(msg, "HTTP/1.1 200 OK\r\n") || !strings.HasSuffix(msg, "\r\n\r\n") {
+			t.Errorf("malformed reply %q", msg)
+		}
+		if !strings.Contains(msg, "\r\nLOCATION: http://192.168.1.2:8200/dlna/description.xml\r\n") {
+			t.Errorf("reply without the DLNA location: %q", msg)
+		}
+	}
+
+	replies, _ = ssdpAnswer(search(upnpDeviceType), tv)
+	if len(replies) != 1 || !strings.Contains(replies[0], "\r\nST: "+upnpDeviceType+"\r\n") ||
+		!strings.Contains(replies[0], "\r\nUSN: "+dlnaUDN()+"::"+upnpDeviceType+"\r\n") {
+		t.Errorf("device type search: %q", replies)
+	}
+
+	for name, c := range map[string]struct {
+		packet []byte
+		src    net.IP
+	}{
+		"other target": {search("urn:schemas-upnp-org:device:MediaRenderer:1"), tv},
+		"loopback":     {search("ssdp:all"), net.IPv4(127, 0, 0, 1)},
+		"internet":     {search("ssdp:all"), net.IPv4(8, 8, 8, 8)},
+		"notify":       {[]byte("NOTIFY * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nNT: upnp:rootdevice\r\nNTS: ssdp:alive\r\n\r\n"), tv},
+		"no MAN":       {[]byte("M-SEARCH * HTTP/1.1\r\nST: ssdp:all\r\n\r\n"), tv},
+		"garbage":      {[]byte("\x00\x01 not http"), tv},
+	} {
+		if replies, _ := ssdpAnswer(c.packet, c.src); len(replies) != 0 {
+			t.Errorf("%s: answered %q", name, replies)
+		}
+	}
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// EXIF extraction from JPEG (APP1), PNG (eXIf) and HEIC (the Exif item of
+// the ISO base media file), in pure Go. Only the fields the photo timeline
+// uses are read.
+
+var photoExts = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".heic": true, ".heif": true}
+
+type exifData struct {
+	Taken       time.Time `json:"taken,omitempty"`
+	Make        string    `json:"make,omitempty"`
+	Model       string    `json:"model,omitempty"`
+	Orientation int       `json:"orientation,omitempty"`
+	Lat         *float64  `json:"lat,omitempty"`
+	Lon         *float64  `json:"lon,omitempty"`
+
+	// The IFD1 JPEG thumbnail, as offset and length inside the file.
+	ThumbOffset int64 `json:"thumb_offset,omitempty"`
+	ThumbLength int64 `json:"thumb_length,omitempty"`
+}
+
+var errNoExif = errors.New("no EXIF data")
+
+// maxExifSize bounds what is read as EXIF; real blocks stay far below it.
+const maxExifSize = 1 << 20
+
+// readExif returns the EXIF data of the image at path.
+func readExif(path string) (exifData, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return exifData{}, err
+	}
+	defer f.Close()
+
+	var tiff []byte
+	var base int64 // file offset of tiff
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg":
+		tiff, base, err = jpegExif(f)
+	case ".png":
+		tiff, base, err = pngExif(f)
+	case ".heic", ".heif":
+		tiff, base, err = heifExif(f)
+	default:
+		return exifData{}, errNoExif
+	}
+	if err != nil {
+		return exifData{}, err
+	}
+	x, err := parseTIFF(tiff)
+	if x.ThumbLength > 0 {
+		x.ThumbOffset += base
+	}
+	return x, err
+}
+
+func jpegExif(f *os.File) ([]byte, int64, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(f, hdr[:2]); err != nil || hdr[0] != 0xFF || hdr[1] != 0xD8 {
+		return nil, 0, errors.New("not a JPEG file")
+	}
+	pos := int64(2)
+	for {
+		if _, err := f.ReadAt(hdr[:], pos); err != nil {
+			return nil, 0, errNoExif
+		}
+		if hdr[0] != 0xFF {
+			return nil, 0, errNoExif
+		}
+		marker := hdr[1]
+		if marker == 0xDA || marker == 0xD9 { // image data starts
+			return nil, 0, errNoExif
+		}
+		size := int64(binary.BigEndian.Uint16(hdr[2:]))
+		if marker == 0xE1 && size > 8 && size <= maxExifSize {
+			seg := make([]byte, size-2)
+			if _, err := f.ReadAt(seg, pos+4); err != nil {
+				return nil, 0, err
+			}
+			if bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+				return seg[6:], pos + 10, nil
+			}
+		}
+		pos += 2 + size
+	}
+}
+
+func pngExif(f *os.File) ([]byte, int64, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(f, hdr[:]); err != nil || string(hdr[:]) != "\x89PNG\r\n\x1a\n" {
+		return nil, 0, errors.New("not a PNG file")
+	}
+	pos := int64(8)
+	for {
+		if _, err := f.ReadAt(hdr[:], pos); err != nil {
+			return nil, 0, errNoExif
+		}
+		size := int64(binary.BigEndian.Uint32(hdr[:4]))
+		switch string(hdr[4:]) {
+		case "eXIf":
+			if size > maxExifSize {
+				return nil, 0, errNoExif
+			}
+			data := make([]byte, size)
+			if _, err := f.ReadAt(data, pos+8); err != nil {
+				return nil, 0, err
+			}
+			return data, pos + 8, nil
+		case "IDAT", "IEND":
+			// eXIf must come before the image data.
+			return nil, 0, errNoExif
+		}
+		pos += 12 + size
+	}
+}
+
+// heifExif finds the Exif item through the meta box's iinf and iloc.
+func heifExif(f *os.File) ([]byte, int64, error) {
+	meta, err := findBox(f, "meta")
+	if err != nil {
+		return nil, 0, err
+	}
+	// meta is a full box: skip version and flags.
+	body := meta[4:]
+	var exifID uint32
+	var iloc []byte
+	for len(body) >= 8 {
+		size := int(binary.BigEndian.Uint32(body))
+		typ := string(body[4:8])
+		if size < 8 || size > len(body) {
+			break
+		}
+		switch typ {
+		case "iinf":
+			exifID = heifExifItem(body[8:size])
+		case "iloc":
+			iloc = body[8:size]
+		}
+		body = body[size:]
+	}
+	if exifID == 0 || iloc == nil {
+		return nil, 0, errNoExif
+	}
+	off, length, ok := heifItemExtent(iloc, exifID)
+	if !ok || length < 8 || length > maxExifSize {
+		return nil, 0, errNoExif
+	}
+	data := make([]byte, length)
+	if _, err := f.ReadAt(data, off); err != nil {
+		return nil, 0, err
+	}
+	// The item starts with the offset of the TIFF header after it.
+	skip := int64(binary.BigEndian.Uint32(data)) + 4
+	if skip >= length {
+		return nil, 0, errNoExif
+	}
+	return data[skip:], off + skip, nil
+}
+
+// findBox returns the body of the first top-level box of type typ.
+func findBox(f *os.File, typ string) ([]byte, error) {
+	var hdr [16]byte
+	for pos := int64(0); ; {
+		if _, err := f.ReadAt(hdr[:8], pos); err != nil {
+			return nil, errNoExif
+		}
+		size := int64(binary.BigEndian.Uint32(hdr[:4]))
+		head := int64(8)
+		if size == 1 {
+			if _, err := f.ReadAt(hdr[8:16], pos+8); err != nil {
+				return nil, errNoExif
+			}
+			size = int64(binary.BigEndian.Uint64(hdr[8:16]))
+			head = 16
+		}
+		if size < head {
+			return nil, errNoExif
+		}
+		if string(hdr[4:8]) == typ {
+			if size-head > maxExifSize {
+				return nil, errNoExif
+			}
+			body := make([]byte, size-head)
+			if _, err := f.ReadAt(body, pos+head); err != nil {
+				return nil, err
+			}
+			return body, nil
+		}
+		pos += size
+	}
+}
+
+// heifExifItem returns the item ID of the Exif item listed in iinf.
+func heifExifItem(b []byte) uint32 {
+	if len(b) < 6 {
+		return 0
+	}
+	version := b[0]
+	b = b[4:]
+	if version == 0 {
+		b = b[2:]
+	} else {
+		b = b[4:]
+	}
+	for len(b) >= 8 {
+		size := int(binary.BigEndian.Uint32(b))
+		if size < 8 || size > len(b) {
+			return 0
+		}
+		typ, infe := string(b[4:8]), b[8:size]
+		b = b[size:]
+		if typ != "infe" || len(infe) < 4 || infe[0] < 2 {
+			continue
+		}
+		var id uint32
+		var rest []byte
+		if infe[0] == 2 && len(infe) >= 12 {
+			id, rest = uint32(binary.BigEndian.Uint16(infe[4:])), infe[8:]
+		} else if infe[0] >= 3 && len(infe) >= 14 {
+			id, rest = binary.BigEndian.Uint32(infe[4:]), infe[10:]
+		} else {
+			continue
+		}
+		if string(rest[:4]) == "Exif" {
+			return id
+		}
+	}
+	return 0
+}
+
+// heifItemExtent returns where the first extent of item id lies in the file.
+func heifItemExtent(b []byte, id uint32) (off, length int64, ok bool) {
+	if len(b) < 8 {
+		return 0, 0, false
+	}
+	version := b[0]
+	offSize, lenSize := int(b[4]>>4), int(b[4]&15)
+	baseSize, idxSize := int(b[5]>>4), 0
+	if version == 1 || version == 2 {
+		idxSize = int(b[5] & 15)
+	}
+	p := 6
+	read := func(n int) (uint64, bool) {
+		if p+n > len(b) {
+			return 0, false
+		}
+		var v uint64
+		for _, c := range b[p : p+n] {
+			v = v<<8 | uint64(c)
+		}
+		p += n
+		return v, true
+	}
+	var count uint64
+	if version < 2 {
+		count, ok = read(2)
+	} else {
+		count, ok = read(4)
+	}
+	for i := uint64(0); ok && i < count; i++ {
+		var item, method, base, extents uint64
+		if version < 2 {
+			item, ok = read(2)
+		} else {
+			item, ok = read(4)
+		}
+		if version == 1 || version == 2 {
+			method, _ = read(2)
+		}
+		read(2) // data reference index
+		base, _ = read(baseSize)
+		extents, ok = read(2)
+		for e := uint64(0); ok && e < extents; e++ {
+			read(idxSize)
+			eoff, _ := read(offSize)
+			var elen uint64
+			elen, ok = read(lenSize)
+			if ok && e == 0 && uint32(item) == id {
+				// Only file offsets (construction method 0) are supported.
+				return int64(base + eoff), int64(elen), method == 0
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// EXIF tags read.
+const (
+	tagMake             = 0x010F
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagDateTime         = 0x0132
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagDateTimeOriginal = 0x9003
+	tagOffsetOriginal   = 0x9011
+	tagThumbOffset      = 0x0201
+	tagThumbLength      = 0x0202
+	tagGPSLatRef        = 1
+	tagGPSLat           = 2
+	tagGPSLonRef        = 3
+	tagGPSLon           = 4
+)
+
+type tiffReader struct {
+	b  []byte
+	bo binary.ByteOrder
+}
+
+type ifdEntry struct {
+	typ   uint16
+	count uint32
+	data  []byte
+}
+
+func parseTIFF(b []byte) (exifData, error) {
+	var x exifData
+	if len(b) < 8 {
+		return x, errNoExif
+	}
+	t := tiffReader{b: b}
+	switch string(b[:2]) {
+	case "II":
+		t.bo = binary.LittleEndian
+	case "MM":
+		t.bo = binary.BigEndian
+	default:
+		return x, errNoExif
+	}
+	if t.bo.Uint16(b[2:]) != 42 {
+		return x, errNoExif
+	}
+	ifd0, next := t.ifd(t.bo.Uint32(b[4:]))
+	if ifd0 == nil {
+		return x, fmt.Errorf("bad EXIF IFD")
+	}
+	x.Make = t.ascii(ifd0[tagMake])
+	x.Model = t.ascii(ifd0[tagModel])
+	x.Orientation = int(t.uint(ifd0[tagOrientation], 0))
+	taken := t.ascii(ifd0[tagDateTime])
+	var offset string
+	if e, ok := ifd0[tagExifIFD]; ok {
+		sub, _ := t.ifd(t.uint(e, 0))
+		if s := t.ascii(sub[tagDateTimeOriginal]); s != "" {
+			taken = s
+		}
+		offset = t.ascii(sub[tagOffsetOriginal])
+	}
+	x.Taken = exifTime(taken, offset)
+	if e, ok := ifd0[tagGPSIFD]; ok {
+		gps, _ := t.ifd(t.uint(e, 0))
+		x.Lat = t.coord(gps[tagGPSLat], t.ascii(gps[tagGPSLatRef]), "S")
+		x.Lon = t.coord(gps[tagGPSLon], t.ascii(gps[tagGPSLonRef]), "W")
+	}
+	if next != 0 {
+		if ifd1, _ := t.ifd(next); ifd1 != nil {
+			off, n := t.uint(ifd1[tagThumbOffset], 0), t.uint(ifd1[tagThumbLength], 0)
+			if n > 0 && int(off)+int(n) <= len(b) {
+				x.ThumbOffset, x.ThumbLength = int64(off), int64(n)
+			}
+		}
+	}
+	return x, nil
+}
+
+// ifd reads the directory at off and returns its entries and the offset of
+// the next one.
+func (t tiffReader) ifd(off uint32) (map[uint16]ifdEntry, uint32) {
+	b := t.b
+	if off < 8 || int(off)+2 > len(b) {
+		return nil, 0
+	}
+	n := int(t.bo.Uint16(b[off:]))
+	p := int(off) + 2
+	if p+12*n > len(b) {
+		return nil, 0
+	}
+	sizes := map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+	entries := make(map[uint16]ifdEntry, n)
+	for i := 0; i < n; i, p = i+1, p+12 {
+		tag, typ, count := t.bo.Uint16(b[p:]), t.bo.Uint16(b[p+2:]), t.bo.Uint32(b[p+4:])
+		size := sizes[typ] * int(count)
+		if size == 0 || count > maxExifSize {
+			continue
+		}
+		data := b[p+8 : p+12]
+		if size > 4 {
+			at := int(t.bo.Uint32(b[p+8:]))
+			if at+size > len(b) || at < 0 {
+				continue
+			}
+			data = b[at : at+size]
+		}
+		entries[tag] = ifdEntry{typ: typ, count: count, data: data[:min(size, len(data))]}
+	}
+	var next uint32
+	if p+4 <= len(b) {
+		next = t.bo.Uint32(b[p:])
+	}
+	return entries, next
+}
+
+func (t tiffReader) ascii(e ifdEntry) string {
+	if e.typ != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(e.data), "\x00"))
+}
+
+// uint returns value i of a BYTE, SHORT or LONG entry.
+func (t tiffReader) uint(e ifdEntry, i int) uint32 {
+	switch e.typ {
+	case 1, 7:
+		if i < len(e.data) {
+			return uint32(e.data[i])
+		}
+	case 3:
+		if 2*i+2 <= len(e.data) {
+			return uint32(t.bo.Uint16(e.data[2*i:]))
+		}
+	case 4:
+		if 4*i+4 <= len(e.data) {
+			return t.bo.Uint32(e.data[4*i:])
+		}
+	}
+	return 0
+}
+
+func (t tiffReader) rational(e ifdEntry, i int) float64 {
+	if e.typ != 5 || 8*i+8 > len(e.data) {
+		return 0
+	}
+	num, den := t.bo.Uint32(e.data[8*i:]), t.bo.Uint32(e.data[8*i+4:])
+	if den == 0 {
+		return 0
+	}
+	return float64(num) / float64(den)
+}
+
+// coord reads a GPS degrees/minutes/seconds triple; neg is the reference
+// (S or W) that makes it negative.
+func (t tiffReader) coord(e ifdEntry, ref, neg string) *float64 {
+	if e.typ != 5 || e.count < 3 {
+		return nil
+	}
+	v := t.rational(e, 0) + t.rational(e, 1)/60 + t.rational(e, 2)/3600
+	if v == 0 {
+		return nil
+	}
+	if strings.EqualFold(ref, neg) {
+		v = -v
+	}
+	return &v
+}
+
+// exifTime parses an EXIF "2006:01:02 15:04:05" time. Without an offset tag
+// the camera's local time is kept as if it were UTC, so the wall clock date
+// stays the one the photo was taken on.
+func exifTime(s, offset string) time.Time {
+	loc := time.UTC
+	if o, err := time.Parse("-07:00", offset); err == nil {
+		_, secs := o.Zone()
+		loc = time.FixedZone("", secs)
+	}
+	t, err := time.ParseInLocation("2006:01:02 15:04:05", s, loc)
+	if err != nil || t.Year() < 1900 {
+		return time.Time{}
+	}
+	return t
+}
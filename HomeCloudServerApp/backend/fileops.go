@@ -0,0 +1,583 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// opError is a failure of one of the *Item operations below, carrying the
+// HTTP status and client message it maps to.
+type opError struct {
+	status int
+	code   string
+	msg    string
+}
+
+func (e *opError) Error() string { return e.msg }
+
+func opFail(status int, msg string) error {
+	return &opError{status: status, code: errorCode(status), msg: msg}
+}
+
+// errorInfo maps any error returned by the resolver or an *Item operation
+// onto an HTTP status, a machine-readable code and a message that is safe
+// to show to clients.
+func errorInfo(err error) (int, string, string) {
+	var oe *opError
+	switch {
+	case errors.As(err, &oe):
+		return oe.status, oe.code, oe.msg
+	case errors.Is(err, errInvalidPath):
+		return http.StatusBadRequest, "invalid_path", "Invalid path"
+	case errors.Is(err, errSymlinkDenied):
+		return http.StatusForbidden, "symlink_denied", "Access denied"
+	case errors.Is(err, errPathEscape):
+		return http.StatusForbidden, "access_denied", "Access denied"
+	case errors.Is(err, os.ErrNotExist):
+		return http.StatusNotFound, "not_found", "Not found"
+	}
+	log.Printf("Operation failed: %v", err)
+	return http.StatusInternalServerError, "internal", "Internal error"
+}
+
+// internalFail logs err, which may name server paths, and returns an
+// error that only shows msg to clients. An *opError is already meant for
+// clients and is passed through.
+func internalFail(msg string, err error) error {
+	var oe *opError
+	if errors.As(err, &oe) {
+		return oe
+	}
+	log.Printf("%s: %v", msg, err)
+	return opFail(http.StatusInternalServerError, msg)
+}
+
+func replyOpError(w http.ResponseWriter, r *http.Request, err error) {
+	status, code, msg := errorInfo(err)
+	replyErrorCode(w, r, status, code, msg)
+}
+
+// Conflict policies accepted as on_conflict by every mutating endpoint and
+// as the ON_CONFLICT server default.
+const (
+	conflictRename    = "rename"
+	conflictOverwrite = "overwrite"
+	conflictSkip      = "skip"
+	conflictFail      = "fail"
+)
+
+// Actions reported back to clients once a conflict policy was applied.
+const (
+	actionCreated     = "created"
+	actionRenamed     = "renamed"
+	actionOverwritten = "overwritten"
+	actionSkipped     = "skipped"
+)
+
+var defaultConflictPolicy = conflictRename
+
+func validConflictPolicy(p string) bool {
+	switch p {
+	case conflictRename, conflictOverwrite, conflictSkip, conflictFail:
+		return true
+	}
+	return false
+}
+
+// conflictPolicy picks the policy for a request: an explicit value from the
+// JSON body wins over the on_conflict query parameter, which wins over the
+// server default.
+func conflictPolicy(r *http.Request, fromBody string) (string, error) {
+	p := fromBody
+	if p == "" {
+		p = r.URL.Query().Get("on_conflict")
+	}
+	if p == "" {
+		return defaultConflictPolicy, nil
+	}
+	if !validConflictPolicy(p) {
+		return "", opFail(http.StatusBadRequest, fmt.Sprintf("Unknown on_conflict %q (use rename, overwrite, skip or fail)", p))
+	}
+	return p, nil
+}
+
+// resolveConflict decides where an item destined for dst ends up under
+// policy. With actionOverwritten the caller must replace dst, with
+// actionSkipped it must leave everything alone.
+func resolveConflict(dst string, isFile bool, policy string) (string, string, error) {
+	if _, err := os.Lstat(dst); os.IsNotExist(err) {
+		return dst, actionCreated, nil
+	}
+	switch policy {
+	case conflictOverwrite:
+		return dst, actionOverwritten, nil
+	case conflictSkip:
+		return dst, actionSkipped, nil
+	case conflictFail:
+		return "", "", &opError{status: http.StatusConflict, code: "already_exists", msg: "Target already exists"}
+	}
+	return nextFreePath(dst, isFile), actionRenamed, nil
+}
+
+// replacePath moves src onto dst, replacing whatever is at dst. The old
+// entry is parked in the internal folder until the swap has succeeded.
+func replacePath(src, dst string) error {
+	if _, err := os.Lstat(dst); os.IsNotExist(err) {
+		return movePath(src, dst)
+	}
+
+	old := internalPathFor(dst, "replaced", newID())
+	if err := os.MkdirAll(filepath.Dir(old), 0700); err != nil {
+		return err
+	}
+	if err := rootRename(dst, old); err != nil {
+		return err
+	}
+	if err := movePath(src, dst); err != nil {
+		rootRename(old, dst)
+		return err
+	}
+	return rootRemoveAll(old)
+}
+
+// movePath renames src to dst and moves its size index entry along, which
+// keeps the owners of the moved files.
+func movePath(src, dst string) error {
+	rt := rootOf(dst)
+	if rt != rootOf(src) {
+		return moveAcrossRoots(context.Background(), src, dst, func(int64, int) {})
+	}
+	if watcherReady.Load() {
+		// A freshly created target folder has to be indexed before the
+		// move, or the moved entry would be rescanned without owners.
+		if known, _ := rt.index.has(filepath.Dir(dst)); !known {
+			rt.index.refresh(filepath.Dir(dst))
+		}
+	}
+	if err := rootRename(src, dst); err != nil {
+		return err
+	}
+	if watcherReady.Load() {
+		rt.index.moved(src, dst)
+	}
+	return nil
+}
+
+// relocate moves src onto dst like replacePath. A move to another storage
+// root copies the data, so it stops once ctx is done and reports progress.
+func relocate(ctx context.Context, src, dst string, progress func(int64, int)) error {
+	if rootOf(src) != rootOf(dst) {
+		return moveAcrossRoots(ctx, src, dst, progress)
+	}
+	return replacePath(src, dst)
+}
+
+// moveAcrossRoots moves src to dst on another storage root, which is
+// usually another disk: the entry is copied into the internal folder of
+// dst, renamed into place and only then deleted from src. The files keep
+// their owners. Symlinks are only copied under SYMLINK_POLICY=follow, so
+// a tree that contains any is refused rather than moved without them.
+func moveAcrossRoots(ctx context.Context, src, dst string, progress func(int64, int)) error {
+	if symlinkPolicy != symlinkFollow {
+		link, err := findSymlink(src)
+		if err != nil {
+			return err
+		}
+		if link != "" {
+			log.Printf("Move: %s contains the symlink %s, not moving it to another storage root", src, link)
+			return opFail(http.StatusConflict, "Cannot move symbolic links to another storage root")
+		}
+	}
+
+	var owners map[string]string
+	if rt := rootOf(src); rt != nil && watcherReady.Load() {
+		owners = rt.index.ownersOf(src)
+	}
+
+	tmp := internalPathFor(dst, "move", newID())
+	if err := os.MkdirAll(filepath.Dir(tmp), 0700); err != nil {
+		return err
+	}
+	if err := copyTree(ctx, src, tmp, progress); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := replacePath(tmp, dst); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if rt := rootOf(dst); rt != nil && watcherReady.Load() {
+		for rel, owner := range owners {
+			rt.index.claim(filepath.Join(dst, filepath.FromSlash(rel)), owner)
+		}
+	}
+
+	if err := rootRemoveAll(src); err != nil {
+		return err
+	}
+	if rt := rootOf(src); rt != nil && watcherReady.Load() {
+		rt.index.refresh(src)
+	}
+	return nil
+}
+
+// findSymlink returns the first symlink in the tree at root, or "".
+func findSymlink(root string) (string, error) {
+	var link string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			link = path
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return link, err
+}
+
+// writeConflictHeaders reports the outcome of a conflict policy on the
+// plain-text endpoints.
+func writeConflictHeaders(w http.ResponseWriter, action, final string) {
+	w.Header().Set("X-Conflict-Action", action)
+	w.Header().Set("X-Final-Path", relFromAbs(final))
+}
+
+// renameItem renames oldRel to newRel, creating missing parent folders.
+// It returns the absolute destination path and the conflict action taken.
+func renameItem(ctx context.Context, oldRel, newRel, policy string) (string, string, error) {
+	oldPath, err := resolveItemPath(oldRel)
+	if err != nil {
+		return "", "", err
+	}
+	newPath, err := resolveItemPath(newRel)
+	if err != nil {
+		return "", "", err
+	}
+
+	oldInfo, err := os.Stat(oldPath)
+	if os.IsNotExist(err) {
+		return "", "", opFail(http.StatusNotFound, "Old path does not exist")
+	}
+	if err != nil {
+		return "", "", internalFail("Failed to rename", err)
+	}
+	if oldPath == newPath {
+		return newPath, actionSkipped, nil
+	}
+	if sameEntry(oldPath, newPath, oldInfo) {
+		return caseRename(oldPath, newPath)
+	}
+
+	final, action, err := resolveConflict(newPath, !oldInfo.IsDir(), policy)
+	if err != nil || action == actionSkipped {
+		return final, action, err
+	}
+
+	if err := mkdirAllJournaled(filepath.Dir(final), 0755); err != nil {
+		return "", "", internalFail("Failed to create target folder", err)
+	}
+
+	reservation, err := reserveMove(oldPath, final)
+	if err != nil {
+		return "", "", err
+	}
+	defer reservation.release()
+	if err := relocate(ctx, oldPath, final, func(int64, int) {}); err != nil {
+		return "", "", internalFail("Failed to rename", err)
+	}
+	journalChange(changeMove, final, oldPath, false)
+	return final, action, nil
+}
+
+// sameEntry reports whether dst only differs from src in case and names
+// the same file, as on case-insensitive filesystems (photo.JPG and
+// photo.jpg). That is no conflict.
+func sameEntry(src, dst string, srcInfo os.FileInfo) bool {
+	if src == dst || !strings.EqualFold(src, dst) {
+		return false
+	}
+	dstInfo, err := os.Stat(dst)
+	return err == nil && os.SameFile(srcInfo, dstInfo)
+}
+
+// caseRename changes the case of a name in place.
+func caseRename(src, dst string) (string, string, error) {
+	if err := movePath(src, dst); err != nil {
+		log.Printf("Rename of %s failed: %v", src, err)
+		return "", "", opFail(http.StatusInternalServerError, "Failed to rename")
+	}
+	journalChange(changeMove, dst, src, false)
+	return dst, actionCreated, nil
+}
+
+// movePlan is a validated move, see prepareMove.
+type movePlan struct {
+	src, dst string
+	action   string
+	// caseOnly marks a rename that only changes the case of the name.
+	caseOnly bool
+	// bytes and files are only counted for moves to another root, which
+	// copy the data.
+	bytes int64
+	files int
+
+	reservation *quotaReservation
+}
+
+// prepareMove validates a move of srcRel to destRel under policy. By
+// default a "name(N)" variant of the destination is picked when it is
+// taken.
+func prepareMove(srcRel, destRel, policy string) (*movePlan, error) {
+	src, err := resolveItemPath(srcRel)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := resolveItemPath(destRel)
+	if err != nil {
+		return nil, err
+	}
+
+	srcInfo, err := os.Stat(src)
+	if os.IsNotExist(err) {
+		return nil, opFail(http.StatusNotFound, "Source not found")
+	}
+	if err != nil {
+		return nil, internalFail("Failed to move", err)
+	}
+	if src == dst && policy != conflictRename {
+		return &movePlan{src: src, dst: dst, action: actionSkipped}, nil
+	}
+	if sameEntry(src, dst, srcInfo) {
+		return &movePlan{src: src, dst: dst, action: actionCreated, caseOnly: true}, nil
+	}
+
+	final, action, err := resolveConflict(dst, !srcInfo.IsDir(), policy)
+	if err != nil {
+		return nil, err
+	}
+	plan := &movePlan{src: src, dst: final, action: action}
+	if action == actionSkipped {
+		return plan, nil
+	}
+	if plan.crossRoot() {
+		if plan.bytes, plan.files, err = measureTree(src); err != nil {
+			return nil, internalFail("Failed to read source", err)
+		}
+	}
+	if plan.reservation, err = reserveMove(src, final); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// crossRoot reports whether the move copies to another storage root.
+func (p *movePlan) crossRoot() bool {
+	return rootOf(p.src) != rootOf(p.dst)
+}
+
+// execute performs the move. Every plan from prepareMove must be executed
+// to settle its reservation.
+func (p *movePlan) execute(ctx context.Context, progress func(int64, int)) error {
+	if p.action == actionSkipped {
+		return nil
+	}
+	if p.caseOnly {
+		_, _, err := caseRename(p.src, p.dst)
+		return err
+	}
+	defer p.reservation.release()
+	if err := relocate(ctx, p.src, p.dst, progress); err != nil {
+		return internalFail("Failed to move", err)
+	}
+	journalChange(changeMove, p.dst, p.src, false)
+	return nil
+}
+
+// moveItem moves srcRel to destRel right away. It returns the absolute
+// destination path and the conflict action taken.
+func moveItem(ctx context.Context, srcRel, destRel, policy string) (string, string, error) {
+	plan, err := prepareMove(srcRel, destRel, policy)
+	if err != nil {
+		return "", "", err
+	}
+	if err := plan.execute(ctx, func(int64, int) {}); err != nil {
+		return "", "", err
+	}
+	return plan.dst, plan.action, nil
+}
+
+// deleteItem removes the file or folder at rel.
+func deleteItem(rel string) error {
+	fullPath, err := resolveItemPath(rel)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Lstat(fullPath)
+	if os.IsNotExist(err) {
+		log.Println("Delete: File or folder not found:", fullPath)
+		return opFail(http.StatusNotFound, "File or folder not found")
+	}
+
+	if err := rootRemoveAll(fullPath); err != nil {
+		log.Println("Delete: Failed to delete:", err)
+		return opFail(http.StatusInternalServerError, "Failed to delete file/folder")
+	}
+	journalChange(changeDelete, fullPath, "", info != nil && info.IsDir())
+	log.Println("Deleted successfully:", fullPath)
+	return nil
+}
+
+// mkdirItem creates the folder rel. When the name is taken the policy
+// applies; overwrite replaces a file of that name but keeps an existing
+// folder (reported as skipped). It returns the absolute path of the folder.
+func mkdirItem(rel, policy string) (string, string, error) {
+	if rel == "" {
+		return "", "", errInvalidPath
+	}
+	targetPath, err := resolveItemPath(rel)
+	if err != nil {
+		return "", "", err
+	}
+
+	final, action, err := resolveConflict(targetPath, false, policy)
+	if err != nil || action == actionSkipped {
+		return final, action, err
+	}
+	if action == actionOverwritten {
+		if info, err := os.Stat(final); err == nil && info.IsDir() {
+			return final, actionSkipped, nil
+		}
+		if err := rootRemove(final); err != nil {
+			return "", "", internalFail("Failed to create folder", err)
+		}
+	}
+
+	if err := mkdirAllJournaled(final, os.ModePerm); err != nil {
+		return "", "", internalFail("Failed to create folder", err)
+	}
+	return final, action, nil
+}
+
+// copyPlan is a validated copy: where it reads from, where it finally ends
+// up, and how much it is going to write.
+type copyPlan struct {
+	src, dst string
+	action   string
+	bytes    int64
+	files    int
+
+	// reservation holds the quota for the copy until execute finishes.
+	reservation *quotaReservation
+}
+
+// prepareCopy validates a copy of srcRel to destRel under policy and
+// reserves quota for it on behalf of user.
+func prepareCopy(user, srcRel, destRel, policy string) (*copyPlan, error) {
+	src, err := resolveItemPath(srcRel)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := resolveItemPath(destRel)
+	if err != nil {
+		return nil, err
+	}
+
+	srcInfo, err := os.Stat(src)
+	if os.IsNotExist(err) {
+		return nil, opFail(http.StatusNotFound, "Source not found")
+	}
+	if err != nil {
+		return nil, internalFail("Failed to copy", err)
+	}
+	// copyTree skips links unless they are trusted, which for a linked
+	// source would leave nothing to copy.
+	if linkInfo, err := os.Lstat(src); err == nil && linkInfo.Mode()&os.ModeSymlink != 0 && symlinkPolicy != symlinkFollow {
+		return nil, errSymlinkDenied
+	}
+	if src == dst && policy == conflictOverwrite {
+		return nil, opFail(http.StatusBadRequest, "Cannot copy a file or folder onto itself")
+	}
+
+	final, action, err := resolveConflict(dst, !srcInfo.IsDir(), policy)
+	if err != nil {
+		return nil, err
+	}
+	plan := &copyPlan{src: src, dst: final, action: action}
+	if action == actionSkipped {
+		return plan, nil
+	}
+	if srcInfo.IsDir() && (isWithin(src, final) || isWithin(final, src)) {
+		return nil, opFail(http.StatusBadRequest, "Cannot copy a folder into itself")
+	}
+
+	plan.bytes, plan.files, err = measureTree(src)
+	if err != nil {
+		return nil, internalFail("Failed to read source", err)
+	}
+	if plan.reservation, err = reserveQuota(plan.bytes, user, final); err != nil {
+		return nil, err
+	}
+
+	if err := mkdirAllJournaled(filepath.Dir(final), os.ModePerm); err != nil {
+		plan.reservation.release()
+		return nil, internalFail("Failed to create target folder", err)
+	}
+	return plan, nil
+}
+
+// execute performs the copy. Overwrites are copied next to the internal
+// folder first so the old target survives a failed or cancelled copy.
+// Every plan from prepareCopy must be executed to settle its reservation.
+func (p *copyPlan) execute(ctx context.Context, progress func(int64, int)) error {
+	if p.action == actionSkipped {
+		return nil
+	}
+	// Committing after a failure is fine: the index just sees what is left.
+	defer p.reservation.commit(p.dst)
+	if p.action != actionOverwritten {
+		if err := copyTree(ctx, p.src, p.dst, progress); err != nil {
+			rootRemoveAll(p.dst)
+			return err
+		}
+		journalChange(changeCreate, p.dst, "", false)
+		return nil
+	}
+
+	tmp := internalPathFor(p.dst, "copy", newID())
+	if err := os.MkdirAll(filepath.Dir(tmp), 0700); err != nil {
+		return err
+	}
+	if err := copyTree(ctx, p.src, tmp, progress); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := replacePath(tmp, p.dst); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	journalChange(changeModify, p.dst, "", false)
+	return nil
+}
+
+// copyItem copies srcRel to destRel synchronously. It returns the absolute
+// destination path and the conflict action taken.
+func copyItem(ctx context.Context, user, srcRel, destRel, policy string) (string, string, error) {
+	plan, err := prepareCopy(user, srcRel, destRel, policy)
+	if err != nil {
+		return "", "", err
+	}
+	if err := plan.execute(ctx, func(int64, int) {}); err != nil {
+		return "", "", internalFail("Failed to copy", err)
+	}
+	return plan.dst, plan.action, nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// uploadRequest builds an upload of name with content into the folder dir.
+func uploadRequest(dir, policy, name, content string) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", name)
+	fw.Write([]byte(content))
+	mw.Close()
+	r := httptest.NewRequest("POST", "/upload?path="+url.QueryEscape(dir)+"&on_conflict="+policy, &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+// TestConflictPolicies puts new.txt ("new") onto the existing dir/file.txt
+// ("in") under every policy, by upload, copy and move.
+func TestConflictPolicies(t *testing.T) {
+	actions := map[string]func(policy string) *httptest.ResponseRecorder{
+		"upload": func(policy string) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			uploadHandler(rec, uploadRequest("dir", policy, "file.txt", "new"))
+			return rec
+		},
+		"copy": func(policy string) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			copyHandler(rec, httptest.NewRequest("POST", "/copy",
+				strings.NewReader(`{"source":"new.txt","dest":"dir/file.txt","on_conflict":"`+policy+`"}`)))
+			return rec
+		},
+		"move": func(policy string) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			moveHandler(rec, httptest.NewRequest("POST", "/move",
+				strings.NewReader(`{"source":"new.txt","dest":"dir/file.txt","on_conflict":"`+policy+`"}`)))
+			return rec
+		},
+	}
+	for _, c := range []struct {
+		policy  string
+		status  int
+		action  string
+		final   string
+		content string // of dir/file.txt afterwards
+	}{
+		{conflictRename, http.StatusOK, actionRenamed, "dir/file(1).txt", "in"},
+		{conflictOverwrite, http.StatusOK, actionOverwritten, "dir/file.txt", "new"},
+		{conflictSkip, http.StatusOK, actionSkipped, "dir/file.txt", "in"},
+		{conflictFail, http.StatusConflict, "", "", "in"},
+	} {
+		for name, do := range actions {
+			t.Run(name+"/"+c.policy, func(t *testing.T) {
+				root := testRoot(t)
+				src := filepath.Join(root, "new.txt")
+				os.WriteFile(src, []byte("new"), 0644)
+
+				rec := do(c.policy)
+				if rec.Code != c.status {
+					t.Fatalf("status %d, want %d: %s", rec.Code, c.status, rec.Body)
+				}
+				if got := rec.Header().Get("X-Conflict-Action"); got != c.action {
+					t.Errorf("action %q, want %q", got, c.action)
+				}
+				if got := rec.Header().Get("X-Final-Path"); got != c.final {
+					t.Errorf("final path %q, want %q", got, c.final)
+				}
+				if c.status == http.StatusConflict && !strings.Contains(rec.Body.String(), "Target already exists") {
+					t.Errorf("body %q", rec.Body)
+				}
+				if got := readString(t, filepath.Join(root, "dir", "file.txt")); got != c.content {
+					t.Errorf("dir/file.txt = %q, want %q", got, c.content)
+				}
+				if c.action == actionRenamed {
+					if got := readString(t, filepath.Join(root, "dir", "file(1).txt")); got != "new" {
+						t.Errorf("renamed copy = %q, want %q", got, "new")
+					}
+				}
+				_, err := os.Stat(src)
+				if moved := name == "move" && (c.action == actionRenamed || c.action == actionOverwritten); moved != os.IsNotExist(err) {
+					t.Errorf("source still there: %t, want %t", err == nil, !moved)
+				}
+			})
+		}
+	}
+}
+
+// TestCaseOnlyRename renames a file to another case of its own name, which
+// on case-insensitive filesystems names the file itself. A hard link stands
+// in for that here. It is no conflict, whatever the policy.
+func TestCaseOnlyRename(t *testing.T) {
+	for _, policy := range []string{conflictRename, conflictOverwrite, conflictSkip, conflictFail} {
+		root := testRoot(t)
+		oldPath := filepath.Join(root, "dir", "file.txt")
+		newPath := filepath.Join(root, "dir", "FILE.txt")
+		if err := os.Link(oldPath, newPath); err != nil {
+			t.Skip("no hard links:", err)
+		}
+		info, _ := os.Stat(oldPath)
+		if !sameEntry(oldPath, newPath, info) {
+			t.Fatal("sameEntry does not match a case-only rename")
+		}
+
+		for name, do := range map[string]func(context.Context, string, string, string) (string, string, error){
+			"rename": renameItem,
+			"move":   moveItem,
+		} {
+			final, action, err := do(context.Background(), "dir/file.txt", "dir/FILE.txt", policy)
+			if err != nil || final != newPath || action != actionCreated {
+				t.Errorf("%s with %s: %q, %q, %v; want %q, %q", name, policy, final, action, err, newPath, actionCreated)
+			}
+		}
+		if got := readString(t, newPath); got != "in" {
+			t.Errorf("%s: FILE.txt = %q", policy, got)
+		}
+	}
+
+	root := testRoot(t)
+	os.WriteFile(filepath.Join(root, "dir", "FILE.txt"), []byte("other"), 0644)
+	info, _ := os.Stat(filepath.Join(root, "dir", "file.txt"))
+	if sameEntry(filepath.Join(root, "dir", "file.txt"), filepath.Join(root, "dir", "FILE.txt"), info) {
+		t.Error("sameEntry matched two different files")
+	}
+	if _, _, err := renameItem(context.Background(), "dir/file.txt", "dir/FILE.txt", conflictFail); err == nil {
+		t.Error("renaming onto a different file with fail did not conflict")
+	}
+}
+
+// TestUploadOverwriteStaysInRoot swaps the internal folder for a link out
+// of the root: an overwriting upload must not write through it.
+func TestUploadOverwriteStaysInRoot(t *testing.T) {
+	root := testRoot(t)
+	outside := filepath.Join(filepath.Dir(root), "outside")
+	os.RemoveAll(filepath.Join(root, internalDirName))
+	os.Symlink(outside, filepath.Join(root, internalDirName))
+
+	rec := httptest.NewRecorder()
+	uploadHandler(rec, uploadRequest("dir", conflictOverwrite, "file.txt", "new"))
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status %d, want 500", rec.Code)
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 1 {
+		t.Errorf("upload wrote outside the root: %d entries", len(entries))
+	}
+	if got := readString(t, filepath.Join(root, "dir", "file.txt")); got != "in" {
+		t.Errorf("dir/file.txt = %q, want it untouched", got)
+	}
+}
+
+// testRoots sets up the storage roots a and b, each with dir/file.txt.
+func testRoots(t *testing.T) (string, string) {
+	base := t.TempDir()
+	a, b := filepath.Join(base, "a"), filepath.Join(base, "b")
+	for _, root := range []string{a, b} {
+		os.MkdirAll(filepath.Join(root, "dir"), 0755)
+		os.WriteFile(filepath.Join(root, "dir", "file.txt"), []byte("in"), 0644)
+	}
+	old := storageRoots
+	storageRoots = []*storageRoot{{Name: "a", Dir: a}, {Name: "b", Dir: b}}
+	t.Cleanup(func() { storageRoots = old })
+	return a, b
+}
+
+func postMove(body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	moveHandler(rec, httptest.NewRequest("POST", "/move", strings.NewReader(body)))
+	return rec
+}
+
+func TestMoveAcrossRoots(t *testing.T) {
+	a, b := testRoots(t)
+
+	rec := postMove(`{"source":"a/dir","dest":"b/moved"}`)
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Final-Path") != "b/moved" {
+		t.Fatalf("small move: status %d, final %q", rec.Code, rec.Header().Get("X-Final-Path"))
+	}
+	if got := readString(t, filepath.Join(b, "moved", "file.txt")); got != "in" {
+		t.Errorf("moved file = %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(a, "dir")); !os.IsNotExist(err) {
+		t.Errorf("source still there: %v", err)
+	}
+
+	// Large moves run as a job.
+	many := filepath.Join(a, "many")
+	os.Mkdir(many, 0755)
+	for i := 0; i < copyJobFiles; i++ {
+		os.WriteFile(filepath.Join(many, fmt.Sprintf("f%03d.txt", i)), []byte("data"), 0644)
+	}
+	rec = postMove(`{"source":"a/many","dest":"b/many"}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("large move: status %d, want 202; body %s", rec.Code, rec.Body)
+	}
+	jobsMu.RLock()
+	job := jobs[strings.TrimPrefix(rec.Header().Get("Location"), "/jobs/")]
+	jobsMu.RUnlock()
+	if job == nil {
+		t.Fatal("no job for the move")
+	}
+	if snap := waitJob(t, job); snap.Status != jobDone || snap.Type != "move" || snap.DoneFiles != copyJobFiles {
+		t.Errorf("job finished %s (%s) with %d files", snap.Status, snap.Error, snap.DoneFiles)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(b, "many")); len(entries) != copyJobFiles {
+		t.Errorf("moved %d files, want %d", len(entries), copyJobFiles)
+	}
+	if _, err := os.Stat(many); !os.IsNotExist(err) {
+		t.Errorf("source still there: %v", err)
+	}
+}
+
+func TestMoveAcrossRootsCancel(t *testing.T) {
+	a, b := testRoots(t)
+	plan, err := prepareMove("a/dir", "b/dir", conflictOverwrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !plan.crossRoot() || plan.action != actionOverwritten {
+		t.Fatalf("plan: cross root %t, action %q", plan.crossRoot(), plan.action)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := plan.execute(ctx, func(int64, int) {}); err == nil {
+		t.Fatal("cancelled move succeeded")
+	}
+
+	for _, root := range []string{a, b} {
+		if got := readString(t, filepath.Join(root, "dir", "file.txt")); got != "in" {
+			t.Errorf("%s: dir/file.txt = %q after a cancelled move", root, got)
+		}
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(b, internalDirName, "move", "*")); len(leftovers) != 0 {
+		t.Errorf("staging left behind: %v", leftovers)
+	}
+}
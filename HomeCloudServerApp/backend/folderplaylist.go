@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Folder playlists: /playlist/<folder>.m3u8 (or .xspf) lists the audio and
+// video files of a folder for players like VLC. Entries are absolute
+// /stream/ URLs signed for the requesting user, so the playlist can be
+// shared with a player without the user's token.
+
+const maxPlaylistEntries = 10000
+
+type playlistEntry struct {
+	url      string
+	title    string
+	artist   string
+	album    string
+	duration float64
+}
+
+func folderPlaylistHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/playlist/")
+	ext := strings.ToLower(path.Ext(name))
+	if ext != ".m3u8" && ext != ".m3u" && ext != ".xspf" {
+		replyError(w, r, http.StatusNotFound, "Playlist names end in .m3u8 or .xspf")
+		return
+	}
+	folder := strings.TrimSuffix(name, path.Ext(name))
+	abs, err := resolvePath(folder)
+	if err != nil {
+		replyOpError(w, r, err)
+		return
+	}
+	if info, err := os.Stat(abs); err != nil || !info.IsDir() {
+		replyError(w, r, http.StatusNotFound, "Folder not found")
+		return
+	}
+	recursive, _ := strconv.ParseBool(r.URL.Query().Get("recursive"))
+
+	files := folderMedia(abs, recursive)
+	base, user, exp := externalURL(r), requestUser(r), time.Now().Add(playlistURLTTL)
+	entries := make([]playlistEntry, 0, len(files))
+	for _, f := range files {
+		rel := relFromAbs(f)
+		e := playlistEntry{
+			url:      base + "/stream/" + escapePath(rel) + signedQuery(user, rel, "", exp),
+			title:    strings.TrimSuffix(filepath.Base(f), filepath.Ext(f)),
+			duration: -1,
+		}
+		if t := library.trackAt(f); t != nil {
+			e.title, e.artist, e.album, e.duration = t.Title, t.Artist, t.Album, t.Duration
+		}
+		entries = append(entries, e)
+	}
+
+	title := path.Base(relFromAbs(abs))
+	w.Header().Set("Cache-Control", "no-store")
+	if ext == ".xspf" {
+		writeXSPF(w, title, entries)
+		return
+	}
+	w.Header().Set("Content-Type", "audio/x-mpegurl; charset=utf-8")
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	fmt.Fprintf(&b, "#PLAYLIST:%s\n", title)
+	for _, e := range entries {
+		label := e.title
+		if e.artist != "" {
+			label = e.artist + " - " + e.title
+		}
+		dur := -1
+		if e.duration > 0 {
+			dur = int(e.duration + 0.5)
+		}
+		fmt.Fprintf(&b, "#EXTINF:%d,%s\n%s\n", dur, label, e.url)
+	}
+	w.Write([]byte(b.String()))
+}
+
+// folderMedia returns the audio and video files in dir, in natural order.
+// Hidden files and folders are skipped and symlinked folders are not
+// followed.
+func folderMedia(dir string, recursive bool) []string {
+	var files []string
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if len(files) >= maxPlaylistEntries {
+			return filepath.SkipAll
+		}
+		if err != nil || p == dir {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") || d.IsDir() && !recursive {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		ext := strings.ToLower(filepath.Ext(p))
+		if d.IsDir() || !audioExts[ext] && !hlsVideoExts[ext] {
+			return nil
+		}
+		// Same rules as /stream, including the symlink policy.
+		if _, err := resolvePath(relFromAbs(p)); err != nil {
+			return nil
+		}
+		if info, err := os.Stat(p); err == nil && info.Mode().IsRegular() {
+			files = append(files, p)
+		}
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool {
+		return naturalPathLess(relFromAbs(files[i]), relFromAbs(files[j]))
+	})
+	return files
+}
+
+// naturalPathLess orders slash-separated paths folder by folder with
+// naturalLess.
+func naturalPathLess(a, b string) bool {
+	as, bs := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] != bs[i] {
+			return naturalLess(as[i], bs[i])
+		}
+	}
+	return len(as) < len(bs)
+}
+
+// naturalLess orders names case-insensitively with runs of digits compared
+// by value, so "Episode 2" comes before "Episode 10".
+func naturalLess(a, b string) bool {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	for a != "" && b != "" {
+		da, db := leadingDigits(a), leadingDigits(b)
+		if da != "" && db != "" {
+			na, nb := strings.TrimLeft(da, "0"), strings.TrimLeft(db, "0")
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			if na != nb {
+				return na < nb
+			}
+			a, b = a[len(da):], b[len(db):]
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+func leadingDigits(s string) string {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return s[:i]
+}
+
+// externalURL is the scheme and host the client reached the server at.
+func externalURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"http://xspf.org/ns/0/ playlist"`
+	Version string      `xml:"version,attr"`
+	Title   string      `xml:"title"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+type xspfTrack struct {
+	Location string `xml:"location"`
+	Title    string `xml:"title"`
+	Creator  string `xml:"creator,omitempty"`
+	Album    string `xml:"album,omitempty"`
+	Duration int64  `xml:"duration,omitempty"`
+}
+
+func writeXSPF(w http.ResponseWriter, title string, entries []playlistEntry) {
+	pl := xspfPlaylist{Version: "1", Title: title}
+	for _, e := range entries {
+		t := xspfTrack{Location: e.url, Title: e.title, Creator: e.artist, Album: e.album}
+		if e.duration > 0 {
+			t.Duration = int64(e.duration * 1000)
+		}
+		pl.Tracks = append(pl.Tracks, t)
+	}
+	w.Header().Set("Content-Type", "application/xspf+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	enc.Encode(pl)
+}
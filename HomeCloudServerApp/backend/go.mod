@@ -1,6 +1,6 @@
 module fileserver
 
-go 1.24.5
+go 1.25.0
 
 require (
 	github.com/fsnotify/fsnotify v1.9.0
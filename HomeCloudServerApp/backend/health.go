@@ -0,0 +1,189 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/disk"
+)
+
+// Set at build time:
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse --short HEAD)"
+var (
+	version = "dev"
+	commit  = "unknown"
+)
+
+// minFreeDiskBytes is the physical free space below which the server
+// reports itself as not ready, regardless of the quota.
+const minFreeDiskBytes = 64 << 20
+
+// readyCacheTTL limits how often /readyz touches the disk.
+const readyCacheTTL = 5 * time.Second
+
+var (
+	startedAt = time.Now()
+
+	// watcherReady is set once startWatcher has sized the tree and
+	// registered its watches.
+	watcherReady atomic.Bool
+
+	readyMu      sync.Mutex
+	readyChecked time.Time
+	readyChecks  map[string]string
+	readyOK      bool
+)
+
+// healthzHandler is the liveness probe: it answers as long as the process
+// serves HTTP and does no I/O.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	reply(w, r, http.StatusOK, "ok", map[string]interface{}{
+		"status":         "ok",
+		"uptime_seconds": int64(time.Since(startedAt).Seconds()),
+	})
+}
+
+// readyzHandler reports whether the server can take uploads: the watcher
+// finished its initial walk and the storage root is writable and not full.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ok, checks := readiness()
+	status, text := http.StatusOK, "ready"
+	if !ok {
+		status, text = http.StatusServiceUnavailable, "not ready"
+	}
+	reply(w, r, status, text, map[string]interface{}{
+		"ready":  ok,
+		"checks": checks,
+	})
+}
+
+func readiness() (bool, map[string]string) {
+	readyMu.Lock()
+	defer readyMu.Unlock()
+
+	select {
+	case <-shutdownCh:
+		return false, map[string]string{"server": "shutting down"}
+	default:
+	}
+
+	if readyChecks != nil && time.Since(readyChecked) < readyCacheTTL {
+		return readyOK, readyChecks
+	}
+
+	checks := map[string]string{"watcher": "ok", "storage_writable": "ok", "storage_space": "ok"}
+	ok := true
+	fail := func(name, reason string) {
+		checks[name] = reason
+		ok = false
+	}
+
+	if !watcherReady.Load() {
+		fail("watcher", "initial scan in progress")
+	}
+
+	if err := probeWritable(); err != nil {
+		log.Printf("Readiness: storage not writable: %v", err)
+		fail("storage_writable", "cannot write to storage")
+	}
+
+	if !fitsQuota(1) {
+		fail("storage_space", "storage quota exhausted")
+	} else {
+		for _, rt := range storageRoots {
+			if usage, err := disk.Usage(rt.Dir); err == nil && usage.Free < minFreeDiskBytes {
+				fail("storage_space", "disk is full")
+				break
+			}
+		}
+	}
+
+	readyChecked, readyChecks, readyOK = time.Now(), checks, ok
+	return ok, checks
+}
+
+// watchdogHealthy reports whether the systemd watchdog may be pinged: the
+// readiness checks pass, apart from the initial scan, a full disk and a
+// shutdown in progress, which a restart would not help with.
+func watchdogHealthy() bool {
+	ok, checks := readiness()
+	if ok {
+		return true
+	}
+	for name, state := range checks {
+		switch name {
+		case "watcher", "storage_space", "server":
+			continue
+		}
+		if state != "ok" {
+			return false
+		}
+	}
+	return true
+}
+
+// probeWritable creates and removes a file in the internal folder of every
+// storage root.
+func probeWritable() error {
+	for _, rt := range storageRoots {
+		dir := rt.internal()
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		f, err := os.CreateTemp(dir, "ready-*")
+		if err != nil {
+			return err
+		}
+		f.Close()
+		if err := os.Remove(f.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	reply(w, r, http.StatusOK, "", map[string]interface{}{
+		"version":    version,
+		"commit":     commit,
+		"go_version": runtime.Version(),
+		"os":         runtime.GOOS,
+		"arch":       runtime.GOARCH,
+		"api":        apiVersion,
+		"features":   enabledFeatures(),
+	})
+}
+
+// enabledFeatures lists optional capabilities so clients can adapt to what
+// this build and configuration support.
+func enabledFeatures() []string {
+	features := []string{"api_v1", "openapi", "copy_jobs", "batch", "conflict_policies"}
+	if publicEnabled {
+		features = append(features, "public_folder")
+	}
+	if reflinkSupported {
+		features = append(features, "reflink")
+	}
+	if hlsTranscoder != nil {
+		features = append(features, "hls_"+hlsTranscoder.Name())
+	}
+	if len(musicFolders) > 0 {
+		features = append(features, "music_library")
+	}
+	if len(photoFolders) > 0 {
+		features = append(features, "photo_timeline")
+	}
+	if len(dlnaFolders) > 0 {
+		features = append(features, "dlna")
+	}
+	if systemdSupported {
+		features = append(features, "systemd")
+	}
+	return features
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWatchdogHealthy(t *testing.T) {
+	t.Cleanup(func() {
+		readyMu.Lock()
+		readyChecks = nil
+		readyMu.Unlock()
+	})
+	for _, c := range []struct {
+		checks  map[string]string
+		healthy bool
+	}{
+		{map[string]string{"watcher": "ok", "storage_writable": "ok", "storage_space": "ok"}, true},
+		{map[string]string{"watcher": "initial scan in progress", "storage_writable": "ok", "storage_space": "ok"}, true},
+		{map[string]string{"watcher": "ok", "storage_writable": "ok", "storage_space": "disk is full"}, true},
+		{map[string]string{"watcher": "ok", "storage_writable": "cannot write to storage", "storage_space": "ok"}, false},
+	} {
+		ok := true
+		for _, state := range c.checks {
+			ok = ok && state == "ok"
+		}
+		readyMu.Lock()
+		readyChecked, readyChecks, readyOK = time.Now(), c.checks, ok
+		readyMu.Unlock()
+		if got := watchdogHealthy(); got != c.healthy {
+			t.Errorf("%v: watchdogHealthy() = %t, want %t", c.checks, got, c.healthy)
+		}
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HLS streaming at /hls/<path>/master.m3u8. Segments are cut on demand by
+// the configured transcoder and kept in the internal folder of the root the
+// video lies on; the janitor drops the least recently used ones.
+var (
+	hlsMode          = hlsAuto
+	hlsCacheMaxBytes = int64(4096) << 20
+	hlsCacheMaxAge   = 24 * time.Hour
+
+	hlsTranscoder transcoder
+)
+
+const (
+	hlsSegmentSeconds  = 6
+	hlsSegmentTimeout  = 5 * time.Minute
+	hlsJanitorInterval = 10 * time.Minute
+)
+
+var hlsVideoExts = map[string]bool{
+	".mp4": true, ".m4v": true, ".mkv": true, ".mov": true, ".webm": true,
+	".avi": true, ".wmv": true, ".flv": true, ".ts": true, ".mpg": true, ".mpeg": true,
+}
+
+var hlsSegmentName = regexp.MustCompile(`^([0-9]{5})\.ts$`)
+
+var (
+	hlsMu sync.Mutex
+	// hlsProbes caches mediaInfo per cache key.
+	hlsProbes = map[string]mediaInfo{}
+	// hlsInflight holds the segments being cut, so concurrent requests for
+	// the same segment share one ffmpeg run.
+	hlsInflight = map[string]*hlsWork{}
+	// hlsSlots limits how many segments are cut at once.
+	hlsSlots = make(chan struct{}, max(1, runtime.NumCPU()/2))
+)
+
+type hlsWork struct {
+	done chan struct{}
+	err  error
+}
+
+func initHLS() {
+	hlsTranscoder = newTranscoder(hlsMode)
+	if hlsTranscoder != nil {
+		log.Printf("HLS: %s mode", hlsTranscoder.Name())
+	}
+}
+
+// hlsSource is a video requested through /hls.
+type hlsSource struct {
+	abs  string
+	rel  string
+	info os.FileInfo
+	// key identifies this version of the file in the segment cache.
+	key string
+}
+
+func (s hlsSource) cacheDir() string {
+	return internalPathFor(s.abs, "hls", s.key)
+}
+
+func hlsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		replyError(w, r, http.StatusMethodNotAllowed, "use GET method")
+		return
+	}
+	rel, variant, file := parseHLSPath(strings.TrimPrefix(r.URL.Path, "/hls/"))
+	if rel == "" {
+		replyError(w, r, http.StatusNotFound, "Not found")
+		return
+	}
+
+	src, err := openHLSSource(rel)
+	if err != nil {
+		replyOpError(w, r, err)
+		return
+	}
+	info, err := hlsProbe(src)
+	if err != nil {
+		log.Printf("HLS: probing %s: %v", src.rel, err)
+		replyError(w, r, http.StatusUnsupportedMediaType, "Cannot read video")
+		return
+	}
+	variants := hlsTranscoder.Variants(info)
+	touchHLSCache(src)
+
+	if file == "master.m3u8" {
+		writePlaylist(w, hlsMaster(variants, info, linkQuery(r, rel)))
+		return
+	}
+
+	var v *hlsVariant
+	for i := range variants {
+		if variants[i].Name == variant {
+			v = &variants[i]
+		}
+	}
+	if v == nil {
+		replyError(w, r, http.StatusNotFound, "Not found")
+		return
+	}
+
+	if file == "index.m3u8" {
+		writePlaylist(w, hlsMediaPlaylist(linkQuery(r, rel), src, *v, info))
+		return
+	}
+
+	m := hlsSegmentName.FindStringSubmatch(file)
+	if m == nil || v.Passthrough {
+		replyError(w, r, http.StatusNotFound, "Not found")
+		return
+	}
+	n, _ := strconv.Atoi(m[1])
+	if n >= hlsSegmentCount(info) {
+		replyError(w, r, http.StatusNotFound, "Not found")
+		return
+	}
+	seg, err := hlsSegment(src, *v, info, n)
+	if err != nil {
+		log.Printf("HLS: segment %d of %s (%s): %v", n, src.rel, v.Name, err)
+		replyError(w, r, http.StatusInternalServerError, "Transcoding failed")
+		return
+	}
+	defer seg.Close()
+	var modTime time.Time
+	if st, err := seg.Stat(); err == nil {
+		modTime = st.ModTime()
+	}
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	http.ServeContent(w, r, file, modTime, seg)
+}
+
+// parseHLSPath splits the path below /hls/ into the video, the variant and
+// the file: <path>/master.m3u8, <path>/<variant>/index.m3u8 or
+// <path>/<variant>/<n>.ts.
+func parseHLSPath(rest string) (rel, variant, file string) {
+	if p, ok := strings.CutSuffix(rest, "/master.m3u8"); ok {
+		return p, "", "master.m3u8"
+	}
+	dir, file := pathSplit(rest)
+	rel, variant = pathSplit(dir)
+	return rel, variant, file
+}
+
+// hlsSourceRel is the video a request below /hls/ is for, which is what
+// its signed URL covers.
+func hlsSourceRel(rest string) string {
+	rel, _, _ := parseHLSPath(rest)
+	return rel
+}
+
+// pathSplit splits off the last element of a slash-separated path.
+func pathSplit(p string) (string, string) {
+	i := strings.LastIndex(p, "/")
+	if i < 0 {
+		return "", p
+	}
+	return p[:i], p[i+1:]
+}
+
+func openHLSSource(rel string) (hlsSource, error) {
+	abs, err := resolveItemPath(rel)
+	if err != nil {
+		return hlsSource{}, err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return hlsSource{}, err
+	}
+	if info.IsDir() || !hlsVideoExts[strings.ToLower(filepath.Ext(abs))] {
+		return hlsSource{}, opFail(http.StatusUnsupportedMediaType, "Not a video file")
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%d", abs, info.Size(), info.ModTime().UnixNano())))
+	return hlsSource{abs: abs, rel: relFromAbs(abs), info: info, key: hex.EncodeToString(sum[:8])}, nil
+}
+
+func hlsProbe(src hlsSource) (mediaInfo, error) {
+	hlsMu.Lock()
+	info, ok := hlsProbes[src.key]
+	hlsMu.Unlock()
+	if ok {
+		return info, nil
+	}
+	ctx, cancel := hlsContext()
+	defer cancel()
+	info, err := hlsTranscoder.Probe(ctx, src.abs)
+	if err != nil {
+		return mediaInfo{}, err
+	}
+	hlsMu.Lock()
+	if len(hlsProbes) > 1000 {
+		hlsProbes = map[string]mediaInfo{}
+	}
+	hlsProbes[src.key] = info
+	hlsMu.Unlock()
+	return info, nil
+}
+
+// hlsContext bounds one ffmpeg run and stops it on shutdown. Runs are not
+// tied to the request, since other clients may wait for the same segment.
+func hlsContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), hlsSegmentTimeout)
+	go func() {
+		select {
+		case <-shutdownCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func writePlaylist(w http.ResponseWriter, body string) {
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(body))
+}
+
+func hlsMaster(variants []hlsVariant, info mediaInfo, query string) string {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	for _, v := range variants {
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d", v.Bandwidth)
+		if info.Width > 0 && info.Height > 0 && v.Height > 0 {
+			width := int(math.Round(float64(info.Width)*float64(v.Height)/float64(info.Height)/2)) * 2
+			fmt.Fprintf(&b, ",RESOLUTION=%dx%d", width, v.Height)
+		}
+		fmt.Fprintf(&b, "\n%s/index.m3u8%s\n", v.Name, query)
+	}
+	return b.String()
+}
+
+func hlsSegmentCount(info mediaInfo) int {
+	if len(info.Cuts) > 0 {
+		return len(info.Cuts)
+	}
+	return int(math.Ceil(info.Duration / hlsSegmentSeconds))
+}
+
+func hlsMediaPlaylist(query string, src hlsSource, v hlsVariant, info mediaInfo) string {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-MEDIA-SEQUENCE:0\n")
+
+	if v.Passthrough {
+		// One segment: the original file from /stream.
+		target := max(1, int(math.Ceil(info.Duration)))
+		fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n#EXTINF:%s,\n", target, fmtSeconds(info.Duration))
+		fmt.Fprintf(&b, "/stream/%s%s\n", escapePath(src.rel), query)
+		b.WriteString("#EXT-X-ENDLIST\n")
+		return b.String()
+	}
+
+	target := hlsSegmentSeconds
+	for n := 0; n < hlsSegmentCount(info); n++ {
+		_, dur := hlsSegmentRange(info, n)
+		target = max(target, int(math.Ceil(dur)))
+	}
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", target)
+	for n := 0; n < hlsSegmentCount(info); n++ {
+		_, dur := hlsSegmentRange(info, n)
+		fmt.Fprintf(&b, "#EXTINF:%s,\n%05d.ts%s\n", fmtSeconds(dur), n, query)
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+	return b.String()
+}
+
+func hlsSegmentRange(info mediaInfo, n int) (start, dur float64) {
+	if len(info.Cuts) > 0 {
+		end := info.Duration
+		if n+1 < len(info.Cuts) {
+			end = info.Cuts[n+1]
+		}
+		return info.Cuts[n], end - info.Cuts[n]
+	}
+	start = float64(n * hlsSegmentSeconds)
+	return start, math.Min(hlsSegmentSeconds, info.Duration-start)
+}
+
+// escapePath escapes each element of a slash-separated path.
+func escapePath(p string) string {
+	parts := strings.Split(p, "/")
+	for i, s := range parts {
+		parts[i] = url.PathEscape(s)
+	}
+	return strings.Join(parts, "/")
+}
+
+// hlsSegment returns the cached segment n, cutting it first if needed.
+// hlsSegment returns segment n of v, cutting it first when it is not
+// cached. The file is opened right away: the janitor may remove the cache
+// between the check and the read, which then just counts as a miss.
+func hlsSegment(src hlsSource, v hlsVariant, info mediaInfo, n int) (*os.File, error) {
+	dst := filepath.Join(src.cacheDir(), v.Name, fmt.Sprintf("%05d.ts", n))
+	for attempt := 0; ; attempt++ {
+		f, err := os.Open(dst)
+		if err == nil || !os.IsNotExist(err) || attempt == 2 {
+			return f, err
+		}
+		if err := hlsCut(src, v, info, n, dst); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// hlsCut cuts segment n into dst, once for all concurrent requests.
+func hlsCut(src hlsSource, v hlsVariant, info mediaInfo, n int, dst string) error {
+	hlsMu.Lock()
+	if work := hlsInflight[dst]; work != nil {
+		hlsMu.Unlock()
+		<-work.done
+		return work.err
+	}
+	work := &hlsWork{done: make(chan struct{})}
+	hlsInflight[dst] = work
+	hlsMu.Unlock()
+
+	work.err = cutSegment(src, v, info, n, dst)
+
+	hlsMu.Lock()
+	delete(hlsInflight, dst)
+	hlsMu.Unlock()
+	close(work.done)
+	return work.err
+}
+
+func cutSegment(src hlsSource, v hlsVariant, info mediaInfo, n int, dst string) error {
+	select {
+	case hlsSlots <- struct{}{}:
+	case <-shutdownCh:
+		return fmt.Errorf("shutting down")
+	}
+	defer func() { <-hlsSlots }()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	ctx, cancel := hlsContext()
+	defer cancel()
+	tmp := dst + ".tmp"
+	start, dur := hlsSegmentRange(info, n)
+	if err := hlsTranscoder.Segment(ctx, src.abs, v, start, dur, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// touchHLSCache marks the cache of src as used, for the janitor. The
+// folder is created here so a fresh cache is marked too.
+func touchHLSCache(src hlsSource) {
+	dir := src.cacheDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Printf("HLS: creating cache %s: %v", dir, err)
+		return
+	}
+	now := time.Now()
+	os.Chtimes(dir, now, now)
+}
+
+// hlsJanitor removes segment caches that were not used for hlsCacheMaxAge
+// and then the least recently used ones until the caches fit
+// hlsCacheMaxBytes.
+func hlsJanitor(ctx context.Context) {
+	if hlsTranscoder == nil {
+		return
+	}
+	ticker := time.NewTicker(hlsJanitorInterval)
+	defer ticker.Stop()
+	for {
+		cleanHLSCache()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func cleanHLSCache() {
+	type cacheDir struct {
+		path string
+		used time.Time
+		size int64
+	}
+	var dirs []cacheDir
+	var total int64
+	for _, rt := range storageRoots {
+		entries, err := os.ReadDir(rt.internal("hls"))
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil || !e.IsDir() {
+				continue
+			}
+			p := filepath.Join(rt.internal("hls"), e.Name())
+			if time.Since(info.ModTime()) > hlsCacheMaxAge && removeHLSCache(p) {
+				continue
+			}
+			size := treeSize(p)
+			dirs = append(dirs, cacheDir{p, info.ModTime(), size})
+			total += size
+		}
+	}
+
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].used.Before(dirs[j].used) })
+	for _, d := range dirs {
+		if total <= hlsCacheMaxBytes {
+			break
+		}
+		if removeHLSCache(d.path) {
+			total -= d.size
+		}
+	}
+}
+
+// removeHLSCache removes the segment cache at dir unless a segment is
+// being cut into it. hlsMu is held throughout, so no cut can start in
+// between.
+func removeHLSCache(dir string) bool {
+	hlsMu.Lock()
+	defer hlsMu.Unlock()
+	for dst := range hlsInflight {
+		if isWithin(dir, dst) {
+			return false
+		}
+	}
+	os.RemoveAll(dir)
+	return true
+}
+
+func treeSize(root string) int64 {
+	var size int64
+	filepath.Walk(root, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
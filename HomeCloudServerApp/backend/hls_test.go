@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKeyframeCuts(t *testing.T) {
+	// A 2 s GOP with one late keyframe: cuts land on keyframes only.
+	keyframes := []float64{0.0334, 2.0334, 4.0334, 6.0334, 8.0334, 13.5, 15.5, 17.5, 19.5}
+	cuts := keyframeCuts(keyframes, 21)
+	want := []float64{0, 6.034, 13.5, 19.5}
+	if len(cuts) != len(want) {
+		t.Fatalf("cuts = %v, want %v", cuts, want)
+	}
+	for i := range want {
+		if cuts[i] != want[i] {
+			t.Fatalf("cuts = %v, want %v", cuts, want)
+		}
+	}
+
+	info := mediaInfo{Duration: 21, Cuts: cuts}
+	if n := hlsSegmentCount(info); n != 4 {
+		t.Errorf("segment count = %d, want 4", n)
+	}
+	var total float64
+	for n := 0; n < hlsSegmentCount(info); n++ {
+		start, dur := hlsSegmentRange(info, n)
+		if start != cuts[n] {
+			t.Errorf("segment %d starts at %v, want %v", n, start, cuts[n])
+		}
+		total += dur
+	}
+	if total < 20.999 || total > 21.001 {
+		t.Errorf("segments cover %v s, want 21", total)
+	}
+	if !strings.Contains(hlsMediaPlaylist("", hlsSource{}, hlsVariant{Name: "copy"}, info), "#EXT-X-TARGETDURATION:8\n") {
+		t.Error("target duration does not cover the longest segment")
+	}
+
+	if cuts := keyframeCuts(nil, 21); cuts != nil {
+		t.Errorf("no keyframes: cuts = %v, want none", cuts)
+	}
+}
+
+// TestHLSSignedPlaylists follows a signed master playlist down to the
+// stream, without a token.
+func TestHLSSignedPlaylists(t *testing.T) {
+	root := testRoot(t)
+	os.WriteFile(filepath.Join(root, "dir", "clip.mp4"), []byte("video"), 0644)
+	old := hlsTranscoder
+	hlsTranscoder = passthroughTranscoder{}
+	t.Cleanup(func() { hlsTranscoder = old })
+
+	var rt route
+	for _, r := range appRoutes() {
+		if r.Pattern == "/hls/" {
+			rt = r
+		}
+	}
+	if !rt.Signed {
+		t.Fatal("/hls/ is not a signed route")
+	}
+	h := acceptSigned(rt, func(w http.ResponseWriter, r *http.Request) {
+		replyError(w, r, http.StatusUnauthorized, "Unauthorized")
+	})
+	get := func(url string) string {
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest("GET", url, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: status %d", url, rec.Code)
+		}
+		return rec.Body.String()
+	}
+
+	query := signedQuery(adminUser, "dir/clip.mp4", "", time.Now().Add(time.Hour))
+	master := get("/hls/dir/clip.mp4/master.m3u8" + query)
+	if !strings.Contains(master, "source/index.m3u8"+query+"\n") {
+		t.Fatalf("master playlist does not pass the signature on:\n%s", master)
+	}
+	media := get("/hls/dir/clip.mp4/source/index.m3u8" + query)
+	if !strings.Contains(media, "/stream/dir/clip.mp4"+query+"\n") {
+		t.Fatalf("media playlist does not sign the stream URL:\n%s", media)
+	}
+
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest("GET", "/hls/dir/other.mp4/master.m3u8"+query, nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("signature for another video: status %d, want 401", rec.Code)
+	}
+}
+
+func TestRemoveHLSCacheSkipsCuts(t *testing.T) {
+	dir := t.TempDir()
+	cache := filepath.Join(dir, "abc")
+	os.MkdirAll(filepath.Join(cache, "720p"), 0700)
+
+	dst := filepath.Join(cache, "720p", "00003.ts")
+	hlsMu.Lock()
+	hlsInflight[dst] = &hlsWork{done: make(chan struct{})}
+	hlsMu.Unlock()
+	if removeHLSCache(cache) {
+		t.Error("removed a cache with a segment being cut")
+	}
+	if _, err := os.Stat(cache); err != nil {
+		t.Fatal(err)
+	}
+
+	hlsMu.Lock()
+	delete(hlsInflight, dst)
+	hlsMu.Unlock()
+	if !removeHLSCache(cache) {
+		t.Error("kept an idle cache")
+	}
+	if _, err := os.Stat(cache); !os.IsNotExist(err) {
+		t.Errorf("cache still there: %v", err)
+	}
+}
+
+// fakeTranscoder cuts segments that name their start time.
+type fakeTranscoder struct{ cuts *atomic.Int32 }
+
+func (fakeTranscoder) Name() string { return "fake" }
+
+func (fakeTranscoder) Probe(ctx context.Context, src string) (mediaInfo, error) {
+	return mediaInfo{Duration: 12}, nil
+}
+
+func (fakeTranscoder) Variants(info mediaInfo) []hlsVariant {
+	return []hlsVariant{{Name: "720p", Height: 720, Bandwidth: 2800000}}
+}
+
+func (t fakeTranscoder) Segment(ctx context.Context, src string, v hlsVariant, start, dur float64, dst string) error {
+	t.cuts.Add(1)
+	return os.WriteFile(dst, []byte(fmt.Sprintf("segment at %v", start)), 0600)
+}
+
+// TestHLSSegmentCache serves segments from the cache and cuts them again
+// when the janitor removed the cache in between.
+func TestHLSSegmentCache(t *testing.T) {
+	root := testRoot(t)
+	os.WriteFile(filepath.Join(root, "dir", "clip.mp4"), []byte("video"), 0644)
+	var cuts atomic.Int32
+	old := hlsTranscoder
+	hlsTranscoder = fakeTranscoder{&cuts}
+	t.Cleanup(func() { hlsTranscoder = old })
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		hlsHandler(rec, httptest.NewRequest("GET", "/hls/dir/clip.mp4/"+path, nil))
+		return rec
+	}
+
+	if rec := get("master.m3u8"); rec.Code != http.StatusOK {
+		t.Fatalf("master: status %d", rec.Code)
+	}
+	src, err := openHLSSource("dir/clip.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(src.cacheDir()); err != nil {
+		t.Fatalf("the playlist did not create and mark the cache: %v", err)
+	}
+
+	for i, want := range []int32{1, 1} {
+		rec := get("720p/00001.ts")
+		if rec.Code != http.StatusOK || rec.Body.String() != "segment at 6" {
+			t.Fatalf("request %d: status %d, body %q", i, rec.Code, rec.Body)
+		}
+		if cuts.Load() != want {
+			t.Errorf("request %d: %d cuts, want %d", i, cuts.Load(), want)
+		}
+	}
+
+	if !removeHLSCache(src.cacheDir()) {
+		t.Fatal("cache not removed")
+	}
+	if rec := get("720p/00001.ts"); rec.Code != http.StatusOK || rec.Body.String() != "segment at 6" {
+		t.Fatalf("after the janitor: status %d, body %q", rec.Code, rec.Body)
+	}
+	if cuts.Load() != 2 {
+		t.Errorf("%d cuts, want the removed segment cut again", cuts.Load())
+	}
+}
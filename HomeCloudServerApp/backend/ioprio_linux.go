@@ -0,0 +1,17 @@
+//go:build linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassIdle  = 3
+	ioprioClassShift = 13
+)
+
+// lowerIOPriority moves the calling thread to the idle I/O class, so its
+// disk reads only run when nothing else needs the disk.
+func lowerIOPriority() {
+	unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, 0, ioprioClassIdle<<ioprioClassShift)
+}
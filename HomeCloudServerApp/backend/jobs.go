@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+
+	// Finished jobs stay queryable for this long.
+	jobRetention = time.Hour
+)
+
+// Job is a long running server side operation (copying a large tree, ...)
+// that clients poll through /jobs/<id>.
+type Job struct {
+	ID         string     `json:"id"`
+	Type       string     `json:"type"`
+	Owner      string     `json:"owner"`
+	Status     string     `json:"status"`
+	Source     string     `json:"source,omitempty"`
+	Dest       string     `json:"dest,omitempty"`
+	Action     string     `json:"action,omitempty"`
+	TotalBytes int64      `json:"total_bytes"`
+	DoneBytes  int64      `json:"done_bytes"`
+	TotalFiles int        `json:"total_files"`
+	DoneFiles  int        `json:"done_files"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+
+	cancel context.CancelFunc
+}
+
+var (
+	jobs   = make(map[string]*Job)
+	jobsMu sync.RWMutex
+	jobsWG sync.WaitGroup
+)
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// startJob registers job and runs fn in the background. fn reports progress
+// through job.addProgress and should stop promptly once ctx is cancelled.
+func startJob(job *Job, fn func(ctx context.Context, job *Job) error) *Job {
+	ctx, cancel := context.WithCancel(context.Background())
+	job.ID = newID()
+	job.Status = jobRunning
+	job.StartedAt = time.Now()
+	job.cancel = cancel
+
+	jobsMu.Lock()
+	pruneJobsLocked()
+	jobs[job.ID] = job
+	jobsMu.Unlock()
+
+	jobsWG.Add(1)
+	go func() {
+		defer jobsWG.Done()
+		defer cancel()
+		err := fn(ctx, job)
+
+		jobsMu.Lock()
+		now := time.Now()
+		job.FinishedAt = &now
+		switch {
+		case err == nil:
+			job.Status = jobDone
+		case ctx.Err() != nil:
+			job.Status = jobCancelled
+		default:
+			job.Status = jobFailed
+			_, _, job.Error = errorInfo(err)
+		}
+		jobsMu.Unlock()
+
+		log.Printf("Job %s (%s) finished: %s", job.ID, job.Type, job.Status)
+	}()
+
+	return job
+}
+
+// cancelJobs cancels every running job and waits until they have cleaned
+// up after themselves.
+func cancelJobs() {
+	jobsMu.RLock()
+	for _, j := range jobs {
+		j.cancel()
+	}
+	jobsMu.RUnlock()
+	jobsWG.Wait()
+}
+
+func (j *Job) addProgress(bytes int64, files int) {
+	jobsMu.Lock()
+	j.DoneBytes += bytes
+	j.DoneFiles += files
+	jobsMu.Unlock()
+}
+
+func pruneJobsLocked() {
+	for id, j := range jobs {
+		if j.FinishedAt != nil && time.Since(*j.FinishedAt) > jobRetention {
+			delete(jobs, id)
+		}
+	}
+}
+
+// visibleTo reports whether user may see and cancel the job: its owner
+// and the admin can.
+func (j *Job) visibleTo(user string) bool {
+	return j.Owner == user || user == adminUser
+}
+
+func jobSnapshot(j *Job) Job {
+	jobsMu.RLock()
+	defer jobsMu.RUnlock()
+	return *j
+}
+
+// jobsHandler serves GET /jobs, GET /jobs/<id> and DELETE /jobs/<id>.
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs"), "/")
+
+	if id == "" {
+		if r.Method != "GET" {
+			replyError(w, r, http.StatusMethodNotAllowed, "use GET method")
+			return
+		}
+		jobsMu.Lock()
+		pruneJobsLocked()
+		list := make([]Job, 0, len(jobs))
+		for _, j := range jobs {
+			if j.visibleTo(user) {
+				list = append(list, *j)
+			}
+		}
+		jobsMu.Unlock()
+		sort.Slice(list, func(a, b int) bool { return list[a].StartedAt.Before(list[b].StartedAt) })
+
+		reply(w, r, http.StatusOK, "", list)
+		return
+	}
+
+	jobsMu.RLock()
+	job, ok := jobs[id]
+	jobsMu.RUnlock()
+	if !ok || !job.visibleTo(user) {
+		replyError(w, r, http.StatusNotFound, "Job not found")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "DELETE":
+		job.cancel()
+	default:
+		replyError(w, r, http.StatusMethodNotAllowed, "use GET or DELETE method")
+		return
+	}
+
+	reply(w, r, http.StatusOK, "", jobSnapshot(job))
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The change journal gives every create, modify, delete and move below the
+// storage roots a sequence number, so sync clients can ask /changes what
+// happened since their last cursor instead of walking /list. Handlers record
+// what they did (which is how moves are known as moves); the watcher records
+// everything else and skips what a handler already reported.
+//
+// A cursor is only valid within one epoch. The epoch changes when the
+// journal cannot vouch for being complete: it was lost, the server did not
+// shut down cleanly, the storage changed while the server was stopped or
+// the watcher dropped events. Clients then get a reset and have to rescan.
+
+const (
+	journalKeep    = 100000
+	journalMarkTTL = time.Minute
+	changesLimit   = 1000
+)
+
+const (
+	changeCreate = "create"
+	changeModify = "modify"
+	changeDelete = "delete"
+	changeMove   = "move"
+)
+
+type changeRecord struct {
+	Seq     uint64     `json:"seq"`
+	Time    time.Time  `json:"time"`
+	Op      string     `json:"op"`
+	Path    string     `json:"path"`
+	From    string     `json:"from,omitempty"`
+	Dir     bool       `json:"dir,omitempty"`
+	Size    int64      `json:"size,omitempty"`
+	ModTime *time.Time `json:"mtime,omitempty"`
+}
+
+// journalHeader is the first line of the journal file.
+type journalHeader struct {
+	Epoch string `json:"epoch"`
+	Seq   uint64 `json:"seq"`
+}
+
+// journalMark is the state of a path when it was last recorded, so the
+// watcher event for the same change is not recorded twice.
+type journalMark struct {
+	exists bool
+	size   int64
+	mod    time.Time
+	at     time.Time
+}
+
+type changeJournal struct {
+	mu      sync.Mutex
+	epoch   string
+	seq     uint64 // last sequence number handed out
+	records []changeRecord
+	file    *os.File
+	lines   int
+	marks   map[string]journalMark
+
+	// saved is the storage fingerprint of the last clean shutdown, checked
+	// once the initial scan is done.
+	saved map[string]string
+}
+
+var changes = &changeJournal{marks: map[string]journalMark{}}
+
+func journalFile() string { return storageRoots[0].internal("journal.jsonl") }
+
+func journalCleanFile() string { return storageRoots[0].internal("journal.clean") }
+
+// initJournal loads the journal of the last run. It starts a new epoch when
+// there is none or the last run did not close it.
+func initJournal() {
+	j := changes
+	if b, err := os.ReadFile(journalCleanFile()); err == nil && json.Unmarshal(b, &j.saved) == nil {
+		j.load()
+	}
+	os.Remove(journalCleanFile())
+	if j.epoch == "" {
+		if _, err := os.Stat(journalFile()); err == nil {
+			log.Printf("Change journal was not closed cleanly, sync clients will rescan")
+		}
+		j.epoch = newID()
+		j.records = nil
+	}
+	if err := j.rewrite(); err != nil {
+		log.Printf("Warning: change journal is not saved: %v", err)
+	}
+	onShutdown(j.close)
+}
+
+func (j *changeJournal) load() {
+	f, err := os.Open(journalFile())
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	if !sc.Scan() {
+		return
+	}
+	var h journalHeader
+	if json.Unmarshal(sc.Bytes(), &h) != nil || h.Epoch == "" {
+		return
+	}
+	j.epoch, j.seq = h.Epoch, h.Seq
+	for sc.Scan() {
+		var rec changeRecord
+		// A torn last line from a crash is skipped.
+		if json.Unmarshal(sc.Bytes(), &rec) != nil || rec.Seq <= j.seq {
+			continue
+		}
+		j.records = append(j.records, rec)
+		j.seq = rec.Seq
+	}
+	j.trimLocked()
+}
+
+// rewrite replaces the journal file with the records in memory.
+func (j *changeJournal) rewrite() error {
+	if j.file != nil {
+		j.file.Close()
+		j.file = nil
+	}
+	base := j.seq
+	if len(j.records) > 0 {
+		base = j.records[0].Seq - 1
+	}
+	file := journalFile()
+	os.MkdirAll(filepath.Dir(file), 0700)
+	tmp := file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	enc.Encode(journalHeader{Epoch: j.epoch, Seq: base})
+	for _, rec := range j.records {
+		enc.Encode(rec)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		f.Close()
+		return err
+	}
+	j.file, j.lines = f, len(j.records)
+	return nil
+}
+
+func (j *changeJournal) close() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return
+	}
+	j.file.Close()
+	j.file = nil
+	if watcherReady.Load() {
+		b, _ := json.Marshal(storageFingerprint())
+		os.WriteFile(journalCleanFile(), b, 0600)
+	}
+}
+
+// checkOffline starts a new epoch when the storage changed while the
+// server was stopped. It runs once the initial scan is done.
+func (j *changeJournal) checkOffline() {
+	j.mu.Lock()
+	saved := j.saved
+	j.saved = nil
+	j.mu.Unlock()
+	if saved != nil && !maps.Equal(saved, storageFingerprint()) {
+		j.reset("storage changed while the server was stopped")
+	}
+}
+
+// storageFingerprint summarises every root by its total size, number of
+// folders and newest folder mtime. Adding, removing or renaming an entry
+// moves its folder's mtime, so most offline changes show up; an edit that
+// keeps a file's size does not.
+func storageFingerprint() map[string]string {
+	fp := map[string]string{}
+	for _, rt := range storageRoots {
+		var dirs []string
+		rt.index.mu.RLock()
+		total := rt.index.top.total
+		forEachDir(rt.index.top, rt.Dir, func(dir string) { dirs = append(dirs, dir) })
+		rt.index.mu.RUnlock()
+		var newest int64
+		for _, dir := range dirs {
+			if info, err := os.Stat(dir); err == nil {
+				newest = max(newest, info.ModTime().UnixNano())
+			}
+		}
+		fp[rt.Dir] = fmt.Sprintf("%d:%d:%d", total, len(dirs), newest)
+	}
+	return fp
+}
+
+// trimLocked drops the oldest records beyond journalKeep.
+func (j *changeJournal) trimLocked() {
+	if n := len(j.records) - journalKeep; n > 0 {
+		j.records = append([]changeRecord(nil), j.records[n:]...)
+	}
+}
+
+// reset starts a new epoch, invalidating every cursor.
+func (j *changeJournal) reset(reason string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	log.Printf("Change journal reset (%s), sync clients will rescan", reason)
+	j.epoch = newID()
+	j.records = nil
+	j.marks = map[string]journalMark{}
+	if err := j.rewrite(); err != nil {
+		log.Printf("Warning: change journal is not saved: %v", err)
+	}
+}
+
+// add records a change of abs (moved from src if set). info is the current
+// state of abs, nil when it is gone.
+func (j *changeJournal) add(op, abs, src string, dir bool, info os.FileInfo) {
+	rec := changeRecord{Time: time.Now().UTC(), Op: op, Path: relFromAbs(abs), Dir: dir}
+	if src != "" {
+		rec.From = relFromAbs(src)
+	}
+	mark := journalMark{at: time.Now()}
+	if info != nil {
+		rec.Dir = info.IsDir()
+		mod := info.ModTime().UTC()
+		rec.ModTime = &mod
+		if !rec.Dir {
+			rec.Size = info.Size()
+		}
+		mark = journalMark{exists: true, size: info.Size(), mod: info.ModTime(), at: mark.at}
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.seq++
+	rec.Seq = j.seq
+	j.records = append(j.records, rec)
+	j.marks[abs] = mark
+	if src != "" {
+		j.marks[src] = journalMark{at: mark.at}
+	}
+	if len(j.records) > journalKeep+journalKeep/10 {
+		j.trimLocked()
+	}
+	if len(j.marks) > 4096 {
+		for p, m := range j.marks {
+			if time.Since(m.at) > journalMarkTTL {
+				delete(j.marks, p)
+			}
+		}
+	}
+	if j.file == nil {
+		return
+	}
+	if j.lines > 2*journalKeep {
+		if err := j.rewrite(); err != nil {
+			log.Printf("Warning: compacting the change journal: %v", err)
+		}
+		return
+	}
+	line, _ := json.Marshal(rec)
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		log.Printf("Warning: writing the change journal: %v", err)
+	}
+	j.lines++
+}
+
+// recorded reports whether the last record of abs already describes its
+// current state.
+func (j *changeJournal) recorded(abs string, info os.FileInfo) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	m, ok := j.marks[abs]
+	if ok && time.Since(m.at) > journalMarkTTL {
+		ok = false
+	}
+	if info == nil {
+		if ok && !m.exists {
+			return true
+		}
+		// Entries inside a deleted or moved folder go with it.
+		for dir := filepath.Dir(abs); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+			if m, ok := j.marks[dir]; ok && !m.exists && time.Since(m.at) <= journalMarkTTL {
+				return true
+			}
+		}
+		return false
+	}
+	return ok && m.exists && (info.IsDir() || m.size == info.Size() && m.mod.Equal(info.ModTime()))
+}
+
+// journalChange records a change made by a handler. For deletes dir tells
+// what was removed; otherwise abs is looked at.
+func journalChange(op, abs, src string, dir bool) {
+	var info os.FileInfo
+	if op != changeDelete {
+		var err error
+		if info, err = os.Lstat(abs); err != nil {
+			return
+		}
+	}
+	changes.add(op, abs, src, dir, info)
+}
+
+// mkdirAllJournaled is os.MkdirAll that records the topmost folder it
+// created.
+func mkdirAllJournaled(dir string, perm os.FileMode) error {
+	top := firstMissing(dir)
+	_, statErr := os.Lstat(top)
+	if err := rootMkdirAll(dir, perm); err != nil {
+		return err
+	}
+	if os.IsNotExist(statErr) {
+		journalChange(changeCreate, top, "", true)
+	}
+	return nil
+}
+
+// observe records a change the watcher saw at abs. known and knownDir are
+// what the size index knew about abs before the event.
+func (j *changeJournal) observe(abs string, known, knownDir bool) {
+	info, _ := os.Lstat(abs)
+	if j.recorded(abs, info) {
+		return
+	}
+	switch {
+	case info == nil && known:
+		j.add(changeDelete, abs, "", knownDir, nil)
+	case info != nil && !known:
+		j.add(changeCreate, abs, "", false, info)
+	case info != nil && !info.IsDir():
+		j.add(changeModify, abs, "", false, info)
+	}
+}
+
+type changesResult struct {
+	Cursor  string         `json:"cursor"`
+	Reset   bool           `json:"reset"`
+	More    bool           `json:"more"`
+	Changes []changeRecord `json:"changes"`
+}
+
+// after returns up to limit records after cursor. A cursor from another
+// epoch or older than the journal gets a reset with the current cursor.
+func (j *changeJournal) after(cursor string, limit int) changesResult {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	res := changesResult{Cursor: j.epoch + "." + strconv.FormatUint(j.seq, 10), Reset: true, Changes: []changeRecord{}}
+	epoch, s, _ := strings.Cut(cursor, ".")
+	seq, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || epoch != j.epoch || seq > j.seq {
+		return res
+	}
+	first := j.seq + 1
+	if len(j.records) > 0 {
+		first = j.records[0].Seq
+	}
+	if seq+1 < first {
+		return res
+	}
+	i := int(seq + 1 - first)
+	end := min(i+limit, len(j.records))
+	res.Changes = append(res.Changes, j.records[i:end]...)
+	if len(res.Changes) > 0 {
+		seq = res.Changes[len(res.Changes)-1].Seq
+	}
+	res.Cursor, res.Reset, res.More = j.epoch+"."+strconv.FormatUint(seq, 10), false, end < len(j.records)
+	return res
+}
+
+// changesHandler returns the journal after the cursor in since. Without a
+// cursor, or with one the journal no longer covers, it answers reset with a
+// fresh cursor: the client rescans with /list and continues from there.
+// The journal names every path on every root, so only the admin may read
+// it.
+func changesHandler(w http.ResponseWriter, r *http.Request) {
+	if requestUser(r) != adminUser {
+		replyError(w, r, http.StatusForbidden, "Only the admin can read the change journal")
+		return
+	}
+	if !watcherReady.Load() {
+		replyError(w, r, http.StatusServiceUnavailable, "Storage scan still running")
+		return
+	}
+	limit := changesLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			replyError(w, r, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+		limit = min(n, 10*changesLimit)
+	}
+	since := r.URL.Query().Get("since")
+	res := changes.after(since, limit)
+	if res.Reset && since != "" {
+		log.Printf("Changes: cursor %q is not in the journal, client must rescan", since)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	reply(w, r, http.StatusOK, "", res)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func addChanges(j *changeJournal, n int) {
+	for i := 0; i < n; i++ {
+		j.add(changeDelete, filepath.Join(storageRoots[0].Dir, "gone.txt"), "", false, nil)
+	}
+}
+
+func TestJournalCursor(t *testing.T) {
+	testRoot(t)
+	j := testJournal(t)
+	addChanges(j, 3)
+
+	for _, c := range []struct {
+		since  string
+		limit  int
+		reset  bool
+		more   bool
+		cursor string
+		seqs   []uint64
+	}{
+		{"", 10, true, false, "test.3", nil},
+		{"test.0", 10, false, false, "test.3", []uint64{1, 2, 3}},
+		{"test.1", 10, false, false, "test.3", []uint64{2, 3}},
+		{"test.1", 1, false, true, "test.2", []uint64{2}},
+		{"test.3", 10, false, false, "test.3", nil},
+		{"test.4", 10, true, false, "test.3", nil},
+		{"other.1", 10, true, false, "test.3", nil},
+		{"test", 10, true, false, "test.3", nil},
+		{"test.x", 10, true, false, "test.3", nil},
+	} {
+		res := j.after(c.since, c.limit)
+		var seqs []uint64
+		for _, rec := range res.Changes {
+			seqs = append(seqs, rec.Seq)
+		}
+		if res.Reset != c.reset || res.More != c.more || res.Cursor != c.cursor || len(seqs) != len(c.seqs) {
+			t.Errorf("after(%q, %d) = %+v, want reset %t, more %t, cursor %s, seqs %v", c.since, c.limit, res, c.reset, c.more, c.cursor, c.seqs)
+			continue
+		}
+		for i := range seqs {
+			if seqs[i] != c.seqs[i] {
+				t.Errorf("after(%q, %d): seqs %v, want %v", c.since, c.limit, seqs, c.seqs)
+				break
+			}
+		}
+	}
+}
+
+func TestJournalEpochReset(t *testing.T) {
+	testRoot(t)
+	j := testJournal(t)
+	addChanges(j, 2)
+	cursor := j.after("", 10).Cursor
+
+	j.reset("test")
+	t.Cleanup(func() { j.file.Close() })
+	res := j.after(cursor, 10)
+	if !res.Reset || len(res.Changes) != 0 {
+		t.Errorf("old cursor after a reset: %+v, want a reset", res)
+	}
+	if strings.HasPrefix(res.Cursor, "test.") {
+		t.Errorf("cursor %s still has the old epoch", res.Cursor)
+	}
+
+	addChanges(j, 1)
+	if res := j.after(res.Cursor, 10); res.Reset || len(res.Changes) != 1 {
+		t.Errorf("new cursor: %+v, want the one new change", res)
+	}
+}
+
+func TestJournalTrim(t *testing.T) {
+	testRoot(t)
+	j := testJournal(t)
+	addChanges(j, journalKeep+journalKeep/10+1)
+
+	if len(j.records) != journalKeep {
+		t.Fatalf("%d records kept, want %d", len(j.records), journalKeep)
+	}
+	first := j.records[0].Seq
+	if res := j.after("test.1", 10); !res.Reset {
+		t.Error("a cursor older than the journal did not get a reset")
+	}
+	if res := j.after("test."+strconv.FormatUint(first-1, 10), 10); res.Reset || res.Changes[0].Seq != first {
+		t.Errorf("cursor just before the oldest record: %+v", res.Changes[:1])
+	}
+}
+
+func TestJournalLoadTornLine(t *testing.T) {
+	testRoot(t)
+	j := testJournal(t)
+	j.epoch = ""
+	file := journalFile()
+	os.WriteFile(file, []byte(`{"epoch":"saved","seq":4}
+{"seq":5,"op":"create","path":"a.txt"}
+{"seq":6,"op":"delete","path":"b.txt"}
+{"seq":7,"op":"cre`), 0600)
+
+	j.load()
+	if j.epoch != "saved" || j.seq != 6 || len(j.records) != 2 {
+		t.Fatalf("loaded epoch %q, seq %d, %d records; want saved, 6, 2", j.epoch, j.seq, len(j.records))
+	}
+	if res := j.after("saved.4", 10); res.Reset || len(res.Changes) != 2 || res.Cursor != "saved.6" {
+		t.Errorf("after the saved cursor: %+v", res)
+	}
+}
+
+func TestChangesAdminOnly(t *testing.T) {
+	testJournal(t)
+	r := httptest.NewRequest("GET", "/changes", nil)
+	r = r.WithContext(context.WithValue(r.Context(), ctxUser, "alice"))
+	rec := httptest.NewRecorder()
+	changesHandler(rec, r)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("status %d for a USERS login, want 403", rec.Code)
+	}
+}
@@ -1,16 +1,21 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"mime"
 	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -28,7 +33,6 @@ import (
 var (
 	watchDir          = "./uploads"
 	authToken         = "password"
-	storageQuotaGB    = 50
 	maxUploadFileSize = int64(1 << 30)
 	serverPort        = "8090"
 )
@@ -46,9 +50,6 @@ var (
 	cachedDirSize int64
 	labelCache    = make(map[string]string)
 	labelCacheMu  sync.RWMutex
-
-	isDirty bool
-	dirtyMu sync.Mutex
 )
 
 type SystemStats struct {
@@ -89,6 +90,104 @@ func loadEnv() {
 			}
 		}
 	}
+	if val := os.Getenv("SYMLINK_POLICY"); val != "" {
+		if validSymlinkPolicy(val) {
+			symlinkPolicy = val
+		} else {
+			log.Printf("Warning: unknown SYMLINK_POLICY %q, using %q", val, symlinkPolicy)
+		}
+	}
+	if val := os.Getenv("PUBLIC_DIR"); val != "" {
+		publicDir = val
+	}
+	if val := os.Getenv("PUBLIC_LISTING"); val != "" {
+		publicListing, _ = strconv.ParseBool(val)
+	}
+	if val := os.Getenv("ON_CONFLICT"); val != "" {
+		if validConflictPolicy(val) {
+			defaultConflictPolicy = val
+		} else {
+			log.Printf("Warning: unknown ON_CONFLICT %q, using %q", val, defaultConflictPolicy)
+		}
+	}
+	if val := os.Getenv("USERS"); val != "" {
+		accounts, quotas, err := parseUsers(val)
+		if err != nil {
+			log.Printf("Warning: %v; only AUTH_TOKEN can log in", err)
+		} else {
+			userAccounts, userQuotaGB = accounts, quotas
+		}
+	}
+	if val := os.Getenv("STORAGE_ROOTS"); val != "" {
+		if roots, err := parseStorageRoots(val); err != nil {
+			log.Printf("Warning: %v; using WATCH_DIR %s", err, watchDir)
+		} else {
+			storageRoots = roots
+		}
+	}
+	if val := os.Getenv("FOLDER_QUOTAS"); val != "" {
+		if quotas, err := parseFolderQuotas(val); err != nil {
+			log.Printf("Warning: %v; folder quotas disabled", err)
+		} else {
+			folderQuotaGB = quotas
+		}
+	}
+	if val := os.Getenv("SIZE_RECONCILE_HOURS"); val != "" {
+		if hours, err := strconv.Atoi(val); err == nil && hours > 0 {
+			reconcileInterval = time.Duration(hours) * time.Hour
+		}
+	}
+	if val := os.Getenv("SHUTDOWN_TIMEOUT"); val != "" {
+		var secs int
+		if _, err := fmt.Sscanf(val, "%d", &secs); err == nil && secs >= 0 {
+			shutdownTimeout = time.Duration(secs) * time.Second
+		}
+	}
+	if val := os.Getenv("HLS_MODE"); val != "" {
+		if validHLSMode(val) {
+			hlsMode = val
+		} else {
+			log.Printf("Warning: unknown HLS_MODE %q, using %q", val, hlsMode)
+		}
+	}
+	if val := os.Getenv("HLS_CACHE_MB"); val != "" {
+		if mb, err := strconv.Atoi(val); err == nil && mb > 0 {
+			hlsCacheMaxBytes = int64(mb) << 20
+		}
+	}
+	if val := os.Getenv("HLS_CACHE_HOURS"); val != "" {
+		if hours, err := strconv.Atoi(val); err == nil && hours > 0 {
+			hlsCacheMaxAge = time.Duration(hours) * time.Hour
+		}
+	}
+	if val := os.Getenv("MUSIC_FOLDERS"); val != "" {
+		musicFolderPaths = nil
+		for _, f := range strings.Split(val, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				musicFolderPaths = append(musicFolderPaths, f)
+			}
+		}
+	}
+	if val := os.Getenv("PHOTO_FOLDERS"); val != "" {
+		photoFolderPaths = nil
+		for _, f := range strings.Split(val, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				photoFolderPaths = append(photoFolderPaths, f)
+			}
+		}
+	}
+	if val := os.Getenv("DLNA_FOLDERS"); val != "" {
+		for _, f := range strings.Split(val, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				dlnaFolderPaths = append(dlnaFolderPaths, f)
+			}
+		}
+	}
+	dlnaName = os.Getenv("DLNA_NAME")
+	dlnaInterface = os.Getenv("DLNA_INTERFACE")
+	if val := os.Getenv("DLNA_PORT"); val != "" {
+		dlnaPort = val
+	}
 	if val := os.Getenv("MAX_UPLOAD_SIZE"); val != "" {
 		var size int64
 		if _, err := fmt.Sscanf(val, "%d", &size); err == nil {
@@ -98,32 +197,57 @@ func loadEnv() {
 }
 
 func main() {
+	printUnit := flag.Bool("systemd-unit", false, "print a systemd service unit for this binary and exit")
+	flag.Parse()
+
 	loadEnv()
-	os.MkdirAll(watchDir, os.ModePerm)
-	go startWatcher()
-	go statsWorker()
-
-	http.HandleFunc("/login", loginHandler)
-
-	http.Handle("/uploads/", http.StripPrefix("/uploads/", http.FileServer(http.Dir(watchDir))))
-	http.HandleFunc("/upload", authMiddleware(uploadHandler))
-	http.HandleFunc("/download/", authMiddleware(downloadHandler))
-	http.HandleFunc("/stream/", authMiddleware(streamHandler))
-	http.HandleFunc("/list", authMiddleware(listHandler))
-	http.HandleFunc("/list/", authMiddleware(listHandler))
-	http.HandleFunc("/rename", authMiddleware(renameHandler))
-	http.HandleFunc("/move", authMiddleware(moveHandler))
-	http.HandleFunc("/delete", authMiddleware(deleteHandler))
-	http.HandleFunc("/mkdir", authMiddleware(mkdirHandler))
-	http.HandleFunc("/info", authMiddleware(systemInfoHandler))
-	http.HandleFunc("/settings", authMiddleware(settingsHandler))
-
-	fmt.Printf("Server running at http://localhost:%s\n", serverPort)
-	fmt.Printf("API Port: %s\n", serverPort)
+
+	if *printUnit {
+		unit, err := systemdUnit()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Print(unit)
+		return
+	}
+
+	initRoots()
+	initJournal()
+	initHashes()
+	initHLS()
+	initMusic()
+	initPhotos()
+	initDLNA()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	goBackground(ctx, startWatcher)
+	goBackground(ctx, statsWorker)
+	goBackground(ctx, sdWatchdog)
+	goBackground(ctx, hlsJanitor)
+	goBackground(ctx, musicIndexer)
+	goBackground(ctx, photoIndexer)
+
+	registerRoutes(appRoutes())
+
+	ln, err := listen()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// With socket activation the port comes from the .socket unit.
+	addr := ln.Addr().String()
+	port := addr[strings.LastIndex(addr, ":")+1:]
+	fmt.Printf("Server running at http://localhost:%s\n", port)
+	fmt.Printf("API Port: %s\n", port)
+
+	goBackground(ctx, dlnaServer)
 
 	// Wrap everything with CORS middleware
-	handler := corsMiddleware(http.DefaultServeMux)
-	log.Fatal(http.ListenAndServe("0.0.0.0:"+serverPort, handler))
+	handler := corsMiddleware(requestIDMiddleware(trackRequests(http.DefaultServeMux)))
+	if err := serve(&http.Server{Handler: handler}, ln, cancel); err != nil {
+		// A non-zero exit lets Restart=on-failure bring the server back.
+		log.Fatalf("Server failed: %v", err)
+	}
 }
 
 func streamHandler(w http.ResponseWriter, r *http.Request) {
@@ -136,44 +260,73 @@ func streamHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	relativePath := strings.TrimPrefix(r.URL.Path, "/stream/")
+	// r.URL.Path is already decoded, and it is what a signed URL was
+	// checked against: decoding again would open another file ("%41"
+	// becoming "A") and fail on names with a literal "%".
+	serveStream(w, r, strings.TrimPrefix(r.URL.Path, "/stream/"))
+}
 
-	decodedPath, err := url.QueryUnescape(relativePath)
+// serveStream sends the file at the client path decodedPath with range
+// support.
+func serveStream(w http.ResponseWriter, r *http.Request, decodedPath string) {
+	file, fileInfo, fullPath, err := openStream(decodedPath)
 	if err != nil {
-		decodedPath = relativePath
+		replyOpError(w, r, err)
+		return
 	}
-	cleanPath := filepath.Clean("/" + decodedPath)
-	fullPath := filepath.Join(watchDir, cleanPath)
-
-	absWatchDir, _ := filepath.Abs(watchDir)
-	absTarget, _ := filepath.Abs(fullPath)
+	defer file.Close()
+	sendStream(w, r, fullPath, file, fileInfo)
+}
 
-	if !strings.HasPrefix(absTarget, absWatchDir) {
-		http.Error(w, "Access denied", http.StatusForbidden)
-		return
+// openStream opens the file at the client path decodedPath for
+// sendStream and returns its absolute path as well.
+func openStream(decodedPath string) (*os.File, os.FileInfo, string, error) {
+	fullPath, err := resolvePath(decodedPath)
+	if err != nil {
+		return nil, nil, "", err
 	}
 
-	fileInfo, err := os.Stat(fullPath)
+	file, err := openInRoot(decodedPath)
 	if os.IsNotExist(err) {
 		log.Printf("Stream: File not found: %s", fullPath)
-		http.NotFound(w, r)
-		return
+		return nil, nil, "", opFail(http.StatusNotFound, "Not found")
 	}
-
-	if fileInfo.IsDir() {
-		http.Error(w, "Cannot stream a directory", http.StatusBadRequest)
-		return
+	if err != nil {
+		return nil, nil, "", internalFail("Failed to open file", err)
 	}
 
-	file, err := os.Open(fullPath)
+	fileInfo, err := file.Stat()
 	if err != nil {
-		log.Printf("Stream: Failed to open file: %s - %v", fullPath, err)
-		http.Error(w, "Failed to open file", http.StatusInternalServerError)
-		return
+		file.Close()
+		return nil, nil, "", internalFail("Failed to open file", err)
 	}
-	defer file.Close()
 
-	ext := strings.ToLower(filepath.Ext(fullPath))
+	if fileInfo.IsDir() {
+		file.Close()
+		return nil, nil, "", opFail(http.StatusBadRequest, "Cannot stream a directory")
+	}
+	return file, fileInfo, fullPath, nil
+}
+
+// sendStream serves the opened file at fullPath with range support.
+func sendStream(w http.ResponseWriter, r *http.Request, fullPath string, file *os.File, fileInfo os.FileInfo) {
+	cleanPath := "/" + relFromAbs(fullPath)
+	mimeType := mediaType(filepath.Ext(fullPath))
+
+	w.Header().Set("Content-Type", mimeType)
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Range, Authorization, Content-Type")
+	w.Header().Set("Access-Control-Expose-Headers", "Content-Length, Content-Range, Accept-Ranges")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+
+	log.Printf("Serving stream: %s (Type: %s)", cleanPath, mimeType)
+	http.ServeContent(w, r, fileInfo.Name(), fileInfo.ModTime(), file)
+}
+
+// mediaType is the Content-Type streams of files with extension ext get.
+func mediaType(ext string) string {
+	ext = strings.ToLower(ext)
 	mimeType := mime.TypeByExtension(ext)
 	if mimeType == "" {
 		switch ext {
@@ -189,16 +342,7 @@ func streamHandler(w http.ResponseWriter, r *http.Request) {
 	} else if ext == ".mp3" {
 		mimeType = "audio/mpeg"
 	}
-
-	w.Header().Set("Content-Type", mimeType)
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Range, Authorization, Content-Type")
-	w.Header().Set("Access-Control-Expose-Headers", "Content-Length, Content-Range, Accept-Ranges")
-	w.Header().Set("Cache-Control", "public, max-age=3600")
-
-	log.Printf("Serving stream: %s (Type: %s)", cleanPath, mimeType)
-	http.ServeContent(w, r, fileInfo.Name(), fileInfo.ModTime(), file)
+	return mimeType
 }
 
 func getDiskLabel(p disk.PartitionStat) string {
@@ -222,7 +366,7 @@ func getDiskLabel(p disk.PartitionStat) string {
 
 func systemInfoHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
-		http.Error(w, "use GET method", http.StatusMethodNotAllowed)
+		replyError(w, r, http.StatusMethodNotAllowed, "use GET method")
 		return
 	}
 
@@ -230,7 +374,7 @@ func systemInfoHandler(w http.ResponseWriter, r *http.Request) {
 	stats := currentStats
 	statsMu.RUnlock()
 
-	projectPath, _ := filepath.Abs(watchDir)
+	projectPath := storageRoots[0].Dir
 	hostStat, _ := host.Info()
 
 	var disks []map[string]interface{}
@@ -239,14 +383,17 @@ func systemInfoHandler(w http.ResponseWriter, r *http.Request) {
 	// [Antigravity] Enforcing Storage Quota
 	// We calculate the usage based on our internal tracker (cachedDirSize)
 	// and the Total based on the strict Quota setting.
-	mu.RLock()
-	usedBytes := uint64(cachedDirSize)
-	mu.RUnlock()
-	totalQuota := uint64(storageQuotaGB) * 1024 * 1024 * 1024
-
+	used, reserved := quotaUsage()
+	usedBytes := uint64(used)
+	totalQuota := uint64(quotaLimit())
+	quotaMu.Lock()
+	quotaSetting := storageQuotaGB
+	quotaMu.Unlock()
+
+	// Space promised to running uploads and copies is not free anymore.
 	var freeSpace uint64
-	if totalQuota > usedBytes {
-		freeSpace = totalQuota - usedBytes
+	if totalQuota > usedBytes+uint64(reserved) {
+		freeSpace = totalQuota - usedBytes - uint64(reserved)
 	} else {
 		freeSpace = 0
 	}
@@ -265,7 +412,8 @@ func systemInfoHandler(w http.ResponseWriter, r *http.Request) {
 		"real_used":       usedBytes,
 		"real_free":       freeSpace,
 		"is_project_disk": true,
-		"quota_setting":   storageQuotaGB,
+		"quota_setting":   quotaSetting,
+		"reserved":        reserved,
 	}
 	projectDisk = projectDiskEntry
 
@@ -318,13 +466,13 @@ func systemInfoHandler(w http.ResponseWriter, r *http.Request) {
 			"upload_Mbps":   stats.NetUpload * 8,
 		},
 		"project_disk": projectDisk,
+		"quotas":       quotaReport(),
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(info)
+	reply(w, r, http.StatusOK, "", info)
 }
 
-func statsWorker() {
+func statsWorker(ctx context.Context) {
 	ticker := time.NewTicker(2 * time.Second)
 	defer ticker.Stop()
 
@@ -332,8 +480,13 @@ func statsWorker() {
 
 	updateStats(&lastNetStat)
 
-	for range ticker.C {
-		updateStats(&lastNetStat)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			updateStats(&lastNetStat)
+		}
 	}
 }
 
@@ -416,7 +569,7 @@ func updateStats(lastNetStat *[]net.IOCountersStat) {
 
 func loginHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		http.Error(w, "use POST method", http.StatusMethodNotAllowed)
+		replyError(w, r, http.StatusMethodNotAllowed, "use POST method")
 		return
 	}
 
@@ -426,24 +579,25 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 
 	var req Req
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Bad request", http.StatusBadRequest)
+		replyError(w, r, http.StatusBadRequest, "Bad request")
 		return
 	}
 
-	if req.Password != authToken {
-		http.Error(w, "Incorrect Password", http.StatusUnauthorized)
+	user, ok := userForToken(req.Password)
+	if !ok {
+		replyError(w, r, http.StatusUnauthorized, "Incorrect Password")
 		return
 	}
 
-	w.Write([]byte("Server connected"))
+	reply(w, r, http.StatusOK, "Server connected", map[string]interface{}{"user": user})
 }
 
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, DELETE, PUT, PATCH")
-		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Range, X-Requested-With")
-		w.Header().Set("Access-Control-Expose-Headers", "Content-Length, Content-Range, Accept-Ranges")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Range, X-Requested-With, If-Match, If-None-Match")
+		w.Header().Set("Access-Control-Expose-Headers", "Content-Length, Content-Range, Accept-Ranges, X-Conflict-Action, X-Final-Path, X-Request-ID, ETag")
 		w.Header().Set("Access-Control-Max-Age", "86400")
 
 		if r.Method == http.MethodOptions {
@@ -462,450 +616,633 @@ func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		auth := r.Header.Get("Authorization")
 		token := r.URL.Query().Get("token")
 
-		if (auth == "" || !strings.HasPrefix(auth, "Bearer ") || strings.TrimPrefix(auth, "Bearer ") != authToken) && token != authToken {
-			log.Printf("Unauthorized [%s]: Path=%s Remote=%s tokenParam=%s", r.Method, r.URL.Path, r.RemoteAddr, token)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		user, ok := "", false
+		if strings.HasPrefix(auth, "Bearer ") {
+			user, ok = userForToken(strings.TrimPrefix(auth, "Bearer "))
+		}
+		if !ok {
+			user, ok = userForToken(token)
+		}
+		if !ok {
+			log.Printf("Unauthorized [%s]: Path=%s Remote=%s token_param=%t", r.Method, r.URL.Path, r.RemoteAddr, token != "")
+			replyError(w, r, http.StatusUnauthorized, "Unauthorized")
 			return
 		}
-		next(w, r)
+		next(w, r.WithContext(context.WithValue(r.Context(), ctxUser, user)))
 	}
 }
 
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Upload request received from %s", r.RemoteAddr)
 	if r.Method != "POST" {
-		http.Error(w, "use POST method", http.StatusMethodNotAllowed)
+		replyError(w, r, http.StatusMethodNotAllowed, "use POST method")
 		return
 	}
 
 	err := r.ParseMultipartForm(maxUploadFileSize)
 	if err != nil {
 		log.Printf("Upload: ParseMultipartForm error: %v", err)
-		http.Error(w, "File too large or corrupt", http.StatusBadRequest)
+		replyError(w, r, http.StatusBadRequest, "File too large or corrupt")
 		return
 	}
 
 	file, handler, err := r.FormFile("file")
 	if err != nil {
 		log.Printf("Upload: FormFile error: %v", err)
-		http.Error(w, "File not found", http.StatusBadRequest)
+		replyError(w, r, http.StatusBadRequest, "File not found")
 		return
 	}
 	defer file.Close()
 
-	mu.RLock()
-	usedBytes := uint64(cachedDirSize)
-	mu.RUnlock()
-
-	totalQuota := uint64(storageQuotaGB) * 1024 * 1024 * 1024
+	usedBytes, reservedBytes := quotaUsage()
 	const hardLimit = 1000 * 1024 * 1024 * 1024
 
-	if usedBytes+uint64(handler.Size) > hardLimit {
+	if usedBytes+reservedBytes+handler.Size > hardLimit {
 		log.Printf("Upload rejected: Absolute hard limit reached (1000GB)")
-		http.Error(w, "HomeCloud project limited to maximum 1000 GB total", http.StatusInsufficientStorage)
-		return
-	}
-
-	if usedBytes+uint64(handler.Size) > totalQuota {
-		log.Printf("Upload rejected: Quota exceeded (%d GB)", storageQuotaGB)
-		http.Error(w, fmt.Sprintf("Storage quota exceeded (%d GB)", storageQuotaGB), http.StatusInsufficientStorage)
+		replyError(w, r, http.StatusInsufficientStorage, "HomeCloud project limited to maximum 1000 GB total")
 		return
 	}
 
 	log.Printf("Uploading file: %s, Size: %d", handler.Filename, handler.Size)
 
 	subPath := r.URL.Query().Get("path")
-
-	cleanSubPath := filepath.Clean(subPath)
-	if strings.HasPrefix(cleanSubPath, "..") {
-		http.Error(w, "Invalid path", http.StatusBadRequest)
+	policy, err := conflictPolicy(r, "")
+	if err != nil {
+		replyOpError(w, r, err)
 		return
 	}
 
-	safePath := filepath.Join(watchDir, cleanSubPath)
+	safePath, err := resolvePath(subPath)
+	if err != nil {
+		replyOpError(w, r, err)
+		return
+	}
 
-	err = os.MkdirAll(safePath, os.ModePerm)
+	err = mkdirAllJournaled(safePath, os.ModePerm)
 	if err != nil {
 		log.Printf("Upload: Failed to create directory: %v", err)
-		http.Error(w, "Failed to create target directory", http.StatusInternalServerError)
+		replyError(w, r, http.StatusInternalServerError, "Failed to create target directory")
+		return
+	}
+
+	if handler.Filename != filepath.Base(handler.Filename) || !filepath.IsLocal(handler.Filename) {
+		replyError(w, r, http.StatusBadRequest, "Invalid file name")
 		return
 	}
 
 	filePath := filepath.Join(safePath, handler.Filename)
-	fileBase := handler.Filename
-	fileExt := ""
-	if dot := strings.LastIndex(fileBase, "."); dot != -1 {
-		fileExt = fileBase[dot:]
-		fileBase = fileBase[:dot]
+	if _, err := resolvePath(relFromAbs(filePath)); err != nil {
+		replyOpError(w, r, err)
+		return
 	}
 
-	counter := 1
-	for {
-		if _, err := os.Stat(filePath); os.IsNotExist(err) {
-			break
+	unlock, err := lockForWrite(r, filePath)
+	if err != nil {
+		replyOpError(w, r, err)
+		return
+	}
+	defer unlock()
+
+	filePath, action, err := resolveConflict(filePath, true, policy)
+	if err != nil {
+		replyOpError(w, r, err)
+		return
+	}
+	if action == actionSkipped {
+		writeConflictHeaders(w, action, filePath)
+		reply(w, r, http.StatusOK, "File already exists, upload skipped: "+relFromAbs(filePath), newOpResult(action, filePath))
+		return
+	}
+
+	reservation, err := reserveQuota(handler.Size, requestUser(r), filePath)
+	if err != nil {
+		replyOpError(w, r, err)
+		return
+	}
+	defer reservation.release()
+
+	// Overwrites are written aside first so a failed upload never destroys
+	// the file it was meant to replace.
+	writePath := filePath
+	if action == actionOverwritten {
+		writePath = internalPathFor(filePath, "upload", newID())
+		if err := rootMkdirAll(filepath.Dir(writePath), 0700); err != nil {
+			replyOpError(w, r, internalFail("Failed to save file", err))
+			return
 		}
-		filePath = filepath.Join(safePath, fmt.Sprintf("%s(%d)%s", fileBase, counter, fileExt))
-		counter++
 	}
 
-	dst, err := os.Create(filePath)
+	dst, err := rootOpenFile(writePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
-		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+		replyError(w, r, http.StatusInternalServerError, "Failed to save file")
 		return
 	}
-	defer dst.Close()
 
-	_, err = io.Copy(dst, file)
+	// The reservation covers handler.Size; never write more than that.
+	sum := sha256.New()
+	_, err = io.Copy(io.MultiWriter(dst, sum), io.LimitReader(file, handler.Size))
+	dst.Close()
 	if err != nil {
-		http.Error(w, "Failed to copy file content", http.StatusInternalServerError)
+		rootRemove(writePath)
+		replyError(w, r, http.StatusInternalServerError, "Failed to copy file content")
 		return
 	}
 
-	w.Write([]byte("File uploaded successfully to " + filepath.ToSlash(filepath.Join(subPath, filepath.Base(filePath)))))
+	if writePath != filePath {
+		if err := replacePath(writePath, filePath); err != nil {
+			rootRemove(writePath)
+			replyError(w, r, http.StatusInternalServerError, "Failed to save file")
+			return
+		}
+	}
+
+	reservation.commit(filePath)
+	storeHash(filePath, hex.EncodeToString(sum.Sum(nil)))
+	if action == actionOverwritten {
+		journalChange(changeModify, filePath, "", false)
+	} else {
+		journalChange(changeCreate, filePath, "", false)
+	}
+	if tag, ok := cachedETag(filePath); ok {
+		w.Header().Set("ETag", tag)
+	}
+	writeConflictHeaders(w, action, filePath)
+	reply(w, r, http.StatusOK, "File uploaded successfully to "+relFromAbs(filePath), newOpResult(action, filePath))
 }
 
 func downloadHandler(w http.ResponseWriter, r *http.Request) {
 	relativePath := strings.TrimPrefix(r.URL.Path, "/download/")
 
-	cleanPath := filepath.Clean(relativePath)
-	if strings.HasPrefix(cleanPath, "..") {
-		http.Error(w, "Invalid path", http.StatusBadRequest)
+	fullPath, err := resolveItemPath(relativePath)
+	if err != nil {
+		replyOpError(w, r, err)
 		return
 	}
 
-	fullPath := filepath.Join(watchDir, cleanPath)
-
-	absWatchDir, _ := filepath.Abs(watchDir)
-	absTarget, _ := filepath.Abs(fullPath)
-
-	if !strings.HasPrefix(absTarget, absWatchDir) {
-		http.Error(w, "Access denied", http.StatusForbidden)
+	file, err := openInRoot(relativePath)
+	if os.IsNotExist(err) {
+		replyError(w, r, http.StatusNotFound, "Not found")
 		return
 	}
+	if err != nil {
+		replyError(w, r, http.StatusInternalServerError, "Failed to open file")
+		return
+	}
+	defer file.Close()
 
-	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
-		http.NotFound(w, r)
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		replyError(w, r, http.StatusBadRequest, "Cannot download a directory")
 		return
 	}
 
+	// Conditional requests need the tag; otherwise only a cached one is sent.
+	sum, ok := cachedHash(fullPath, info)
+	if !ok && (r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Range") != "") {
+		sum, _ = fileHash(fullPath)
+	}
+	if sum != "" {
+		w.Header().Set("ETag", etagOf(sum))
+	}
 	w.Header().Set("Content-Disposition", "attachment; filename=\""+filepath.Base(fullPath)+"\"")
-	http.ServeFile(w, r, fullPath)
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
 }
 
 func listHandler(w http.ResponseWriter, r *http.Request) {
 	basePath := strings.TrimPrefix(r.URL.Path, "/list")
 	basePath = strings.TrimPrefix(basePath, "/")
 
-	cleanPath := filepath.Clean(basePath)
-	if strings.Contains(cleanPath, "..") {
-		http.Error(w, "Invalid path", http.StatusBadRequest)
+	if clean, err := cleanRelPath(basePath); err == nil && clean == "." && multiRoot() {
+		items := rootItems()
+		if !wantsEnvelope(r) {
+			items = legacyItems(items)
+		}
+		reply(w, r, http.StatusOK, "", items)
 		return
 	}
 
-	absPath := filepath.Join(watchDir, cleanPath)
+	absPath, err := resolvePath(basePath)
+	if err != nil {
+		replyOpError(w, r, err)
+		return
+	}
+	cleanPath, _ := cleanRelPath(basePath)
 
 	info, err := os.Stat(absPath)
 	if err != nil {
-		http.Error(w, "Not found", http.StatusNotFound)
+		replyError(w, r, http.StatusNotFound, "Not found")
 		return
 	}
 
 	if !info.IsDir() {
+		file, err := openInRoot(cleanPath)
+		if err != nil {
+			replyOpError(w, r, err)
+			return
+		}
+		defer file.Close()
 		w.Header().Set("Content-Type", mime.TypeByExtension(filepath.Ext(absPath)))
 		w.Header().Set("Cache-Control", "public, max-age=86400")
-		http.ServeFile(w, r, absPath)
+		http.ServeContent(w, r, info.Name(), info.ModTime(), file)
 		return
 	}
 
-	type Item struct {
-		Name     string    `json:"name"`
-		Path     string    `json:"path"`
-		FullPath string    `json:"full_path"`
-		IsDir    bool      `json:"is_dir"`
-		Size     int64     `json:"size"`
-		ModTime  time.Time `json:"mod_time"`
-	}
-
 	entries, err := os.ReadDir(absPath)
 	if err != nil {
-		http.Error(w, "Failed to read directory", http.StatusInternalServerError)
+		replyError(w, r, http.StatusInternalServerError, "Failed to read directory")
 		return
 	}
 
-	absWatchDir, _ := filepath.Abs(watchDir)
-	var items []*Item
+	var items []*fileItem
+	withHash, _ := strconv.ParseBool(r.URL.Query().Get("hash"))
 
 	for _, entry := range entries {
+		if strings.EqualFold(filepath.Join(absPath, entry.Name()), internalPathFor(absPath)) {
+			continue
+		}
+
 		entryRelPath := filepath.Join(cleanPath, entry.Name())
 		entryRelPath = filepath.ToSlash(entryRelPath)
 
-		entryAbsPath := filepath.Join(absWatchDir, filepath.FromSlash(entryRelPath))
-
 		entryInfo, err := entry.Info()
 		if err != nil {
-			http.Error(w, "Failed to get file info", http.StatusInternalServerError)
+			replyError(w, r, http.StatusInternalServerError, "Failed to get file info")
 			return
 		}
 
-		items = append(items, &Item{
-			Name:     entry.Name(),
-			Path:     entryRelPath,
-			FullPath: entryAbsPath,
-			IsDir:    entry.IsDir(),
-			Size:     entryInfo.Size(),
-			ModTime:  entryInfo.ModTime(),
-		})
+		size := entryInfo.Size()
+		if entry.IsDir() {
+			if total, ok := folderSize(filepath.Join(absPath, entry.Name())); ok {
+				size = total
+			}
+		}
+
+		item := &fileItem{
+			Name:    entry.Name(),
+			Path:    entryRelPath,
+			IsDir:   entry.IsDir(),
+			Size:    size,
+			ModTime: entryInfo.ModTime(),
+		}
+		if entryInfo.Mode().IsRegular() {
+			entryAbs := filepath.Join(absPath, entry.Name())
+			if sum, ok := cachedHash(entryAbs, entryInfo); ok {
+				item.SHA256 = sum
+			} else if withHash {
+				item.SHA256, _ = fileHash(entryAbs)
+			}
+		}
+		items = append(items, item)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(items)
+	if !wantsEnvelope(r) {
+		reply(w, r, http.StatusOK, "", legacyItems(items))
+		return
+	}
+	if items == nil {
+		items = []*fileItem{}
+	}
+	reply(w, r, http.StatusOK, "", items)
 }
 
 func renameHandler(w http.ResponseWriter, r *http.Request) {
 	type Req struct {
-		OldPath string `json:"old"`
-		NewPath string `json:"new"`
+		OldPath    string `json:"old"`
+		NewPath    string `json:"new"`
+		OnConflict string `json:"on_conflict"`
 	}
 
 	var req Req
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Bad request", http.StatusBadRequest)
+		replyError(w, r, http.StatusBadRequest, "Bad request")
 		return
 	}
-
-	oldPath := filepath.Join(watchDir, filepath.Clean(req.OldPath))
-	newPath := filepath.Join(watchDir, filepath.Clean(req.NewPath))
-
-	if _, err := os.Stat(oldPath); os.IsNotExist(err) {
-		http.Error(w, "Old path does not exist", http.StatusNotFound)
+	policy, err := conflictPolicy(r, req.OnConflict)
+	if err != nil {
+		replyOpError(w, r, err)
 		return
 	}
 
-	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
-		http.Error(w, "Failed to create target folder: "+err.Error(), http.StatusInternalServerError)
+	oldAbs, err := resolveItemPath(req.OldPath)
+	if err != nil {
+		replyOpError(w, r, err)
 		return
 	}
+	unlock, err := lockForWrite(r, oldAbs)
+	if err != nil {
+		replyOpError(w, r, err)
+		return
+	}
+	defer unlock()
 
-	if err := os.Rename(oldPath, newPath); err != nil {
-		http.Error(w, "Failed to rename: "+err.Error(), http.StatusInternalServerError)
+	final, action, err := renameItem(r.Context(), req.OldPath, req.NewPath, policy)
+	if err != nil {
+		replyOpError(w, r, err)
 		return
 	}
+	writeConflictHeaders(w, action, final)
 
-	fmt.Fprintf(w, "Rename successful from %s to %s", req.OldPath, req.NewPath)
+	if action == actionSkipped {
+		reply(w, r, http.StatusOK, fmt.Sprintf("Rename skipped, %s already exists", req.NewPath), newOpResult(action, final))
+		return
+	}
+	reply(w, r, http.StatusOK, fmt.Sprintf("Rename successful from %s to %s", req.OldPath, relFromAbs(final)), newOpResult(action, final))
 }
 
 func moveHandler(w http.ResponseWriter, r *http.Request) {
 	type Req struct {
-		Source string `json:"source"`
-		Dest   string `json:"dest"`
+		Source     string `json:"source"`
+		Dest       string `json:"dest"`
+		OnConflict string `json:"on_conflict"`
 	}
 	var req Req
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Bad request", http.StatusBadRequest)
+		replyError(w, r, http.StatusBadRequest, "Bad request")
+		return
+	}
+	policy, err := conflictPolicy(r, req.OnConflict)
+	if err != nil {
+		replyOpError(w, r, err)
 		return
 	}
-	src := filepath.Join(watchDir, filepath.Clean(req.Source))
-	dst := filepath.Join(watchDir, filepath.Clean(req.Dest))
 
-	if _, err := os.Stat(src); os.IsNotExist(err) {
-		http.Error(w, "Source not found", http.StatusNotFound)
+	plan, err := prepareMove(req.Source, req.Dest, policy)
+	if err != nil {
+		replyOpError(w, r, err)
 		return
 	}
 
-	fileBase := filepath.Base(dst)
-	fileExt := ""
-	if dot := strings.LastIndex(fileBase, "."); dot != -1 && !((filepath.Base(src) == fileBase) && (dot == 0)) {
-		srcInfo, err := os.Stat(src)
-		if err == nil && !srcInfo.IsDir() {
-			fileExt = fileBase[dot:]
-			fileBase = fileBase[:dot]
+	// A move to another storage root copies the data; large ones run as
+	// a background job like copies.
+	if !plan.crossRoot() || plan.bytes < copyJobBytes && plan.files < copyJobFiles {
+		if err := plan.execute(r.Context(), func(int64, int) {}); err != nil {
+			replyOpError(w, r, err)
+			return
+		}
+		writeConflictHeaders(w, plan.action, plan.dst)
+		if plan.action == actionSkipped {
+			reply(w, r, http.StatusOK, "Move skipped, destination already exists", newOpResult(plan.action, plan.dst))
+			return
 		}
+		reply(w, r, http.StatusOK, "File/folder moved successfully", newOpResult(plan.action, plan.dst))
+		return
 	}
 
-	counter := 1
-	for {
-		if _, err := os.Stat(dst); os.IsNotExist(err) {
-			break
-		}
+	job := startJob(&Job{
+		Type:       "move",
+		Owner:      requestUser(r),
+		Source:     req.Source,
+		Dest:       relFromAbs(plan.dst),
+		Action:     plan.action,
+		TotalBytes: plan.bytes,
+		TotalFiles: plan.files,
+	}, func(ctx context.Context, job *Job) error {
+		return plan.execute(ctx, job.addProgress)
+	})
+	writeConflictHeaders(w, plan.action, plan.dst)
 
-		dir := filepath.Dir(dst)
-		dst = filepath.Join(dir, fmt.Sprintf("%s(%d)%s", fileBase, counter, fileExt))
-		counter++
-	}
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	reply(w, r, http.StatusAccepted, "", jobSnapshot(job))
+}
 
-	if err := os.Rename(src, dst); err != nil {
-		http.Error(w, "Failed to move: "+err.Error(), http.StatusInternalServerError)
-		return
+// nextFreePath returns p, or the first "name(N)" variant of it that does not
+// exist yet. For files the counter goes before the extension.
+func nextFreePath(p string, isFile bool) string {
+	dir := filepath.Dir(p)
+	base := filepath.Base(p)
+	ext := ""
+	if dot := strings.LastIndex(base, "."); isFile && dot > 0 {
+		ext = base[dot:]
+		base = base[:dot]
+	}
+
+	candidate := p
+	for counter := 1; ; counter++ {
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+		candidate = filepath.Join(dir, fmt.Sprintf("%s(%d)%s", base, counter, ext))
 	}
-	w.Write([]byte("File/folder moved successfully"))
 }
 
 func deleteHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "DELETE" {
-		http.Error(w, "Use DELETE method", http.StatusMethodNotAllowed)
+		replyError(w, r, http.StatusMethodNotAllowed, "Use DELETE method")
 		return
 	}
 
 	target := r.URL.Query().Get("path")
 	if target == "" {
 		log.Println("Delete: empty path")
-		http.Error(w, "path parameter required", http.StatusBadRequest)
-		return
-	}
-
-	cleanPath := filepath.Clean(target)
-	if strings.HasPrefix(cleanPath, "..") {
-		http.Error(w, "Invalid path", http.StatusBadRequest)
+		replyError(w, r, http.StatusBadRequest, "path parameter required")
 		return
 	}
-	fullPath := filepath.Join(watchDir, cleanPath)
-
-	absWatchDir, _ := filepath.Abs(watchDir)
-	absTarget, _ := filepath.Abs(fullPath)
 
 	log.Println("Target:", target)
-	log.Println("Full path:", fullPath)
-
-	if !strings.HasPrefix(absTarget, absWatchDir) {
-		log.Println("Delete: Path not in allowed directory")
-		http.Error(w, "Access denied", http.StatusForbidden)
-		return
-	}
-
-	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
-		log.Println("Delete: File or folder not found:", fullPath)
-		http.Error(w, "File or folder not found", http.StatusNotFound)
-		return
+	if abs, err := resolveItemPath(target); err == nil {
+		unlock, err := lockForWrite(r, abs)
+		if err != nil {
+			replyOpError(w, r, err)
+			return
+		}
+		defer unlock()
 	}
-
-	if err := os.RemoveAll(fullPath); err != nil {
-		log.Println("Delete: Failed to delete:", err)
-		http.Error(w, "Failed to delete file/folder", http.StatusInternalServerError)
+	if err := deleteItem(target); err != nil {
+		replyOpError(w, r, err)
 		return
 	}
 
-	log.Println("Deleted successfully:", fullPath)
-	w.Write([]byte("File/folder deleted successfully"))
+	reply(w, r, http.StatusOK, "File/folder deleted successfully", nil)
 }
 
 func mkdirHandler(w http.ResponseWriter, r *http.Request) {
 	type Req struct {
-		Path string `json:"path"`
+		Path       string `json:"path"`
+		OnConflict string `json:"on_conflict"`
 	}
 	var req Req
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Bad request", http.StatusBadRequest)
+		replyError(w, r, http.StatusBadRequest, "Bad request")
 		return
 	}
-
-	if req.Path == "" || strings.Contains(req.Path, "..") {
-		http.Error(w, "Invalid path", http.StatusBadRequest)
+	policy, err := conflictPolicy(r, req.OnConflict)
+	if err != nil {
+		replyOpError(w, r, err)
 		return
 	}
 
-	cleanPath := filepath.Clean(req.Path)
-	if strings.HasPrefix(cleanPath, "..") {
-		http.Error(w, "Invalid path", http.StatusBadRequest)
+	targetPath, action, err := mkdirItem(req.Path, policy)
+	if err != nil {
+		replyOpError(w, r, err)
 		return
 	}
+	writeConflictHeaders(w, action, targetPath)
 
-	targetPath := filepath.Join(watchDir, cleanPath)
-
-	absTarget, _ := filepath.Abs(targetPath)
-	absWatch, _ := filepath.Abs(watchDir)
-	if !strings.HasPrefix(absTarget, absWatch) {
-		http.Error(w, "Access denied", http.StatusForbidden)
+	if action == actionSkipped {
+		reply(w, r, http.StatusOK, "Folder already exists: "+relFromAbs(targetPath), newOpResult(action, targetPath))
 		return
 	}
+	reply(w, r, http.StatusCreated, "Folder created: "+relFromAbs(targetPath), newOpResult(action, targetPath))
+}
 
-	folderBase := cleanPath
-	counter := 1
-	for {
-		if _, err := os.Stat(targetPath); os.IsNotExist(err) {
-			break
-		}
-		targetPath = filepath.Join(watchDir, fmt.Sprintf("%s(%d)", folderBase, counter))
-		counter++
-	}
+// changeListeners are told about every path the watchers saw change, after
+// the size index was updated. Removed folders are reported once, not per
+// entry inside them; new folders likewise.
+var changeListeners []func(abs string)
 
-	if err := os.MkdirAll(targetPath, os.ModePerm); err != nil {
-		http.Error(w, "Failed to create folder: "+err.Error(), http.StatusInternalServerError)
-		return
+// onChange registers fn as a change listener. It must be called before the
+// watchers start.
+func onChange(fn func(abs string)) {
+	changeListeners = append(changeListeners, fn)
+}
+
+func notifyChanged(abs string) {
+	for _, fn := range changeListeners {
+		fn(abs)
 	}
+}
 
-	w.WriteHeader(http.StatusCreated)
-	w.Write([]byte("Folder created: " + targetPath))
+// startWatcher runs one watcher per storage root and marks the server
+// ready once all of them have sized their tree.
+func startWatcher(ctx context.Context) {
+	var scanned, running sync.WaitGroup
+	for _, rt := range storageRoots {
+		scanned.Add(1)
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			watchRoot(ctx, rt, scanned.Done)
+		}()
+	}
+	scanned.Wait()
+	publishDirSize()
+	changes.checkOffline()
+	watcherReady.Store(true)
+	running.Wait()
 }
 
-func startWatcher() {
+func watchRoot(ctx context.Context, rt *storageRoot, ready func()) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer watcher.Close()
 
-	// Initial calculation
-	initialSize, _ := getDirSize(watchDir)
-	mu.Lock()
-	cachedDirSize = initialSize
-	mu.Unlock()
+	index := rt.index
+	index.watch = func(dir string) {
+		if err := watcher.Add(dir); err != nil {
+			log.Printf("Watcher: cannot watch %s: %v", dir, err)
+		}
+	}
+	index.unwatch = func(dir string) { watcher.Remove(dir) }
 
-	err = filepath.Walk(watchDir, func(path string, info os.FileInfo, err error) error {
-		if info != nil && info.IsDir() {
-			return watcher.Add(path)
+	// Initial calculation. Watches are added with absolute paths, so event
+	// names match the index.
+	index.top = index.scan(rt.Dir, false)
+	index.loadOwners()
+	ready()
+	defer func() {
+		if err := index.saveOwners(); err != nil {
+			log.Printf("Saving file owners: %v", err)
 		}
-		return nil
-	})
+	}()
 
-	if err != nil {
-		log.Fatal(err)
+	// Events are coalesced per path and applied in batches.
+	pending := make(map[string]struct{})
+	flush := time.NewTicker(debounceDuration)
+	defer flush.Stop()
+	reconcile := time.NewTicker(reconcileInterval)
+	defer reconcile.Stop()
+	saveOwners := time.NewTicker(time.Minute)
+	defer saveOwners.Stop()
+	reconciling := false
+	reconciled := make(chan struct{}, 1)
+	startReconcile := func() {
+		if reconciling {
+			return
+		}
+		reconciling = true
+		go func() {
+			index.reconcile()
+			reconciled <- struct{}{}
+		}()
 	}
 
-	// Ticker to update size if dirty
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
-
-	go func() {
-		for range ticker.C {
-			dirtyMu.Lock()
-			needsUpdate := isDirty
-			isDirty = false
-			dirtyMu.Unlock()
-
-			if needsUpdate {
-				newSize, _ := getDirSize(watchDir)
-				mu.Lock()
-				cachedDirSize = newSize
-				mu.Unlock()
+	applyPending := func() {
+		if len(pending) == 0 {
+			return
+		}
+		// What the index knew before tells the journal created from
+		// modified and what kind of entry was deleted.
+		type before struct{ known, dir bool }
+		prev := make(map[string]before, len(pending))
+		for p := range pending {
+			known, dir := index.has(p)
+			prev[p] = before{known, dir}
+		}
+		for p := range pending {
+			index.refresh(p)
+		}
+		for p := range pending {
+			if _, ok := index.parts(p); ok {
+				notifyChanged(p)
+				changes.observe(p, prev[p].known, prev[p].dir)
 			}
 		}
-	}()
+		pending = make(map[string]struct{})
+		publishDirSize()
+	}
 
 	for {
 		select {
+		case <-ctx.Done():
+			// Apply what was already delivered, so the journal saved at
+			// shutdown does not miss the last changes.
+			for drained := false; !drained; {
+				select {
+				case event, ok := <-watcher.Events:
+					if ok {
+						pending[event.Name] = struct{}{}
+					}
+					drained = !ok
+				default:
+					drained = true
+				}
+			}
+			applyPending()
+			return
+
 		case event, ok := <-watcher.Events:
 			if !ok {
 				return
 			}
+			pending[event.Name] = struct{}{}
 
-			// Handle directory creation/deletion for watcher
-			if event.Op&fsnotify.Create == fsnotify.Create {
-				info, err := os.Stat(event.Name)
-				if err == nil && info.IsDir() {
-					watcher.Add(event.Name)
-				}
+		case <-flush.C:
+			applyPending()
+
+		case <-reconcile.C:
+			startReconcile()
+
+		case <-saveOwners.C:
+			if err := index.saveOwners(); err != nil {
+				log.Printf("Saving file owners: %v", err)
 			}
 
-			// Mark as dirty regarding size
-			dirtyMu.Lock()
-			isDirty = true
-			dirtyMu.Unlock()
+		case <-reconciled:
+			reconciling = false
+			publishDirSize()
 
 		case err, ok := <-watcher.Errors:
 			if !ok {
 				return
 			}
 			log.Println("Watcher error:", err)
+			// Dropped events leave the index stale until the next rescan.
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				startReconcile()
+				changes.reset("watcher overflow")
+			}
 		}
 	}
 }
@@ -915,53 +1252,74 @@ func handleEvent(event fsnotify.Event) {
 	// No-op for now to save resources
 }
 
-func getDirSize(path string) (int64, error) {
-	var size int64
-	err := filepath.WalkDir(path, func(_ string, d os.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		if !d.IsDir() {
-			info, err := d.Info()
-			if err == nil {
-				size += info.Size()
-			}
-		}
-		return nil
-	})
-	return size, err
-}
-
 func settingsHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"storage_quota_gb": storageQuotaGB,
-		})
+		reply(w, r, http.StatusOK, "", currentSettings())
 		return
 	}
 
 	if r.Method == "POST" {
+		if requestUser(r) != adminUser {
+			replyError(w, r, http.StatusForbidden, "Only the admin can change settings")
+			return
+		}
+
 		type Settings struct {
-			StorageQuotaGB int `json:"storage_quota_gb"`
+			StorageQuotaGB *int           `json:"storage_quota_gb"`
+			UserQuotasGB   map[string]int `json:"user_quotas_gb"`
+			FolderQuotasGB map[string]int `json:"folder_quotas_gb"`
 		}
 		var s Settings
 		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
-			http.Error(w, "Bad request", http.StatusBadRequest)
+			replyError(w, r, http.StatusBadRequest, "Bad request")
+			return
+		}
+		if s.StorageQuotaGB == nil && s.UserQuotasGB == nil && s.FolderQuotasGB == nil {
+			replyError(w, r, http.StatusBadRequest, "Nothing to update")
 			return
 		}
 
-		if s.StorageQuotaGB < 1 || s.StorageQuotaGB > 1000 {
-			http.Error(w, "Quota must be between 1 and 1000 GB", http.StatusBadRequest)
+		if s.StorageQuotaGB != nil && (*s.StorageQuotaGB < 1 || *s.StorageQuotaGB > 1000) {
+			replyError(w, r, http.StatusBadRequest, "Quota must be between 1 and 1000 GB")
 			return
 		}
+		// A quota of 0 removes the limit.
+		for name, q := range s.UserQuotasGB {
+			if q < 0 || q > 1000 {
+				replyError(w, r, http.StatusBadRequest, "Quota must be between 1 and 1000 GB")
+				return
+			}
+			if !knownUser(name) {
+				replyError(w, r, http.StatusBadRequest, "Unknown user: "+name)
+				return
+			}
+		}
+		for name, q := range s.FolderQuotasGB {
+			if q < 0 || q > 1000 {
+				replyError(w, r, http.StatusBadRequest, "Quota must be between 1 and 1000 GB")
+				return
+			}
+			if clean, err := cleanRelPath(name); err != nil || filepath.ToSlash(clean) != name || !validTopFolder(name) {
+				replyError(w, r, http.StatusBadRequest, "Not a top-level folder: "+name)
+				return
+			}
+		}
 
-		mu.Lock()
-		storageQuotaGB = s.StorageQuotaGB
-		mu.Unlock()
+		quotaMu.Lock()
+		if s.StorageQuotaGB != nil {
+			storageQuotaGB = *s.StorageQuotaGB
+		}
+		applyQuotas(userQuotaGB, s.UserQuotasGB)
+		applyQuotas(folderQuotaGB, s.FolderQuotasGB)
+		quotaMu.Unlock()
 
-		w.Write([]byte(fmt.Sprintf("Storage quota updated to %d GB (Restart server to reset from .env)", storageQuotaGB)))
+		msg := "Quotas updated (Restart server to reset from .env)"
+		if s.StorageQuotaGB != nil {
+			msg = fmt.Sprintf("Storage quota updated to %d GB (Restart server to reset from .env)", *s.StorageQuotaGB)
+		}
+		reply(w, r, http.StatusOK, msg, currentSettings())
 		return
 	}
 
-	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	replyError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
 }
@@ -0,0 +1,663 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The music library indexes the tags of every audio file in the music
+// folders (MUSIC_FOLDERS, all storage by default). A background scan at idle
+// I/O priority builds it on start, reusing the tags cached in
+// .homecloud/music.json for files that did not change; after that the
+// watchers keep it current.
+
+var musicFolderPaths []string
+
+// musicFolder is a folder the library covers, as configured.
+type musicFolder struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	Path string `json:"path"`
+
+	abs string
+}
+
+var musicFolders []musicFolder
+
+type musicTrack struct {
+	ID          string  `json:"id"`
+	Title       string  `json:"title"`
+	Artist      string  `json:"artist"`
+	ArtistID    string  `json:"artist_id"`
+	AlbumArtist string  `json:"album_artist,omitempty"`
+	Album       string  `json:"album"`
+	AlbumID     string  `json:"album_id"`
+	Genre       string  `json:"genre,omitempty"`
+	Year        int     `json:"year,omitempty"`
+	Track       int     `json:"track,omitempty"`
+	Disc        int     `json:"disc,omitempty"`
+	Duration    float64 `json:"duration"`
+	Size        int64   `json:"size"`
+	Path        string  `json:"path"`
+	StreamURL   string  `json:"stream_url"`
+	CoverURL    string  `json:"cover_url,omitempty"`
+
+	abs      string
+	modTime  time.Time
+	hasCover bool
+}
+
+// musicCacheEntry is what music.json keeps per file.
+type musicCacheEntry struct {
+	Size    int64     `json:"size"`
+	ModTime int64     `json:"mod_time"`
+	Tags    audioTags `json:"tags"`
+}
+
+type musicLibrary struct {
+	mu     sync.RWMutex
+	tracks map[string]*musicTrack // by absolute path
+	byID   map[string]*musicTrack
+	cache  map[string]musicCacheEntry
+	dirty  bool
+}
+
+var (
+	library = &musicLibrary{
+		tracks: map[string]*musicTrack{},
+		byID:   map[string]*musicTrack{},
+		cache:  map[string]musicCacheEntry{},
+	}
+	musicReady atomic.Bool
+
+	// musicEvents queues watcher changes for the indexer. When it is full
+	// the indexer rescans instead.
+	musicEvents   = make(chan string, 4096)
+	musicOverflow atomic.Bool
+)
+
+// initMusic resolves MUSIC_FOLDERS and subscribes to watcher changes. It
+// runs after initRoots.
+func initMusic() {
+	paths := musicFolderPaths
+	if len(paths) == 0 {
+		for _, rt := range storageRoots {
+			paths = append(paths, rt.virtualPath("."))
+		}
+	}
+	for _, p := range paths {
+		abs, err := resolvePath(p)
+		if err != nil {
+			log.Printf("Warning: MUSIC_FOLDERS entry %q: %v", p, err)
+			continue
+		}
+		name := filepath.Base(abs)
+		if p == "." {
+			name = "Music"
+		}
+		musicFolders = append(musicFolders, musicFolder{ID: len(musicFolders) + 1, Name: name, Path: relFromAbs(abs), abs: abs})
+	}
+	loadPlaylists()
+	onChange(func(abs string) {
+		if musicFolderOf(abs) == nil {
+			return
+		}
+		select {
+		case musicEvents <- abs:
+		default:
+			musicOverflow.Store(true)
+		}
+	})
+}
+
+// musicFolderOf returns the music folder abs lies in, or nil.
+func musicFolderOf(abs string) *musicFolder {
+	for i := range musicFolders {
+		if isWithin(musicFolders[i].abs, abs) {
+			return &musicFolders[i]
+		}
+	}
+	return nil
+}
+
+func musicCacheFile() string {
+	return storageRoots[0].internal("music.json")
+}
+
+func shortHash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:8])
+}
+
+// musicIndexer builds the library and then applies watcher changes.
+func musicIndexer(ctx context.Context) {
+	if len(musicFolders) == 0 {
+		return
+	}
+	library.load()
+	library.scanAll()
+	musicReady.Store(true)
+	log.Printf("Music library: %d tracks", library.count())
+	library.save()
+
+	save := time.NewTicker(time.Minute)
+	defer save.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			library.save()
+			return
+		case abs := <-musicEvents:
+			library.update(abs)
+		case <-save.C:
+			if musicOverflow.Swap(false) {
+				library.scanAll()
+			}
+			library.save()
+		}
+	}
+}
+
+// scanAll walks all music folders at idle I/O priority and drops tracks
+// whose files are gone.
+func (lib *musicLibrary) scanAll() {
+	done := make(chan map[string]bool)
+	go func() {
+		// Like the size index reconciliation, the thread keeps its lowered
+		// priority and leaves with the goroutine.
+		runtime.LockOSThread()
+		lowerIOPriority()
+		seen := map[string]bool{}
+		for _, f := range musicFolders {
+			lib.scanTree(f.abs, seen)
+		}
+		done <- seen
+	}()
+	seen := <-done
+
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+	for abs := range lib.tracks {
+		if !seen[abs] {
+			lib.removeLocked(abs)
+		}
+	}
+	for abs := range lib.cache {
+		if !seen[abs] {
+			delete(lib.cache, abs)
+			lib.dirty = true
+		}
+	}
+}
+
+func (lib *musicLibrary) scanTree(root string, seen map[string]bool) {
+	var n int
+	filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if strings.EqualFold(d.Name(), internalDirName) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !audioExts[strings.ToLower(filepath.Ext(p))] {
+			return nil
+		}
+		if n++; n%reconcileYieldEvery == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if info, err := d.Info(); err == nil {
+			lib.index(p, info)
+			if seen != nil {
+				seen[p] = true
+			}
+		}
+		return nil
+	})
+}
+
+// update applies a watcher change of abs.
+func (lib *musicLibrary) update(abs string) {
+	info, err := os.Lstat(abs)
+	switch {
+	case err != nil:
+		lib.mu.Lock()
+		prefix := abs + string(filepath.Separator)
+		for p := range lib.tracks {
+			if p == abs || strings.HasPrefix(p, prefix) {
+				lib.removeLocked(p)
+				delete(lib.cache, p)
+			}
+		}
+		lib.mu.Unlock()
+	case info.IsDir():
+		lib.scanTree(abs, nil)
+	case info.Mode().IsRegular() && audioExts[strings.ToLower(filepath.Ext(abs))]:
+		lib.index(abs, info)
+	}
+}
+
+// index adds or refreshes the track at abs, reading its tags unless the
+// cache has them for this size and modification time.
+func (lib *musicLibrary) index(abs string, info os.FileInfo) {
+	lib.mu.RLock()
+	entry, ok := lib.cache[abs]
+	_, indexed := lib.tracks[abs]
+	lib.mu.RUnlock()
+	fresh := ok && entry.Size == info.Size() && entry.ModTime == info.ModTime().UnixNano()
+	if fresh && indexed {
+		return
+	}
+	if !fresh {
+		tags, _, err := readAudio(abs, false)
+		if errors.Is(err, errSymlinkDenied) || errors.Is(err, errPathEscape) {
+			// A link the symlink policy rejects is no track.
+			return
+		}
+		if err != nil {
+			log.Printf("Music library: reading %s: %v", relFromAbs(abs), err)
+		}
+		entry = musicCacheEntry{Size: info.Size(), ModTime: info.ModTime().UnixNano(), Tags: tags}
+	}
+
+	t := newMusicTrack(abs, entry)
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+	lib.removeLocked(abs)
+	lib.tracks[abs] = t
+	lib.byID[t.ID] = t
+	if !fresh {
+		lib.cache[abs] = entry
+		lib.dirty = true
+	}
+}
+
+func (lib *musicLibrary) removeLocked(abs string) {
+	if t := lib.tracks[abs]; t != nil {
+		delete(lib.byID, t.ID)
+		delete(lib.tracks, abs)
+		lib.dirty = true
+	}
+}
+
+func newMusicTrack(abs string, e musicCacheEntry) *musicTrack {
+	tags := e.Tags
+	rel := relFromAbs(abs)
+	dir := filepath.Dir(abs)
+	t := &musicTrack{
+		ID:          shortHash("track:" + rel),
+		Title:       tags.Title,
+		Artist:      tags.Artist,
+		AlbumArtist: tags.AlbumArtist,
+		Album:       tags.Album,
+		Genre:       tags.Genre,
+		Year:        tags.Year,
+		Track:       tags.Track,
+		Disc:        tags.Disc,
+		Duration:    tags.Duration,
+		Size:        e.Size,
+		Path:        rel,
+		StreamURL:   "/stream/" + escapePath(rel),
+		abs:         abs,
+		modTime:     time.Unix(0, e.ModTime),
+		hasCover:    tags.HasCover,
+	}
+	if t.Title == "" {
+		t.Title = strings.TrimSuffix(filepath.Base(abs), filepath.Ext(abs))
+	}
+	if t.Artist == "" {
+		t.Artist = first(t.AlbumArtist, "Unknown Artist")
+	}
+	if t.Album == "" {
+		t.Album = filepath.Base(dir)
+	}
+	t.ArtistID = shortHash("artist:" + strings.ToLower(t.Artist))
+	// Without an album artist, an album is the tracks of one folder, so
+	// compilations stay together.
+	if t.AlbumArtist != "" {
+		t.AlbumID = shortHash("album:" + strings.ToLower(t.AlbumArtist) + "\x00" + strings.ToLower(t.Album))
+	} else {
+		t.AlbumID = shortHash("album:" + strings.ToLower(t.Album) + "\x00" + dir)
+	}
+	if t.hasCover || folderCover(dir) != "" {
+		t.CoverURL = "/music/cover/" + t.ID
+	}
+	return t
+}
+
+// folderCoverNames are image files used as album covers.
+var folderCoverNames = []string{"cover.jpg", "cover.png", "folder.jpg", "folder.png", "front.jpg", "front.png", "albumart.jpg"}
+
+func folderCover(dir string) string {
+	for _, name := range folderCoverNames {
+		p := filepath.Join(dir, name)
+		if _, err := resolvePath(relFromAbs(p)); err != nil {
+			continue
+		}
+		if info, err := os.Stat(p); err == nil && info.Mode().IsRegular() {
+			return p
+		}
+	}
+	return ""
+}
+
+func (lib *musicLibrary) count() int {
+	lib.mu.RLock()
+	defer lib.mu.RUnlock()
+	return len(lib.tracks)
+}
+
+func (lib *musicLibrary) load() {
+	data, err := os.ReadFile(musicCacheFile())
+	if err != nil {
+		return
+	}
+	var cache map[string]musicCacheEntry
+	if err := json.Unmarshal(data, &cache); err != nil {
+		log.Printf("Warning: cannot read %s: %v", musicCacheFile(), err)
+		return
+	}
+	lib.mu.Lock()
+	lib.cache = cache
+	lib.mu.Unlock()
+}
+
+func (lib *musicLibrary) save() {
+	lib.mu.Lock()
+	if !lib.dirty {
+		lib.mu.Unlock()
+		return
+	}
+	data, err := json.Marshal(lib.cache)
+	lib.dirty = false
+	lib.mu.Unlock()
+	if err != nil {
+		return
+	}
+	file := musicCacheFile()
+	tmp := file + ".tmp"
+	os.MkdirAll(filepath.Dir(file), 0700)
+	if err := os.WriteFile(tmp, data, 0600); err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		log.Printf("Saving music library: %v", err)
+	}
+}
+
+// snapshot returns all tracks sorted by album, disc and track number.
+func (lib *musicLibrary) snapshot() []*musicTrack {
+	lib.mu.RLock()
+	tracks := make([]*musicTrack, 0, len(lib.tracks))
+	for _, t := range lib.tracks {
+		tracks = append(tracks, t)
+	}
+	lib.mu.RUnlock()
+	sort.Slice(tracks, func(i, j int) bool {
+		a, b := tracks[i], tracks[j]
+		if a.AlbumID != b.AlbumID {
+			return strings.ToLower(a.Album) < strings.ToLower(b.Album) || (strings.EqualFold(a.Album, b.Album) && a.AlbumID < b.AlbumID)
+		}
+		if a.Disc != b.Disc {
+			return a.Disc < b.Disc
+		}
+		if a.Track != b.Track {
+			return a.Track < b.Track
+		}
+		return a.Path < b.Path
+	})
+	return tracks
+}
+
+func (lib *musicLibrary) track(id string) *musicTrack {
+	lib.mu.RLock()
+	defer lib.mu.RUnlock()
+	return lib.byID[id]
+}
+
+// trackAt is the indexed track of the file abs, or nil.
+func (lib *musicLibrary) trackAt(abs string) *musicTrack {
+	lib.mu.RLock()
+	defer lib.mu.RUnlock()
+	return lib.tracks[abs]
+}
+
+type musicArtist struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	AlbumCount int    `json:"album_count"`
+	TrackCount int    `json:"track_count"`
+}
+
+type musicAlbum struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Artist     string    `json:"artist"`
+	ArtistID   string    `json:"artist_id"`
+	Year       int       `json:"year,omitempty"`
+	Genre      string    `json:"genre,omitempty"`
+	TrackCount int       `json:"track_count"`
+	Duration   float64   `json:"duration"`
+	CoverURL   string    `json:"cover_url,omitempty"`
+	Added      time.Time `json:"added"`
+
+	artists map[string]bool
+	cover   string
+}
+
+// musicAlbums groups tracks into albums, in the order of tracks.
+func musicAlbums(tracks []*musicTrack) []*musicAlbum {
+	var albums []*musicAlbum
+	byID := map[string]*musicAlbum{}
+	for _, t := range tracks {
+		a := byID[t.AlbumID]
+		if a == nil {
+			a = &musicAlbum{ID: t.AlbumID, Name: t.Album, Artist: t.AlbumArtist, artists: map[string]bool{}}
+			byID[t.AlbumID] = a
+			albums = append(albums, a)
+		}
+		a.artists[t.Artist] = true
+		a.TrackCount++
+		a.Duration += t.Duration
+		a.Year = max(a.Year, t.Year)
+		a.Genre = first(a.Genre, t.Genre)
+		if t.modTime.After(a.Added) {
+			a.Added = t.modTime
+		}
+		if a.CoverURL == "" && t.CoverURL != "" {
+			a.CoverURL = "/music/cover/" + a.ID
+			a.cover = t.ID
+		}
+	}
+	for _, a := range albums {
+		if a.Artist == "" {
+			if len(a.artists) == 1 {
+				for name := range a.artists {
+					a.Artist = name
+				}
+			} else {
+				a.Artist = "Various Artists"
+			}
+		}
+		a.ArtistID = shortHash("artist:" + strings.ToLower(a.Artist))
+	}
+	return albums
+}
+
+// musicQuery filters tracks by the common query parameters.
+func musicQuery(r *http.Request, tracks []*musicTrack) []*musicTrack {
+	q := r.URL.Query()
+	album, artist, genre := q.Get("album"), q.Get("artist"), q.Get("genre")
+	search := strings.ToLower(q.Get("q"))
+	folder, _ := strconv.Atoi(q.Get("folder"))
+	var out []*musicTrack
+	for _, t := range tracks {
+		switch {
+		case album != "" && t.AlbumID != album:
+		case artist != "" && t.ArtistID != artist && shortHash("artist:"+strings.ToLower(t.AlbumArtist)) != artist:
+		case genre != "" && !strings.EqualFold(t.Genre, genre):
+		case folder > 0 && (musicFolderOf(t.abs) == nil || musicFolderOf(t.abs).ID != folder):
+		case search != "" && !strings.Contains(strings.ToLower(t.Title+"\x00"+t.Artist+"\x00"+t.Album), search):
+		default:
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// markIndexing tells clients the lists are incomplete during the first scan.
+func markIndexing(w http.ResponseWriter, ready *atomic.Bool) {
+	if !ready.Load() {
+		w.Header().Set("X-Indexing", "true")
+	}
+}
+
+// page applies ?offset= and ?limit= to n items.
+func page(r *http.Request, n int) (int, int) {
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = n
+	}
+	offset = min(max(offset, 0), n)
+	return offset, min(offset+limit, n)
+}
+
+func musicArtistsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		replyError(w, r, http.StatusMethodNotAllowed, "use GET method")
+		return
+	}
+	tracks := musicQuery(r, library.snapshot())
+	byID := map[string]*musicArtist{}
+	albums := map[string]map[string]bool{}
+	for _, t := range tracks {
+		a := byID[t.ArtistID]
+		if a == nil {
+			a = &musicArtist{ID: t.ArtistID, Name: t.Artist}
+			byID[t.ArtistID] = a
+			albums[t.ArtistID] = map[string]bool{}
+		}
+		a.TrackCount++
+		albums[t.ArtistID][t.AlbumID] = true
+	}
+	artists := make([]*musicArtist, 0, len(byID))
+	for id, a := range byID {
+		a.AlbumCount = len(albums[id])
+		artists = append(artists, a)
+	}
+	sort.Slice(artists, func(i, j int) bool { return strings.ToLower(artists[i].Name) < strings.ToLower(artists[j].Name) })
+	from, to := page(r, len(artists))
+	markIndexing(w, &musicReady)
+	reply(w, r, http.StatusOK, "", artists[from:to])
+}
+
+func musicAlbumsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		replyError(w, r, http.StatusMethodNotAllowed, "use GET method")
+		return
+	}
+	albums := musicAlbums(musicQuery(r, library.snapshot()))
+	switch r.URL.Query().Get("sort") {
+	case "year":
+		sort.SliceStable(albums, func(i, j int) bool { return albums[i].Year < albums[j].Year })
+	case "recent":
+		sort.SliceStable(albums, func(i, j int) bool { return albums[i].Added.After(albums[j].Added) })
+	case "artist":
+		sort.SliceStable(albums, func(i, j int) bool { return strings.ToLower(albums[i].Artist) < strings.ToLower(albums[j].Artist) })
+	}
+	if albums == nil {
+		albums = []*musicAlbum{}
+	}
+	from, to := page(r, len(albums))
+	markIndexing(w, &musicReady)
+	reply(w, r, http.StatusOK, "", albums[from:to])
+}
+
+func musicTracksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		replyError(w, r, http.StatusMethodNotAllowed, "use GET method")
+		return
+	}
+	tracks := musicQuery(r, library.snapshot())
+	if tracks == nil {
+		tracks = []*musicTrack{}
+	}
+	from, to := page(r, len(tracks))
+	markIndexing(w, &musicReady)
+	reply(w, r, http.StatusOK, "", tracks[from:to])
+}
+
+// musicCoverHandler serves the cover of a track or album.
+func musicCoverHandler(w http.ResponseWriter, r *http.Request) {
+	t := coverTrack(strings.TrimPrefix(r.URL.Path, "/music/cover/"))
+	if t == nil {
+		replyError(w, r, http.StatusNotFound, "Not found")
+		return
+	}
+	serveCover(w, r, t)
+}
+
+// coverTrack returns the track whose cover stands for id: a track, or the
+// first track with a cover of an album or an artist.
+func coverTrack(id string) *musicTrack {
+	if t := library.track(id); t != nil {
+		return t
+	}
+	for _, a := range musicAlbums(library.snapshot()) {
+		if (a.ID == id || a.ArtistID == id) && a.cover != "" {
+			return library.track(a.cover)
+		}
+	}
+	return nil
+}
+
+func serveCover(w http.ResponseWriter, r *http.Request, t *musicTrack) {
+	data, ctype, err := coverImage(t)
+	if err != nil {
+		replyError(w, r, http.StatusNotFound, "No cover")
+		return
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Write(data)
+}
+
+// coverImage returns the cover of t: the embedded picture, else a cover
+// image in its folder.
+func coverImage(t *musicTrack) ([]byte, string, error) {
+	if t.hasCover {
+		if _, cover, err := readAudio(t.abs, true); err == nil && cover != nil {
+			return cover.Data, cover.MIME, nil
+		}
+	}
+	if p := folderCover(filepath.Dir(t.abs)); p != "" {
+		f, err := openInRoot(relFromAbs(p))
+		if err != nil {
+			return nil, "", err
+		}
+		defer f.Close()
+		data, err := io.ReadAll(f)
+		return data, mime.TypeByExtension(filepath.Ext(p)), err
+	}
+	return nil, "", os.ErrNotExist
+}
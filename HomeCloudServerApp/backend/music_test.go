@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestMusicSymlinkPolicy links a track and a folder cover out of the root:
+// under follow-inside neither may be read.
+func TestMusicSymlinkPolicy(t *testing.T) {
+	root := testRoot(t)
+	symlinkPolicy = symlinkFollowInside
+	outside := filepath.Join(filepath.Dir(root), "outside")
+	dir := filepath.Join(root, "dir")
+	os.WriteFile(filepath.Join(outside, "cover.jpg"), []byte("jpeg"), 0644)
+	os.WriteFile(filepath.Join(outside, "song.mp3"), []byte("ID3"), 0644)
+	os.Symlink(filepath.Join(outside, "cover.jpg"), filepath.Join(dir, "cover.jpg"))
+	os.Symlink(filepath.Join(outside, "song.mp3"), filepath.Join(dir, "song.mp3"))
+	os.WriteFile(filepath.Join(dir, "front.png"), []byte("png"), 0644)
+
+	if got := folderCover(dir); got != filepath.Join(dir, "front.png") {
+		t.Errorf("folderCover = %q, want front.png", got)
+	}
+	if _, _, err := readAudio(filepath.Join(dir, "song.mp3"), false); err == nil {
+		t.Error("readAudio read through a link out of the root")
+	}
+
+	lib := &musicLibrary{tracks: map[string]*musicTrack{}, byID: map[string]*musicTrack{}, cache: map[string]musicCacheEntry{}}
+	lib.scanTree(root, nil)
+	if lib.count() != 0 {
+		t.Errorf("indexed %d tracks, want the link skipped", lib.count())
+	}
+
+	os.Remove(filepath.Join(dir, "front.png"))
+	if got := folderCover(dir); got != "" {
+		t.Errorf("folderCover = %q, want none", got)
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//go:embed docs.html
+var docsPage []byte
+
+type props map[string]interface{}
+
+func str(desc string) map[string]interface{} {
+	return map[string]interface{}{"type": "string", "description": desc}
+}
+
+func boolean(desc string) map[string]interface{} {
+	return map[string]interface{}{"type": "boolean", "description": desc}
+}
+
+func integer(desc string) map[string]interface{} {
+	return map[string]interface{}{"type": "integer", "description": desc}
+}
+
+func array(items map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"type": "array", "items": items}
+}
+
+func ref(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+func object(p props, required ...string) map[string]interface{} {
+	o := map[string]interface{}{"type": "object", "properties": p}
+	if len(required) > 0 {
+		o["required"] = required
+	}
+	return o
+}
+
+// apiSchemas are the shared component schemas referenced by the route table.
+func apiSchemas() map[string]interface{} {
+	return map[string]interface{}{
+		"Envelope": object(props{
+			"version":    str("API version"),
+			"ok":         boolean("Whether the call succeeded"),
+			"request_id": str("Request ID, also sent as X-Request-ID"),
+			"message":    str("Human readable message"),
+			"data":       map[string]interface{}{"description": "Result of the call"},
+			"error":      ref("Error"),
+		}, "version", "ok", "request_id"),
+		"Error": object(props{
+			"code":    str("Machine readable error code, e.g. not_found, access_denied, already_exists, quota_exceeded"),
+			"message": str("Human readable message"),
+		}, "code", "message"),
+		"FileItem": object(props{
+			"name":     str("Entry name"),
+			"path":     str("Path relative to the storage root"),
+			"is_dir":   boolean("Whether the entry is a folder"),
+			"size":     integer("Size in bytes; for folders the total of everything inside"),
+			"mod_time": map[string]interface{}{"type": "string", "format": "date-time"},
+			"sha256":   str("SHA-256 of a file, when already computed"),
+		}),
+		"FileHash": object(props{
+			"path":     str("Path relative to the storage root"),
+			"size":     integer("Size in bytes"),
+			"mod_time": map[string]interface{}{"type": "string", "format": "date-time"},
+			"sha256":   str("SHA-256 of the content, hex"),
+			"etag":     str("Strong ETag: the quoted sha256"),
+		}),
+		"SubtitleTrack": object(props{
+			"name":     str("Track name, relative to the media file's folder"),
+			"path":     str("Path relative to the storage root"),
+			"language": str("Language tag from the file name, e.g. en or pt-BR"),
+			"label":    str("Display label"),
+			"format":   str("srt or vtt; always served as WebVTT"),
+			"forced":   boolean("Forced subtitles"),
+			"sdh":      boolean("Subtitles for the deaf and hard of hearing"),
+			"url":      str("URL of the track as WebVTT"),
+		}),
+		"MusicTrack": object(props{
+			"id":           str("Track ID"),
+			"title":        str("Title; the file name when untagged"),
+			"artist":       str("Artist"),
+			"artist_id":    str("Artist ID"),
+			"album_artist": str("Album artist"),
+			"album":        str("Album; the folder name when untagged"),
+			"album_id":     str("Album ID"),
+			"genre":        str("Genre"),
+			"year":         integer("Year"),
+			"track":        integer("Track number"),
+			"disc":         integer("Disc number"),
+			"duration":     map[string]interface{}{"type": "number", "description": "Duration in seconds"},
+			"size":         integer("File size in bytes"),
+			"path":         str("Path relative to the storage root"),
+			"stream_url":   str("URL to play the track"),
+			"cover_url":    str("URL of the cover art, when there is one"),
+		}),
+		"MusicAlbum": object(props{
+			"id":          str("Album ID"),
+			"name":        str("Album name"),
+			"artist":      str("Album artist, or Various Artists"),
+			"artist_id":   str("Artist ID"),
+			"year":        integer("Year"),
+			"genre":       str("Genre"),
+			"track_count": integer("Number of tracks"),
+			"duration":    map[string]interface{}{"type": "number", "description": "Total duration in seconds"},
+			"cover_url":   str("URL of the cover art, when there is one"),
+			"added":       map[string]interface{}{"type": "string", "format": "date-time"},
+		}),
+		"MusicArtist": object(props{
+			"id":          str("Artist ID"),
+			"name":        str("Artist name"),
+			"album_count": integer("Number of albums"),
+			"track_count": integer("Number of tracks"),
+		}),
+		"Playlist": object(props{
+			"id":          str("Playlist ID"),
+			"name":        str("Name"),
+			"owner":       str("User who created it"),
+			"public":      boolean("Visible to all users"),
+			"paths":       array(str("Track path")),
+			"track_count": integer("Tracks still in the library"),
+			"duration":    map[string]interface{}{"type": "number", "description": "Total duration in seconds"},
+			"tracks":      array(ref("MusicTrack")),
+			"created":     map[string]interface{}{"type": "string", "format": "date-time"},
+			"updated":     map[string]interface{}{"type": "string", "format": "date-time"},
+		}),
+		"PhotoDay": object(props{
+			"date":   str("Date taken, YYYY-MM-DD on the camera's clock"),
+			"count":  integer("Number of photos"),
+			"photos": array(ref("Photo")),
+		}),
+		"Photo": object(props{
+			"path":        str("Path relative to the storage root"),
+			"name":        str("File name"),
+			"taken":       map[string]interface{}{"type": "string", "format": "date-time"},
+			"taken_from":  str("exif, or file when the image has no capture time"),
+			"camera":      str("Camera make and model"),
+			"orientation": integer("EXIF orientation (1-8)"),
+			"lat":         map[string]interface{}{"type": "number", "description": "GPS latitude"},
+			"lon":         map[string]interface{}{"type": "number", "description": "GPS longitude"},
+			"size":        integer("File size in bytes"),
+			"thumb_url":   str("URL of the upright thumbnail"),
+		}),
+		"FileSignature": object(props{
+			"path":       str("Path relative to the storage root"),
+			"size":       integer("File size in bytes"),
+			"block_size": integer("Block size; the last block may be shorter"),
+			"version":    str("Identifies this state of the file; pass as base to /delta"),
+			"blocks": array(object(props{
+				"weak":   integer("Rolling checksum"),
+				"strong": str("SHA-256, hex"),
+			})),
+		}),
+		"Change": object(props{
+			"seq":   integer("Sequence number"),
+			"time":  map[string]interface{}{"type": "string", "format": "date-time"},
+			"op":    str("create, modify, delete or move"),
+			"path":  str("Path relative to the storage root"),
+			"from":  str("Previous path of a move"),
+			"dir":   boolean("The entry is a folder; list it again recursively after a create or modify"),
+			"size":  integer("File size in bytes"),
+			"mtime": map[string]interface{}{"type": "string", "format": "date-time"},
+		}),
+		"SignedURL": object(props{
+			"path":    str("Path the URL is valid for"),
+			"expires": map[string]interface{}{"type": "string", "format": "date-time"},
+			"ip":      str("Only this client address may use it"),
+			"query":   str("Query string to append to a stream, download or thumbnail URL of the path"),
+			"urls":    map[string]interface{}{"type": "object", "additionalProperties": str("Absolute URL"), "description": "Ready URLs by route (stream, download, photos/thumb)"},
+		}),
+		"OpResult": object(props{
+			"action": str("created, renamed, overwritten or skipped"),
+			"item":   ref("FileItem"),
+		}),
+		"Job": object(props{
+			"id":          str("Job ID"),
+			"type":        str("Job type, e.g. copy"),
+			"owner":       str("User who started the job"),
+			"status":      str("running, done, failed or cancelled"),
+			"source":      str("Source path"),
+			"dest":        str("Destination path"),
+			"action":      str("Conflict action"),
+			"total_bytes": integer("Bytes to process"),
+			"done_bytes":  integer("Bytes processed"),
+			"total_files": integer("Files to process"),
+			"done_files":  integer("Files processed"),
+			"error":       str("Failure reason"),
+			"started_at":  map[string]interface{}{"type": "string", "format": "date-time"},
+			"finished_at": map[string]interface{}{"type": "string", "format": "date-time"},
+		}),
+		"BatchOperation": object(props{
+			"op":          str("move, copy, delete, rename or mkdir"),
+			"path":        str("delete, mkdir: target path"),
+			"source":      str("move, copy: source path"),
+			"dest":        str("move, copy: destination path"),
+			"old":         str("rename: current path"),
+			"new":         str("rename: new path"),
+			"on_conflict": str("Conflict policy for this operation"),
+		}, "op"),
+		"BatchResponse": object(props{
+			"atomic":      boolean("Whether the batch ran in all-or-nothing mode"),
+			"success":     boolean("Whether every operation succeeded"),
+			"rolled_back": boolean("Whether completed operations were undone"),
+			"results": array(object(props{
+				"index":      integer("Position in the request"),
+				"op":         str("Operation"),
+				"status":     str("ok, error, skipped, rolled_back or rollback_failed"),
+				"action":     str("Conflict action"),
+				"path":       str("Resulting path"),
+				"code":       integer("HTTP status of the failure"),
+				"error_code": str("Machine readable error code"),
+				"error":      str("Failure message"),
+			})),
+		}),
+		"Settings": object(props{
+			"storage_quota_gb": integer("Storage quota in GB (1-1000)"),
+			"user_quotas_gb":   map[string]interface{}{"type": "object", "additionalProperties": integer("Quota in GB, 0 removes it"), "description": "Per-user quotas"},
+			"folder_quotas_gb": map[string]interface{}{"type": "object", "additionalProperties": integer("Quota in GB, 0 removes it"), "description": "Per top-level folder quotas"},
+		}),
+	}
+}
+
+func buildOpenAPI(routes []route) map[string]interface{} {
+	paths := map[string]interface{}{}
+	for _, rt := range routes {
+		item := map[string]interface{}{}
+		for _, op := range rt.Ops {
+			item[strings.ToLower(op.Method)] = buildOperation(rt, op)
+		}
+		paths[rt.docPath()] = item
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "HomeCloud API",
+			"version": apiVersion,
+			"description": "Every path is served under " + apiPrefix + " with the JSON envelope. " +
+				"The same paths without the prefix are legacy aliases that return the old plain-text bodies.",
+		},
+		"servers": []interface{}{map[string]interface{}{"url": apiPrefix}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": apiSchemas(),
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer"},
+				"token":  map[string]interface{}{"type": "apiKey", "in": "query", "name": "token"},
+				"signed": map[string]interface{}{"type": "apiKey", "in": "query", "name": "sig", "description": "Signed URL for one path, with the u and exp parameters it was issued with"},
+			},
+		},
+	}
+}
+
+func buildOperation(rt route, op apiOp) map[string]interface{} {
+	o := map[string]interface{}{
+		"summary":     op.Summary,
+		"operationId": operationID(op.Method, rt.docPath()),
+	}
+	if op.Description != "" {
+		o["description"] = op.Description
+	}
+	if !rt.Public {
+		o["security"] = []interface{}{
+			map[string]interface{}{"bearer": []string{}},
+			map[string]interface{}{"token": []string{}},
+		}
+		if rt.Signed {
+			o["security"] = append(o["security"].([]interface{}), map[string]interface{}{"signed": []string{}})
+		}
+	}
+
+	var params []interface{}
+	for _, p := range op.Params {
+		params = append(params, map[string]interface{}{
+			"name":        p.Name,
+			"in":          p.In,
+			"description": p.Description,
+			"required":    p.Required || p.In == "path",
+			"schema":      map[string]interface{}{"type": "string"},
+		})
+	}
+	if len(params) > 0 {
+		o["parameters"] = params
+	}
+
+	switch {
+	case op.Multipart:
+		o["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{"multipart/form-data": map[string]interface{}{
+				"schema": object(props{"file": map[string]interface{}{"type": "string", "format": "binary"}}, "file"),
+			}},
+		}
+	case op.Body != nil:
+		o["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": op.Body}},
+		}
+	}
+
+	responses := map[string]interface{}{}
+	for code, resp := range op.Responses {
+		r := map[string]interface{}{"description": resp.Description}
+		switch {
+		case resp.Raw != "":
+			r["content"] = map[string]interface{}{resp.Raw: map[string]interface{}{"schema": map[string]interface{}{"type": "string", "format": "binary"}}}
+		default:
+			schema := ref("Envelope")
+			if resp.Data != nil {
+				schema = map[string]interface{}{"allOf": []interface{}{
+					ref("Envelope"),
+					object(props{"data": resp.Data}),
+				}}
+			}
+			r["content"] = map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+		}
+		responses[strconv.Itoa(code)] = r
+	}
+	if _, ok := responses["default"]; !ok {
+		responses["default"] = map[string]interface{}{
+			"description": "Error",
+			"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": ref("Envelope")}},
+		}
+	}
+	o["responses"] = responses
+	return o
+}
+
+// operationID turns "GET /jobs/{id}" into "getJobsId".
+func operationID(method, path string) string {
+	id := strings.ToLower(method)
+	for _, part := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '{' || r == '}' || r == '.' }) {
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		replyError(w, r, http.StatusMethodNotAllowed, "use GET method")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(buildOpenAPI(registeredRoutes))
+}
+
+func docsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		replyError(w, r, http.StatusMethodNotAllowed, "use GET method")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(docsPage)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Files remember which user wrote them so per-user quotas can be enforced.
+// Ownership lives in the size index next to the file sizes and is saved to
+// the internal folder, since the filesystem has no notion of HomeCloud
+// users.
+
+func (ix *sizeIndex) ownersFile() string {
+	return filepath.Join(ix.exclude, "owners.json")
+}
+
+func (n *dirNode) setOwner(name, user string) {
+	if user == "" {
+		delete(n.owners, name)
+		return
+	}
+	if n.owners == nil {
+		n.owners = map[string]string{}
+	}
+	n.owners[name] = user
+}
+
+// claim makes user the owner of the file at abs, or of every file in the
+// folder at abs.
+func (ix *sizeIndex) claim(abs, user string) {
+	parts, ok := ix.parts(abs)
+	if !ok || len(parts) == 0 {
+		return
+	}
+	name := parts[len(parts)-1]
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	parent := ix.lookupLocked(parts[:len(parts)-1])
+	if parent == nil {
+		return
+	}
+	if _, ok := parent.files[name]; ok {
+		ix.claimFileLocked(parent, name, user)
+	} else if d := parent.dirs[name]; d != nil {
+		ix.claimTreeLocked(d, user)
+	}
+}
+
+func (ix *sizeIndex) claimFileLocked(n *dirNode, name, user string) {
+	size := n.files[name]
+	if old := n.owners[name]; old != "" {
+		ix.userUsed[old] -= size
+	}
+	n.setOwner(name, user)
+	ix.userUsed[user] += size
+	ix.ownersDirty = true
+}
+
+func (ix *sizeIndex) claimTreeLocked(n *dirNode, user string) {
+	for name := range n.files {
+		ix.claimFileLocked(n, name, user)
+	}
+	for _, d := range n.dirs {
+		ix.claimTreeLocked(d, user)
+	}
+}
+
+func (ix *sizeIndex) disownTreeLocked(n *dirNode) {
+	for name, owner := range n.owners {
+		ix.userUsed[owner] -= n.files[name]
+		ix.ownersDirty = true
+	}
+	for _, d := range n.dirs {
+		ix.disownTreeLocked(d)
+	}
+}
+
+// moved carries the index entry of src over to dst after src was renamed
+// on disk. A rescan of dst would lose who owns the files, and the watcher
+// keeps reporting events of a moved folder under its old path.
+func (ix *sizeIndex) moved(src, dst string) {
+	sp, srcOK := ix.parts(src)
+	dp, dstOK := ix.parts(dst)
+	if !srcOK || !dstOK || len(sp) == 0 || len(dp) == 0 {
+		ix.refresh(src)
+		ix.refresh(dst)
+		return
+	}
+	sname, dname := sp[len(sp)-1], dp[len(dp)-1]
+
+	ix.mu.Lock()
+	from := ix.lookupLocked(sp[:len(sp)-1])
+	to := ix.lookupLocked(dp[:len(dp)-1])
+	if from == nil || to == nil {
+		ix.mu.Unlock()
+		ix.refresh(src)
+		ix.refresh(dst)
+		return
+	}
+	if ix.pending != nil {
+		ix.pending[src] = struct{}{}
+		ix.pending[dst] = struct{}{}
+	}
+
+	// Whatever dst replaced is gone.
+	if _, ok := to.files[dname]; ok {
+		ix.dropFileLocked(to, dname)
+	}
+	if to.dirs[dname] != nil {
+		ix.dropDirLocked(to, dname, dst)
+	}
+
+	if size, ok := from.files[sname]; ok {
+		owner := from.owners[sname]
+		delete(from.files, sname)
+		delete(from.owners, sname)
+		from.grow(-size)
+		to.files[dname] = size
+		to.setOwner(dname, owner)
+		to.grow(size)
+	} else if d := from.dirs[sname]; d != nil {
+		delete(from.dirs, sname)
+		from.grow(-d.total)
+		d.parent = to
+		d.info, _ = os.Lstat(dst)
+		to.dirs[dname] = d
+		to.grow(d.total)
+		forEachDir(d, src, ix.unwatch)
+		forEachDir(d, dst, ix.watch)
+	}
+	ix.ownersDirty = true
+	ix.mu.Unlock()
+
+	// Pick up anything the index did not know about yet.
+	ix.refresh(dst)
+}
+
+// ownersOf returns the owners of the file at abs or of the files in the
+// folder at abs, keyed by their path relative to abs.
+func (ix *sizeIndex) ownersOf(abs string) map[string]string {
+	table := map[string]string{}
+	parts, ok := ix.parts(abs)
+	if !ok || len(parts) == 0 {
+		return table
+	}
+	name := parts[len(parts)-1]
+
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	parent := ix.lookupLocked(parts[:len(parts)-1])
+	if parent == nil {
+		return table
+	}
+	if owner := parent.owners[name]; owner != "" {
+		table["."] = owner
+	} else if d := parent.dirs[name]; d != nil {
+		collectOwners(d, "", table)
+	}
+	return table
+}
+
+func collectOwners(n *dirNode, rel string, table map[string]string) {
+	for name, owner := range n.owners {
+		table[filepath.ToSlash(filepath.Join(rel, name))] = owner
+	}
+	for name, d := range n.dirs {
+		collectOwners(d, filepath.Join(rel, name), table)
+	}
+}
+
+// userUsage is the size of everything user owns.
+func (ix *sizeIndex) userUsage(user string) int64 {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return ix.userUsed[user]
+}
+
+// carryOwners copies ownership from an old index tree onto a rescan of
+// the same folder.
+func carryOwners(old, fresh *dirNode) {
+	for name, owner := range old.owners {
+		if _, ok := fresh.files[name]; ok {
+			fresh.setOwner(name, owner)
+		}
+	}
+	for name, d := range old.dirs {
+		if f := fresh.dirs[name]; f != nil {
+			carryOwners(d, f)
+		}
+	}
+}
+
+func sumOwners(n *dirNode, used map[string]int64) {
+	for name, owner := range n.owners {
+		used[owner] += n.files[name]
+	}
+	for _, d := range n.dirs {
+		sumOwners(d, used)
+	}
+}
+
+// saveOwners writes the ownership table when it changed since the last
+// save. Paths are stored relative to the storage root.
+func (ix *sizeIndex) saveOwners() error {
+	ix.mu.Lock()
+	if !ix.ownersDirty {
+		ix.mu.Unlock()
+		return nil
+	}
+	table := map[string]string{}
+	collectOwners(ix.top, "", table)
+	ix.ownersDirty = false
+	ix.mu.Unlock()
+
+	data, err := json.Marshal(table)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(ix.ownersFile()), 0700); err != nil {
+		return err
+	}
+	tmp := ix.ownersFile() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ix.ownersFile())
+}
+
+// loadOwners applies the table saved by saveOwners. Entries for files that
+// are gone are dropped.
+func (ix *sizeIndex) loadOwners() {
+	data, err := os.ReadFile(ix.ownersFile())
+	if os.IsNotExist(err) {
+		return
+	}
+	var table map[string]string
+	if err == nil {
+		err = json.Unmarshal(data, &table)
+	}
+	if err != nil {
+		log.Printf("Warning: cannot read %s: %v", ix.ownersFile(), err)
+		return
+	}
+	for rel, owner := range table {
+		ix.claim(filepath.Join(ix.root, filepath.FromSlash(rel)), owner)
+	}
+	ix.mu.Lock()
+	ix.ownersDirty = len(table) > 0
+	ix.mu.Unlock()
+}
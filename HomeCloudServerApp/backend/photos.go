@@ -0,0 +1,583 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The photo index keeps the EXIF data of every image in the photo folders
+// (PHOTO_FOLDERS, all storage by default) for the timeline. Like the music
+// library it is built by a background scan, cached in
+// .homecloud/photos.json and kept current by the watchers.
+
+var photoFolderPaths []string
+
+var photoFolders []string // absolute
+
+type photoItem struct {
+	Path        string    `json:"path"`
+	Name        string    `json:"name"`
+	Taken       time.Time `json:"taken"`
+	TakenFrom   string    `json:"taken_from"`
+	Camera      string    `json:"camera,omitempty"`
+	Orientation int       `json:"orientation,omitempty"`
+	Lat         *float64  `json:"lat,omitempty"`
+	Lon         *float64  `json:"lon,omitempty"`
+	Size        int64     `json:"size"`
+	ThumbURL    string    `json:"thumb_url"`
+
+	abs string
+}
+
+type photoCacheEntry struct {
+	Size    int64    `json:"size"`
+	ModTime int64    `json:"mod_time"`
+	Exif    exifData `json:"exif"`
+}
+
+type photoIndex struct {
+	mu     sync.RWMutex
+	photos map[string]*photoItem // by absolute path
+	cache  map[string]photoCacheEntry
+	dirty  bool
+}
+
+var (
+	photos = &photoIndex{
+		photos: map[string]*photoItem{},
+		cache:  map[string]photoCacheEntry{},
+	}
+	photosReady atomic.Bool
+
+	photoEvents   = make(chan string, 4096)
+	photoOverflow atomic.Bool
+)
+
+// thumbSizes are the thumbnail sizes served; requests round up to one.
+var thumbSizes = []int{128, 256, 512, 1024}
+
+// thumbSlots limits how many images are decoded at once.
+var thumbSlots = make(chan struct{}, max(1, runtime.NumCPU()/2))
+
+// maxThumbPixels refuses images whose decoding would take too much memory.
+const maxThumbPixels = 100 << 20
+
+// initPhotos resolves PHOTO_FOLDERS and subscribes to watcher changes. It
+// runs after initRoots.
+func initPhotos() {
+	paths := photoFolderPaths
+	if len(paths) == 0 {
+		for _, rt := range storageRoots {
+			paths = append(paths, rt.virtualPath("."))
+		}
+	}
+	for _, p := range paths {
+		abs, err := resolvePath(p)
+		if err != nil {
+			log.Printf("Warning: PHOTO_FOLDERS entry %q: %v", p, err)
+			continue
+		}
+		photoFolders = append(photoFolders, abs)
+	}
+	onChange(func(abs string) {
+		if !inPhotoFolders(abs) {
+			return
+		}
+		select {
+		case photoEvents <- abs:
+		default:
+			photoOverflow.Store(true)
+		}
+	})
+}
+
+func inPhotoFolders(abs string) bool {
+	for _, f := range photoFolders {
+		if isWithin(f, abs) {
+			return true
+		}
+	}
+	return false
+}
+
+func photoCacheFile() string {
+	return storageRoots[0].internal("photos.json")
+}
+
+// photoIndexer builds the index and then applies watcher changes.
+func photoIndexer(ctx context.Context) {
+	if len(photoFolders) == 0 {
+		return
+	}
+	photos.load()
+	photos.scanAll()
+	photosReady.Store(true)
+	log.Printf("Photo index: %d photos", photos.count())
+	photos.save()
+
+	save := time.NewTicker(time.Minute)
+	defer save.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			photos.save()
+			return
+		case abs := <-photoEvents:
+			photos.update(abs)
+		case <-save.C:
+			if photoOverflow.Swap(false) {
+				photos.scanAll()
+			}
+			photos.save()
+		}
+	}
+}
+
+func (ix *photoIndex) scanAll() {
+	done := make(chan map[string]bool)
+	go func() {
+		runtime.LockOSThread()
+		lowerIOPriority()
+		seen := map[string]bool{}
+		for _, f := range photoFolders {
+			ix.scanTree(f, seen)
+		}
+		done <- seen
+	}()
+	seen := <-done
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	for abs := range ix.photos {
+		if !seen[abs] {
+			delete(ix.photos, abs)
+			ix.dirty = true
+		}
+	}
+	for abs := range ix.cache {
+		if !seen[abs] {
+			delete(ix.cache, abs)
+			ix.dirty = true
+		}
+	}
+}
+
+func (ix *photoIndex) scanTree(root string, seen map[string]bool) {
+	var n int
+	filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if strings.EqualFold(d.Name(), internalDirName) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !photoExts[strings.ToLower(filepath.Ext(p))] {
+			return nil
+		}
+		if n++; n%reconcileYieldEvery == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if info, err := d.Info(); err == nil {
+			ix.index(p, info)
+			if seen != nil {
+				seen[p] = true
+			}
+		}
+		return nil
+	})
+}
+
+// update applies a watcher change of abs.
+func (ix *photoIndex) update(abs string) {
+	info, err := os.Lstat(abs)
+	switch {
+	case err != nil:
+		ix.mu.Lock()
+		prefix := abs + string(filepath.Separator)
+		for p := range ix.photos {
+			if p == abs || strings.HasPrefix(p, prefix) {
+				delete(ix.photos, p)
+				delete(ix.cache, p)
+				removeThumbs(p)
+				ix.dirty = true
+			}
+		}
+		ix.mu.Unlock()
+	case info.IsDir():
+		ix.scanTree(abs, nil)
+	case info.Mode().IsRegular() && photoExts[strings.ToLower(filepath.Ext(abs))]:
+		ix.index(abs, info)
+	}
+}
+
+func (ix *photoIndex) index(abs string, info os.FileInfo) {
+	ix.mu.RLock()
+	entry, ok := ix.cache[abs]
+	_, indexed := ix.photos[abs]
+	ix.mu.RUnlock()
+	fresh := ok && entry.Size == info.Size() && entry.ModTime == info.ModTime().UnixNano()
+	if fresh && indexed {
+		return
+	}
+	if !fresh {
+		x, err := readExif(abs)
+		if err != nil && err != errNoExif {
+			log.Printf("Photo index: reading %s: %v", relFromAbs(abs), err)
+		}
+		entry = photoCacheEntry{Size: info.Size(), ModTime: info.ModTime().UnixNano(), Exif: x}
+	}
+
+	p := newPhotoItem(abs, entry)
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.photos[abs] = p
+	if !fresh {
+		ix.cache[abs] = entry
+		ix.dirty = true
+	}
+}
+
+func newPhotoItem(abs string, e photoCacheEntry) *photoItem {
+	x := e.Exif
+	rel := relFromAbs(abs)
+	p := &photoItem{
+		Path:        rel,
+		Name:        filepath.Base(abs),
+		Taken:       x.Taken,
+		TakenFrom:   "exif",
+		Orientation: x.Orientation,
+		Lat:         x.Lat,
+		Lon:         x.Lon,
+		Size:        e.Size,
+		ThumbURL:    "/photos/thumb/" + escapePath(rel),
+		abs:         abs,
+	}
+	if p.Taken.IsZero() {
+		p.Taken = time.Unix(0, e.ModTime).UTC()
+		p.TakenFrom = "file"
+	}
+	p.Camera = x.Model
+	if x.Make != "" && !strings.HasPrefix(strings.ToLower(x.Model), strings.ToLower(x.Make)) {
+		p.Camera = strings.TrimSpace(x.Make + " " + x.Model)
+	}
+	return p
+}
+
+func (ix *photoIndex) count() int {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return len(ix.photos)
+}
+
+func (ix *photoIndex) load() {
+	data, err := os.ReadFile(photoCacheFile())
+	if err != nil {
+		return
+	}
+	var cache map[string]photoCacheEntry
+	if err := json.Unmarshal(data, &cache); err != nil {
+		log.Printf("Warning: cannot read %s: %v", photoCacheFile(), err)
+		return
+	}
+	ix.mu.Lock()
+	ix.cache = cache
+	ix.mu.Unlock()
+}
+
+func (ix *photoIndex) save() {
+	ix.mu.Lock()
+	if !ix.dirty {
+		ix.mu.Unlock()
+		return
+	}
+	data, err := json.Marshal(ix.cache)
+	ix.dirty = false
+	ix.mu.Unlock()
+	if err != nil {
+		return
+	}
+	file := photoCacheFile()
+	tmp := file + ".tmp"
+	os.MkdirAll(filepath.Dir(file), 0700)
+	if err := os.WriteFile(tmp, data, 0600); err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		log.Printf("Saving photo index: %v", err)
+	}
+}
+
+// photoDay is one date of the timeline.
+type photoDay struct {
+	Date   string       `json:"date"`
+	Count  int          `json:"count"`
+	Photos []*photoItem `json:"photos"`
+}
+
+// photoTimelineHandler lists the photos newest first, grouped by the date
+// they were taken on, optionally only those of ?year= and ?month=.
+func photoTimelineHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		replyError(w, r, http.StatusMethodNotAllowed, "use GET method")
+		return
+	}
+	q := r.URL.Query()
+	var year, month int
+	var err error
+	if s := q.Get("year"); s != "" {
+		if year, err = strconv.Atoi(s); err != nil {
+			replyError(w, r, http.StatusBadRequest, "Invalid year")
+			return
+		}
+	}
+	if s := q.Get("month"); s != "" {
+		if month, err = strconv.Atoi(s); err != nil || month < 1 || month > 12 {
+			replyError(w, r, http.StatusBadRequest, "Invalid month")
+			return
+		}
+	}
+
+	photos.mu.RLock()
+	var list []*photoItem
+	for _, p := range photos.photos {
+		if (year == 0 || p.Taken.Year() == year) && (month == 0 || int(p.Taken.Month()) == month) {
+			list = append(list, p)
+		}
+	}
+	photos.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Taken.Equal(list[j].Taken) {
+			return list[i].Taken.After(list[j].Taken)
+		}
+		return list[i].Path < list[j].Path
+	})
+
+	days := []*photoDay{}
+	for _, p := range list {
+		// The date on the camera's clock, not the server's.
+		date := p.Taken.Format("2006-01-02")
+		if len(days) == 0 || days[len(days)-1].Date != date {
+			days = append(days, &photoDay{Date: date})
+		}
+		d := days[len(days)-1]
+		d.Photos = append(d.Photos, p)
+		d.Count++
+	}
+	from, to := page(r, len(days))
+	markIndexing(w, &photosReady)
+	reply(w, r, http.StatusOK, "", days[from:to])
+}
+
+// photoThumbHandler serves a JPEG thumbnail of an image, turned upright by
+// its EXIF orientation. Thumbnails are cached next to the HLS segments.
+func photoThumbHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		replyError(w, r, http.StatusMethodNotAllowed, "use GET method")
+		return
+	}
+	abs, err := resolveItemPath(strings.TrimPrefix(r.URL.Path, "/photos/thumb/"))
+	if err != nil {
+		replyOpError(w, r, err)
+		return
+	}
+	info, err := os.Stat(abs)
+	if err != nil || info.IsDir() {
+		replyError(w, r, http.StatusNotFound, "Not found")
+		return
+	}
+	ext := strings.ToLower(filepath.Ext(abs))
+	if !photoExts[ext] && ext != ".gif" {
+		replyError(w, r, http.StatusUnsupportedMediaType, "Not an image")
+		return
+	}
+	size := thumbSizes[len(thumbSizes)-1]
+	if s, err := strconv.Atoi(r.URL.Query().Get("size")); err == nil {
+		for _, ts := range thumbSizes {
+			if ts >= s {
+				size = ts
+				break
+			}
+		}
+	} else {
+		size = 256
+	}
+
+	cached := thumbPath(abs, size)
+	if ti, err := os.Stat(cached); err != nil || ti.ModTime().Before(info.ModTime()) {
+		if err := makeThumb(abs, cached, size); err != nil {
+			log.Printf("Thumbnail of %s: %v", relFromAbs(abs), err)
+			replyError(w, r, http.StatusUnsupportedMediaType, "Cannot make a thumbnail of this image")
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	http.ServeFile(w, r, cached)
+}
+
+func thumbPath(abs string, size int) string {
+	return internalPathFor(abs, "thumbs", fmt.Sprintf("%s-%d.jpg", shortHash(relFromAbs(abs)), size))
+}
+
+func removeThumbs(abs string) {
+	for _, size := range thumbSizes {
+		os.Remove(thumbPath(abs, size))
+	}
+}
+
+func makeThumb(src, dst string, size int) error {
+	thumbSlots <- struct{}{}
+	defer func() { <-thumbSlots }()
+
+	x, _ := readExif(src)
+	var img image.Image
+	ext := strings.ToLower(filepath.Ext(src))
+	if ext == ".heic" || ext == ".heif" {
+		// No HEVC decoder in the standard library: use the JPEG preview
+		// the EXIF data carries, if any.
+		if x.ThumbLength == 0 {
+			return fmt.Errorf("no embedded preview")
+		}
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		data := make([]byte, x.ThumbLength)
+		_, err = f.ReadAt(data, x.ThumbOffset)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if img, err = jpeg.Decode(bytes.NewReader(data)); err != nil {
+			return err
+		}
+	} else {
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		cfg, _, err := image.DecodeConfig(f)
+		if err != nil {
+			return err
+		}
+		if cfg.Width*cfg.Height > maxThumbPixels {
+			return fmt.Errorf("image too large (%dx%d)", cfg.Width, cfg.Height)
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if img, _, err = image.Decode(f); err != nil {
+			return err
+		}
+	}
+	img = orient(scaleDown(img, size), x.Orientation)
+
+	// Concurrent requests for the same thumbnail each write their own
+	// file; whichever is renamed last wins with identical content.
+	os.MkdirAll(filepath.Dir(dst), 0700)
+	out, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := out.Name()
+	err = jpeg.Encode(out, img, &jpeg.Options{Quality: 82})
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// scaleDown shrinks img to fit size x size, averaging the source pixels
+// each target pixel covers. Smaller images are only copied.
+func scaleDown(img image.Image, size int) *image.RGBA {
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	dw, dh := sw, sh
+	if sw > size || sh > size {
+		if sw >= sh {
+			dw, dh = size, max(1, sh*size/sw)
+		} else {
+			dw, dh = max(1, sw*size/sh), size
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*sh/dh, max((y+1)*sh/dh, y*sh/dh+1)
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*sw/dw, max((x+1)*sw/dw, x*sw/dw+1)
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(b.Min.X+sx, b.Min.Y+sy).RGBA()
+					r, g, bl, a, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{uint8(r / n >> 8), uint8(g / n >> 8), uint8(bl / n >> 8), uint8(a / n >> 8)})
+		}
+	}
+	return dst
+}
+
+// orient applies an EXIF orientation (1-8) so the image is upright.
+func orient(img *image.RGBA, o int) *image.RGBA {
+	if o < 2 || o > 8 {
+		return img
+	}
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	dw, dh := w, h
+	if o >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch o {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			dst.SetRGBA(dx, dy, img.RGBAAt(x, y))
+		}
+	}
+	return dst
+}
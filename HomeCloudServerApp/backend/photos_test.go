@@ -0,0 +1,69 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestMakeThumbConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "photo.png")
+	img := image.NewRGBA(image.Rect(0, 0, 640, 480))
+	for y := 0; y < 480; y++ {
+		for x := 0; x < 640; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 0, 255})
+		}
+	}
+	f, err := os.Create(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	png.Encode(f, img)
+	f.Close()
+
+	// Enough slots that the requests really run at once.
+	old := thumbSlots
+	thumbSlots = make(chan struct{}, 8)
+	t.Cleanup(func() { thumbSlots = old })
+
+	dst := filepath.Join(dir, "thumbs", "photo.jpg")
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- makeThumb(src, dst, 200)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("makeThumb: %v", err)
+		}
+	}
+
+	out, err := os.Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	cfg, err := jpeg.DecodeConfig(out)
+	if err != nil {
+		t.Fatalf("thumbnail is not a JPEG: %v", err)
+	}
+	if cfg.Width != 200 || cfg.Height != 150 {
+		t.Errorf("thumbnail is %dx%d, want 200x150", cfg.Width, cfg.Height)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(dst))
+	if len(entries) != 1 {
+		t.Errorf("thumbnail folder has %d entries, want only the thumbnail", len(entries))
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Music playlists belong to the user who created them; public ones are
+// visible to everyone. They store track paths, so they survive a rebuild of
+// the library, and are kept in .homecloud/playlists.json of the first root.
+
+type musicPlaylist struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Owner   string    `json:"owner"`
+	Public  bool      `json:"public"`
+	Paths   []string  `json:"paths"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// playlistView is a playlist as the API returns it.
+type playlistView struct {
+	*musicPlaylist
+	TrackCount int           `json:"track_count"`
+	Duration   float64       `json:"duration"`
+	Tracks     []*musicTrack `json:"tracks,omitempty"`
+}
+
+var (
+	playlistsMu sync.Mutex
+	playlists   []*musicPlaylist
+)
+
+func playlistsFile() string {
+	return storageRoots[0].internal("playlists.json")
+}
+
+func loadPlaylists() {
+	data, err := os.ReadFile(playlistsFile())
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, &playlists); err != nil {
+		log.Printf("Warning: cannot read %s: %v", playlistsFile(), err)
+	}
+}
+
+// savePlaylistsLocked writes the playlists; playlistsMu must be held.
+func savePlaylistsLocked() error {
+	data, err := json.MarshalIndent(playlists, "", "  ")
+	if err != nil {
+		return err
+	}
+	file := playlistsFile()
+	os.MkdirAll(filepath.Dir(file), 0700)
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// playlistTracks resolves the paths of p to library tracks, skipping files
+// that are gone.
+func playlistTracks(p *musicPlaylist) []*musicTrack {
+	library.mu.RLock()
+	defer library.mu.RUnlock()
+	tracks := []*musicTrack{}
+	for _, rel := range p.Paths {
+		if t := library.byID[shortHash("track:"+rel)]; t != nil {
+			tracks = append(tracks, t)
+		}
+	}
+	return tracks
+}
+
+func viewPlaylist(p *musicPlaylist, withTracks bool) playlistView {
+	tracks := playlistTracks(p)
+	v := playlistView{musicPlaylist: p, TrackCount: len(tracks)}
+	for _, t := range tracks {
+		v.Duration += t.Duration
+	}
+	if withTracks {
+		v.Tracks = tracks
+	}
+	return v
+}
+
+// playlistRequest is the body of POST and PUT. Tracks are library track IDs.
+type playlistRequest struct {
+	Name   *string   `json:"name"`
+	Public *bool     `json:"public"`
+	Tracks *[]string `json:"tracks"`
+}
+
+func (req playlistRequest) apply(p *musicPlaylist) error {
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" {
+			return opFail(http.StatusBadRequest, "Name is required")
+		}
+		p.Name = name
+	}
+	if req.Public != nil {
+		p.Public = *req.Public
+	}
+	if req.Tracks != nil {
+		paths := make([]string, 0, len(*req.Tracks))
+		for _, id := range *req.Tracks {
+			t := library.track(id)
+			if t == nil {
+				return opFail(http.StatusBadRequest, fmt.Sprintf("Unknown track %q", id))
+			}
+			paths = append(paths, t.Path)
+		}
+		p.Paths = paths
+	}
+	p.Updated = time.Now()
+	return nil
+}
+
+func musicPlaylistsHandler(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	switch r.Method {
+	case "GET":
+		playlistsMu.Lock()
+		list := []playlistView{}
+		for _, p := range playlists {
+			if p.Owner == user || p.Public {
+				list = append(list, viewPlaylist(p, false))
+			}
+		}
+		playlistsMu.Unlock()
+		reply(w, r, http.StatusOK, "", list)
+
+	case "POST":
+		var req playlistRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == nil {
+			replyError(w, r, http.StatusBadRequest, "Bad request")
+			return
+		}
+		p := &musicPlaylist{ID: newID(), Owner: user, Paths: []string{}, Created: time.Now()}
+		if err := req.apply(p); err != nil {
+			replyOpError(w, r, err)
+			return
+		}
+		playlistsMu.Lock()
+		playlists = append(playlists, p)
+		err := savePlaylistsLocked()
+		v := viewPlaylist(p, true)
+		playlistsMu.Unlock()
+		if err != nil {
+			replyOpError(w, r, err)
+			return
+		}
+		reply(w, r, http.StatusCreated, "Playlist created", v)
+
+	default:
+		replyError(w, r, http.StatusMethodNotAllowed, "use GET or POST method")
+	}
+}
+
+// musicPlaylistHandler serves /music/playlists/<id>. With ?format=m3u8 a
+// GET returns the playlist for media players, pointing at /stream.
+func musicPlaylistHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/music/playlists/")
+	user := requestUser(r)
+
+	playlistsMu.Lock()
+	defer playlistsMu.Unlock()
+	idx := -1
+	for i, p := range playlists {
+		if p.ID == id && (p.Owner == user || p.Public || user == adminUser) {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		replyError(w, r, http.StatusNotFound, "Playlist not found")
+		return
+	}
+	p := playlists[idx]
+	if r.Method != "GET" && p.Owner != user && user != adminUser {
+		replyError(w, r, http.StatusForbidden, "Only the owner can change this playlist")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		if r.URL.Query().Get("format") == "m3u8" {
+			writeM3U(w, r, p.Name, playlistTracks(p))
+			return
+		}
+		reply(w, r, http.StatusOK, "", viewPlaylist(p, true))
+
+	case "PUT":
+		var req playlistRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			replyError(w, r, http.StatusBadRequest, "Bad request")
+			return
+		}
+		updated := *p
+		if err := req.apply(&updated); err != nil {
+			replyOpError(w, r, err)
+			return
+		}
+		playlists[idx] = &updated
+		if err := savePlaylistsLocked(); err != nil {
+			playlists[idx] = p
+			replyOpError(w, r, err)
+			return
+		}
+		reply(w, r, http.StatusOK, "Playlist updated", viewPlaylist(&updated, true))
+
+	case "DELETE":
+		playlists = append(playlists[:idx:idx], playlists[idx+1:]...)
+		if err := savePlaylistsLocked(); err != nil {
+			replyOpError(w, r, err)
+			return
+		}
+		reply(w, r, http.StatusOK, "Playlist deleted", nil)
+
+	default:
+		replyError(w, r, http.StatusMethodNotAllowed, "use GET, PUT or DELETE method")
+	}
+}
+
+// writeM3U writes tracks as an extended M3U playlist. The stream URLs are
+// signed for the caller like those of the folder playlists, so the token
+// never ends up in a file players save.
+func writeM3U(w http.ResponseWriter, r *http.Request, name string, tracks []*musicTrack) {
+	w.Header().Set("Content-Type", "audio/x-mpegurl; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	base, user, exp := externalURL(r), requestUser(r), time.Now().Add(playlistURLTTL)
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	fmt.Fprintf(&b, "#PLAYLIST:%s\n", name)
+	for _, t := range tracks {
+		fmt.Fprintf(&b, "#EXTINF:%d,%s - %s\n", int(t.Duration+0.5), t.Artist, t.Title)
+		b.WriteString(base + t.StreamURL + signedQuery(user, t.Path, "", exp) + "\n")
+	}
+	w.Write([]byte(b.String()))
+}
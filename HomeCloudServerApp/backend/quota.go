@@ -0,0 +1,375 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const gb = 1024 * 1024 * 1024
+
+// The quota ledger. cachedDirSize only catches up with the disk after the
+// watcher has seen a write, so every writer reserves its bytes here first;
+// concurrent writers then see each other's reservations and cannot pass
+// the quota together.
+//
+// Every storage root has its own limit (storageQuotaGB unless STORAGE_ROOTS
+// sets one); users (USERS) and top-level folders (FOLDER_QUOTAS) can have
+// their own limits on top.
+var (
+	quotaMu sync.Mutex
+	// storageQuotaGB is the limit of every root without one of its own.
+	// /settings changes it at runtime.
+	storageQuotaGB   = 50
+	reservedBytes    int64
+	reservedByUser   = map[string]int64{}
+	reservedByFolder = map[string]int64{}
+
+	userQuotaGB   = map[string]int{}
+	folderQuotaGB = map[string]int{}
+)
+
+// quotaReservation is space promised to one write. Exactly one of commit
+// or release must be called; further calls are no-ops.
+type quotaReservation struct {
+	bytes  int64
+	root   *storageRoot
+	user   string
+	folder string
+	done   bool
+}
+
+// quotaLimit is the sum of the limits of all roots.
+func quotaLimit() int64 {
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	var total int64
+	for _, rt := range storageRoots {
+		total += rt.quotaLimit()
+	}
+	return total
+}
+
+// parseFolderQuotas reads FOLDER_QUOTAS, e.g.
+//
+//	FOLDER_QUOTAS=Camera Uploads:200,Music:50
+//
+// With STORAGE_ROOTS the folder includes its root: ssd/Camera Uploads:200.
+func parseFolderQuotas(val string) (map[string]int, error) {
+	quotas := map[string]int{}
+	for _, entry := range strings.Split(val, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("FOLDER_QUOTAS entry %q: want folder:quotaGB", entry)
+		}
+		name, err := cleanRelPath(entry[:i])
+		if err == nil {
+			name = filepath.ToSlash(name)
+		}
+		if err != nil || !validTopFolder(name) {
+			return nil, fmt.Errorf("FOLDER_QUOTAS entry %q: not a top-level folder", entry)
+		}
+		n, err := strconv.Atoi(entry[i+1:])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("FOLDER_QUOTAS entry %q: invalid quota", entry)
+		}
+		quotas[name] = n
+	}
+	return quotas, nil
+}
+
+// topFolder is the client path of the top-level folder abs lies in, or of
+// the entry itself: the first path element below the root, prefixed with
+// the root name when there are several roots.
+func topFolder(abs string) string {
+	rel := relFromAbs(abs)
+	n := 1
+	if multiRoot() {
+		n = 2
+	}
+	parts := strings.SplitN(rel, "/", n+1)
+	if len(parts) > n {
+		parts = parts[:n]
+	}
+	return strings.Join(parts, "/")
+}
+
+// validTopFolder reports whether a clean slash-separated path can name a
+// top-level folder.
+func validTopFolder(name string) bool {
+	if name == "." {
+		return false
+	}
+	if !multiRoot() {
+		return !strings.Contains(name, "/")
+	}
+	root, rest, ok := strings.Cut(name, "/")
+	if !ok || strings.Contains(rest, "/") {
+		return false
+	}
+	rt, _, err := splitRoot(root)
+	return err == nil && rt != nil
+}
+
+func folderUsage(folder string) int64 {
+	if folder == "" || !watcherReady.Load() {
+		return 0
+	}
+	abs, err := resolvePath(folder)
+	if err != nil {
+		return 0
+	}
+	size, _ := folderSize(abs)
+	return size
+}
+
+// userUsage is the size of everything user owns on all roots.
+func userUsage(user string) int64 {
+	if user == "" || !watcherReady.Load() {
+		return 0
+	}
+	var total int64
+	for _, rt := range storageRoots {
+		total += rt.index.userUsage(user)
+	}
+	return total
+}
+
+// rootUsed is what is stored on rt. Before the watcher has sized the roots
+// it falls back to the last published total.
+func rootUsed(rt *storageRoot) int64 {
+	if watcherReady.Load() {
+		return rt.index.total()
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	if len(storageRoots) == 1 {
+		return cachedDirSize
+	}
+	return 0
+}
+
+// fitsQuota reports whether every root can still take extra more bytes,
+// counting both stored and reserved bytes.
+func fitsQuota(extra int64) bool {
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	for _, rt := range storageRoots {
+		if rootUsed(rt)+rt.reserved+extra > rt.quotaLimit() {
+			return false
+		}
+	}
+	return true
+}
+
+// reserveQuota sets aside n bytes that user is about to write to dst, or
+// fails with 507 when they do not fit the root, user or folder quota.
+func reserveQuota(n int64, user, dst string) (*quotaReservation, error) {
+	return reserve(&quotaReservation{bytes: n, root: rootOf(dst), user: user, folder: topFolder(dst)})
+}
+
+// reserveMove checks moving the entry at src to dst against the folder
+// quota of dst, and against the quota of the root of dst when the move
+// crosses roots. Moves never change who owns the files, so only a move into
+// another top-level folder needs a reservation; otherwise the result is
+// nil, which is safe to commit or release.
+func reserveMove(src, dst string) (*quotaReservation, error) {
+	folder := topFolder(dst)
+	if folder == topFolder(src) {
+		return nil, nil
+	}
+	var root *storageRoot
+	if rt := rootOf(dst); rt != rootOf(src) {
+		root = rt
+	}
+	var size int64
+	if info, err := os.Lstat(src); err == nil && !info.IsDir() {
+		size = info.Size()
+	} else {
+		size, _ = folderSize(src)
+	}
+	return reserve(&quotaReservation{bytes: size, root: root, folder: folder})
+}
+
+func reserve(res *quotaReservation) (*quotaReservation, error) {
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+
+	if rt := res.root; rt != nil {
+		if rootUsed(rt)+rt.reserved+res.bytes > rt.quotaLimit() {
+			limit := rt.quotaLimit() / gb
+			if rt.Name == "" {
+				log.Printf("Write of %d bytes rejected: Quota exceeded (%d GB, %d bytes reserved)", res.bytes, limit, rt.reserved)
+				return nil, opFail(http.StatusInsufficientStorage, fmt.Sprintf("Storage quota exceeded (%d GB)", limit))
+			}
+			log.Printf("Write of %d bytes rejected: Quota of root %s exceeded (%d GB, %d bytes reserved)", res.bytes, rt.Name, limit, rt.reserved)
+			return nil, opFail(http.StatusInsufficientStorage, fmt.Sprintf("Storage quota of %s exceeded (%d GB)", rt.Name, limit))
+		}
+	}
+	if limit, ok := userQuotaGB[res.user]; ok {
+		if userUsage(res.user)+reservedByUser[res.user]+res.bytes > int64(limit)*gb {
+			log.Printf("Write of %d bytes rejected: Quota of user %s exceeded (%d GB)", res.bytes, res.user, limit)
+			return nil, opFail(http.StatusInsufficientStorage, fmt.Sprintf("Your storage quota is exceeded (%d GB)", limit))
+		}
+	}
+	if limit, ok := folderQuotaGB[res.folder]; ok {
+		if folderUsage(res.folder)+reservedByFolder[res.folder]+res.bytes > int64(limit)*gb {
+			log.Printf("Write of %d bytes rejected: Quota of folder %s exceeded (%d GB)", res.bytes, res.folder, limit)
+			return nil, opFail(http.StatusInsufficientStorage, fmt.Sprintf("Storage quota of %s exceeded (%d GB)", res.folder, limit))
+		}
+	}
+
+	if res.root != nil {
+		res.root.reserved += res.bytes
+		reservedBytes += res.bytes
+	}
+	reservedByUser[res.user] += res.bytes
+	reservedByFolder[res.folder] += res.bytes
+	return res, nil
+}
+
+// commit accounts the written paths in the size index, records who owns
+// them and then drops the reservation, so the bytes are never missing from
+// both.
+func (res *quotaReservation) commit(paths ...string) {
+	if res == nil {
+		return
+	}
+	if watcherReady.Load() {
+		for _, p := range paths {
+			rt := rootOf(p)
+			if rt == nil {
+				continue
+			}
+			rt.index.refresh(p)
+			if res.user != "" {
+				rt.index.claim(p, res.user)
+			}
+		}
+		publishDirSize()
+	}
+	res.release()
+}
+
+// release drops the reservation of a write that failed or wrote nothing.
+func (res *quotaReservation) release() {
+	if res == nil {
+		return
+	}
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	if res.done {
+		return
+	}
+	if res.root != nil {
+		res.root.reserved -= res.bytes
+		reservedBytes -= res.bytes
+	}
+	reservedByUser[res.user] -= res.bytes
+	reservedByFolder[res.folder] -= res.bytes
+	res.done = true
+}
+
+// quotaUsage returns stored and reserved bytes.
+func quotaUsage() (used, reserved int64) {
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	mu.RLock()
+	defer mu.RUnlock()
+	return cachedDirSize, reservedBytes
+}
+
+type quotaStatus struct {
+	Name     string `json:"name"`
+	QuotaGB  int    `json:"quota_gb,omitempty"`
+	Limit    int64  `json:"limit,omitempty"`
+	Used     int64  `json:"used"`
+	Reserved int64  `json:"reserved"`
+	Free     int64  `json:"free,omitempty"`
+}
+
+func newQuotaStatus(name string, quotaGB int, used, reserved int64) quotaStatus {
+	s := quotaStatus{Name: name, QuotaGB: quotaGB, Used: used, Reserved: reserved}
+	if quotaGB > 0 {
+		s.Limit = int64(quotaGB) * gb
+		if s.Free = s.Limit - used - reserved; s.Free < 0 {
+			s.Free = 0
+		}
+	}
+	return s
+}
+
+// quotaReport lists usage against the limits of every user and of every
+// folder that has a quota.
+func quotaReport() map[string]interface{} {
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+
+	names := []string{adminUser}
+	for _, u := range userAccounts {
+		names = append(names, u.Name)
+	}
+	users := make([]quotaStatus, 0, len(names))
+	for _, name := range names {
+		users = append(users, newQuotaStatus(name, userQuotaGB[name], userUsage(name), reservedByUser[name]))
+	}
+
+	folderNames := make([]string, 0, len(folderQuotaGB))
+	for name := range folderQuotaGB {
+		folderNames = append(folderNames, name)
+	}
+	sort.Strings(folderNames)
+	folders := make([]quotaStatus, 0, len(folderNames))
+	for _, name := range folderNames {
+		folders = append(folders, newQuotaStatus(name, folderQuotaGB[name], folderUsage(name), reservedByFolder[name]))
+	}
+
+	report := map[string]interface{}{"users": users, "folders": folders}
+	if multiRoot() {
+		roots := make([]quotaStatus, 0, len(storageRoots))
+		for _, rt := range storageRoots {
+			roots = append(roots, newQuotaStatus(rt.Name, int(rt.quotaLimit()/gb), rootUsed(rt), rt.reserved))
+		}
+		report["roots"] = roots
+	}
+	return report
+}
+
+// applyQuotas merges changes into quotas; 0 removes a limit.
+func applyQuotas(quotas, changes map[string]int) {
+	for name, q := range changes {
+		if q == 0 {
+			delete(quotas, name)
+		} else {
+			quotas[name] = q
+		}
+	}
+}
+
+func currentSettings() map[string]interface{} {
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	users := make(map[string]int, len(userQuotaGB))
+	for k, v := range userQuotaGB {
+		users[k] = v
+	}
+	folders := make(map[string]int, len(folderQuotaGB))
+	for k, v := range folderQuotaGB {
+		folders[k] = v
+	}
+	return map[string]interface{}{
+		"storage_quota_gb": storageQuotaGB,
+		"user_quotas_gb":   users,
+		"folder_quotas_gb": folders,
+	}
+}
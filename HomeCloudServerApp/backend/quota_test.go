@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestSettingsWhileReserving changes the storage quota while uploads
+// reserve space; run it with -race.
+func TestSettingsWhileReserving(t *testing.T) {
+	root := testRoot(t)
+	quotaMu.Lock()
+	old := storageQuotaGB
+	quotaMu.Unlock()
+	t.Cleanup(func() {
+		quotaMu.Lock()
+		storageQuotaGB = old
+		quotaMu.Unlock()
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			r := httptest.NewRequest("POST", "/settings", strings.NewReader(fmt.Sprintf(`{"storage_quota_gb": %d}`, 10+i%5)))
+			r = r.WithContext(context.WithValue(r.Context(), ctxUser, adminUser))
+			rec := httptest.NewRecorder()
+			settingsHandler(rec, r)
+			if rec.Code != http.StatusOK {
+				t.Errorf("settings: status %d", rec.Code)
+				return
+			}
+		}
+	}()
+
+	dst := filepath.Join(root, "dir", "new.txt")
+	for i := 0; i < 200; i++ {
+		res, err := reserveQuota(1, adminUser, dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.release()
+		fitsQuota(1)
+		quotaLimit()
+	}
+	wg.Wait()
+
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	if storageQuotaGB != 10+199%5 {
+		t.Errorf("storage quota %d GB, want the last setting", storageQuotaGB)
+	}
+}
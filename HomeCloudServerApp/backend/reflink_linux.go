@@ -0,0 +1,17 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+const reflinkSupported = true
+
+// reflinkFile makes dst share src's extents (FICLONE). It only succeeds on
+// filesystems with copy-on-write support such as btrfs or XFS.
+func reflinkFile(dst, src *os.File) error {
+	return unix.IoctlFileClone(int(dst.Fd()), int(src.Fd()))
+}
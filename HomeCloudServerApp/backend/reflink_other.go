@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+const reflinkSupported = false
+
+func reflinkFile(dst, src *os.File) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// storageRoot is a folder files are stored in. Without STORAGE_ROOTS there
+// is a single unnamed root at WATCH_DIR and client paths are relative to
+// it. With STORAGE_ROOTS, e.g.
+//
+//	STORAGE_ROOTS=ssd:/data,archive:/mnt/hdd:2000
+//
+// the first element of every client path names the root ("ssd/photos").
+// Each root has its own quota (STORAGE_QUOTA_GB unless given), size index,
+// watcher and internal folder.
+type storageRoot struct {
+	Name    string
+	Dir     string
+	QuotaGB int
+
+	index *sizeIndex
+	// reserved is guarded by quotaMu.
+	reserved int64
+}
+
+var storageRoots []*storageRoot
+
+// parseStorageRoots reads STORAGE_ROOTS. Entries are name:path[:quotaGB];
+// the path may itself contain colons (C:\data).
+func parseStorageRoots(val string) ([]*storageRoot, error) {
+	var roots []*storageRoot
+	seen := map[string]bool{}
+	for _, entry := range strings.Split(val, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, dir, ok := strings.Cut(entry, ":")
+		if !ok || name == "" || dir == "" {
+			return nil, fmt.Errorf("STORAGE_ROOTS entry %q: want name:path[:quotaGB]", entry)
+		}
+		if clean, err := cleanRelPath(name); err != nil || clean != name || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+			return nil, fmt.Errorf("STORAGE_ROOTS entry %q: invalid name", entry)
+		}
+		if seen[strings.ToLower(name)] {
+			return nil, fmt.Errorf("STORAGE_ROOTS entry %q: duplicate name", entry)
+		}
+		seen[strings.ToLower(name)] = true
+
+		rt := &storageRoot{Name: name, Dir: dir}
+		if i := strings.LastIndex(dir, ":"); i > 0 {
+			if q, err := strconv.Atoi(dir[i+1:]); err == nil {
+				if q < 1 {
+					return nil, fmt.Errorf("STORAGE_ROOTS entry %q: invalid quota", entry)
+				}
+				rt.Dir, rt.QuotaGB = dir[:i], q
+			}
+		}
+		roots = append(roots, rt)
+	}
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("STORAGE_ROOTS is empty")
+	}
+	return roots, nil
+}
+
+// initRoots creates the configured roots, or the single WATCH_DIR root
+// when STORAGE_ROOTS is not set.
+func initRoots() {
+	if len(storageRoots) == 0 {
+		storageRoots = []*storageRoot{{Dir: watchDir}}
+	}
+	for _, rt := range storageRoots {
+		abs, err := filepath.Abs(rt.Dir)
+		if err == nil {
+			rt.Dir = abs
+		}
+		os.MkdirAll(rt.Dir, os.ModePerm)
+		rt.index = newSizeIndex(rt.Dir, rt.internal(), func(string) {}, func(string) {})
+	}
+}
+
+// multiRoot reports whether client paths start with a root name.
+func multiRoot() bool {
+	return len(storageRoots) > 0 && storageRoots[0].Name != ""
+}
+
+// splitRoot finds the root a clean client path lives on and the path
+// inside it. In multi-root mode "." (the list of roots) has no root and
+// yields nil.
+func splitRoot(clean string) (*storageRoot, string, error) {
+	if !multiRoot() {
+		return storageRoots[0], clean, nil
+	}
+	if clean == "." {
+		return nil, ".", nil
+	}
+	first, rest, _ := strings.Cut(clean, string(filepath.Separator))
+	for _, rt := range storageRoots {
+		if rt.Name == first {
+			if rest == "" {
+				rest = "."
+			}
+			return rt, rest, nil
+		}
+	}
+	return nil, "", opFail(http.StatusNotFound, "Storage root not found: "+first)
+}
+
+// rootOf returns the root abs lies on, or nil.
+func rootOf(abs string) *storageRoot {
+	var best *storageRoot
+	for _, rt := range storageRoots {
+		if isWithin(rt.Dir, abs) && (best == nil || len(rt.Dir) > len(best.Dir)) {
+			best = rt
+		}
+	}
+	return best
+}
+
+// internal returns a path inside the root's internalDirName. Scratch files
+// go on the root they end up on, so the final rename stays on one
+// filesystem.
+func (rt *storageRoot) internal(elem ...string) string {
+	return filepath.Join(append([]string{rt.Dir, internalDirName}, elem...)...)
+}
+
+// quotaLimit is the limit of rt in bytes. quotaMu must be held.
+func (rt *storageRoot) quotaLimit() int64 {
+	if rt.QuotaGB > 0 {
+		return int64(rt.QuotaGB) * gb
+	}
+	return int64(storageQuotaGB) * gb
+}
+
+// virtualPath is the client path of a path relative to rt.
+func (rt *storageRoot) virtualPath(rel string) string {
+	rel = filepath.ToSlash(rel)
+	if rt.Name == "" {
+		return rel
+	}
+	if rel == "." {
+		return rt.Name
+	}
+	return rt.Name + "/" + rel
+}
+
+// rootItems lists the roots as the folders at the top of a multi-root
+// tree.
+func rootItems() []*fileItem {
+	items := make([]*fileItem, 0, len(storageRoots))
+	for _, rt := range storageRoots {
+		info, err := os.Stat(rt.Dir)
+		if err != nil {
+			continue
+		}
+		size, _ := folderSize(rt.Dir)
+		items = append(items, &fileItem{
+			Name:    rt.Name,
+			Path:    rt.Name,
+			IsDir:   true,
+			Size:    size,
+			ModTime: info.ModTime(),
+		})
+	}
+	return items
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// route is one entry of the route table. main registers exactly these
+// routes and /openapi.json is generated from the same table, so the served
+// document cannot drift from what the server actually handles.
+type route struct {
+	// Pattern is the ServeMux pattern; a trailing slash matches a subtree.
+	Pattern string
+	// DocPath is the OpenAPI path, e.g. "/list/{path}". Defaults to Pattern.
+	DocPath string
+	// Public routes skip authMiddleware.
+	Public bool
+	// Signed routes also accept a signed URL for their path instead of a
+	// token (see signed.go).
+	Signed bool
+	// SignedRel maps the path below Pattern to the file a signed URL was
+	// issued for, when that is not the whole path.
+	SignedRel func(rest string) string
+	Handler   http.HandlerFunc
+	Ops       []apiOp
+}
+
+// apiOp documents one method of a route.
+type apiOp struct {
+	Method      string
+	Summary     string
+	Description string
+	Params      []apiParam
+	// Body is the JSON request schema; Multipart marks a file upload.
+	Body      map[string]interface{}
+	Multipart bool
+	Responses map[int]apiResponse
+}
+
+type apiParam struct {
+	Name        string
+	In          string
+	Description string
+	Required    bool
+}
+
+// apiResponse documents a response. Data is the schema of envelope.data;
+// Raw marks a response that is passed through as-is (file contents).
+type apiResponse struct {
+	Description string
+	Data        map[string]interface{}
+	Raw         string
+}
+
+var registeredRoutes []route
+
+// appRoutes builds the route table. It runs after loadEnv because some
+// routes only exist when they are configured.
+func appRoutes() []route {
+	pathParam := apiParam{Name: "path", In: "path", Description: "Path relative to the storage root", Required: true}
+	queryPath := apiParam{Name: "path", In: "query", Description: "Path relative to the storage root", Required: true}
+	onConflict := apiParam{Name: "on_conflict", In: "query", Description: "rename, overwrite, skip or fail (overrides the server default)"}
+	opResponses := map[int]apiResponse{
+		200: {Description: "Done", Data: ref("OpResult")},
+		404: {Description: "Source not found"},
+		409: {Description: "Target exists and on_conflict is fail"},
+	}
+	rangeHeader := apiParam{Name: "Range", In: "header", Description: "Byte range, e.g. bytes=0-1023"}
+	ifMatch := apiParam{Name: "If-Match", In: "header", Description: "Only act when the file's ETag (\"<sha256>\") is one of these; * when it exists"}
+	ifNoneMatch := apiParam{Name: "If-None-Match", In: "header", Description: "Only act when the file's ETag is none of these; * when it does not exist"}
+
+	routes := []route{
+		{Pattern: "/login", Public: true, Handler: loginHandler, Ops: []apiOp{{
+			Method:    "POST",
+			Summary:   "Check the server password or a user token",
+			Body:      object(props{"password": str("AUTH_TOKEN or a token from USERS")}, "password"),
+			Responses: map[int]apiResponse{200: {Description: "Password accepted", Data: object(props{"user": str("User the password belongs to")})}, 401: {Description: "Incorrect password"}},
+		}}},
+		{Pattern: "/healthz", Public: true, Handler: healthzHandler, Ops: []apiOp{{
+			Method:    "GET",
+			Summary:   "Liveness probe",
+			Responses: map[int]apiResponse{200: {Description: "Server is up", Data: object(props{"status": str("Always ok"), "uptime_seconds": integer("Seconds since start")})}},
+		}}},
+		{Pattern: "/readyz", Public: true, Handler: readyzHandler, Ops: []apiOp{{
+			Method:      "GET",
+			Summary:     "Readiness probe",
+			Description: "Ready once the initial storage scan finished and the storage root is writable and not full.",
+			Responses: map[int]apiResponse{
+				200: {Description: "Ready", Data: object(props{"ready": boolean("Whether all checks passed"), "checks": map[string]interface{}{"type": "object", "additionalProperties": str("ok or the failure reason")}})},
+				503: {Description: "Not ready; envelope data lists the failing checks"},
+			},
+		}}},
+		{Pattern: "/version", Public: true, Handler: versionHandler, Ops: []apiOp{{
+			Method:  "GET",
+			Summary: "Build version and enabled features",
+			Responses: map[int]apiResponse{200: {Description: "Version information", Data: object(props{
+				"version":    str("Release version"),
+				"commit":     str("Source commit"),
+				"go_version": str("Go toolchain"),
+				"os":         str("Operating system"),
+				"arch":       str("CPU architecture"),
+				"api":        str("API version"),
+				"features":   array(str("Feature name")),
+			})}},
+		}}},
+		{Pattern: "/upload", Handler: uploadHandler, Ops: []apiOp{{
+			Method:    "POST",
+			Summary:   "Upload a file",
+			Params:    []apiParam{{Name: "path", In: "query", Description: "Target folder, created when missing"}, onConflict, ifMatch, ifNoneMatch},
+			Multipart: true,
+			Responses: map[int]apiResponse{
+				200: {Description: "Uploaded (or skipped)", Data: ref("OpResult")},
+				412: {Description: "If-Match or If-None-Match failed for the existing file"},
+				507: {Description: "Storage quota exceeded"},
+			},
+		}}},
+		{Pattern: "/download/", DocPath: "/download/{path}", Signed: true, Handler: downloadHandler, Ops: []apiOp{{
+			Method:  "GET",
+			Summary: "Download a file as an attachment",
+			Params:  []apiParam{pathParam, rangeHeader, ifMatch, ifNoneMatch},
+			Responses: map[int]apiResponse{
+				200: {Description: "File contents; ETag is the quoted SHA-256", Raw: "application/octet-stream"},
+				206: {Description: "Partial content", Raw: "application/octet-stream"},
+				304: {Description: "Not modified (If-None-Match)"},
+				412: {Description: "If-Match failed"},
+			},
+		}}},
+		{Pattern: "/hash/", DocPath: "/hash/{path}", Handler: hashHandler, Ops: []apiOp{{
+			Method:      "GET",
+			Summary:     "SHA-256 checksum of a file",
+			Description: "Computed on first use and cached until the file changes. The ETag of downloads and the precondition headers use the same value.",
+			Params:      []apiParam{pathParam},
+			Responses: map[int]apiResponse{
+				200: {Description: "Checksum", Data: ref("FileHash")},
+				400: {Description: "Path is a folder"},
+				404: {Description: "Not found"},
+			},
+		}}},
+		{Pattern: "/sign", Handler: signHandler, Ops: []apiOp{{
+			Method:      "POST",
+			Summary:     "Create a signed URL for a file",
+			Description: "The URL works without a token on the stream, download, thumbnail and HLS routes of that one file until it expires. Players and <video> tags should use these instead of ?token=.",
+			Body: object(props{
+				"path":       str("File path"),
+				"expires_in": integer("Lifetime in seconds (default 3600, at most 7 days)"),
+				"bind_ip":    boolean("Only the caller's address may use the URL"),
+				"ip":         str("Only this address may use the URL"),
+			}, "path"),
+			Responses: map[int]apiResponse{
+				200: {Description: "Signed URL", Data: ref("SignedURL")},
+				400: {Description: "Folder, bad lifetime or bad address"},
+				404: {Description: "Not found"},
+			},
+		}}},
+		{Pattern: "/signature/", DocPath: "/signature/{path}", Handler: signatureHandler, Ops: []apiOp{{
+			Method:      "GET",
+			Summary:     "Block signatures of a file for a delta upload",
+			Description: "Rolling checksum (rsync style: a + b<<16) and SHA-256 of every block. version must be passed to /delta.",
+			Params:      []apiParam{pathParam, {Name: "block_size", In: "query", Description: "Block size in bytes (1 KiB to 8 MiB, default about the square root of the file size)"}},
+			Responses: map[int]apiResponse{
+				200: {Description: "Signatures", Data: ref("FileSignature")},
+				404: {Description: "File not found"},
+			},
+		}}},
+		{Pattern: "/delta/", DocPath: "/delta/{path}", Handler: deltaHandler, Ops: []apiOp{{
+			Method:      "POST",
+			Summary:     "Replace a file by sending only what changed",
+			Description: "The body is \"HCD1\" followed by copy ('C' offset:uint64 length:uint64) and literal ('D' length:uint32 bytes) operations, big-endian. The new file is built aside and only replaces the old one when its size and SHA-256 match.",
+			Params: []apiParam{
+				pathParam,
+				ifMatch,
+				{Name: "base", In: "query", Description: "version from /signature", Required: true},
+				{Name: "size", In: "query", Description: "Size of the new content", Required: true},
+				{Name: "sha256", In: "query", Description: "SHA-256 of the new content, hex", Required: true},
+			},
+			Responses: map[int]apiResponse{
+				200: {Description: "Replaced", Data: ref("OpResult")},
+				400: {Description: "Malformed delta"},
+				412: {Description: "The file changed since the signature was taken, or If-Match failed"},
+				422: {Description: "Rebuilt file does not match size or sha256; nothing was changed"},
+				507: {Description: "Storage quota exceeded"},
+			},
+		}}},
+		{Pattern: "/stream/", DocPath: "/stream/{path}", Signed: true, Handler: streamHandler, Ops: []apiOp{{
+			Method:    "GET",
+			Summary:   "Stream a media file with range support",
+			Params:    []apiParam{pathParam, rangeHeader},
+			Responses: map[int]apiResponse{200: {Description: "File contents", Raw: "application/octet-stream"}, 206: {Description: "Partial content", Raw: "application/octet-stream"}},
+		}}},
+		{Pattern: "/subtitles/", DocPath: "/subtitles/{path}", Signed: true, Handler: subtitlesHandler, Ops: []apiOp{{
+			Method:      "GET",
+			Summary:     "Sidecar subtitles of a media file",
+			Description: "Lists movie.srt, movie.en.srt, ... next to the file or in a Subs folder, with track URLs signed for the caller. With track set, that track (at most 10 MiB) is returned converted to WebVTT.",
+			Params:      []apiParam{pathParam, {Name: "track", In: "query", Description: "Track name from the list"}},
+			Responses: map[int]apiResponse{
+				200: {Description: "Subtitle tracks, or the track as text/vtt", Data: array(ref("SubtitleTrack"))},
+				404: {Description: "Not found"},
+				413: {Description: "Subtitle file too large"},
+			},
+		}}},
+		{Pattern: "/playlist/", DocPath: "/playlist/{name}", Handler: folderPlaylistHandler, Ops: []apiOp{{
+			Method:      "GET",
+			Summary:     "Playlist of the media in a folder",
+			Description: "name is the folder path plus .m3u8 or .xspf. Entries are absolute /stream/ URLs signed for the caller that stay valid for six hours, in natural order (Episode 2 before Episode 10).",
+			Params:      []apiParam{{Name: "name", In: "path", Description: "Folder path with a .m3u8 or .xspf extension", Required: true}, {Name: "recursive", In: "query", Description: "Include subfolders"}},
+			Responses: map[int]apiResponse{
+				200: {Description: "M3U8 or XSPF playlist", Raw: "audio/x-mpegurl"},
+				404: {Description: "Folder not found"},
+			},
+		}}},
+		{Pattern: "/photos/thumb/", DocPath: "/photos/thumb/{path}", Signed: true, Handler: photoThumbHandler, Ops: []apiOp{{
+			Method:      "GET",
+			Summary:     "Thumbnail of an image",
+			Description: "JPEG, rotated by the EXIF orientation. HEIC files use the preview embedded in their EXIF data.",
+			Params:      []apiParam{pathParam, {Name: "size", In: "query", Description: "Longest side: 128, 256 (default), 512 or 1024"}},
+			Responses: map[int]apiResponse{
+				200: {Description: "Thumbnail", Raw: "image/jpeg"},
+				404: {Description: "Not found"},
+				415: {Description: "Not an image, or one that cannot be decoded"},
+			},
+		}}},
+		{Pattern: "/list", Handler: listHandler, Ops: []apiOp{{
+			Method:      "GET",
+			Summary:     "List the storage root",
+			Description: "With STORAGE_ROOTS the entries are the storage roots.",
+			Responses:   map[int]apiResponse{200: {Description: "Folder entries", Data: array(ref("FileItem"))}},
+		}}},
+		{Pattern: "/list/", DocPath: "/list/{path}", Handler: listHandler, Ops: []apiOp{{
+			Method:      "GET",
+			Summary:     "List a folder",
+			Description: "For a file the file itself is returned instead of a listing. Files carry sha256 when it is already known; hash=true computes the missing ones (slow for large folders).",
+			Params:      []apiParam{pathParam, {Name: "hash", In: "query", Description: "Compute missing checksums"}},
+			Responses:   map[int]apiResponse{200: {Description: "Folder entries", Data: array(ref("FileItem"))}, 404: {Description: "Not found"}},
+		}}},
+		{Pattern: "/rename", Handler: renameHandler, Ops: []apiOp{{
+			Method:  "POST",
+			Summary: "Rename a file or folder",
+			Params:  []apiParam{onConflict, ifMatch, ifNoneMatch},
+			Body:    object(props{"old": str("Current path"), "new": str("New path"), "on_conflict": str("Conflict policy")}, "old", "new"),
+			Responses: map[int]apiResponse{
+				200: opResponses[200],
+				404: opResponses[404],
+				409: opResponses[409],
+				412: {Description: "If-Match or If-None-Match failed for the current path"},
+			},
+		}}},
+		{Pattern: "/move", Handler: moveHandler, Ops: []apiOp{{
+			Method:      "POST",
+			Summary:     "Move a file or folder",
+			Description: "Moves to another storage root copy the data; large ones run as a background job, poll /jobs/{id}.",
+			Params:      []apiParam{onConflict},
+			Body:        object(props{"source": str("Path to move"), "dest": str("Destination path including the name"), "on_conflict": str("Conflict policy")}, "source", "dest"),
+			Responses: map[int]apiResponse{
+				200: opResponses[200],
+				202: {Description: "Move to another root started as a job", Data: ref("Job")},
+				404: opResponses[404],
+				409: opResponses[409],
+				507: {Description: "Storage quota exceeded"},
+			},
+		}}},
+		{Pattern: "/copy", Handler: copyHandler, Ops: []apiOp{{
+			Method:      "POST",
+			Summary:     "Copy a file or folder",
+			Description: "Large copies run as a background job; poll /jobs/{id}.",
+			Params:      []apiParam{onConflict},
+			Body:        object(props{"source": str("Path to copy"), "dest": str("Destination path including the name"), "on_conflict": str("Conflict policy")}, "source", "dest"),
+			Responses: map[int]apiResponse{
+				200: {Description: "Copied", Data: ref("OpResult")},
+				202: {Description: "Copy started as a job", Data: ref("Job")},
+				507: {Description: "Storage quota exceeded"},
+			},
+		}}},
+		{Pattern: "/batch", Handler: batchHandler, Ops: []apiOp{{
+			Method:      "POST",
+			Summary:     "Run several operations in one request",
+			Description: "With atomic set, the first failure rolls back every completed step.",
+			Params:      []apiParam{onConflict},
+			Body: object(props{
+				"atomic":      boolean("Roll back everything when one operation fails"),
+				"on_conflict": str("Default conflict policy for all operations"),
+				"operations":  array(ref("BatchOperation")),
+			}, "operations"),
+			Responses: map[int]apiResponse{200: {Description: "All operations succeeded", Data: ref("BatchResponse")}, 207: {Description: "Some operations failed", Data: ref("BatchResponse")}},
+		}}},
+		{Pattern: "/changes", Handler: changesHandler, Ops: []apiOp{{
+			Method:      "GET",
+			Summary:     "Changes since a sync cursor",
+			Description: "Admin only. Returns the journal of creates, modifies, deletes and moves after since, oldest first. Without since, or when the journal no longer covers the cursor (it was truncated, the server crashed, files changed while it was stopped or the watcher dropped events), reset is true: rescan with /list, then continue from the returned cursor.",
+			Params: []apiParam{
+				{Name: "since", In: "query", Description: "Cursor from the previous call"},
+				{Name: "limit", In: "query", Description: "At most this many changes (default 1000); more is true when there are further ones"},
+			},
+			Responses: map[int]apiResponse{200: {Description: "Changes and the next cursor", Data: object(props{
+				"cursor":  str("Pass as since next time"),
+				"reset":   boolean("The cursor is not usable; rescan everything"),
+				"more":    boolean("More changes are waiting; call again right away"),
+				"changes": array(ref("Change")),
+			})}, 403: {Description: "Not the admin"}, 503: {Description: "Initial storage scan still running"}},
+		}}},
+		{Pattern: "/jobs", Handler: jobsHandler, Ops: []apiOp{{
+			Method:      "GET",
+			Summary:     "List background jobs",
+			Description: "Only the jobs the caller started; the admin sees all of them.",
+			Responses:   map[int]apiResponse{200: {Description: "Jobs", Data: array(ref("Job"))}},
+		}}},
+		{Pattern: "/jobs/", DocPath: "/jobs/{id}", Handler: jobsHandler, Ops: []apiOp{
+			{
+				Method:    "GET",
+				Summary:   "Get job progress",
+				Params:    []apiParam{{Name: "id", In: "path", Required: true}},
+				Responses: map[int]apiResponse{200: {Description: "Job", Data: ref("Job")}, 404: {Description: "Job not found"}},
+			},
+			{
+				Method:    "DELETE",
+				Summary:   "Cancel a job",
+				Params:    []apiParam{{Name: "id", In: "path", Required: true}},
+				Responses: map[int]apiResponse{200: {Description: "Cancellation requested", Data: ref("Job")}, 404: {Description: "Job not found"}},
+			},
+		}},
+		{Pattern: "/delete", Handler: deleteHandler, Ops: []apiOp{{
+			Method:    "DELETE",
+			Summary:   "Delete a file or folder",
+			Params:    []apiParam{queryPath, ifMatch, ifNoneMatch},
+			Responses: map[int]apiResponse{200: {Description: "Deleted"}, 404: {Description: "Not found"}, 412: {Description: "If-Match or If-None-Match failed"}},
+		}}},
+		{Pattern: "/mkdir", Handler: mkdirHandler, Ops: []apiOp{{
+			Method:    "POST",
+			Summary:   "Create a folder",
+			Params:    []apiParam{onConflict},
+			Body:      object(props{"path": str("Folder to create"), "on_conflict": str("Conflict policy")}, "path"),
+			Responses: map[int]apiResponse{201: {Description: "Created", Data: ref("OpResult")}, 200: {Description: "Already existed", Data: ref("OpResult")}},
+		}}},
+		{Pattern: "/info", Handler: systemInfoHandler, Ops: []apiOp{{
+			Method:    "GET",
+			Summary:   "System information (CPU, memory, disks, network)",
+			Responses: map[int]apiResponse{200: {Description: "System information", Data: map[string]interface{}{"type": "object"}}},
+		}}},
+		{Pattern: "/settings", Handler: settingsHandler, Ops: []apiOp{
+			{
+				Method:    "GET",
+				Summary:   "Read server settings",
+				Responses: map[int]apiResponse{200: {Description: "Settings", Data: ref("Settings")}},
+			},
+			{
+				Method:      "POST",
+				Summary:     "Change server settings",
+				Description: "Admin only. Omitted fields stay unchanged.",
+				Body:        ref("Settings"),
+				Responses:   map[int]apiResponse{200: {Description: "Updated", Data: ref("Settings")}, 403: {Description: "Not the admin"}},
+			},
+		}},
+		{Pattern: "/shutdown", Handler: shutdownHandler, Ops: []apiOp{{
+			Method:      "POST",
+			Summary:     "Stop the server gracefully",
+			Description: "Admin only. New connections are refused; running transfers get SHUTDOWN_TIMEOUT seconds to finish.",
+			Responses:   map[int]apiResponse{202: {Description: "Shutdown started", Data: object(props{"drain_timeout_seconds": integer("Drain timeout")})}, 403: {Description: "Not the admin"}},
+		}}},
+		{Pattern: "/openapi.json", Public: true, Handler: openAPIHandler, Ops: []apiOp{{
+			Method:    "GET",
+			Summary:   "This OpenAPI document",
+			Responses: map[int]apiResponse{200: {Description: "OpenAPI 3 document", Raw: "application/json"}},
+		}}},
+		{Pattern: "/docs", Public: true, Handler: docsHandler, Ops: []apiOp{{
+			Method:    "GET",
+			Summary:   "Interactive API documentation",
+			Responses: map[int]apiResponse{200: {Description: "HTML page", Raw: "text/html"}},
+		}}},
+	}
+
+	if hlsTranscoder != nil {
+		routes = append(routes, route{Pattern: "/hls/", DocPath: "/hls/{path}/master.m3u8", Signed: true, SignedRel: hlsSourceRel, Handler: hlsHandler, Ops: []apiOp{{
+			Method:      "GET",
+			Summary:     "HLS master playlist of a video",
+			Description: "Variant playlists (<variant>/index.m3u8) and their segments are relative to it and cut on demand. Their URLs are signed for the video, so players need no token after the first request. Without ffmpeg the single variant points at /stream.",
+			Params:      []apiParam{pathParam},
+			Responses: map[int]apiResponse{
+				200: {Description: "Playlist", Raw: "application/vnd.apple.mpegurl"},
+				404: {Description: "Not found"},
+				415: {Description: "Not a video file"},
+			},
+		}}})
+	}
+	if len(photoFolders) > 0 {
+		routes = append(routes, route{Pattern: "/photos/timeline", Handler: photoTimelineHandler, Ops: []apiOp{{
+			Method:      "GET",
+			Summary:     "Photos grouped by the date they were taken",
+			Description: "Dates come from EXIF (JPEG, PNG, HEIC), else from the file time. Days are newest first; limit and offset count days.",
+			Params: []apiParam{
+				{Name: "year", In: "query"},
+				{Name: "month", In: "query", Description: "1-12"},
+				{Name: "limit", In: "query", Description: "Maximum number of days"},
+				{Name: "offset", In: "query", Description: "Days to skip"},
+			},
+			Responses: map[int]apiResponse{200: {Description: "Days", Data: array(ref("PhotoDay"))}, 400: {Description: "Invalid year or month"}},
+		}}})
+	}
+	if len(musicFolders) > 0 {
+		idParam := apiParam{Name: "id", In: "path", Required: true}
+		limits := []apiParam{{Name: "limit", In: "query", Description: "Maximum number of results"}, {Name: "offset", In: "query", Description: "Results to skip"}}
+		playlistBody := object(props{
+			"name":   str("Playlist name"),
+			"public": boolean("Visible to all users"),
+			"tracks": array(str("Track ID")),
+		})
+		routes = append(routes,
+			route{Pattern: "/music/artists", Handler: musicArtistsHandler, Ops: []apiOp{{
+				Method:    "GET",
+				Summary:   "Artists in the music library",
+				Params:    append([]apiParam{{Name: "genre", In: "query"}}, limits...),
+				Responses: map[int]apiResponse{200: {Description: "Artists by name", Data: array(ref("MusicArtist"))}},
+			}}},
+			route{Pattern: "/music/albums", Handler: musicAlbumsHandler, Ops: []apiOp{{
+				Method:      "GET",
+				Summary:     "Albums in the music library",
+				Description: "Tracks without an album artist are grouped into albums by folder.",
+				Params: append([]apiParam{
+					{Name: "artist", In: "query", Description: "Artist ID"},
+					{Name: "genre", In: "query"},
+					{Name: "sort", In: "query", Description: "name (default), year, recent or artist"},
+				}, limits...),
+				Responses: map[int]apiResponse{200: {Description: "Albums", Data: array(ref("MusicAlbum"))}},
+			}}},
+			route{Pattern: "/music/tracks", Handler: musicTracksHandler, Ops: []apiOp{{
+				Method:      "GET",
+				Summary:     "Tracks in the music library",
+				Description: "Sorted by album, disc and track number. Play them with their stream_url.",
+				Params: append([]apiParam{
+					{Name: "album", In: "query", Description: "Album ID"},
+					{Name: "artist", In: "query", Description: "Artist ID"},
+					{Name: "genre", In: "query"},
+					{Name: "q", In: "query", Description: "Search title, artist and album"},
+				}, limits...),
+				Responses: map[int]apiResponse{200: {Description: "Tracks", Data: array(ref("MusicTrack"))}},
+			}}},
+			route{Pattern: "/rest/", DocPath: "/rest/{method}", Public: true, Handler: subsonicHandler, Ops: []apiOp{{
+				Method:      "GET",
+				Summary:     "Subsonic API for music players",
+				Description: "Subsonic/OpenSubsonic methods ping, getLicense, getMusicFolders, getIndexes, getArtists, getArtist, getAlbum, getSong, getMusicDirectory, getAlbumList2, search3, stream, download and getCoverArt, optionally with a .view suffix. Log in with u (admin for AUTH_TOKEN) and the token as p, or as t = md5(token + s); or with apiKey. Answers are XML, or JSON with f=json.",
+				Params: []apiParam{
+					{Name: "method", In: "path", Required: true},
+					{Name: "u", In: "query", Description: "User name"},
+					{Name: "p", In: "query", Description: "Token, plain or enc:<hex>"},
+					{Name: "t", In: "query", Description: "md5(token + s)"},
+					{Name: "s", In: "query", Description: "Salt"},
+					{Name: "f", In: "query", Description: "xml (default) or json"},
+				},
+				Responses: map[int]apiResponse{200: {Description: "Subsonic response; failures have status failed", Raw: "text/xml"}},
+			}}},
+			route{Pattern: "/music/cover/", DocPath: "/music/cover/{id}", Handler: musicCoverHandler, Ops: []apiOp{{
+				Method:    "GET",
+				Summary:   "Cover art of a track or album",
+				Params:    []apiParam{idParam},
+				Responses: map[int]apiResponse{200: {Description: "Image", Raw: "image/jpeg"}, 404: {Description: "No cover"}},
+			}}},
+			route{Pattern: "/music/playlists", Handler: musicPlaylistsHandler, Ops: []apiOp{
+				{
+					Method:    "GET",
+					Summary:   "List your and public playlists",
+					Responses: map[int]apiResponse{200: {Description: "Playlists", Data: array(ref("Playlist"))}},
+				},
+				{
+					Method:    "POST",
+					Summary:   "Create a playlist",
+					Body:      playlistBody,
+					Responses: map[int]apiResponse{201: {Description: "Created", Data: ref("Playlist")}, 400: {Description: "Unknown track"}},
+				},
+			}},
+			route{Pattern: "/music/playlists/", DocPath: "/music/playlists/{id}", Handler: musicPlaylistHandler, Ops: []apiOp{
+				{
+					Method:    "GET",
+					Summary:   "Get a playlist with its tracks",
+					Params:    []apiParam{idParam, {Name: "format", In: "query", Description: "m3u8 for an M3U playlist of signed /stream/ URLs valid for six hours"}},
+					Responses: map[int]apiResponse{200: {Description: "Playlist", Data: ref("Playlist")}, 404: {Description: "Playlist not found"}},
+				},
+				{
+					Method:    "PUT",
+					Summary:   "Update a playlist",
+					Params:    []apiParam{idParam},
+					Body:      playlistBody,
+					Responses: map[int]apiResponse{200: {Description: "Updated", Data: ref("Playlist")}, 403: {Description: "Not the owner"}},
+				},
+				{
+					Method:    "DELETE",
+					Summary:   "Delete a playlist",
+					Params:    []apiParam{idParam},
+					Responses: map[int]apiResponse{200: {Description: "Deleted"}, 403: {Description: "Not the owner"}},
+				},
+			}},
+		)
+	}
+	if h := publicHandler(); h != nil {
+		publicEnabled = true
+		routes = append(routes, route{Pattern: "/uploads/", DocPath: "/uploads/{path}", Handler: h, Ops: []apiOp{{
+			Method:    "GET",
+			Summary:   "Static files from PUBLIC_DIR",
+			Params:    []apiParam{pathParam},
+			Responses: map[int]apiResponse{200: {Description: "File contents or listing", Raw: "application/octet-stream"}},
+		}}})
+	} else if publicDir != "" {
+		log.Printf("Warning: PUBLIC_DIR %q is not a folder in storage, static hosting disabled", publicDir)
+	}
+
+	return routes
+}
+
+// registerRoutes installs the route table on http.DefaultServeMux, both at
+// the legacy paths and under apiPrefix.
+func registerRoutes(routes []route) {
+	for _, rt := range routes {
+		h := rt.Handler
+		if !rt.Public {
+			h = authMiddleware(h)
+		}
+		if rt.Signed {
+			h = acceptSigned(rt, h)
+		}
+		handle(rt.Pattern, h)
+	}
+	registeredRoutes = routes
+}
+
+func (rt route) docPath() string {
+	if rt.DocPath != "" {
+		return rt.DocPath
+	}
+	return strings.TrimSuffix(rt.Pattern, "/")
+}
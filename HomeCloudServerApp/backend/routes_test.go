@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// fullRouteTable is appRoutes with every optional feature configured.
+func fullRouteTable(t *testing.T) []route {
+	root := testRoot(t)
+	oldHLS, oldPhotos, oldMusic, oldPublic := hlsTranscoder, photoFolders, musicFolders, publicDir
+	t.Cleanup(func() {
+		hlsTranscoder, photoFolders, musicFolders, publicDir = oldHLS, oldPhotos, oldMusic, oldPublic
+	})
+	hlsTranscoder = passthroughTranscoder{}
+	photoFolders = []string{filepath.Join(root, "dir")}
+	musicFolders = []musicFolder{{ID: 1, Name: "dir", Path: "dir", abs: filepath.Join(root, "dir")}}
+	publicDir = "dir"
+	return appRoutes()
+}
+
+var pathVar = regexp.MustCompile(`\{([^}]+)\}`)
+
+// TestRouteDocs checks the route table against how routes are mounted:
+// subtree patterns need a path template and every template variable a
+// path parameter.
+func TestRouteDocs(t *testing.T) {
+	patterns := map[string]bool{}
+	for _, rt := range fullRouteTable(t) {
+		if patterns[rt.Pattern] {
+			t.Errorf("%s is registered twice", rt.Pattern)
+		}
+		patterns[rt.Pattern] = true
+		if rt.Handler == nil {
+			t.Errorf("%s has no handler", rt.Pattern)
+		}
+		if len(rt.Ops) == 0 {
+			t.Errorf("%s has no documented methods", rt.Pattern)
+		}
+		if strings.HasSuffix(rt.Pattern, "/") != strings.Contains(rt.docPath(), "{") {
+			t.Errorf("%s: subtree patterns and path templates must go together (doc path %s)", rt.Pattern, rt.docPath())
+		}
+		for _, op := range rt.Ops {
+			if op.Summary == "" {
+				t.Errorf("%s %s has no summary", op.Method, rt.docPath())
+			}
+			if len(op.Responses) == 0 {
+				t.Errorf("%s %s documents no responses", op.Method, rt.docPath())
+			}
+			for _, m := range pathVar.FindAllStringSubmatch(rt.docPath(), -1) {
+				found := false
+				for _, p := range op.Params {
+					found = found || (p.In == "path" && p.Name == m[1])
+				}
+				if !found {
+					t.Errorf("%s %s does not document path parameter %q", op.Method, rt.docPath(), m[1])
+				}
+			}
+			for _, p := range op.Params {
+				if p.In == "path" && !strings.Contains(rt.docPath(), "{"+p.Name+"}") {
+					t.Errorf("%s %s documents path parameter %q that is not in the path", op.Method, rt.docPath(), p.Name)
+				}
+			}
+		}
+	}
+}
+
+// TestOpenAPIDocument fetches /openapi.json as served and checks that it
+// describes exactly the registered routes and only refers to schemas it
+// defines.
+func TestOpenAPIDocument(t *testing.T) {
+	routes := fullRouteTable(t)
+	old := registeredRoutes
+	registeredRoutes = routes
+	t.Cleanup(func() { registeredRoutes = old })
+
+	rec := httptest.NewRecorder()
+	openAPIHandler(rec, httptest.NewRequest("GET", "/openapi.json", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/openapi.json: status %d", rec.Code)
+	}
+	var doc struct {
+		OpenAPI    string                                       `json:"openapi"`
+		Paths      map[string]map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas         map[string]interface{} `json:"schemas"`
+			SecuritySchemes map[string]interface{} `json:"securitySchemes"`
+		} `json:"components"`
+	}
+	raw := rec.Body.Bytes()
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		t.Fatalf("/openapi.json is not valid JSON: %v", err)
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		t.Errorf("openapi version %q", doc.OpenAPI)
+	}
+
+	if len(doc.Paths) != len(routes) {
+		t.Errorf("document has %d paths, route table %d", len(doc.Paths), len(routes))
+	}
+	opIDs := map[string]string{}
+	for _, rt := range routes {
+		item, ok := doc.Paths[rt.docPath()]
+		if !ok {
+			t.Errorf("%s (%s) missing from the document", rt.Pattern, rt.docPath())
+			continue
+		}
+		if len(item) != len(rt.Ops) {
+			t.Errorf("%s: document has %d methods, route %d", rt.docPath(), len(item), len(rt.Ops))
+		}
+		for _, op := range rt.Ops {
+			o, ok := item[strings.ToLower(op.Method)]
+			if !ok {
+				t.Errorf("%s %s missing from the document", op.Method, rt.docPath())
+				continue
+			}
+			id, _ := o["operationId"].(string)
+			if prev, dup := opIDs[id]; dup {
+				t.Errorf("operationId %q used by %s and %s %s", id, prev, op.Method, rt.docPath())
+			}
+			opIDs[id] = op.Method + " " + rt.docPath()
+			if _, ok := o["security"]; ok == rt.Public {
+				t.Errorf("%s %s: security does not match Public=%t", op.Method, rt.docPath(), rt.Public)
+			}
+		}
+	}
+
+	for _, m := range regexp.MustCompile(`"#/components/schemas/([^"]+)"`).FindAllSubmatch(raw, -1) {
+		if _, ok := doc.Components.Schemas[string(m[1])]; !ok {
+			t.Errorf("reference to undefined schema %s", m[1])
+		}
+	}
+	for _, m := range regexp.MustCompile(`\{\s*"(\w+)": \[\]`).FindAllSubmatch(raw, -1) {
+		if _, ok := doc.Components.SecuritySchemes[string(m[1])]; !ok {
+			t.Errorf("reference to undefined security scheme %s", m[1])
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Symlink policies accepted by SYMLINK_POLICY.
+//
+//	deny          - any symlink on the way to the target is rejected
+//	follow-inside - symlinks are followed only while they stay inside their storage root
+//	follow        - symlinks are followed wherever they point
+const (
+	symlinkDeny         = "deny"
+	symlinkFollowInside = "follow-inside"
+	symlinkFollow       = "follow"
+)
+
+var symlinkPolicy = symlinkFollowInside
+
+// internalDirName is a hidden folder directly under each storage root holding server
+// bookkeeping such as batch staging areas. Clients can never address it.
+const internalDirName = ".homecloud"
+
+var (
+	errInvalidPath   = errors.New("invalid path")
+	errPathEscape    = errors.New("path escapes storage root")
+	errSymlinkDenied = errors.New("symbolic links are not allowed")
+)
+
+func validSymlinkPolicy(p string) bool {
+	switch p {
+	case symlinkDeny, symlinkFollowInside, symlinkFollow:
+		return true
+	}
+	return false
+}
+
+// cleanRelPath normalises a client supplied path into a clean path relative
+// to the storage root. Leading slashes are ignored; a path that climbs above
+// the root with ".." is rejected. "." means the root itself.
+func cleanRelPath(rel string) (string, error) {
+	if strings.ContainsRune(rel, 0) {
+		return "", errInvalidPath
+	}
+	rel = filepath.FromSlash(rel)
+	if filepath.VolumeName(rel) != "" {
+		return "", errInvalidPath
+	}
+
+	sep := string(filepath.Separator)
+	clean := filepath.Clean(strings.TrimLeft(rel, sep))
+	if clean == ".." || strings.HasPrefix(clean, ".."+sep) {
+		return "", errPathEscape
+	}
+	if !filepath.IsLocal(clean) && clean != "." {
+		return "", errInvalidPath
+	}
+	return clean, nil
+}
+
+// isWithin reports whether target is root or lies underneath it. Both paths
+// must be absolute and clean.
+func isWithin(root, target string) bool {
+	rel, err := filepath.Rel(root, target)
+	if err != nil {
+		return false
+	}
+	if rel == "." {
+		return true
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// resolvePath is the single entry point for turning a client supplied path
+// into a filesystem path on a storage root. Every handler must go through
+// it. The target itself does not have to exist. In multi-root mode "."
+// stands for the list of roots and cannot be resolved.
+func resolvePath(rel string) (string, error) {
+	clean, err := cleanRelPath(rel)
+	if err != nil {
+		return "", err
+	}
+	rt, inner, err := splitRoot(clean)
+	if err != nil {
+		return "", err
+	}
+	if rt == nil {
+		return "", opFail(http.StatusBadRequest, "Path must start with a storage root")
+	}
+
+	if first, _, _ := strings.Cut(inner, string(filepath.Separator)); strings.EqualFold(first, internalDirName) {
+		return "", errPathEscape
+	}
+
+	full := filepath.Join(rt.Dir, inner)
+	if !isWithin(rt.Dir, full) {
+		return "", errPathEscape
+	}
+
+	if err := checkSymlinks(rt.Dir, inner); err != nil {
+		return "", err
+	}
+	return full, nil
+}
+
+// resolveItemPath is resolvePath for operations that act on an entry inside
+// a root (rename, move, delete, ...). The roots themselves are rejected.
+func resolveItemPath(rel string) (string, error) {
+	clean, err := cleanRelPath(rel)
+	if err != nil {
+		return "", err
+	}
+	if _, inner, err := splitRoot(clean); err != nil {
+		return "", err
+	} else if inner == "." {
+		return "", errInvalidPath
+	}
+	return resolvePath(clean)
+}
+
+// checkSymlinks applies symlinkPolicy to every existing component of clean,
+// walking down from rootAbs. Components that do not exist yet are fine.
+func checkSymlinks(rootAbs, clean string) error {
+	if symlinkPolicy == symlinkFollow || clean == "." {
+		return nil
+	}
+
+	realRoot, err := filepath.EvalSymlinks(rootAbs)
+	if err != nil {
+		return err
+	}
+
+	cur := rootAbs
+	for _, part := range strings.Split(clean, string(filepath.Separator)) {
+		cur = filepath.Join(cur, part)
+		info, err := os.Lstat(cur)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+
+		if symlinkPolicy == symlinkDeny {
+			return errSymlinkDenied
+		}
+
+		resolved, err := filepath.EvalSymlinks(cur)
+		if errors.Is(err, os.ErrNotExist) {
+			// Dangling link: judge it by where it would point.
+			target, rerr := os.Readlink(cur)
+			if rerr != nil {
+				return rerr
+			}
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(cur), target)
+			}
+			resolved = filepath.Clean(target)
+		} else if err != nil {
+			return err
+		}
+		if !isWithin(realRoot, resolved) && !isWithin(rootAbs, resolved) {
+			return errPathEscape
+		}
+	}
+	return nil
+}
+
+// internalPathFor returns a path inside internalDirName of the root abs
+// lies on.
+func internalPathFor(abs string, elem ...string) string {
+	rt := rootOf(abs)
+	if rt == nil {
+		rt = storageRoots[0]
+	}
+	return rt.internal(elem...)
+}
+
+// relFromAbs converts a path produced by resolvePath back into the
+// slash-separated form clients use.
+func relFromAbs(abs string) string {
+	rt := rootOf(abs)
+	if rt == nil {
+		return filepath.Base(abs)
+	}
+	rel, err := filepath.Rel(rt.Dir, abs)
+	if err != nil {
+		return filepath.Base(abs)
+	}
+	return rt.virtualPath(rel)
+}
+
+// openInRoot opens a file for reading. Unless symlinks may point anywhere,
+// the open goes through os.Root so the kernel enforces containment at the
+// moment of the open as well.
+func openInRoot(rel string) (*os.File, error) {
+	clean, err := cleanRelPath(rel)
+	if err != nil {
+		return nil, err
+	}
+	if symlinkPolicy == symlinkFollow {
+		full, err := resolvePath(clean)
+		if err != nil {
+			return nil, err
+		}
+		return os.Open(full)
+	}
+	if _, err := resolvePath(clean); err != nil {
+		return nil, err
+	}
+	rt, inner, _ := splitRoot(clean)
+
+	root, err := os.OpenRoot(rt.Dir)
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	return root.Open(inner)
+}
+
+// The mutations below go through os.Root unless symlinks may point
+// anywhere, so a symlink swapped in after resolvePath checked a path cannot
+// redirect them out of the storage root. Reads outside openInRoot (listings,
+// stats, the source side of copies) still use plain paths; the worst a swap
+// can do there is show or copy a file the link points at. os.Root only
+// follows relative links that stay inside, so absolute links are refused
+// here even when follow-inside would accept them.
+
+// openRootFor opens the storage root that all of paths lie on and returns
+// the paths relative to it. A nil root means the plain calls apply.
+func openRootFor(paths ...string) (*os.Root, []string, error) {
+	if symlinkPolicy == symlinkFollow {
+		return nil, nil, nil
+	}
+	rt := rootOf(paths[0])
+	if rt == nil {
+		return nil, nil, nil
+	}
+	rels := make([]string, len(paths))
+	for i, p := range paths {
+		if rootOf(p) != rt {
+			return nil, nil, nil
+		}
+		rel, err := filepath.Rel(rt.Dir, p)
+		if err != nil {
+			return nil, nil, err
+		}
+		rels[i] = rel
+	}
+	root, err := os.OpenRoot(rt.Dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	return root, rels, nil
+}
+
+func rootRename(src, dst string) error {
+	root, rels, err := openRootFor(src, dst)
+	if err != nil {
+		return err
+	}
+	if root == nil {
+		return os.Rename(src, dst)
+	}
+	defer root.Close()
+	return root.Rename(rels[0], rels[1])
+}
+
+func rootRemove(abs string) error {
+	root, rels, err := openRootFor(abs)
+	if err != nil {
+		return err
+	}
+	if root == nil {
+		return os.Remove(abs)
+	}
+	defer root.Close()
+	return root.Remove(rels[0])
+}
+
+func rootRemoveAll(abs string) error {
+	root, rels, err := openRootFor(abs)
+	if err != nil {
+		return err
+	}
+	if root == nil {
+		return os.RemoveAll(abs)
+	}
+	defer root.Close()
+	return root.RemoveAll(rels[0])
+}
+
+func rootMkdir(abs string, perm os.FileMode) error {
+	root, rels, err := openRootFor(abs)
+	if err != nil {
+		return err
+	}
+	if root == nil {
+		return os.Mkdir(abs, perm)
+	}
+	defer root.Close()
+	return root.Mkdir(rels[0], perm)
+}
+
+func rootMkdirAll(abs string, perm os.FileMode) error {
+	root, rels, err := openRootFor(abs)
+	if err != nil {
+		return err
+	}
+	if root == nil {
+		return os.MkdirAll(abs, perm)
+	}
+	defer root.Close()
+	return root.MkdirAll(rels[0], perm)
+}
+
+func rootOpenFile(abs string, flag int, perm os.FileMode) (*os.File, error) {
+	root, rels, err := openRootFor(abs)
+	if err != nil {
+		return nil, err
+	}
+	if root == nil {
+		return os.OpenFile(abs, flag, perm)
+	}
+	defer root.Close()
+	return root.OpenFile(rels[0], flag, perm)
+}
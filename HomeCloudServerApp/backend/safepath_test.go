@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var pathSeeds = []string{
+	"", ".", "/", "..", "../", "../x", "a/../../b", "a/b/../../..", "a/./b//c",
+	"/etc/passwd", "//server/share", `C:\Windows`, `C:x`, `\\server\share\x`,
+	`..\..\x`, "a\x00b", ".homecloud/signing.key", "dir/../.homecloud",
+	"inside/file.txt", "escape/secret.txt", "escape", "dangling", "dir/file.txt",
+}
+
+// testRoot makes a single storage root with a folder, a symlink that stays
+// inside, one that points out of the root and a dangling one that would.
+func testRoot(t testing.TB) string {
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	outside := filepath.Join(base, "outside")
+	for _, d := range []string{filepath.Join(root, "dir"), filepath.Join(root, internalDirName), outside} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.WriteFile(filepath.Join(root, "dir", "file.txt"), []byte("in"), 0644)
+	os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("out"), 0644)
+	// os.Root only follows relative links.
+	os.Symlink("dir", filepath.Join(root, "inside"))
+	os.Symlink(outside, filepath.Join(root, "escape"))
+	os.Symlink(filepath.Join(outside, "missing"), filepath.Join(root, "dangling"))
+
+	oldRoots, oldPolicy := storageRoots, symlinkPolicy
+	storageRoots = []*storageRoot{{Dir: root}}
+	t.Cleanup(func() { storageRoots, symlinkPolicy = oldRoots, oldPolicy })
+	return root
+}
+
+func TestCleanRelPath(t *testing.T) {
+	for in, want := range map[string]string{
+		"":            ".",
+		"/":           ".",
+		"a/b":         filepath.Join("a", "b"),
+		"/a//b/":      filepath.Join("a", "b"),
+		"a/./b/../c":  filepath.Join("a", "c"),
+		"a/..":        ".",
+		"./a":         "a",
+		"music/x.mp3": filepath.Join("music", "x.mp3"),
+	} {
+		if got, err := cleanRelPath(in); err != nil || got != want {
+			t.Errorf("cleanRelPath(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"..", "../x", "a/../../b", "/../etc", "a/b/../../.."} {
+		if _, err := cleanRelPath(in); !errors.Is(err, errPathEscape) {
+			t.Errorf("cleanRelPath(%q) = %v; want errPathEscape", in, err)
+		}
+	}
+	if _, err := cleanRelPath("a\x00b"); !errors.Is(err, errInvalidPath) {
+		t.Errorf("cleanRelPath with NUL = %v; want errInvalidPath", err)
+	}
+}
+
+func FuzzCleanRelPath(f *testing.F) {
+	for _, s := range pathSeeds {
+		f.Add(s)
+	}
+	sep := string(filepath.Separator)
+	f.Fuzz(func(t *testing.T, rel string) {
+		clean, err := cleanRelPath(rel)
+		if err != nil {
+			return
+		}
+		if clean != "." && !filepath.IsLocal(clean) {
+			t.Fatalf("cleanRelPath(%q) = %q, not local", rel, clean)
+		}
+		if filepath.IsAbs(clean) || filepath.VolumeName(clean) != "" {
+			t.Fatalf("cleanRelPath(%q) = %q, absolute", rel, clean)
+		}
+		for _, part := range strings.Split(clean, sep) {
+			if part == ".." {
+				t.Fatalf("cleanRelPath(%q) = %q, contains ..", rel, clean)
+			}
+		}
+		if !isWithin(sep+"root", filepath.Join(sep+"root", clean)) {
+			t.Fatalf("cleanRelPath(%q) = %q, escapes when joined", rel, clean)
+		}
+		if again, err := cleanRelPath(clean); err != nil || again != clean {
+			t.Fatalf("cleanRelPath not idempotent: %q -> %q -> %q, %v", rel, clean, again, err)
+		}
+	})
+}
+
+// realPath resolves the symlinks of the existing part of p.
+func realPath(p string) string {
+	existing, rest := p, ""
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return p
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		// A dangling link: it is where it points.
+		target, rerr := os.Readlink(existing)
+		if rerr != nil {
+			return p
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(existing), target)
+		}
+		resolved = target
+	}
+	return filepath.Join(resolved, rest)
+}
+
+func FuzzResolvePath(f *testing.F) {
+	for _, s := range pathSeeds {
+		f.Add(s)
+	}
+	root := testRoot(f)
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Fuzz(func(t *testing.T, rel string) {
+		for _, policy := range []string{symlinkDeny, symlinkFollowInside} {
+			symlinkPolicy = policy
+			full, err := resolvePath(rel)
+			if err != nil {
+				continue
+			}
+			if !isWithin(root, full) {
+				t.Fatalf("%s: resolvePath(%q) = %q, outside the root", policy, rel, full)
+			}
+			if !isWithin(realRoot, realPath(full)) {
+				t.Fatalf("%s: resolvePath(%q) = %q, resolves outside the root", policy, rel, full)
+			}
+			inner, _ := filepath.Rel(root, full)
+			if first, _, _ := strings.Cut(inner, string(filepath.Separator)); strings.EqualFold(first, internalDirName) {
+				t.Fatalf("%s: resolvePath(%q) = %q, reaches the internal folder", policy, rel, full)
+			}
+			if policy == symlinkDeny && realPath(full) != filepath.Join(realRoot, inner) {
+				t.Fatalf("deny: resolvePath(%q) = %q went through a symlink", rel, full)
+			}
+		}
+	})
+}
+
+func TestResolvePathSymlinks(t *testing.T) {
+	root := testRoot(t)
+	if _, err := os.Lstat(filepath.Join(root, "escape")); err != nil {
+		t.Skip("symlinks not available:", err)
+	}
+	for _, c := range []struct {
+		policy, rel string
+		ok          bool
+	}{
+		{symlinkFollowInside, "inside/file.txt", true},
+		{symlinkFollowInside, "escape/secret.txt", false},
+		{symlinkFollowInside, "dangling", false},
+		{symlinkDeny, "inside/file.txt", false},
+		{symlinkDeny, "dir/file.txt", true},
+		{symlinkFollow, "escape/secret.txt", true},
+	} {
+		symlinkPolicy = c.policy
+		_, err := resolvePath(c.rel)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: resolvePath(%q) error = %v, want ok=%t", c.policy, c.rel, err, c.ok)
+		}
+	}
+}
+
+func TestRootMutationsStayInside(t *testing.T) {
+	root := testRoot(t)
+	if _, err := os.Lstat(filepath.Join(root, "escape")); err != nil {
+		t.Skip("symlinks not available:", err)
+	}
+	symlinkPolicy = symlinkFollowInside
+	// As if "escape" had been swapped in after resolvePath passed the path.
+	if f, err := rootOpenFile(filepath.Join(root, "escape", "new.txt"), os.O_WRONLY|os.O_CREATE, 0644); err == nil {
+		f.Close()
+		t.Fatal("rootOpenFile created a file through a symlink out of the root")
+	}
+	if err := rootRemoveAll(filepath.Join(root, "escape", "secret.txt")); err == nil {
+		t.Fatal("rootRemoveAll removed a file through a symlink out of the root")
+	}
+	if err := rootRename(filepath.Join(root, "dir", "file.txt"), filepath.Join(root, "escape", "moved.txt")); err == nil {
+		t.Fatal("rootRename moved a file through a symlink out of the root")
+	}
+	if err := rootRename(filepath.Join(root, "dir", "file.txt"), filepath.Join(root, "inside", "renamed.txt")); err != nil {
+		t.Fatalf("rootRename inside the root: %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout is how long in-flight requests (uploads, streams) may keep
+// running after a shutdown was requested before they are cut off.
+var shutdownTimeout = 30 * time.Second
+
+var (
+	shutdownCh   = make(chan struct{})
+	shutdownOnce sync.Once
+
+	// background tracks the long running workers (watcher, stats, jobs)
+	// that have to be stopped before the process exits.
+	background sync.WaitGroup
+
+	hooksMu       sync.Mutex
+	shutdownHooks []func()
+
+	activeRequests atomic.Int64
+)
+
+// requestShutdown starts a graceful shutdown. It is safe to call repeatedly.
+func requestShutdown() {
+	shutdownOnce.Do(func() { close(shutdownCh) })
+}
+
+// onShutdown registers fn to run once all requests and workers have
+// stopped, e.g. to flush state to disk. Hooks run in registration order.
+func onShutdown(fn func()) {
+	hooksMu.Lock()
+	shutdownHooks = append(shutdownHooks, fn)
+	hooksMu.Unlock()
+}
+
+// goBackground runs fn as a tracked worker. fn must return once ctx is done.
+func goBackground(ctx context.Context, fn func(ctx context.Context)) {
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		fn(ctx)
+	}()
+}
+
+// trackRequests counts in-flight requests so shutdown can report what it
+// is waiting for.
+func trackRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		activeRequests.Add(1)
+		defer activeRequests.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// shutdownHandler lets the tray app stop the server without killing it.
+func shutdownHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		replyError(w, r, http.StatusMethodNotAllowed, "use POST method")
+		return
+	}
+	if requestUser(r) != adminUser {
+		replyError(w, r, http.StatusForbidden, "Only the admin can stop the server")
+		return
+	}
+	log.Printf("Shutdown requested by %s", r.RemoteAddr)
+	reply(w, r, http.StatusAccepted, "Server shutting down", map[string]interface{}{
+		"drain_timeout_seconds": int(shutdownTimeout.Seconds()),
+	})
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	go requestShutdown()
+}
+
+// listen returns the socket passed in by systemd, if any, and otherwise
+// listens on serverPort.
+func listen() (net.Listener, error) {
+	ln, err := sdListener()
+	if ln != nil || err != nil {
+		if ln != nil {
+			log.Printf("Using socket-activated listener on %s", ln.Addr())
+		}
+		return ln, err
+	}
+	return net.Listen("tcp", "0.0.0.0:"+serverPort)
+}
+
+// serve runs srv on ln until SIGINT/SIGTERM or /shutdown, then drains
+// requests, stops the background workers via cancel and runs the hooks.
+// It returns the error that stopped srv on its own, if any.
+func serve(srv *http.Server, ln net.Listener, cancel context.CancelFunc) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	var failed error
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.Serve(ln) }()
+	sdNotify("READY=1\nSTATUS=Serving on " + ln.Addr().String())
+
+	select {
+	case sig := <-signals:
+		log.Printf("Received %s, shutting down", sig)
+	case <-shutdownCh:
+	case err := <-serveErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Server stopped: %v", err)
+			failed = err
+		}
+	}
+	requestShutdown()
+	sdNotify("STOPPING=1")
+
+	if n := activeRequests.Load(); n > 0 {
+		log.Printf("Waiting up to %s for %d active request(s) to finish", shutdownTimeout, n)
+	}
+	ctx, stop := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer stop()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Drain timed out with %d request(s) still active, closing them", activeRequests.Load())
+		srv.Close()
+	}
+
+	cancel()
+	cancelJobs()
+	background.Wait()
+
+	hooksMu.Lock()
+	hooks := shutdownHooks
+	hooksMu.Unlock()
+	for _, fn := range hooks {
+		fn()
+	}
+	log.Println("Server stopped")
+	return failed
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// resetShutdown undoes requestShutdown once the test is over.
+func resetShutdown(t *testing.T) {
+	t.Cleanup(func() {
+		shutdownCh = make(chan struct{})
+		shutdownOnce = sync.Once{}
+	})
+}
+
+func TestServeResult(t *testing.T) {
+	resetShutdown(t)
+	listener := func() net.Listener {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ln
+	}
+
+	// A listener that fails makes the server stop on its own: that is
+	// a failure the service manager has to see.
+	ln := listener()
+	ln.Close()
+	if err := serve(&http.Server{}, ln, func() {}); err == nil {
+		t.Error("serve returned no error after the listener failed")
+	}
+
+	requestShutdown()
+	if err := serve(&http.Server{}, listener(), func() {}); err != nil {
+		t.Errorf("serve after a requested shutdown: %v", err)
+	}
+}
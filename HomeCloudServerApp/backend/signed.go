@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Signed URLs let players that cannot send headers fetch one file without
+// the user's token in the query. The signature covers the user, the path,
+// an expiry and optionally the client address; the key is kept in the
+// internal folder of the first root so URLs stay valid across restarts. A
+// URL signed for a path works on every route marked Signed.
+
+const (
+	playlistURLTTL  = 6 * time.Hour
+	signedURLTTL    = time.Hour
+	maxSignedURLTTL = 7 * 24 * time.Hour
+)
+
+var (
+	signingKeyOnce sync.Once
+	signingKey     []byte
+)
+
+func urlSigningKey() []byte {
+	signingKeyOnce.Do(func() {
+		file := storageRoots[0].internal("signing.key")
+		if b, err := os.ReadFile(file); err == nil && len(b) >= 32 {
+			signingKey = b
+			return
+		}
+		signingKey = make([]byte, 32)
+		rand.Read(signingKey)
+		os.MkdirAll(filepath.Dir(file), 0700)
+		if err := os.WriteFile(file, signingKey, 0600); err != nil {
+			log.Printf("Warning: cannot save the URL signing key, signed URLs end with this run: %v", err)
+		}
+	})
+	return signingKey
+}
+
+func urlSignature(user, rel, ip string, exp int64) string {
+	mac := hmac.New(sha256.New, urlSigningKey())
+	mac.Write([]byte(user + "\n" + rel + "\n" + ip + "\n" + strconv.FormatInt(exp, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signedQuery is the query string that lets user fetch rel until exp, only
+// from ip unless that is empty.
+func signedQuery(user, rel, ip string, exp time.Time) string {
+	q := url.Values{}
+	q.Set("u", user)
+	q.Set("exp", strconv.FormatInt(exp.Unix(), 10))
+	if ip != "" {
+		q.Set("ip", ip)
+	}
+	q.Set("sig", urlSignature(user, rel, ip, exp.Unix()))
+	return "?" + q.Encode()
+}
+
+// signedUser checks the signed URL parameters of r against rel and returns
+// the user they were minted for.
+func signedUser(r *http.Request, rel string) (string, bool) {
+	q := r.URL.Query()
+	user, ip, sig := q.Get("u"), q.Get("ip"), q.Get("sig")
+	exp, err := strconv.ParseInt(q.Get("exp"), 10, 64)
+	if sig == "" || err != nil || time.Now().Unix() > exp || !knownUser(user) {
+		return "", false
+	}
+	if ip != "" && ip != remoteIP(r) {
+		return "", false
+	}
+	if !hmac.Equal([]byte(sig), []byte(urlSignature(user, rel, ip, exp))) {
+		return "", false
+	}
+	return user, true
+}
+
+// linkQuery signs the URLs a response links to for the file at rel (HLS
+// playlists, subtitle tracks), since players fetch them without the
+// Authorization header. A request that came with a signed URL passes that
+// one on, so following links never extends its lifetime.
+func linkQuery(r *http.Request, rel string) string {
+	q := r.URL.Query()
+	if q.Get("sig") != "" {
+		signed := url.Values{}
+		for _, k := range []string{"u", "exp", "ip", "sig"} {
+			if v := q.Get(k); v != "" {
+				signed.Set(k, v)
+			}
+		}
+		return "?" + signed.Encode()
+	}
+	return signedQuery(requestUser(r), rel, "", time.Now().Add(playlistURLTTL))
+}
+
+// acceptSigned serves requests to rt that carry a valid signed URL with its
+// handler and everything else with fallback.
+func acceptSigned(rt route, fallback http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("sig") == "" {
+			fallback(w, r)
+			return
+		}
+		log.Printf("Incoming request: %s %s from %s agent %s (signed URL)", r.Method, r.URL.Path, r.RemoteAddr, r.UserAgent())
+		rel := strings.TrimPrefix(r.URL.Path, rt.Pattern)
+		if rt.SignedRel != nil {
+			rel = rt.SignedRel(rel)
+		}
+		user, ok := signedUser(r, rel)
+		if !ok {
+			log.Printf("Unauthorized [%s]: Path=%s Remote=%s invalid or expired signed URL", r.Method, r.URL.Path, r.RemoteAddr)
+			replyError(w, r, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		rt.Handler(w, r.WithContext(context.WithValue(r.Context(), ctxUser, user)))
+	}
+}
+
+// remoteIP is the address of the client, without the port.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+type signRequest struct {
+	Path string `json:"path"`
+	// ExpiresIn is the lifetime in seconds (default one hour, at most a week).
+	ExpiresIn int64 `json:"expires_in"`
+	// BindIP limits the URL to the caller's address, IP to another one.
+	BindIP bool   `json:"bind_ip"`
+	IP     string `json:"ip"`
+}
+
+type signedURL struct {
+	Path    string            `json:"path"`
+	Expires time.Time         `json:"expires"`
+	IP      string            `json:"ip,omitempty"`
+	Query   string            `json:"query"`
+	URLs    map[string]string `json:"urls"`
+}
+
+// signHandler mints a signed URL for one file, usable on the stream,
+// download, thumbnail and HLS routes.
+func signHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		replyError(w, r, http.StatusMethodNotAllowed, "use POST method")
+		return
+	}
+	var req signRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		replyError(w, r, http.StatusBadRequest, "Bad request")
+		return
+	}
+	ttl := time.Duration(req.ExpiresIn) * time.Second
+	if req.ExpiresIn == 0 {
+		ttl = signedURLTTL
+	}
+	if ttl <= 0 || ttl > maxSignedURLTTL {
+		replyError(w, r, http.StatusBadRequest, "expires_in must be between 1 second and 7 days")
+		return
+	}
+	ip := ""
+	if req.IP != "" {
+		parsed := net.ParseIP(req.IP)
+		if parsed == nil {
+			replyError(w, r, http.StatusBadRequest, "Invalid ip")
+			return
+		}
+		ip = parsed.String()
+	} else if req.BindIP {
+		ip = remoteIP(r)
+	}
+
+	abs, err := resolveItemPath(req.Path)
+	if err != nil {
+		replyOpError(w, r, err)
+		return
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		replyError(w, r, http.StatusNotFound, "Not found")
+		return
+	}
+	if info.IsDir() {
+		replyError(w, r, http.StatusBadRequest, "Only files can be signed")
+		return
+	}
+
+	rel := relFromAbs(abs)
+	exp := time.Now().Add(ttl).Truncate(time.Second)
+	query := signedQuery(requestUser(r), rel, ip, exp)
+	out := signedURL{Path: rel, Expires: exp.UTC(), IP: ip, Query: query, URLs: map[string]string{}}
+	for _, rt := range registeredRoutes {
+		if rt.Signed {
+			out.URLs[strings.Trim(rt.Pattern, "/")] = externalURL(r) + strings.Replace(rt.docPath(), "{path}", escapePath(rel), 1) + query
+		}
+	}
+	log.Printf("Signed URL for %s issued to %s, expires %s", rel, requestUser(r), out.Expires.Format(time.RFC3339))
+	reply(w, r, http.StatusOK, "", out)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signedRoute is the handler of the route at pattern as the mux would run
+// it: signed URLs are checked, anything else is unauthorized.
+func signedRoute(t *testing.T, pattern string) http.HandlerFunc {
+	for _, rt := range appRoutes() {
+		if rt.Pattern == pattern {
+			return acceptSigned(rt, func(w http.ResponseWriter, r *http.Request) {
+				replyError(w, r, http.StatusUnauthorized, "Unauthorized")
+			})
+		}
+	}
+	t.Fatalf("no route %s", pattern)
+	return nil
+}
+
+func TestSignedURLs(t *testing.T) {
+	root := testRoot(t)
+	os.WriteFile(filepath.Join(root, "dir", "other.txt"), []byte("other"), 0644)
+	h := signedRoute(t, "/stream/")
+	hour := time.Now().Add(time.Hour)
+	tampered := strings.Replace(signedQuery(adminUser, "dir/file.txt", "", hour),
+		"exp="+strconv.FormatInt(hour.Unix(), 10), "exp="+strconv.FormatInt(hour.Unix()+3600, 10), 1)
+
+	for name, c := range map[string]struct {
+		url    string
+		status int
+	}{
+		"valid":      {"/stream/dir/file.txt" + signedQuery(adminUser, "dir/file.txt", "", hour), http.StatusOK},
+		"bound ip":   {"/stream/dir/file.txt" + signedQuery(adminUser, "dir/file.txt", "192.0.2.1", hour), http.StatusOK},
+		"expired":    {"/stream/dir/file.txt" + signedQuery(adminUser, "dir/file.txt", "", time.Now().Add(-time.Minute)), http.StatusUnauthorized},
+		"wrong ip":   {"/stream/dir/file.txt" + signedQuery(adminUser, "dir/file.txt", "198.51.100.7", hour), http.StatusUnauthorized},
+		"other path": {"/stream/dir/other.txt" + signedQuery(adminUser, "dir/file.txt", "", hour), http.StatusUnauthorized},
+		"tampered":   {"/stream/dir/file.txt" + tampered, http.StatusUnauthorized},
+		"other user": {"/stream/dir/file.txt" + strings.Replace(signedQuery(adminUser, "dir/file.txt", "", hour), "u="+adminUser, "u=nobody", 1), http.StatusUnauthorized},
+	} {
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest("GET", c.url, nil)) // from 192.0.2.1
+		if rec.Code != c.status {
+			t.Errorf("%s: status %d, want %d", name, rec.Code, c.status)
+		}
+	}
+}
+
+// TestStreamEscapedName streams names that still look escaped once
+// decoded: the file served is the one the signature covers.
+func TestStreamEscapedName(t *testing.T) {
+	root := testRoot(t)
+	os.WriteFile(filepath.Join(root, "dir", "100% live.mp3"), []byte("percent"), 0644)
+	os.WriteFile(filepath.Join(root, "dir", "%41.mp3"), []byte("escaped"), 0644)
+	os.WriteFile(filepath.Join(root, "dir", "A.mp3"), []byte("plain"), 0644)
+	h := signedRoute(t, "/stream/")
+
+	for rel, want := range map[string]string{
+		"dir/100% live.mp3": "percent",
+		"dir/%41.mp3":       "escaped",
+		"dir/A.mp3":         "plain",
+	} {
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest("GET", "/stream/"+escapePath(rel)+signedQuery(adminUser, rel, "", time.Now().Add(time.Hour)), nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != want {
+			t.Errorf("%s: status %d, body %q; want %q", rel, rec.Code, rec.Body, want)
+		}
+	}
+}
+
+func TestHLSSourceRel(t *testing.T) {
+	for rest, want := range map[string]string{
+		"dir/clip.mp4/master.m3u8":        "dir/clip.mp4",
+		"dir/clip.mp4/720p/index.m3u8":    "dir/clip.mp4",
+		"dir/clip.mp4/720p/3.ts":          "dir/clip.mp4",
+		"clip.mp4/master.m3u8":            "clip.mp4",
+		"a/b/c d.mkv/original/index.m3u8": "a/b/c d.mkv",
+	} {
+		if got := hlsSourceRel(rest); got != want {
+			t.Errorf("hlsSourceRel(%q) = %q, want %q", rest, got, want)
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Full rescans compare the index against the disk at this interval to catch
+// events the watcher missed (queue overflow, changes while stopped, ...).
+var reconcileInterval = 6 * time.Hour
+
+// reconcileYieldEvery is how many entries a reconciliation scan reads
+// before pausing, so it never saturates the disk.
+const reconcileYieldEvery = 1000
+
+// dirNode holds the sizes of one folder: the files directly in it and the
+// total of everything below it.
+type dirNode struct {
+	parent *dirNode
+	files  map[string]int64
+	dirs   map[string]*dirNode
+	total  int64
+	// info is the folder as it was scanned. A folder deleted and recreated
+	// under the same name may get the same inode, so the mtime is compared
+	// as well.
+	info os.FileInfo
+
+	// owners maps file names to the user that wrote them, see owners.go.
+	owners map[string]string
+}
+
+func newDirNode(parent *dirNode) *dirNode {
+	return &dirNode{parent: parent, files: map[string]int64{}, dirs: map[string]*dirNode{}}
+}
+
+// grow adds delta to n and all of its ancestors.
+func (n *dirNode) grow(delta int64) {
+	for ; n != nil; n = n.parent {
+		n.total += delta
+	}
+}
+
+// sizeIndex tracks the size of every folder below a storage root. The
+// watcher feeds it the paths that changed and it re-stats only those, so
+// the quota never needs a walk of the whole tree.
+type sizeIndex struct {
+	mu      sync.RWMutex
+	root    string
+	exclude string
+	top     *dirNode
+
+	// watch and unwatch are called for folders that appear and disappear,
+	// so the watcher follows the tree.
+	watch, unwatch func(string)
+
+	// pending collects paths refreshed while a reconciliation scan runs;
+	// they are replayed on top of the scan result.
+	pending map[string]struct{}
+
+	// userUsed is the size of all files owned by each user.
+	userUsed    map[string]int64
+	ownersDirty bool
+}
+
+func newSizeIndex(root, exclude string, watch, unwatch func(string)) *sizeIndex {
+	return &sizeIndex{root: root, exclude: exclude, top: newDirNode(nil), watch: watch, unwatch: unwatch, userUsed: map[string]int64{}}
+}
+
+// scan builds the tree below abs and watches every folder in it. With
+// throttle set the scan pauses regularly to leave the disk to clients.
+func (ix *sizeIndex) scan(abs string, throttle bool) *dirNode {
+	n := newDirNode(nil)
+	var seen int
+	var walk func(dir string, n *dirNode)
+	walk = func(dir string, n *dirNode) {
+		ix.watch(dir)
+		n.info, _ = os.Lstat(dir)
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return
+		}
+		for _, e := range entries {
+			if seen++; throttle && seen%reconcileYieldEvery == 0 {
+				time.Sleep(10 * time.Millisecond)
+			}
+			p := filepath.Join(dir, e.Name())
+			if e.IsDir() {
+				if p == ix.exclude {
+					continue
+				}
+				child := newDirNode(n)
+				walk(p, child)
+				n.dirs[e.Name()] = child
+				n.total += child.total
+				continue
+			}
+			if info, err := e.Info(); err == nil {
+				n.files[e.Name()] = info.Size()
+				n.total += info.Size()
+			}
+		}
+	}
+	walk(abs, n)
+	return n
+}
+
+// parts splits abs into path elements below the root. ok is false for
+// paths outside the index.
+func (ix *sizeIndex) parts(abs string) ([]string, bool) {
+	rel, err := filepath.Rel(ix.root, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, false
+	}
+	if abs == ix.exclude || strings.HasPrefix(abs, ix.exclude+string(filepath.Separator)) {
+		return nil, false
+	}
+	if rel == "." {
+		return nil, true
+	}
+	return strings.Split(rel, string(filepath.Separator)), true
+}
+
+func (ix *sizeIndex) lookupLocked(parts []string) *dirNode {
+	n := ix.top
+	for _, p := range parts {
+		if n = n.dirs[p]; n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+// has reports whether the index knows abs and whether it is a folder.
+func (ix *sizeIndex) has(abs string) (known, dir bool) {
+	parts, ok := ix.parts(abs)
+	if !ok || len(parts) == 0 {
+		return false, false
+	}
+	name := parts[len(parts)-1]
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	parent := ix.lookupLocked(parts[:len(parts)-1])
+	if parent == nil {
+		return false, false
+	}
+	if parent.dirs[name] != nil {
+		return true, true
+	}
+	_, known = parent.files[name]
+	return known, false
+}
+
+// refresh re-stats abs and updates the index to match. It is idempotent,
+// so it is called for any watcher event on abs and by writers that want
+// their bytes counted right away.
+func (ix *sizeIndex) refresh(abs string) {
+	parts, ok := ix.parts(abs)
+	if !ok || len(parts) == 0 {
+		return
+	}
+	name := parts[len(parts)-1]
+	info, statErr := os.Lstat(abs)
+
+	// Scan new folders before taking the lock.
+	var scanned *dirNode
+	if statErr == nil && info.IsDir() {
+		ix.mu.RLock()
+		parent := ix.lookupLocked(parts[:len(parts)-1])
+		same := parent != nil && parent.dirs[name].is(info)
+		ix.mu.RUnlock()
+		if same {
+			// Changes inside it come with events of their own.
+			return
+		}
+		scanned = ix.scan(abs, false)
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if ix.pending != nil {
+		ix.pending[abs] = struct{}{}
+	}
+
+	parent := ix.lookupLocked(parts[:len(parts)-1])
+	if parent == nil {
+		// The parent folder is new too (e.g. created by MkdirAll right
+		// before the write); indexing it picks up abs as well.
+		ix.mu.Unlock()
+		ix.refresh(filepath.Dir(abs))
+		ix.mu.Lock()
+		return
+	}
+
+	if old := parent.dirs[name]; old != nil && scanned == nil {
+		ix.dropDirLocked(parent, name, abs)
+	}
+	_, isFile := parent.files[name]
+
+	switch {
+	case statErr != nil:
+		if isFile {
+			ix.dropFileLocked(parent, name)
+		}
+	case scanned != nil:
+		if old := parent.dirs[name]; old != nil {
+			if old.is(scanned.info) {
+				// Another refresh got there first.
+				return
+			}
+			// Changed since it was indexed, or a new folder under the old
+			// name: the scan replaces it. Owners only carry over to the
+			// same folder.
+			carried := old.info != nil && scanned.info != nil && os.SameFile(old.info, scanned.info)
+			if carried {
+				carryOwners(old, scanned)
+			}
+			ix.dropDirLocked(parent, name, abs)
+			forEachDir(scanned, abs, ix.watch)
+			if carried {
+				sumOwners(scanned, ix.userUsed)
+				ix.ownersDirty = true
+			}
+		}
+		if isFile {
+			ix.dropFileLocked(parent, name)
+		}
+		scanned.parent = parent
+		parent.dirs[name] = scanned
+		parent.grow(scanned.total)
+	default:
+		ix.setFileLocked(parent, name, info.Size())
+	}
+}
+
+// is reports whether n is the folder info describes, unchanged since it
+// was scanned.
+func (n *dirNode) is(info os.FileInfo) bool {
+	return n != nil && n.info != nil && info != nil && os.SameFile(n.info, info) && n.info.ModTime().Equal(info.ModTime())
+}
+
+// setFileLocked records the size of a file, keeping its owner.
+func (ix *sizeIndex) setFileLocked(n *dirNode, name string, size int64) {
+	delta := size - n.files[name]
+	n.files[name] = size
+	n.grow(delta)
+	if owner := n.owners[name]; owner != "" {
+		ix.userUsed[owner] += delta
+	}
+}
+
+// dropFileLocked removes a file that no longer exists.
+func (ix *sizeIndex) dropFileLocked(n *dirNode, name string) {
+	size := n.files[name]
+	delete(n.files, name)
+	n.grow(-size)
+	if owner := n.owners[name]; owner != "" {
+		ix.userUsed[owner] -= size
+		delete(n.owners, name)
+		ix.ownersDirty = true
+	}
+}
+
+// dropDirLocked removes a folder that no longer exists, with everything
+// in it.
+func (ix *sizeIndex) dropDirLocked(n *dirNode, name, abs string) {
+	old := n.dirs[name]
+	delete(n.dirs, name)
+	n.grow(-old.total)
+	ix.disownTreeLocked(old)
+	forEachDir(old, abs, ix.unwatch)
+}
+
+func forEachDir(n *dirNode, abs string, fn func(string)) {
+	fn(abs)
+	for name, child := range n.dirs {
+		forEachDir(child, filepath.Join(abs, name), fn)
+	}
+}
+
+// reconcile rescans the whole tree at idle I/O priority and replaces the
+// index with the result.
+func (ix *sizeIndex) reconcile() {
+	ix.mu.Lock()
+	ix.pending = map[string]struct{}{}
+	ix.mu.Unlock()
+
+	done := make(chan *dirNode)
+	go func() {
+		// The thread keeps its lowered priority, so it is never handed back
+		// to the scheduler: a goroutine that exits locked takes it along.
+		runtime.LockOSThread()
+		lowerIOPriority()
+		done <- ix.scan(ix.root, true)
+	}()
+	fresh := <-done
+
+	ix.mu.Lock()
+	drift := fresh.total - ix.top.total
+	carryOwners(ix.top, fresh)
+	ix.top = fresh
+	ix.userUsed = map[string]int64{}
+	sumOwners(fresh, ix.userUsed)
+	replay := ix.pending
+	ix.pending = nil
+	ix.mu.Unlock()
+
+	// Anything that changed during the scan may be missing from its result.
+	for abs := range replay {
+		ix.refresh(abs)
+	}
+	if drift != 0 {
+		log.Printf("Size index reconciled, corrected by %d bytes", drift)
+	}
+}
+
+func (ix *sizeIndex) total() int64 {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return ix.top.total
+}
+
+// dirSize returns the total size of the folder at abs.
+func (ix *sizeIndex) dirSize(abs string) (int64, bool) {
+	parts, ok := ix.parts(abs)
+	if !ok {
+		return 0, false
+	}
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	if n := ix.lookupLocked(parts); n != nil {
+		return n.total, true
+	}
+	return 0, false
+}
+
+// publishDirSize copies the total of all root indexes into cachedDirSize,
+// which /info reads.
+func publishDirSize() {
+	var total int64
+	for _, rt := range storageRoots {
+		total += rt.index.total()
+	}
+	mu.Lock()
+	cachedDirSize = total
+	mu.Unlock()
+}
+
+// folderSize is the indexed size of a folder, for listings. It returns
+// false until the watcher has built the index.
+func folderSize(abs string) (int64, bool) {
+	rt := rootOf(abs)
+	if rt == nil || !watcherReady.Load() {
+		return 0, false
+	}
+	return rt.index.dirSize(abs)
+}
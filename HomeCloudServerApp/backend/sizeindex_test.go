@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRefreshRecreatedFolder(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "album")
+	os.Mkdir(dir, 0755)
+	os.WriteFile(filepath.Join(dir, "a.jpg"), make([]byte, 1000), 0644)
+
+	noop := func(string) {}
+	ix := newSizeIndex(root, filepath.Join(root, internalDirName), noop, noop)
+	ix.top = ix.scan(root, false)
+	if got := ix.total(); got != 1000 {
+		t.Fatalf("initial total = %d, want 1000", got)
+	}
+
+	// Deleted and recreated within one debounce window: the watcher only
+	// reports the folder itself.
+	os.RemoveAll(dir)
+	os.Mkdir(dir, 0755)
+	os.WriteFile(filepath.Join(dir, "b.jpg"), make([]byte, 300), 0644)
+	ix.refresh(dir)
+
+	if got, _ := ix.dirSize(dir); got != 300 {
+		t.Errorf("recreated folder size = %d, want 300", got)
+	}
+	if got := ix.total(); got != 300 {
+		t.Errorf("total = %d, want 300", got)
+	}
+
+	// An event on an unchanged folder keeps its node.
+	before := ix.top.dirs["album"]
+	ix.refresh(dir)
+	if ix.top.dirs["album"] != before {
+		t.Error("refresh rescanned a folder that did not change")
+	}
+}
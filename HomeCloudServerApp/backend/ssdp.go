@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SSDP lets DLNA devices find the media server: it answers M-SEARCH
+// requests on 239.255.255.250:1900 and announces the server there while it
+// runs. The socket listens on port 1900 of all addresses, so searches from
+// outside the private network are ignored like HTTP requests are.
+
+var ssdpGroup = &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+
+const (
+	ssdpMaxAge        = 1800
+	ssdpAnnounceEvery = 15 * time.Minute
+)
+
+// ssdpTargets are the notification types (NT/ST) and unique service names
+// the server announces.
+func ssdpTargets() [][2]string {
+	udn := dlnaUDN()
+	return [][2]string{
+		{"upnp:rootdevice", udn + "::upnp:rootdevice"},
+		{udn, udn},
+		{upnpDeviceType, udn + "::" + upnpDeviceType},
+		{upnpCDS, udn + "::" + upnpCDS},
+		{upnpCMS, udn + "::" + upnpCMS},
+	}
+}
+
+func ssdpServer(ctx context.Context) {
+	if len(dlnaFolders) == 0 {
+		return
+	}
+	var ifi *net.Interface
+	if dlnaInterface != "" {
+		var err error
+		if ifi, err = net.InterfaceByName(dlnaInterface); err != nil {
+			log.Printf("Warning: DLNA_INTERFACE %q: %v; using the default interface", dlnaInterface, err)
+		}
+	}
+	conn, err := net.ListenMulticastUDP("udp4", ifi, ssdpGroup)
+	if err != nil {
+		log.Printf("Warning: DLNA discovery disabled, cannot listen on UDP 1900: %v", err)
+		return
+	}
+	log.Printf("DLNA: serving %d folder(s) as %q", len(dlnaFolders), dlnaName)
+
+	go ssdpListen(conn)
+	ssdpNotify(conn, "ssdp:alive")
+	tick := time.NewTicker(ssdpAnnounceEvery)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			ssdpNotify(conn, "ssdp:byebye")
+			conn.Close()
+			return
+		case <-tick.C:
+			ssdpNotify(conn, "ssdp:alive")
+		}
+	}
+}
+
+// ssdpLocation is the description URL as seen from a peer at ip: the
+// DLNA address the route to the peer leaves from, else the first one.
+func ssdpLocation(ip net.IP) string {
+	local := dlnaIPs[0]
+	// Connecting a UDP socket sends nothing; it only picks the route.
+	if c, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: ip, Port: 1900}); err == nil {
+		routed := c.LocalAddr().(*net.UDPAddr).IP
+		c.Close()
+		for _, l := range dlnaIPs {
+			if l.Equal(routed) {
+				local = l
+			}
+		}
+	}
+	return "http://" + net.JoinHostPort(local.String(), dlnaPort) + "/dlna/description.xml"
+}
+
+func ssdpServerHeader() string {
+	return runtime.GOOS + "/1.0 UPnP/1.0 HomeCloud/" + version
+}
+
+func ssdpNotify(conn *net.UDPConn, nts string) {
+	location := ssdpLocation(ssdpGroup.IP)
+	for _, t := range ssdpTargets() {
+		msg := "NOTIFY * HTTP/1.1\r\n" +
+			"HOST: 239.255.255.250:1900\r\n" +
+			"NT: " + t[0] + "\r\n" +
+			"NTS: " + nts + "\r\n" +
+			"USN: " + t[1] + "\r\n"
+		if nts == "ssdp:alive" {
+			msg += fmt.Sprintf("CACHE-CONTROL: max-age=%d\r\n", ssdpMaxAge) +
+				"LOCATION: " + location + "\r\n" +
+				"SERVER: " + ssdpServerHeader() + "\r\n"
+		}
+		conn.WriteToUDP([]byte(msg+"\r\n"), ssdpGroup)
+	}
+}
+
+func ssdpListen(conn *net.UDPConn) {
+	buf := make([]byte, 2048)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		replies, mx := ssdpAnswer(buf[:n], src.IP)
+		if len(replies) == 0 {
+			continue
+		}
+		// Answer within MX seconds, spread out as the spec asks.
+		delay := time.Duration(rand.Int63n(int64(min(max(mx, 1), 3)) * int64(time.Second) / 2))
+		time.AfterFunc(delay, func() {
+			for _, msg := range replies {
+				conn.WriteToUDP([]byte(msg), src)
+			}
+		})
+	}
+}
+
+// ssdpAnswer returns the responses to an M-SEARCH packet from src and the
+// MX it asked for; nothing for other packets, searches for something else
+// and senders outside the private network.
+func ssdpAnswer(packet []byte, src net.IP) ([]string, int) {
+	if !lanIP(src) {
+		return nil, 0
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(packet)))
+	if err != nil || req.Method != "M-SEARCH" || strings.Trim(req.Header.Get("MAN"), `"`) != "ssdp:discover" {
+		return nil, 0
+	}
+	st := req.Header.Get("ST")
+	var replies []string
+	location := ssdpLocation(src)
+	for _, t := range ssdpTargets() {
+		if st != "ssdp:all" && st != t[0] {
+			continue
+		}
+		replies = append(replies, "HTTP/1.1 200 OK\r\n"+
+			fmt.Sprintf("CACHE-CONTROL: max-age=%d\r\n", ssdpMaxAge)+
+			"DATE: "+time.Now().UTC().Format(http.TimeFormat)+"\r\n"+
+			"EXT:\r\n"+
+			"LOCATION: "+location+"\r\n"+
+			"SERVER: "+ssdpServerHeader()+"\r\n"+
+			"ST: "+t[0]+"\r\n"+
+			"USN: "+t[1]+"\r\n\r\n")
+	}
+	mx, _ := strconv.Atoi(req.Header.Get("MX"))
+	return replies, mx
+}
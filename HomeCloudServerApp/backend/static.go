@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// Static hosting serves a single designated storage folder at
+// /uploads/. It is disabled unless PUBLIC_DIR is set and always sits behind
+// authMiddleware.
+var (
+	publicDir     = ""
+	publicListing = false
+)
+
+// publicFS exposes publicDir to http.FileServer. Dotfiles are invisible and
+// directories without an index.html are only browsable when listing is on.
+type publicFS struct {
+	base    string
+	listing bool
+}
+
+func (p publicFS) Open(name string) (http.File, error) {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return nil, os.ErrNotExist
+		}
+	}
+
+	rel := path.Join(p.base, name)
+	f, err := openInRoot(rel)
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() && !p.listing {
+		index, err := openInRoot(path.Join(rel, "index.html"))
+		if err != nil {
+			f.Close()
+			return nil, os.ErrNotExist
+		}
+		index.Close()
+	}
+
+	return dotHidingFile{f}, nil
+}
+
+// dotHidingFile drops dotfiles from directory listings.
+type dotHidingFile struct {
+	*os.File
+}
+
+func (f dotHidingFile) Readdir(n int) ([]os.FileInfo, error) {
+	infos, err := f.File.Readdir(n)
+	visible := infos[:0]
+	for _, info := range infos {
+		if !strings.HasPrefix(info.Name(), ".") {
+			visible = append(visible, info)
+		}
+	}
+	return visible, err
+}
+
+func (f dotHidingFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries, err := f.File.ReadDir(n)
+	visible := entries[:0]
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), ".") {
+			visible = append(visible, e)
+		}
+	}
+	return visible, err
+}
+
+// publicEnabled is set once the /uploads/ route is registered.
+var publicEnabled bool
+
+// publicHandler returns the /uploads/ handler, or nil when static hosting
+// is not configured.
+func publicHandler() http.HandlerFunc {
+	if publicDir == "" {
+		return nil
+	}
+
+	base, err := cleanRelPath(publicDir)
+	if err != nil || base == "." {
+		return nil
+	}
+	if full, err := resolvePath(base); err == nil {
+		os.MkdirAll(full, os.ModePerm)
+	}
+
+	fileServer := http.StripPrefix("/uploads/", http.FileServer(publicFS{base: base, listing: publicListing}))
+	return fileServer.ServeHTTP
+}
@@ -0,0 +1,671 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"image"
+	"image/jpeg"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Subsonic API at /rest/<method>[.view], on top of the music library, so
+// Subsonic and OpenSubsonic players can use the server. Logins are the same
+// as everywhere else: the user name (admin for AUTH_TOKEN) with its token
+// as password, sent plain, hex encoded or as a salted MD5 token.
+
+const subsonicAPIVersion = "1.16.1"
+
+// Subsonic error codes.
+const (
+	ssErrGeneric   = 0
+	ssErrMissing   = 10
+	ssErrLogin     = 40
+	ssErrNotFound  = 70
+	ssErrBadAPIKey = 44
+)
+
+type ssResponse struct {
+	XMLName       xml.Name `xml:"subsonic-response" json:"-"`
+	Xmlns         string   `xml:"xmlns,attr" json:"-"`
+	Status        string   `xml:"status,attr" json:"status"`
+	Version       string   `xml:"version,attr" json:"version"`
+	Type          string   `xml:"type,attr" json:"type"`
+	ServerVersion string   `xml:"serverVersion,attr" json:"serverVersion"`
+	OpenSubsonic  bool     `xml:"openSubsonic,attr" json:"openSubsonic"`
+
+	Error         *ssError        `xml:"error,omitempty" json:"error,omitempty"`
+	License       *ssLicense      `xml:"license,omitempty" json:"license,omitempty"`
+	MusicFolders  *ssMusicFolders `xml:"musicFolders,omitempty" json:"musicFolders,omitempty"`
+	Indexes       *ssIndexes      `xml:"indexes,omitempty" json:"indexes,omitempty"`
+	Artists       *ssIndexes      `xml:"artists,omitempty" json:"artists,omitempty"`
+	Artist        *ssArtist       `xml:"artist,omitempty" json:"artist,omitempty"`
+	Album         *ssAlbum        `xml:"album,omitempty" json:"album,omitempty"`
+	Song          *ssChild        `xml:"song,omitempty" json:"song,omitempty"`
+	Directory     *ssDirectory    `xml:"directory,omitempty" json:"directory,omitempty"`
+	AlbumList2    *ssAlbumList2   `xml:"albumList2,omitempty" json:"albumList2,omitempty"`
+	SearchResult3 *ssSearchResult `xml:"searchResult3,omitempty" json:"searchResult3,omitempty"`
+}
+
+type ssError struct {
+	Code    int    `xml:"code,attr" json:"code"`
+	Message string `xml:"message,attr" json:"message"`
+}
+
+type ssLicense struct {
+	Valid bool `xml:"valid,attr" json:"valid"`
+}
+
+type ssMusicFolders struct {
+	Folders []ssMusicFolder `xml:"musicFolder" json:"musicFolder"`
+}
+
+type ssMusicFolder struct {
+	ID   int    `xml:"id,attr" json:"id"`
+	Name string `xml:"name,attr" json:"name"`
+}
+
+type ssIndexes struct {
+	LastModified    int64     `xml:"lastModified,attr,omitempty" json:"lastModified,omitempty"`
+	IgnoredArticles string    `xml:"ignoredArticles,attr" json:"ignoredArticles"`
+	Index           []ssIndex `xml:"index" json:"index"`
+}
+
+type ssIndex struct {
+	Name    string     `xml:"name,attr" json:"name"`
+	Artists []ssArtist `xml:"artist" json:"artist"`
+}
+
+type ssArtist struct {
+	ID         string    `xml:"id,attr" json:"id"`
+	Name       string    `xml:"name,attr" json:"name"`
+	AlbumCount int       `xml:"albumCount,attr" json:"albumCount"`
+	CoverArt   string    `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	Albums     []ssAlbum `xml:"album,omitempty" json:"album,omitempty"`
+}
+
+type ssAlbum struct {
+	ID        string    `xml:"id,attr" json:"id"`
+	Name      string    `xml:"name,attr" json:"name"`
+	Artist    string    `xml:"artist,attr" json:"artist"`
+	ArtistID  string    `xml:"artistId,attr" json:"artistId"`
+	CoverArt  string    `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	SongCount int       `xml:"songCount,attr" json:"songCount"`
+	Duration  int       `xml:"duration,attr" json:"duration"`
+	Created   string    `xml:"created,attr" json:"created"`
+	Year      int       `xml:"year,attr,omitempty" json:"year,omitempty"`
+	Genre     string    `xml:"genre,attr,omitempty" json:"genre,omitempty"`
+	Songs     []ssChild `xml:"song,omitempty" json:"song,omitempty"`
+}
+
+// ssChild is a song, or an album when browsing by folder.
+type ssChild struct {
+	ID          string `xml:"id,attr" json:"id"`
+	Parent      string `xml:"parent,attr,omitempty" json:"parent,omitempty"`
+	IsDir       bool   `xml:"isDir,attr" json:"isDir"`
+	Title       string `xml:"title,attr" json:"title"`
+	Album       string `xml:"album,attr,omitempty" json:"album,omitempty"`
+	Artist      string `xml:"artist,attr,omitempty" json:"artist,omitempty"`
+	Track       int    `xml:"track,attr,omitempty" json:"track,omitempty"`
+	DiscNumber  int    `xml:"discNumber,attr,omitempty" json:"discNumber,omitempty"`
+	Year        int    `xml:"year,attr,omitempty" json:"year,omitempty"`
+	Genre       string `xml:"genre,attr,omitempty" json:"genre,omitempty"`
+	CoverArt    string `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	Size        int64  `xml:"size,attr,omitempty" json:"size,omitempty"`
+	ContentType string `xml:"contentType,attr,omitempty" json:"contentType,omitempty"`
+	Suffix      string `xml:"suffix,attr,omitempty" json:"suffix,omitempty"`
+	Duration    int    `xml:"duration,attr,omitempty" json:"duration,omitempty"`
+	BitRate     int    `xml:"bitRate,attr,omitempty" json:"bitRate,omitempty"`
+	Path        string `xml:"path,attr,omitempty" json:"path,omitempty"`
+	AlbumID     string `xml:"albumId,attr,omitempty" json:"albumId,omitempty"`
+	ArtistID    string `xml:"artistId,attr,omitempty" json:"artistId,omitempty"`
+	Type        string `xml:"type,attr,omitempty" json:"type,omitempty"`
+}
+
+type ssDirectory struct {
+	ID       string    `xml:"id,attr" json:"id"`
+	Parent   string    `xml:"parent,attr,omitempty" json:"parent,omitempty"`
+	Name     string    `xml:"name,attr" json:"name"`
+	Children []ssChild `xml:"child" json:"child"`
+}
+
+type ssAlbumList2 struct {
+	Albums []ssAlbum `xml:"album" json:"album"`
+}
+
+type ssSearchResult struct {
+	Artists []ssArtist `xml:"artist" json:"artist"`
+	Albums  []ssAlbum  `xml:"album" json:"album"`
+	Songs   []ssChild  `xml:"song" json:"song"`
+}
+
+// subsonicMethods are the supported methods.
+var subsonicMethods = map[string]func(w http.ResponseWriter, r *http.Request, q url.Values) *ssResponse{
+	"ping": func(http.ResponseWriter, *http.Request, url.Values) *ssResponse { return &ssResponse{} },
+	"getLicense": func(http.ResponseWriter, *http.Request, url.Values) *ssResponse {
+		return &ssResponse{License: &ssLicense{Valid: true}}
+	},
+	"getMusicFolders":   ssGetMusicFolders,
+	"getIndexes":        ssGetIndexes,
+	"getArtists":        ssGetArtists,
+	"getArtist":         ssGetArtist,
+	"getAlbum":          ssGetAlbum,
+	"getSong":           ssGetSong,
+	"getMusicDirectory": ssGetMusicDirectory,
+	"getAlbumList2":     ssGetAlbumList2,
+	"search3":           ssSearch3,
+	"stream":            ssStream,
+	"download":          ssStream,
+	"getCoverArt":       ssGetCoverArt,
+}
+
+func subsonicHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeSubsonic(w, r.URL.Query(), ssFail(ssErrGeneric, "Bad request"))
+		return
+	}
+	q := r.Form
+	method := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/rest/"), ".view")
+
+	user, code := subsonicUser(q)
+	switch code {
+	case 0:
+	case ssErrMissing:
+		writeSubsonic(w, q, ssFail(code, "Required parameter is missing: u, with p or t and s"))
+		return
+	default:
+		log.Printf("Subsonic: login failed for %q from %s", q.Get("u"), r.RemoteAddr)
+		writeSubsonic(w, q, ssFail(code, "Wrong username or password"))
+		return
+	}
+	fn, ok := subsonicMethods[method]
+	if !ok {
+		writeSubsonic(w, q, ssFail(ssErrGeneric, "Unknown method "+method))
+		return
+	}
+	r = r.WithContext(context.WithValue(r.Context(), ctxUser, user))
+	if resp := fn(w, r, q); resp != nil {
+		writeSubsonic(w, q, resp)
+	}
+}
+
+// subsonicUser checks the credentials of a request: an OpenSubsonic apiKey,
+// u with p (plain or "enc:" hex) or u with t = md5(password + s). It
+// returns the user or a Subsonic error code.
+func subsonicUser(q url.Values) (string, int) {
+	if key := q.Get("apiKey"); key != "" {
+		if user, ok := userForToken(key); ok {
+			return user, 0
+		}
+		return "", ssErrBadAPIKey
+	}
+	name := q.Get("u")
+	if name == "" {
+		return "", ssErrMissing
+	}
+	token, ok := tokenOf(name)
+	if !ok || token == "" {
+		return "", ssErrLogin
+	}
+	if p := q.Get("p"); p != "" {
+		if h, ok := strings.CutPrefix(p, "enc:"); ok {
+			b, err := hex.DecodeString(h)
+			if err != nil {
+				return "", ssErrLogin
+			}
+			p = string(b)
+		}
+		if subtle.ConstantTimeCompare([]byte(p), []byte(token)) == 1 {
+			return name, 0
+		}
+		return "", ssErrLogin
+	}
+	if t, s := q.Get("t"), q.Get("s"); t != "" && s != "" {
+		sum := md5.Sum([]byte(token + s))
+		if subtle.ConstantTimeCompare([]byte(strings.ToLower(t)), []byte(hex.EncodeToString(sum[:]))) == 1 {
+			return name, 0
+		}
+		return "", ssErrLogin
+	}
+	return "", ssErrMissing
+}
+
+func ssFail(code int, msg string) *ssResponse {
+	return &ssResponse{Status: "failed", Error: &ssError{Code: code, Message: msg}}
+}
+
+// writeSubsonic sends resp as XML, or as JSON with f=json. Subsonic reports
+// errors in the body with status 200.
+func writeSubsonic(w http.ResponseWriter, q url.Values, resp *ssResponse) {
+	if resp.Status == "" {
+		resp.Status = "ok"
+	}
+	resp.Xmlns = "http://subsonic.org/restapi"
+	resp.Version = subsonicAPIVersion
+	resp.Type = "homecloud"
+	resp.ServerVersion = version
+	resp.OpenSubsonic = true
+
+	if q.Get("f") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]*ssResponse{"subsonic-response": resp})
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(resp)
+}
+
+// ssTracks returns the library, only the folder musicFolderId if set.
+func ssTracks(q url.Values) []*musicTrack {
+	tracks := library.snapshot()
+	id, err := strconv.Atoi(q.Get("musicFolderId"))
+	if err != nil {
+		return tracks
+	}
+	var out []*musicTrack
+	for _, t := range tracks {
+		if f := musicFolderOf(t.abs); f != nil && f.ID == id {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+func ssSong(t *musicTrack) ssChild {
+	c := ssChild{
+		ID:          t.ID,
+		Parent:      t.AlbumID,
+		Title:       t.Title,
+		Album:       t.Album,
+		Artist:      t.Artist,
+		Track:       t.Track,
+		DiscNumber:  t.Disc,
+		Year:        t.Year,
+		Genre:       t.Genre,
+		Size:        t.Size,
+		ContentType: mediaType(filepath.Ext(t.abs)),
+		Suffix:      strings.TrimPrefix(strings.ToLower(filepath.Ext(t.abs)), "."),
+		Duration:    int(t.Duration + 0.5),
+		Path:        t.Path,
+		AlbumID:     t.AlbumID,
+		ArtistID:    t.ArtistID,
+		Type:        "music",
+	}
+	if t.Duration > 0 {
+		c.BitRate = int(float64(t.Size) * 8 / t.Duration / 1000)
+	}
+	if t.CoverURL != "" {
+		c.CoverArt = t.ID
+	}
+	return c
+}
+
+func ssAlbumOf(a *musicAlbum) ssAlbum {
+	s := ssAlbum{
+		ID:        a.ID,
+		Name:      a.Name,
+		Artist:    a.Artist,
+		ArtistID:  a.ArtistID,
+		SongCount: a.TrackCount,
+		Duration:  int(a.Duration + 0.5),
+		Created:   a.Added.UTC().Format(time.RFC3339),
+		Year:      a.Year,
+		Genre:     a.Genre,
+	}
+	if a.cover != "" {
+		s.CoverArt = a.ID
+	}
+	return s
+}
+
+// ssArtistsOf lists the album artists of albums by name.
+func ssArtistsOf(albums []*musicAlbum) []ssArtist {
+	byID := map[string]*ssArtist{}
+	var artists []*ssArtist
+	for _, a := range albums {
+		ar := byID[a.ArtistID]
+		if ar == nil {
+			ar = &ssArtist{ID: a.ArtistID, Name: a.Artist}
+			byID[a.ArtistID] = ar
+			artists = append(artists, ar)
+		}
+		ar.AlbumCount++
+		if ar.CoverArt == "" && a.cover != "" {
+			ar.CoverArt = a.ArtistID
+		}
+	}
+	sort.Slice(artists, func(i, j int) bool { return sortName(artists[i].Name) < sortName(artists[j].Name) })
+	out := make([]ssArtist, len(artists))
+	for i, a := range artists {
+		out[i] = *a
+	}
+	return out
+}
+
+const ssIgnoredArticles = "The El La Los Las Le Les"
+
+// sortName is name in lower case without a leading article.
+func sortName(name string) string {
+	lower := strings.ToLower(name)
+	for _, a := range strings.Fields(ssIgnoredArticles) {
+		if rest, ok := strings.CutPrefix(lower, strings.ToLower(a)+" "); ok {
+			return rest
+		}
+	}
+	return lower
+}
+
+func ssIndexOf(artists []ssArtist) []ssIndex {
+	var index []ssIndex
+	for _, a := range artists {
+		key := "#"
+		if r := []rune(sortName(a.Name)); len(r) > 0 && unicode.IsLetter(r[0]) {
+			key = string(unicode.ToUpper(r[0]))
+		}
+		if len(index) == 0 || index[len(index)-1].Name != key {
+			index = append(index, ssIndex{Name: key})
+		}
+		index[len(index)-1].Artists = append(index[len(index)-1].Artists, a)
+	}
+	return index
+}
+
+func ssGetMusicFolders(w http.ResponseWriter, r *http.Request, q url.Values) *ssResponse {
+	folders := &ssMusicFolders{Folders: []ssMusicFolder{}}
+	for _, f := range musicFolders {
+		folders.Folders = append(folders.Folders, ssMusicFolder{ID: f.ID, Name: f.Name})
+	}
+	return &ssResponse{MusicFolders: folders}
+}
+
+func ssGetIndexes(w http.ResponseWriter, r *http.Request, q url.Values) *ssResponse {
+	tracks := ssTracks(q)
+	var modified time.Time
+	for _, t := range tracks {
+		if t.modTime.After(modified) {
+			modified = t.modTime
+		}
+	}
+	idx := &ssIndexes{LastModified: modified.UnixMilli(), IgnoredArticles: ssIgnoredArticles}
+	// Nothing changed since the client's copy: an empty index says so.
+	if since, err := strconv.ParseInt(q.Get("ifModifiedSince"), 10, 64); err == nil && since >= idx.LastModified {
+		return &ssResponse{Indexes: idx}
+	}
+	idx.Index = ssIndexOf(ssArtistsOf(musicAlbums(tracks)))
+	return &ssResponse{Indexes: idx}
+}
+
+func ssGetArtists(w http.ResponseWriter, r *http.Request, q url.Values) *ssResponse {
+	artists := ssArtistsOf(musicAlbums(ssTracks(q)))
+	return &ssResponse{Artists: &ssIndexes{IgnoredArticles: ssIgnoredArticles, Index: ssIndexOf(artists)}}
+}
+
+func ssGetArtist(w http.ResponseWriter, r *http.Request, q url.Values) *ssResponse {
+	id := q.Get("id")
+	var artist *ssArtist
+	for _, a := range musicAlbums(library.snapshot()) {
+		if a.ArtistID != id {
+			continue
+		}
+		if artist == nil {
+			artist = &ssArtist{ID: id, Name: a.Artist}
+		}
+		s := ssAlbumOf(a)
+		artist.Albums = append(artist.Albums, s)
+		artist.AlbumCount++
+		if artist.CoverArt == "" {
+			artist.CoverArt = s.CoverArt
+		}
+	}
+	if artist == nil {
+		return ssFail(ssErrNotFound, "Artist not found")
+	}
+	return &ssResponse{Artist: artist}
+}
+
+// ssAlbumByID returns the album id and its tracks.
+func ssAlbumByID(id string) (*musicAlbum, []*musicTrack) {
+	var tracks []*musicTrack
+	for _, t := range library.snapshot() {
+		if t.AlbumID == id {
+			tracks = append(tracks, t)
+		}
+	}
+	if len(tracks) == 0 {
+		return nil, nil
+	}
+	return musicAlbums(tracks)[0], tracks
+}
+
+func ssGetAlbum(w http.ResponseWriter, r *http.Request, q url.Values) *ssResponse {
+	a, tracks := ssAlbumByID(q.Get("id"))
+	if a == nil {
+		return ssFail(ssErrNotFound, "Album not found")
+	}
+	s := ssAlbumOf(a)
+	for _, t := range tracks {
+		s.Songs = append(s.Songs, ssSong(t))
+	}
+	return &ssResponse{Album: &s}
+}
+
+func ssGetSong(w http.ResponseWriter, r *http.Request, q url.Values) *ssResponse {
+	t := library.track(q.Get("id"))
+	if t == nil {
+		return ssFail(ssErrNotFound, "Song not found")
+	}
+	s := ssSong(t)
+	return &ssResponse{Song: &s}
+}
+
+// ssGetMusicDirectory browses the index of getIndexes: an artist holds
+// albums, an album holds songs.
+func ssGetMusicDirectory(w http.ResponseWriter, r *http.Request, q url.Values) *ssResponse {
+	id := q.Get("id")
+	if a, tracks := ssAlbumByID(id); a != nil {
+		dir := &ssDirectory{ID: a.ID, Parent: a.ArtistID, Name: a.Name}
+		for _, t := range tracks {
+			dir.Children = append(dir.Children, ssSong(t))
+		}
+		return &ssResponse{Directory: dir}
+	}
+	var dir *ssDirectory
+	for _, a := range musicAlbums(library.snapshot()) {
+		if a.ArtistID != id {
+			continue
+		}
+		if dir == nil {
+			dir = &ssDirectory{ID: id, Name: a.Artist}
+		}
+		c := ssChild{ID: a.ID, Parent: id, IsDir: true, Title: a.Name, Album: a.Name, Artist: a.Artist, Year: a.Year, Genre: a.Genre}
+		if a.cover != "" {
+			c.CoverArt = a.ID
+		}
+		dir.Children = append(dir.Children, c)
+	}
+	if dir == nil {
+		return ssFail(ssErrNotFound, "Directory not found")
+	}
+	return &ssResponse{Directory: dir}
+}
+
+func ssGetAlbumList2(w http.ResponseWriter, r *http.Request, q url.Values) *ssResponse {
+	albums := musicAlbums(ssTracks(q))
+	switch q.Get("type") {
+	case "random":
+		rand.Shuffle(len(albums), func(i, j int) { albums[i], albums[j] = albums[j], albums[i] })
+	case "newest":
+		sort.SliceStable(albums, func(i, j int) bool { return albums[i].Added.After(albums[j].Added) })
+	case "alphabeticalByName":
+		sort.SliceStable(albums, func(i, j int) bool { return sortName(albums[i].Name) < sortName(albums[j].Name) })
+	case "alphabeticalByArtist":
+		sort.SliceStable(albums, func(i, j int) bool {
+			if a, b := sortName(albums[i].Artist), sortName(albums[j].Artist); a != b {
+				return a < b
+			}
+			return albums[i].Year < albums[j].Year
+		})
+	case "byYear":
+		from, _ := strconv.Atoi(q.Get("fromYear"))
+		to, _ := strconv.Atoi(q.Get("toYear"))
+		lo, hi := min(from, to), max(from, to)
+		var in []*musicAlbum
+		for _, a := range albums {
+			if a.Year >= lo && a.Year <= hi {
+				in = append(in, a)
+			}
+		}
+		albums = in
+		sort.SliceStable(albums, func(i, j int) bool {
+			if from > to {
+				return albums[i].Year > albums[j].Year
+			}
+			return albums[i].Year < albums[j].Year
+		})
+	case "byGenre":
+		var in []*musicAlbum
+		for _, a := range albums {
+			if strings.EqualFold(a.Genre, q.Get("genre")) {
+				in = append(in, a)
+			}
+		}
+		albums = in
+	case "frequent", "recent", "starred", "highest":
+		// Plays, stars and ratings are not recorded.
+		albums = nil
+	case "":
+		return ssFail(ssErrMissing, "Required parameter is missing: type")
+	default:
+		return ssFail(ssErrGeneric, "Unknown list type "+q.Get("type"))
+	}
+
+	from, to := ssPage(q, "size", "offset", 10, len(albums))
+	list := &ssAlbumList2{Albums: []ssAlbum{}}
+	for _, a := range albums[from:to] {
+		list.Albums = append(list.Albums, ssAlbumOf(a))
+	}
+	return &ssResponse{AlbumList2: list}
+}
+
+// ssPage reads a count and offset parameter pair for n results.
+func ssPage(q url.Values, count, offset string, def, n int) (int, int) {
+	size, err := strconv.Atoi(q.Get(count))
+	if err != nil || size < 0 {
+		size = def
+	}
+	size = min(size, 500)
+	off, _ := strconv.Atoi(q.Get(offset))
+	off = min(max(off, 0), n)
+	return off, min(off+size, n)
+}
+
+// ssSearch3 matches every word of query against names. An empty query
+// (or "") returns everything, which clients use to sync the library.
+func ssSearch3(w http.ResponseWriter, r *http.Request, q url.Values) *ssResponse {
+	words := strings.Fields(strings.ToLower(strings.Trim(q.Get("query"), `"`)))
+	matches := func(s string) bool {
+		s = strings.ToLower(s)
+		for _, w := range words {
+			if !strings.Contains(s, w) {
+				return false
+			}
+		}
+		return true
+	}
+
+	tracks := ssTracks(q)
+	albums := musicAlbums(tracks)
+	res := &ssSearchResult{Artists: []ssArtist{}, Albums: []ssAlbum{}, Songs: []ssChild{}}
+
+	var artists []ssArtist
+	for _, a := range ssArtistsOf(albums) {
+		if matches(a.Name) {
+			artists = append(artists, a)
+		}
+	}
+	from, to := ssPage(q, "artistCount", "artistOffset", 20, len(artists))
+	res.Artists = append(res.Artists, artists[from:to]...)
+
+	var found []*musicAlbum
+	for _, a := range albums {
+		if matches(a.Name + " " + a.Artist) {
+			found = append(found, a)
+		}
+	}
+	from, to = ssPage(q, "albumCount", "albumOffset", 20, len(found))
+	for _, a := range found[from:to] {
+		res.Albums = append(res.Albums, ssAlbumOf(a))
+	}
+
+	var songs []*musicTrack
+	for _, t := range tracks {
+		if matches(t.Title + " " + t.Artist + " " + t.Album) {
+			songs = append(songs, t)
+		}
+	}
+	from, to = ssPage(q, "songCount", "songOffset", 20, len(songs))
+	for _, t := range songs[from:to] {
+		res.Songs = append(res.Songs, ssSong(t))
+	}
+	return &ssResponse{SearchResult3: res}
+}
+
+// ssStream serves the original file through the /stream code; there is no
+// audio transcoding, so format and maxBitRate are ignored.
+func ssStream(w http.ResponseWriter, r *http.Request, q url.Values) *ssResponse {
+	t := library.track(q.Get("id"))
+	if t == nil {
+		return ssFail(ssErrNotFound, "Song not found")
+	}
+	file, info, fullPath, err := openStream(t.Path)
+	if err != nil {
+		status, _, msg := errorInfo(err)
+		if status == http.StatusNotFound {
+			return ssFail(ssErrNotFound, "Song not found")
+		}
+		return ssFail(ssErrGeneric, msg)
+	}
+	defer file.Close()
+	sendStream(w, r, fullPath, file, info)
+	return nil
+}
+
+func ssGetCoverArt(w http.ResponseWriter, r *http.Request, q url.Values) *ssResponse {
+	t := coverTrack(q.Get("id"))
+	if t == nil {
+		return ssFail(ssErrNotFound, "Cover art not found")
+	}
+	data, ctype, err := coverImage(t)
+	if err != nil {
+		return ssFail(ssErrNotFound, "Cover art not found")
+	}
+	if size, err := strconv.Atoi(q.Get("size")); err == nil && size > 0 {
+		if img, _, err := image.Decode(bytes.NewReader(data)); err == nil {
+			b := img.Bounds()
+			if b.Dx() > size || b.Dy() > size {
+				var out bytes.Buffer
+				if jpeg.Encode(&out, scaleDown(img, size), &jpeg.Options{Quality: 85}) == nil {
+					data, ctype = out.Bytes(), "image/jpeg"
+				}
+			}
+		}
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Write(data)
+	return nil
+}
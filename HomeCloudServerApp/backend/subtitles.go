@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Sidecar subtitles: for movie.mp4 the tracks are movie.srt, movie.en.srt,
+// movie.de.forced.vtt, ... next to it or in a Subs folder beside it. They
+// are served as WebVTT, the only format browsers load into <track>.
+
+var subtitleExts = map[string]bool{".srt": true, ".vtt": true}
+
+// maxSubtitleBytes bounds what a track may take in memory.
+const maxSubtitleBytes = 10 << 20
+
+// subtitleFolders are checked next to the media file as well.
+var subtitleFolders = []string{"Subs", "subs", "Subtitles", "subtitles"}
+
+type subtitleTrack struct {
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	Language string `json:"language,omitempty"`
+	Label    string `json:"label"`
+	Format   string `json:"format"`
+	Forced   bool   `json:"forced,omitempty"`
+	SDH      bool   `json:"sdh,omitempty"`
+	URL      string `json:"url"`
+
+	abs string
+}
+
+func subtitlesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		replyError(w, r, http.StatusMethodNotAllowed, "use GET method")
+		return
+	}
+	rel := strings.TrimPrefix(r.URL.Path, "/subtitles/")
+	media, err := resolveItemPath(rel)
+	if err != nil {
+		replyOpError(w, r, err)
+		return
+	}
+	if info, err := os.Stat(media); err != nil || info.IsDir() {
+		replyError(w, r, http.StatusNotFound, "Not found")
+		return
+	}
+
+	tracks := findSubtitles(media, linkQuery(r, relFromAbs(media)))
+	name := r.URL.Query().Get("track")
+	if name == "" {
+		reply(w, r, http.StatusOK, "", tracks)
+		return
+	}
+
+	for _, t := range tracks {
+		if t.Name != name {
+			continue
+		}
+		f, err := openInRoot(t.Path)
+		if err != nil {
+			replyOpError(w, r, err)
+			return
+		}
+		data, err := io.ReadAll(io.LimitReader(f, maxSubtitleBytes+1))
+		f.Close()
+		if err != nil {
+			replyOpError(w, r, internalFail("Failed to read subtitle", err))
+			return
+		}
+		if len(data) > maxSubtitleBytes {
+			replyError(w, r, http.StatusRequestEntityTooLarge, "Subtitle file too large")
+			return
+		}
+		text := decodeSubtitle(data)
+		if t.Format == "srt" {
+			text = srtToVTT(text)
+		}
+		w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+		w.Header().Set("Cache-Control", "private, max-age=3600")
+		w.Write([]byte(text))
+		return
+	}
+	replyError(w, r, http.StatusNotFound, "Subtitle track not found")
+}
+
+// findSubtitles lists the sidecar tracks of the file at media, sorted by
+// language. query signs the track URLs.
+func findSubtitles(media, query string) []subtitleTrack {
+	base := strings.TrimSuffix(filepath.Base(media), filepath.Ext(media))
+	dir := filepath.Dir(media)
+	tracks := []subtitleTrack{}
+
+	dirs := []string{dir}
+	for _, sub := range subtitleFolders {
+		dirs = append(dirs, filepath.Join(dir, sub), filepath.Join(dir, sub, base))
+	}
+	seen := map[string]bool{}
+	for _, d := range dirs {
+		entries, err := os.ReadDir(d)
+		if err != nil {
+			continue
+		}
+		inOwnFolder := filepath.Base(d) == base && d != dir
+		for _, e := range entries {
+			name := e.Name()
+			ext := strings.ToLower(filepath.Ext(name))
+			if e.IsDir() || !subtitleExts[ext] {
+				continue
+			}
+			stem := strings.TrimSuffix(name, filepath.Ext(name))
+			var tags string
+			switch {
+			case stem == base:
+			case strings.HasPrefix(stem, base+"."):
+				tags = stem[len(base)+1:]
+			case inOwnFolder:
+				// Subs/movie/2_English.srt
+				tags = stem
+			default:
+				continue
+			}
+			abs := filepath.Join(d, name)
+			if seen[abs] {
+				continue
+			}
+			seen[abs] = true
+			// Same rules as every other path, including the symlink policy.
+			if _, err := resolvePath(relFromAbs(abs)); err != nil {
+				continue
+			}
+			t := subtitleTrack{Name: relName(dir, abs), Path: relFromAbs(abs), Format: ext[1:], abs: abs}
+			t.Language, t.Forced, t.SDH = subtitleTags(tags)
+			t.Label = subtitleLabel(t)
+			t.URL = "/subtitles/" + escapePath(relFromAbs(media)) + query + "&track=" + url.QueryEscape(t.Name)
+			tracks = append(tracks, t)
+		}
+	}
+	sort.SliceStable(tracks, func(i, j int) bool { return tracks[i].Language < tracks[j].Language })
+	return tracks
+}
+
+// relName is abs relative to dir with slashes, naming a track uniquely.
+func relName(dir, abs string) string {
+	rel, err := filepath.Rel(dir, abs)
+	if err != nil {
+		return filepath.Base(abs)
+	}
+	return filepath.ToSlash(rel)
+}
+
+var languageTag = regexp.MustCompile(`^[a-zA-Z]{2,3}([-_][a-zA-Z]{2,4})?$`)
+
+// subtitleTags reads the dot-separated tags between media name and
+// extension, e.g. "en.forced" or "pt-BR.sdh".
+func subtitleTags(tags string) (lang string, forced, sdh bool) {
+	if tags == "" {
+		return "", false, false
+	}
+	for _, tag := range strings.Split(tags, ".") {
+		switch strings.ToLower(tag) {
+		case "forced":
+			forced = true
+		case "sdh", "cc", "hi":
+			sdh = true
+		default:
+			if lang == "" && languageTag.MatchString(tag) {
+				lang = strings.ReplaceAll(tag, "_", "-")
+			}
+		}
+	}
+	return lang, forced, sdh
+}
+
+func subtitleLabel(t subtitleTrack) string {
+	label := t.Language
+	if label == "" {
+		label = strings.TrimSuffix(filepath.Base(t.Name), filepath.Ext(t.Name))
+	}
+	if t.Forced {
+		label += " (forced)"
+	}
+	if t.SDH {
+		label += " (SDH)"
+	}
+	return label
+}
+
+// decodeSubtitle turns subtitle bytes into a string. UTF-8 and UTF-16 are
+// recognised by their BOM or by shape; anything else that is not valid
+// UTF-8 is taken as Windows-1252, which most older SRTs are and which reads
+// Latin-1 text correctly too.
+func decodeSubtitle(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}):
+		return string(data[3:])
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		return decodeUTF16(data[2:], false)
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		return decodeUTF16(data[2:], true)
+	}
+	if utf8.Valid(data) {
+		return string(data)
+	}
+	if be, ok := looksUTF16(data); ok {
+		return decodeUTF16(data, be)
+	}
+	return decodeCP1252(data)
+}
+
+// looksUTF16 detects BOM-less UTF-16 by the zero high bytes of ASCII text.
+func looksUTF16(data []byte) (bigEndian, ok bool) {
+	n := min(len(data), 4096) &^ 1
+	if n < 4 {
+		return false, false
+	}
+	var even, odd int
+	for i := 0; i < n; i += 2 {
+		if data[i] == 0 {
+			even++
+		}
+		if data[i+1] == 0 {
+			odd++
+		}
+	}
+	half := n / 2
+	switch {
+	case odd > half*3/4 && even < half/10:
+		return false, true
+	case even > half*3/4 && odd < half/10:
+		return true, true
+	}
+	return false, false
+}
+
+func decodeUTF16(data []byte, bigEndian bool) string {
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		if bigEndian {
+			units[i] = uint16(data[2*i])<<8 | uint16(data[2*i+1])
+		} else {
+			units[i] = uint16(data[2*i+1])<<8 | uint16(data[2*i])
+		}
+	}
+	return string(utf16.Decode(units))
+}
+
+// cp1252 maps 0x80-0x9F of Windows-1252; the rest of the code page equals
+// Latin-1. Undefined bytes map to U+FFFD.
+var cp1252 = [32]rune{
+	'€', '�', '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', '�', 'Ž', '�',
+	'�', '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', '�', 'ž', 'Ÿ',
+}
+
+func decodeCP1252(data []byte) string {
+	var b strings.Builder
+	b.Grow(len(data))
+	for _, c := range data {
+		if c >= 0x80 && c < 0xA0 {
+			b.WriteRune(cp1252[c-0x80])
+		} else {
+			b.WriteRune(rune(c))
+		}
+	}
+	return b.String()
+}
+
+var (
+	srtTiming = regexp.MustCompile(`^\s*(\d+):(\d{1,2}):(\d{1,2})[,.](\d{1,3})\s*-->\s*(\d+):(\d{1,2}):(\d{1,2})[,.](\d{1,3})`)
+	// Tags WebVTT does not know: SSA overrides like {\an8} and <font>.
+	srtDropTags  = regexp.MustCompile(`\{\\[^}]*\}|</?font[^>]*>`)
+	srtBlankLine = regexp.MustCompile(`\n\s*\n`)
+)
+
+// srtToVTT converts SubRip text to WebVTT: a header, dotted timestamps and
+// no formatting WebVTT cannot show. Cue numbers become cue identifiers.
+func srtToVTT(srt string) string {
+	srt = strings.TrimPrefix(srt, "\uFEFF")
+	srt = strings.ReplaceAll(srt, "\r\n", "\n")
+	srt = strings.ReplaceAll(srt, "\r", "\n")
+
+	var b strings.Builder
+	b.WriteString("WEBVTT\n\n")
+	for _, block := range srtBlankLine.Split(strings.TrimSpace(srt), -1) {
+		lines := strings.Split(block, "\n")
+		timing := -1
+		for i, line := range lines {
+			if srtTiming.MatchString(line) {
+				timing = i
+				break
+			}
+		}
+		if timing < 0 {
+			continue
+		}
+		if timing > 0 {
+			b.WriteString(strings.TrimSpace(lines[timing-1]) + "\n")
+		}
+		m := srtTiming.FindStringSubmatch(lines[timing])
+		b.WriteString(vttTime(m[1:5]) + " --> " + vttTime(m[5:9]) + "\n")
+		for _, line := range lines[timing+1:] {
+			// A line of "-->" would end the cue early in WebVTT.
+			line = strings.ReplaceAll(srtDropTags.ReplaceAllString(line, ""), "-->", "->")
+			b.WriteString(line + "\n")
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func vttTime(p []string) string {
+	pad := func(s string, n int) string {
+		for len(s) < n {
+			s = "0" + s
+		}
+		return s
+	}
+	ms := p[3]
+	for len(ms) < 3 {
+		ms += "0"
+	}
+	return pad(p[0], 2) + ":" + pad(p[1], 2) + ":" + pad(p[2], 2) + "." + ms
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+func TestSrtToVTT(t *testing.T) {
+	srt := "\uFEFF1\r\n00:00:01,500 --> 00:00:04,000\r\n<font color=\"red\">Hello</font>\r\n{\\an8}world\r\n\r\n" +
+		"2\r\n0:1:2.5 --> 0:01:03,25\r\nA --> B\r\n\r\n\r\n" +
+		"no timing here\r\n\r\n"
+	want := "WEBVTT\n\n" +
+		"1\n00:00:01.500 --> 00:00:04.000\nHello\nworld\n\n" +
+		"2\n00:01:02.500 --> 00:01:03.250\nA -> B\n\n"
+	if got := srtToVTT(srt); got != want {
+		t.Errorf("srtToVTT:\n%q\nwant\n%q", got, want)
+	}
+}
+
+func utf16Bytes(s string, bigEndian bool) []byte {
+	var b []byte
+	for _, u := range utf16.Encode([]rune(s)) {
+		if bigEndian {
+			b = append(b, byte(u>>8), byte(u))
+		} else {
+			b = append(b, byte(u), byte(u>>8))
+		}
+	}
+	return b
+}
+
+func TestDecodeSubtitle(t *testing.T) {
+	const text = "1\n00:00:01,000 --> 00:00:02,000\nCafé – naïve\n"
+	for name, c := range map[string]struct {
+		data []byte
+		want string
+	}{
+		"utf-8":          {[]byte(text), text},
+		"utf-8 bom":      {append([]byte{0xEF, 0xBB, 0xBF}, text...), text},
+		"utf-16le bom":   {append([]byte{0xFF, 0xFE}, utf16Bytes(text, false)...), text},
+		"utf-16be bom":   {append([]byte{0xFE, 0xFF}, utf16Bytes(text, true)...), text},
+		"utf-16le plain": {utf16Bytes(text, false), text},
+		"utf-16be plain": {utf16Bytes(text, true), text},
+		"cp1252":         {[]byte("Caf\xe9 \x93quoted\x94 \x80 5\r\n"), "Café “quoted” € 5\r\n"},
+		"cp1252 unused":  {[]byte("a\x81b"), "a�b"},
+	} {
+		if got := decodeSubtitle(c.data); got != c.want {
+			t.Errorf("%s: %q, want %q", name, got, c.want)
+		}
+	}
+}
+
+func TestLooksUTF16(t *testing.T) {
+	for name, c := range map[string]struct {
+		data          []byte
+		bigEndian, ok bool
+	}{
+		"little endian": {utf16Bytes("Hello, world", false), false, true},
+		"big endian":    {utf16Bytes("Hello, world", true), true, true},
+		"ascii":         {[]byte("Hello, world"), false, false},
+		"too short":     {[]byte{'H', 0}, false, false},
+		"binary":        {[]byte{0, 0, 0, 0, 1, 2, 3, 4}, false, false},
+	} {
+		if be, ok := looksUTF16(c.data); be != c.bigEndian || ok != c.ok {
+			t.Errorf("%s: looksUTF16 = %t, %t; want %t, %t", name, be, ok, c.bigEndian, c.ok)
+		}
+	}
+}
+
+// TestSubtitlesSigned follows the signed track URLs of a signed track list.
+func TestSubtitlesSigned(t *testing.T) {
+	root := testRoot(t)
+	dir := filepath.Join(root, "dir")
+	os.WriteFile(filepath.Join(dir, "clip.mp4"), []byte("video"), 0644)
+	os.WriteFile(filepath.Join(dir, "clip.en.srt"), []byte("1\n00:00:01,000 --> 00:00:02,000\nHi\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "clip.de.srt"), []byte(strings.Repeat("x", maxSubtitleBytes+1)), 0644)
+
+	var rt route
+	for _, r := range appRoutes() {
+		if r.Pattern == "/subtitles/" {
+			rt = r
+		}
+	}
+	if !rt.Signed {
+		t.Fatal("/subtitles/ is not a signed route")
+	}
+	h := acceptSigned(rt, func(w http.ResponseWriter, r *http.Request) {
+		replyError(w, r, http.StatusUnauthorized, "Unauthorized")
+	})
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest("GET", url, nil))
+		return rec
+	}
+
+	query := signedQuery(adminUser, "dir/clip.mp4", "", time.Now().Add(time.Hour))
+	rec := get("/subtitles/dir/clip.mp4" + query)
+	var tracks []subtitleTrack
+	if err := json.Unmarshal(rec.Body.Bytes(), &tracks); rec.Code != http.StatusOK || err != nil {
+		t.Fatalf("list: status %d, %v", rec.Code, err)
+	}
+	urls := map[string]string{}
+	for _, tr := range tracks {
+		if !strings.Contains(tr.URL, query+"&track=") {
+			t.Errorf("track URL %q is not signed", tr.URL)
+		}
+		urls[tr.Language] = tr.URL
+	}
+
+	rec = get(urls["en"])
+	if rec.Code != http.StatusOK || rec.Body.String() != "WEBVTT\n\n1\n00:00:01.000 --> 00:00:02.000\nHi\n\n" {
+		t.Errorf("track: status %d, body %q", rec.Code, rec.Body)
+	}
+	if rec := get(urls["de"]); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized track: status %d, want 413", rec.Code)
+	}
+	if rec := get("/subtitles/dir/clip.mp4?track=clip.en.srt"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("unsigned track: status %d, want 401", rec.Code)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// systemdUnit renders a service unit for the running binary. The server
+// reads .env from its working directory, so that is set to the binary's
+// folder.
+func systemdUnit() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+		exe = resolved
+	}
+
+	var b strings.Builder
+	b.WriteString("[Unit]\n")
+	b.WriteString("Description=HomeCloud file server\n")
+	b.WriteString("After=network-online.target\n")
+	b.WriteString("Wants=network-online.target\n\n")
+
+	b.WriteString("[Service]\n")
+	b.WriteString("Type=notify\n")
+	b.WriteString("NotifyAccess=main\n")
+	fmt.Fprintf(&b, "ExecStart=%s\n", exe)
+	fmt.Fprintf(&b, "WorkingDirectory=%s\n", filepath.Dir(exe))
+	if u, err := user.Current(); err == nil && u.Uid != "0" {
+		fmt.Fprintf(&b, "User=%s\n", u.Username)
+	}
+	b.WriteString("Restart=on-failure\n")
+	b.WriteString("RestartSec=5\n")
+	b.WriteString("WatchdogSec=30\n")
+	// Leave room for draining uploads before systemd sends SIGKILL.
+	fmt.Fprintf(&b, "TimeoutStopSec=%d\n", int(shutdownTimeout.Seconds())+10)
+	b.WriteString("\n[Install]\n")
+	b.WriteString("WantedBy=multi-user.target\n")
+	return b.String(), nil
+}
@@ -0,0 +1,110 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// sdListenFDsStart is the first file descriptor systemd passes to a
+// socket-activated service (SD_LISTEN_FDS_START).
+const sdListenFDsStart = 3
+
+const systemdSupported = true
+
+// sdNotify sends state to the service manager when running under
+// Type=notify. It reports whether a message was sent.
+func sdNotify(state string) bool {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false
+	}
+	// A leading @ names a socket in the abstract namespace.
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Printf("sd_notify: %v", err)
+		return false
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("sd_notify: %v", err)
+		return false
+	}
+	return true
+}
+
+// sdWatchdog pings the systemd watchdog at half the configured WatchdogSec
+// until ctx is done, skipping pings while watchdogHealthy fails so systemd
+// restarts a server that lost its storage. It returns immediately when no
+// watchdog is configured.
+func sdWatchdog(ctx context.Context) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(usec) * time.Microsecond / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if watchdogHealthy() {
+				sdNotify("WATCHDOG=1")
+			} else {
+				log.Printf("Not ready, skipping the watchdog ping")
+			}
+		}
+	}
+}
+
+// sdListener returns the socket passed in by systemd socket activation,
+// or nil when the process was not socket activated.
+func sdListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	// The variables are meant for this process only, not for ffmpeg and
+	// other children.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	if n > 1 {
+		log.Printf("Warning: systemd passed %d sockets, only the first one is used", n)
+		for fd := sdListenFDsStart + 1; fd < sdListenFDsStart+n; fd++ {
+			syscall.Close(fd)
+		}
+	}
+
+	syscall.CloseOnExec(sdListenFDsStart)
+	f := os.NewFile(sdListenFDsStart, "systemd-socket")
+	defer f.Close()
+
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("socket activation: %w", err)
+	}
+	return ln, nil
+}
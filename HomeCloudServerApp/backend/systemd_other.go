@@ -0,0 +1,20 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"net"
+)
+
+const systemdSupported = false
+
+func sdNotify(state string) bool {
+	return false
+}
+
+func sdWatchdog(ctx context.Context) {}
+
+func sdListener() (net.Listener, error) {
+	return nil, nil
+}
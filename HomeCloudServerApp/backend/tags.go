@@ -0,0 +1,820 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Tag readers for the music library: ID3v1/v2 (MP3), Vorbis comments (FLAC,
+// Ogg Vorbis, Opus) and iTunes-style MP4 atoms (M4A). Only the headers are
+// read; cover art is copied out only when asked for.
+
+var audioExts = map[string]bool{
+	".mp3": true, ".flac": true, ".m4a": true, ".m4b": true, ".aac": true,
+	".ogg": true, ".oga": true, ".opus": true, ".wav": true,
+}
+
+// maxTagBytes bounds how much of a file a tag block may make us read.
+const maxTagBytes = 32 << 20
+
+var errNoTags = errors.New("no tags")
+
+type audioTags struct {
+	Title       string
+	Artist      string
+	AlbumArtist string
+	Album       string
+	Genre       string
+	Year        int
+	Track       int
+	Disc        int
+	Duration    float64
+	HasCover    bool
+}
+
+type coverArt struct {
+	MIME string
+	Data []byte
+}
+
+// readAudio reads the tags of an audio file, and its embedded cover when
+// withCover is set. Files without tags give zero tags and no error. The
+// open goes through openInRoot, so links the symlink policy rejects fail.
+func readAudio(path string, withCover bool) (audioTags, *coverArt, error) {
+	f, err := openInRoot(relFromAbs(path))
+	if err != nil {
+		return audioTags{}, nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return audioTags{}, nil, err
+	}
+	r := &tagReader{f: f, size: info.Size(), withCover: withCover}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mp3", ".aac":
+		err = r.readMP3()
+	case ".flac":
+		err = r.readFLAC()
+	case ".ogg", ".oga", ".opus":
+		err = r.readOgg()
+	case ".m4a", ".m4b":
+		err = r.readMP4()
+	}
+	if errors.Is(err, errNoTags) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		err = nil
+	}
+	return r.tags, r.cover, err
+}
+
+type tagReader struct {
+	f         *os.File
+	size      int64
+	withCover bool
+	tags      audioTags
+	cover     *coverArt
+}
+
+func (r *tagReader) readAt(off int64, n int) ([]byte, error) {
+	if n < 0 || n > maxTagBytes || off < 0 || off+int64(n) > r.size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := make([]byte, n)
+	_, err := r.f.ReadAt(b, off)
+	return b, err
+}
+
+func (r *tagReader) setCover(mime string, data []byte) {
+	if r.tags.HasCover || len(data) == 0 {
+		return
+	}
+	r.tags.HasCover = true
+	if r.withCover {
+		if mime == "" || !strings.Contains(mime, "/") {
+			mime = sniffImage(data)
+		}
+		r.cover = &coverArt{MIME: mime, Data: append([]byte(nil), data...)}
+	}
+}
+
+func sniffImage(data []byte) string {
+	if bytes.HasPrefix(data, []byte("\x89PNG")) {
+		return "image/png"
+	}
+	return "image/jpeg"
+}
+
+// setNumber parses "3" or "3/12".
+func setNumber(dst *int, s string) {
+	s, _, _ = strings.Cut(strings.TrimSpace(s), "/")
+	if n, err := strconv.Atoi(s); err == nil && n > 0 {
+		*dst = n
+	}
+}
+
+func setYear(dst *int, s string) {
+	s = strings.TrimSpace(s)
+	if len(s) >= 4 {
+		if n, err := strconv.Atoi(s[:4]); err == nil && n > 0 {
+			*dst = n
+		}
+	}
+}
+
+// ---- ID3 / MP3 ----
+
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+// readID3v2 reads an ID3v2 tag at off and returns the offset after it.
+func (r *tagReader) readID3v2(off int64) (int64, error) {
+	head, err := r.readAt(off, 10)
+	if err != nil || string(head[:3]) != "ID3" {
+		return off, errNoTags
+	}
+	version, flags := head[3], head[5]
+	size := syncsafe(head[6:10])
+	end := off + 10 + int64(size)
+	if flags&0x10 != 0 {
+		end += 10 // footer
+	}
+	body, err := r.readAt(off+10, size)
+	if err != nil {
+		return end, err
+	}
+	if version < 4 && flags&0x80 != 0 {
+		body = bytes.ReplaceAll(body, []byte{0xff, 0x00}, []byte{0xff})
+	}
+	if flags&0x40 != 0 && len(body) >= 4 {
+		// Extended header.
+		skip := int(binary.BigEndian.Uint32(body)) + 4
+		if version == 4 {
+			skip = syncsafe(body)
+		}
+		if skip > len(body) {
+			return end, nil
+		}
+		body = body[skip:]
+	}
+
+	idLen, headLen := 4, 10
+	if version == 2 {
+		idLen, headLen = 3, 6
+	}
+	for len(body) >= headLen && body[0] != 0 {
+		id := string(body[:idLen])
+		var n int
+		var fflags byte
+		switch version {
+		case 2:
+			n = int(body[3])<<16 | int(body[4])<<8 | int(body[5])
+		case 3:
+			n = int(binary.BigEndian.Uint32(body[4:8]))
+		default:
+			n = syncsafe(body[4:8])
+			fflags = body[9]
+		}
+		if n < 0 || headLen+n > len(body) {
+			break
+		}
+		data := body[headLen : headLen+n]
+		body = body[headLen+n:]
+		if version == 4 {
+			if fflags&0x02 != 0 {
+				data = bytes.ReplaceAll(data, []byte{0xff, 0x00}, []byte{0xff})
+			}
+			if fflags&0x01 != 0 && len(data) >= 4 {
+				data = data[4:]
+			}
+		}
+		r.id3Frame(id, data)
+	}
+	return end, nil
+}
+
+func (r *tagReader) id3Frame(id string, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	t := &r.tags
+	switch id {
+	case "TIT2", "TT2":
+		t.Title = id3Text(data)
+	case "TPE1", "TP1":
+		t.Artist = id3Text(data)
+	case "TPE2", "TP2":
+		t.AlbumArtist = id3Text(data)
+	case "TALB", "TAL":
+		t.Album = id3Text(data)
+	case "TCON", "TCO":
+		t.Genre = id3Genre(id3Text(data))
+	case "TRCK", "TRK":
+		setNumber(&t.Track, id3Text(data))
+	case "TPOS", "TPA":
+		setNumber(&t.Disc, id3Text(data))
+	case "TYER", "TYE", "TDRC", "TDOR", "TORY":
+		if t.Year == 0 {
+			setYear(&t.Year, id3Text(data))
+		}
+	case "TLEN":
+		if ms, err := strconv.Atoi(id3Text(data)); err == nil && t.Duration == 0 {
+			t.Duration = float64(ms) / 1000
+		}
+	case "APIC":
+		// encoding, MIME\0, picture type, description\0, data
+		enc := data[0]
+		mime, rest, ok := bytes.Cut(data[1:], []byte{0})
+		if !ok || len(rest) < 1 {
+			return
+		}
+		if _, pic, ok := cutID3String(enc, rest[1:]); ok {
+			r.setCover(string(mime), pic)
+		}
+	case "PIC":
+		// encoding, 3-char format, picture type, description\0, data
+		if len(data) < 5 {
+			return
+		}
+		mime := "image/jpeg"
+		if strings.EqualFold(string(data[1:4]), "PNG") {
+			mime = "image/png"
+		}
+		if _, pic, ok := cutID3String(data[0], data[5:]); ok {
+			r.setCover(mime, pic)
+		}
+	}
+}
+
+// cutID3String splits a terminated string in encoding enc off b.
+func cutID3String(enc byte, b []byte) ([]byte, []byte, bool) {
+	if enc == 1 || enc == 2 {
+		for i := 0; i+1 < len(b); i += 2 {
+			if b[i] == 0 && b[i+1] == 0 {
+				return b[:i], b[i+2:], true
+			}
+		}
+		return nil, nil, false
+	}
+	return bytes.Cut(b, []byte{0})
+}
+
+// id3Text decodes a text frame; of several values only the first is kept.
+func id3Text(data []byte) string {
+	enc, b := data[0], data[1:]
+	var s string
+	switch enc {
+	case 1:
+		switch {
+		case bytes.HasPrefix(b, []byte{0xff, 0xfe}):
+			s = decodeUTF16(b[2:], false)
+		case bytes.HasPrefix(b, []byte{0xfe, 0xff}):
+			s = decodeUTF16(b[2:], true)
+		default:
+			s = decodeUTF16(b, false)
+		}
+	case 2:
+		s = decodeUTF16(b, true)
+	case 3:
+		s = string(b)
+	default:
+		s = decodeLatin1(b)
+	}
+	s, _, _ = strings.Cut(s, "\x00")
+	return strings.TrimSpace(s)
+}
+
+func decodeLatin1(b []byte) string {
+	if utf8.Valid(b) {
+		// Many taggers write UTF-8 and call it Latin-1.
+		return string(b)
+	}
+	return decodeCP1252(b)
+}
+
+// id3Genre resolves "(17)", "17" and "(17)Rock" to genre names.
+func id3Genre(s string) string {
+	if strings.HasPrefix(s, "(") {
+		if i := strings.Index(s, ")"); i > 0 {
+			if rest := strings.TrimSpace(s[i+1:]); rest != "" {
+				return rest
+			}
+			s = s[1:i]
+		}
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		if n >= 0 && n < len(id3Genres) {
+			return id3Genres[n]
+		}
+		return ""
+	}
+	return s
+}
+
+var id3Genres = []string{
+	"Blues", "Classic Rock", "Country", "Dance", "Disco", "Funk", "Grunge", "Hip-Hop",
+	"Jazz", "Metal", "New Age", "Oldies", "Other", "Pop", "R&B", "Rap", "Reggae", "Rock",
+	"Techno", "Industrial", "Alternative", "Ska", "Death Metal", "Pranks", "Soundtrack",
+	"Euro-Techno", "Ambient", "Trip-Hop", "Vocal", "Jazz+Funk", "Fusion", "Trance",
+	"Classical", "Instrumental", "Acid", "House", "Game", "Sound Clip", "Gospel", "Noise",
+	"Alternative Rock", "Bass", "Soul", "Punk", "Space", "Meditative", "Instrumental Pop",
+	"Instrumental Rock", "Ethnic", "Gothic", "Darkwave", "Techno-Industrial", "Electronic",
+	"Pop-Folk", "Eurodance", "Dream", "Southern Rock", "Comedy", "Cult", "Gangsta", "Top 40",
+	"Christian Rap", "Pop/Funk", "Jungle", "Native American", "Cabaret", "New Wave",
+	"Psychedelic", "Rave", "Showtunes", "Trailer", "Lo-Fi", "Tribal", "Acid Punk",
+	"Acid Jazz", "Polka", "Retro", "Musical", "Rock & Roll", "Hard Rock",
+}
+
+func (r *tagReader) readID3v1() {
+	b, err := r.readAt(r.size-128, 128)
+	if err != nil || string(b[:3]) != "TAG" {
+		return
+	}
+	field := func(p []byte) string {
+		p, _, _ = bytes.Cut(p, []byte{0})
+		return strings.TrimSpace(decodeLatin1(p))
+	}
+	t := &r.tags
+	if t.Title == "" {
+		t.Title = field(b[3:33])
+	}
+	if t.Artist == "" {
+		t.Artist = field(b[33:63])
+	}
+	if t.Album == "" {
+		t.Album = field(b[63:93])
+	}
+	if t.Year == 0 {
+		setYear(&t.Year, field(b[93:97]))
+	}
+	if t.Track == 0 && b[125] == 0 && b[126] != 0 {
+		t.Track = int(b[126])
+	}
+	if t.Genre == "" && int(b[127]) < len(id3Genres) {
+		t.Genre = id3Genres[b[127]]
+	}
+}
+
+func (r *tagReader) readMP3() error {
+	audio, err := r.readID3v2(0)
+	if err != nil && !errors.Is(err, errNoTags) {
+		return err
+	}
+	r.readID3v1()
+	if r.tags.Duration == 0 {
+		r.tags.Duration = r.mp3Duration(audio)
+	}
+	return nil
+}
+
+var (
+	mp3Bitrates = [2][3][16]int{
+		{ // MPEG-1: layer I, II, III
+			{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+			{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+			{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+		},
+		{ // MPEG-2/2.5
+			{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+			{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+			{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+		},
+	}
+	mp3Rates = [3]int{44100, 48000, 32000}
+)
+
+// mp3Duration reads the first frame after off: the frame count of a
+// Xing/Info or VBRI header when there is one, else the bitrate of a
+// constant bitrate stream.
+func (r *tagReader) mp3Duration(off int64) float64 {
+	buf, err := r.readAt(off, int(min(64<<10, r.size-off)))
+	if err != nil && len(buf) == 0 {
+		return 0
+	}
+	for i := 0; i+4 <= len(buf); i++ {
+		if buf[i] != 0xff || buf[i+1]&0xe0 != 0xe0 {
+			continue
+		}
+		h := binary.BigEndian.Uint32(buf[i:])
+		ver := (h >> 19) & 3 // 3: MPEG-1, 2: MPEG-2, 0: MPEG-2.5
+		layer := (h >> 17) & 3
+		bri := (h >> 12) & 15
+		sri := (h >> 10) & 3
+		if ver == 1 || layer == 0 || bri == 0 || bri == 15 || sri == 3 {
+			continue
+		}
+		v := 0
+		if ver != 3 {
+			v = 1
+		}
+		l := 3 - int(layer) // 0: layer I
+		bitrate := mp3Bitrates[v][l][bri] * 1000
+		rate := mp3Rates[sri]
+		switch ver {
+		case 2:
+			rate /= 2
+		case 0:
+			rate /= 4
+		}
+		samples := 1152
+		switch {
+		case l == 0:
+			samples = 384
+		case l == 2 && v == 1:
+			samples = 576
+		}
+
+		frame := buf[i:]
+		mono := (h>>6)&3 == 3
+		side := 32
+		switch {
+		case v == 0 && mono:
+			side = 17
+		case v == 1 && !mono:
+			side = 17
+		case v == 1 && mono:
+			side = 9
+		}
+		if x := 4 + side; len(frame) >= x+12 && (string(frame[x:x+4]) == "Xing" || string(frame[x:x+4]) == "Info") {
+			if frame[x+7]&1 != 0 {
+				frames := binary.BigEndian.Uint32(frame[x+8:])
+				return float64(frames) * float64(samples) / float64(rate)
+			}
+		}
+		if len(frame) >= 36+18 && string(frame[36:40]) == "VBRI" {
+			frames := binary.BigEndian.Uint32(frame[36+14:])
+			return float64(frames) * float64(samples) / float64(rate)
+		}
+		audio := r.size - off - int64(i)
+		if b, err := r.readAt(r.size-128, 3); err == nil && string(b) == "TAG" {
+			audio -= 128
+		}
+		return float64(audio) * 8 / float64(bitrate)
+	}
+	return 0
+}
+
+// ---- Vorbis comments (FLAC, Ogg) ----
+
+func (r *tagReader) vorbisComments(b []byte) {
+	le := binary.LittleEndian
+	if len(b) < 8 {
+		return
+	}
+	n := int(le.Uint32(b))
+	if 4+n+4 > len(b) {
+		return
+	}
+	b = b[4+n:]
+	count := int(le.Uint32(b))
+	b = b[4:]
+	t := &r.tags
+	for ; count > 0 && len(b) >= 4; count-- {
+		n := int(le.Uint32(b))
+		if n < 0 || 4+n > len(b) {
+			return
+		}
+		key, val, ok := strings.Cut(string(b[4:4+n]), "=")
+		b = b[4+n:]
+		if !ok {
+			continue
+		}
+		val = strings.TrimSpace(val)
+		switch strings.ToUpper(key) {
+		case "TITLE":
+			t.Title = first(t.Title, val)
+		case "ARTIST":
+			t.Artist = first(t.Artist, val)
+		case "ALBUMARTIST", "ALBUM ARTIST", "ALBUM_ARTIST":
+			t.AlbumArtist = first(t.AlbumArtist, val)
+		case "ALBUM":
+			t.Album = first(t.Album, val)
+		case "GENRE":
+			t.Genre = first(t.Genre, val)
+		case "TRACKNUMBER":
+			setNumber(&t.Track, val)
+		case "DISCNUMBER":
+			setNumber(&t.Disc, val)
+		case "DATE", "YEAR", "ORIGINALDATE":
+			if t.Year == 0 {
+				setYear(&t.Year, val)
+			}
+		case "METADATA_BLOCK_PICTURE":
+			if pic, err := base64.StdEncoding.DecodeString(val); err == nil {
+				r.flacPicture(pic)
+			}
+		}
+	}
+}
+
+func first(cur, val string) string {
+	if cur != "" {
+		return cur
+	}
+	return val
+}
+
+// flacPicture reads a FLAC PICTURE block.
+func (r *tagReader) flacPicture(b []byte) {
+	be := binary.BigEndian
+	if len(b) < 8 {
+		return
+	}
+	n := int(be.Uint32(b[4:]))
+	if 8+n+4 > len(b) {
+		return
+	}
+	mime := string(b[8 : 8+n])
+	b = b[8+n:]
+	n = int(be.Uint32(b))
+	if 4+n+20 > len(b) {
+		return
+	}
+	b = b[4+n+16:]
+	n = int(be.Uint32(b))
+	if 4+n > len(b) {
+		return
+	}
+	r.setCover(mime, b[4:4+n])
+}
+
+func (r *tagReader) readFLAC() error {
+	off, _ := r.readID3v2(0)
+	if off < 0 {
+		off = 0
+	}
+	magic, err := r.readAt(off, 4)
+	if err != nil || string(magic) != "fLaC" {
+		return errNoTags
+	}
+	off += 4
+	for {
+		h, err := r.readAt(off, 4)
+		if err != nil {
+			return err
+		}
+		last, typ := h[0]&0x80 != 0, h[0]&0x7f
+		n := int(h[1])<<16 | int(h[2])<<8 | int(h[3])
+		off += 4
+		switch typ {
+		case 0: // STREAMINFO
+			b, err := r.readAt(off, n)
+			if err == nil && len(b) >= 18 {
+				rate := int(b[10])<<12 | int(b[11])<<4 | int(b[12])>>4
+				total := int64(b[13]&0x0f)<<32 | int64(binary.BigEndian.Uint32(b[14:]))
+				if rate > 0 {
+					r.tags.Duration = float64(total) / float64(rate)
+				}
+			}
+		case 4: // VORBIS_COMMENT
+			if b, err := r.readAt(off, n); err == nil {
+				r.vorbisComments(b)
+			}
+		case 6: // PICTURE
+			if !r.tags.HasCover {
+				if b, err := r.readAt(off, n); err == nil {
+					r.flacPicture(b)
+				}
+			}
+		}
+		off += int64(n)
+		if last {
+			return nil
+		}
+	}
+}
+
+// readOgg reads the identification and comment packets of the first
+// logical stream, and the duration from the last page.
+func (r *tagReader) readOgg() error {
+	var packets [][]byte
+	var cur []byte
+	var serial uint32
+	off := int64(0)
+	for len(packets) < 2 {
+		h, err := r.readAt(off, 27)
+		if err != nil || string(h[:4]) != "OggS" {
+			return errNoTags
+		}
+		nsegs := int(h[26])
+		segs, err := r.readAt(off+27, nsegs)
+		if err != nil {
+			return err
+		}
+		size := 0
+		for _, s := range segs {
+			size += int(s)
+		}
+		body, err := r.readAt(off+27+int64(nsegs), size)
+		if err != nil {
+			return err
+		}
+		if s := binary.LittleEndian.Uint32(h[14:]); off == 0 {
+			serial = s
+		} else if s != serial {
+			off += 27 + int64(nsegs) + int64(size)
+			continue
+		}
+		off += 27 + int64(nsegs) + int64(size)
+		p := 0
+		for _, seg := range segs {
+			cur = append(cur, body[p:p+int(seg)]...)
+			p += int(seg)
+			if seg < 255 {
+				packets = append(packets, cur)
+				cur = nil
+			}
+		}
+		if len(cur) > maxTagBytes {
+			return errNoTags
+		}
+	}
+
+	ident, comment := packets[0], packets[1]
+	rate, preSkip := 0, 0
+	switch {
+	case len(ident) >= 16 && string(ident[1:7]) == "vorbis":
+		rate = int(binary.LittleEndian.Uint32(ident[12:]))
+		if len(comment) > 7 && string(comment[1:7]) == "vorbis" {
+			r.vorbisComments(comment[7:])
+		}
+	case len(ident) >= 12 && string(ident[:8]) == "OpusHead":
+		rate = 48000
+		preSkip = int(binary.LittleEndian.Uint16(ident[10:]))
+		if len(comment) > 8 && string(comment[:8]) == "OpusTags" {
+			r.vorbisComments(comment[8:])
+		}
+	}
+
+	if rate > 0 {
+		n := min(r.size, 64<<10)
+		tail, err := r.readAt(r.size-n, int(n))
+		if err == nil {
+			if i := bytes.LastIndex(tail, []byte("OggS")); i >= 0 && i+14 <= len(tail) {
+				granule := int64(binary.LittleEndian.Uint64(tail[i+6:]))
+				if granule > 0 {
+					r.tags.Duration = float64(granule-int64(preSkip)) / float64(rate)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ---- MP4 ----
+
+func (r *tagReader) readMP4() error {
+	moov, ok := r.findAtom(0, r.size, "moov")
+	if !ok {
+		return errNoTags
+	}
+	if moov[1]-moov[0] > maxTagBytes {
+		return errNoTags
+	}
+	b, err := r.readAt(moov[0], int(moov[1]-moov[0]))
+	if err != nil {
+		return err
+	}
+	for _, a := range mp4Atoms(b) {
+		switch a.typ {
+		case "mvhd":
+			r.mp4Duration(a.data)
+		case "udta":
+			for _, m := range mp4Atoms(a.data) {
+				if m.typ == "meta" && len(m.data) > 4 {
+					for _, l := range mp4Atoms(m.data[4:]) {
+						if l.typ == "ilst" {
+							r.mp4Items(l.data)
+						}
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// findAtom locates a top-level atom, returning the range of its contents.
+func (r *tagReader) findAtom(off, end int64, typ string) ([2]int64, bool) {
+	for off+8 <= end {
+		h, err := r.readAt(off, 8)
+		if err != nil {
+			return [2]int64{}, false
+		}
+		size, head := int64(binary.BigEndian.Uint32(h)), int64(8)
+		switch size {
+		case 0:
+			size = end - off
+		case 1:
+			ext, err := r.readAt(off+8, 8)
+			if err != nil {
+				return [2]int64{}, false
+			}
+			size, head = int64(binary.BigEndian.Uint64(ext)), 16
+		}
+		if size < head || off+size > end {
+			return [2]int64{}, false
+		}
+		if string(h[4:8]) == typ {
+			return [2]int64{off + head, off + size}, true
+		}
+		off += size
+	}
+	return [2]int64{}, false
+}
+
+type mp4Atom struct {
+	typ  string
+	data []byte
+}
+
+func mp4Atoms(b []byte) []mp4Atom {
+	var atoms []mp4Atom
+	for len(b) >= 8 {
+		size := int(binary.BigEndian.Uint32(b))
+		if size < 8 || size > len(b) {
+			break
+		}
+		atoms = append(atoms, mp4Atom{string(b[4:8]), b[8:size]})
+		b = b[size:]
+	}
+	return atoms
+}
+
+func (r *tagReader) mp4Duration(b []byte) {
+	be := binary.BigEndian
+	if len(b) < 20 {
+		return
+	}
+	var scale uint32
+	var dur uint64
+	if b[0] == 1 && len(b) >= 32 {
+		scale, dur = be.Uint32(b[20:]), be.Uint64(b[24:])
+	} else {
+		scale, dur = be.Uint32(b[12:]), uint64(be.Uint32(b[16:]))
+	}
+	if scale > 0 {
+		r.tags.Duration = float64(dur) / float64(scale)
+	}
+}
+
+func (r *tagReader) mp4Items(b []byte) {
+	t := &r.tags
+	for _, item := range mp4Atoms(b) {
+		var data []byte
+		var kind uint32
+		for _, d := range mp4Atoms(item.data) {
+			if d.typ == "data" && len(d.data) >= 8 {
+				kind, data = binary.BigEndian.Uint32(d.data)&0xffffff, d.data[8:]
+				break
+			}
+		}
+		if data == nil {
+			continue
+		}
+		text := strings.TrimSpace(string(data))
+		switch item.typ {
+		case "\xa9nam":
+			t.Title = text
+		case "\xa9ART":
+			t.Artist = text
+		case "aART":
+			t.AlbumArtist = text
+		case "\xa9alb":
+			t.Album = text
+		case "\xa9gen":
+			t.Genre = text
+		case "gnre":
+			if len(data) >= 2 {
+				if n := int(binary.BigEndian.Uint16(data)) - 1; n >= 0 && n < len(id3Genres) {
+					t.Genre = id3Genres[n]
+				}
+			}
+		case "\xa9day":
+			setYear(&t.Year, text)
+		case "trkn":
+			if len(data) >= 4 {
+				t.Track = int(binary.BigEndian.Uint16(data[2:]))
+			}
+		case "disk":
+			if len(data) >= 4 {
+				t.Disc = int(binary.BigEndian.Uint16(data[2:]))
+			}
+		case "covr":
+			mime := "image/jpeg"
+			if kind == 14 {
+				mime = "image/png"
+			}
+			r.setCover(mime, data)
+		}
+	}
+}
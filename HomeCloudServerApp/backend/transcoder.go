@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// HLS modes accepted by HLS_MODE.
+//
+//	auto        - the best mode the installed tools allow (default)
+//	transcode   - re-encode to an H.264/AAC ladder with ffmpeg
+//	remux       - cut the original streams into MPEG-TS without re-encoding
+//	passthrough - no segmenting; the playlist points at /stream
+//	off         - no /hls route
+const (
+	hlsAuto        = "auto"
+	hlsTranscode   = "transcode"
+	hlsRemux       = "remux"
+	hlsPassthrough = "passthrough"
+	hlsOff         = "off"
+)
+
+func validHLSMode(m string) bool {
+	switch m {
+	case hlsAuto, hlsTranscode, hlsRemux, hlsPassthrough, hlsOff:
+		return true
+	}
+	return false
+}
+
+// mediaInfo is what a transcoder knows about a source file. Zero values
+// mean unknown.
+type mediaInfo struct {
+	Duration float64
+	Width    int
+	Height   int
+	Bitrate  int
+	// Cuts are the segment start times, for sources that can only be cut
+	// on keyframes. Empty means every hlsSegmentSeconds.
+	Cuts []float64
+}
+
+// hlsVariant is one rendition in the master playlist.
+type hlsVariant struct {
+	Name      string
+	Height    int
+	Bandwidth int
+	// Passthrough variants are the original file as a single segment.
+	Passthrough bool
+}
+
+// transcoder produces the HLS renditions of a video.
+type transcoder interface {
+	// Name is the mode, reported by /version.
+	Name() string
+	Probe(ctx context.Context, src string) (mediaInfo, error)
+	Variants(info mediaInfo) []hlsVariant
+	// Segment writes [start, start+dur) of src in variant v to dst as
+	// MPEG-TS.
+	Segment(ctx context.Context, src string, v hlsVariant, start, dur float64, dst string) error
+}
+
+// hlsLadder lists the transcode renditions; sources only get those up to
+// their own height.
+var hlsLadder = []hlsVariant{
+	{Name: "1080p", Height: 1080, Bandwidth: 5000000},
+	{Name: "720p", Height: 720, Bandwidth: 2800000},
+	{Name: "480p", Height: 480, Bandwidth: 1400000},
+	{Name: "360p", Height: 360, Bandwidth: 800000},
+}
+
+// newTranscoder picks the transcoder for mode, falling back to what the
+// installed tools can do. It returns nil for "off".
+func newTranscoder(mode string) transcoder {
+	if mode == hlsOff {
+		return nil
+	}
+	if mode == hlsPassthrough {
+		return passthroughTranscoder{}
+	}
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		log.Printf("HLS: ffmpeg not found, serving videos without segmenting")
+		return passthroughTranscoder{}
+	}
+	ffprobe, err := exec.LookPath("ffprobe")
+	if err != nil {
+		log.Printf("HLS: ffprobe not found, serving videos without segmenting")
+		return passthroughTranscoder{}
+	}
+	tc := ffmpegTranscoder{ffmpeg: ffmpeg, ffprobe: ffprobe, remux: mode == hlsRemux}
+	if !tc.remux && !hasEncoder(ffmpeg, "libx264") {
+		log.Printf("HLS: ffmpeg has no libx264 encoder, remuxing without re-encoding")
+		tc.remux = true
+	}
+	return tc
+}
+
+func hasEncoder(ffmpeg, name string) bool {
+	out, err := exec.Command(ffmpeg, "-hide_banner", "-encoders").Output()
+	return err == nil && bytes.Contains(out, []byte(" "+name+" "))
+}
+
+// ffmpegTranscoder cuts segments with ffmpeg, re-encoding them unless
+// remux is set.
+type ffmpegTranscoder struct {
+	ffmpeg, ffprobe string
+	remux           bool
+}
+
+func (t ffmpegTranscoder) Name() string {
+	if t.remux {
+		return hlsRemux
+	}
+	return hlsTranscode
+}
+
+func (t ffmpegTranscoder) Probe(ctx context.Context, src string) (mediaInfo, error) {
+	out, err := exec.CommandContext(ctx, t.ffprobe, "-v", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "stream=width,height:format=duration,bit_rate,start_time",
+		"-of", "json", src).Output()
+	if err != nil {
+		return mediaInfo{}, fmt.Errorf("ffprobe: %w", err)
+	}
+	var probe struct {
+		Streams []struct {
+			Width  int `json:"width"`
+			Height int `json:"height"`
+		} `json:"streams"`
+		Format struct {
+			Duration  string `json:"duration"`
+			BitRate   string `json:"bit_rate"`
+			StartTime string `json:"start_time"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return mediaInfo{}, fmt.Errorf("ffprobe: %w", err)
+	}
+	var info mediaInfo
+	info.Duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	info.Bitrate, _ = strconv.Atoi(probe.Format.BitRate)
+	if len(probe.Streams) > 0 {
+		info.Width, info.Height = probe.Streams[0].Width, probe.Streams[0].Height
+	}
+	if info.Duration <= 0 {
+		return mediaInfo{}, fmt.Errorf("ffprobe: no duration for %s", src)
+	}
+	if t.remux {
+		start, _ := strconv.ParseFloat(probe.Format.StartTime, 64)
+		keyframes, err := t.keyframes(ctx, src, start)
+		if err != nil {
+			return mediaInfo{}, err
+		}
+		info.Cuts = keyframeCuts(keyframes, info.Duration)
+	}
+	return info, nil
+}
+
+// keyframes lists the video keyframe times of src, relative to its start
+// as -ss counts them. It reads the packet headers of the whole file but
+// decodes nothing.
+func (t ffmpegTranscoder) keyframes(ctx context.Context, src string, start float64) ([]float64, error) {
+	out, err := exec.CommandContext(ctx, t.ffprobe, "-v", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "packet=pts_time,flags",
+		"-of", "csv=p=0", src).Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe: %w", err)
+	}
+	var times []float64
+	for _, line := range strings.Split(string(out), "\n") {
+		pts, flags, _ := strings.Cut(strings.TrimSpace(line), ",")
+		if !strings.HasPrefix(flags, "K") {
+			continue
+		}
+		if sec, err := strconv.ParseFloat(pts, 64); err == nil {
+			times = append(times, sec-start)
+		}
+	}
+	sort.Float64s(times)
+	return times, nil
+}
+
+// keyframeCuts picks segment starts from the keyframes: the first keyframe
+// at least hlsSegmentSeconds after the previous cut. Times are rounded up
+// to the millisecond, since -ss with stream copy starts at the last
+// keyframe before the given time. A source without keyframes gets no cuts
+// and is segmented by time.
+func keyframeCuts(keyframes []float64, duration float64) []float64 {
+	if len(keyframes) == 0 {
+		return nil
+	}
+	cuts := []float64{0}
+	for _, k := range keyframes {
+		k = math.Ceil(k*1000) / 1000
+		if k >= cuts[len(cuts)-1]+hlsSegmentSeconds && k < duration {
+			cuts = append(cuts, k)
+		}
+	}
+	return cuts
+}
+
+func (t ffmpegTranscoder) Variants(info mediaInfo) []hlsVariant {
+	if t.remux {
+		bw := info.Bitrate
+		if bw <= 0 {
+			bw = 8000000
+		}
+		return []hlsVariant{{Name: "copy", Height: info.Height, Bandwidth: bw}}
+	}
+	var variants []hlsVariant
+	for _, v := range hlsLadder {
+		if info.Height == 0 || v.Height <= info.Height {
+			variants = append(variants, v)
+		}
+	}
+	if len(variants) == 0 {
+		variants = hlsLadder[len(hlsLadder)-1:]
+	}
+	return variants
+}
+
+// Segment cuts one segment. Re-encoding starts it on a fresh keyframe at
+// exactly start; a remux copies from the keyframe start lies on, which is
+// why remuxed sources are cut at info.Cuts.
+func (t ffmpegTranscoder) Segment(ctx context.Context, src string, v hlsVariant, start, dur float64, dst string) error {
+	args := []string{"-hide_banner", "-loglevel", "error", "-nostdin",
+		"-ss", fmtSeconds(start), "-i", src, "-t", fmtSeconds(dur),
+		"-map", "0:v:0", "-map", "0:a:0?", "-sn", "-dn"}
+	if t.remux {
+		args = append(args, "-c", "copy")
+	} else {
+		rate := v.Bandwidth - 128000
+		args = append(args,
+			"-vf", fmt.Sprintf("scale=-2:%d", v.Height),
+			"-c:v", "libx264", "-preset", "veryfast", "-profile:v", "main",
+			"-b:v", strconv.Itoa(rate), "-maxrate", strconv.Itoa(rate*107/100), "-bufsize", strconv.Itoa(rate*3/2),
+			"-c:a", "aac", "-ac", "2", "-b:a", "128k")
+	}
+	args = append(args, "-output_ts_offset", fmtSeconds(start), "-muxdelay", "0", "-f", "mpegts", "-y", dst)
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, t.ffmpeg, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) > 500 {
+			msg = msg[len(msg)-500:]
+		}
+		return fmt.Errorf("ffmpeg: %v: %s", err, msg)
+	}
+	return nil
+}
+
+// passthroughTranscoder is used without ffmpeg: the file is offered as is,
+// which plays wherever the browser supports the container.
+type passthroughTranscoder struct{}
+
+func (passthroughTranscoder) Name() string { return hlsPassthrough }
+
+func (passthroughTranscoder) Probe(ctx context.Context, src string) (mediaInfo, error) {
+	return mediaInfo{}, nil
+}
+
+func (passthroughTranscoder) Variants(info mediaInfo) []hlsVariant {
+	return []hlsVariant{{Name: "source", Bandwidth: 8000000, Passthrough: true}}
+}
+
+func (passthroughTranscoder) Segment(ctx context.Context, src string, v hlsVariant, start, dur float64, dst string) error {
+	return fmt.Errorf("passthrough cannot segment")
+}
+
+func fmtSeconds(s float64) string {
+	return strconv.FormatFloat(math.Max(s, 0), 'f', 3, 64)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// adminUser is the name of whoever logs in with AUTH_TOKEN. It has no
+// per-user quota and is the only user that may change settings.
+const adminUser = "admin"
+
+// userAccount is an extra login from USERS, e.g.
+//
+//	USERS=alice:secret1:200,bob:secret2
+//
+// gives alice a 200 GB quota and bob none beyond the global one.
+type userAccount struct {
+	Name  string
+	Token string
+}
+
+var userAccounts []userAccount
+
+// parseUsers reads the USERS list and records the quotas it assigns.
+func parseUsers(val string) ([]userAccount, map[string]int, error) {
+	var accounts []userAccount
+	quotas := map[string]int{}
+	for _, entry := range strings.Split(val, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+			return nil, nil, fmt.Errorf("USERS entry %q: want name:token[:quotaGB]", entry)
+		}
+		if parts[0] == adminUser {
+			return nil, nil, fmt.Errorf("USERS entry %q: %s is reserved for AUTH_TOKEN", entry, adminUser)
+		}
+		accounts = append(accounts, userAccount{Name: parts[0], Token: parts[1]})
+		if len(parts) == 3 {
+			gb, err := strconv.Atoi(parts[2])
+			if err != nil || gb < 1 {
+				return nil, nil, fmt.Errorf("USERS entry %q: invalid quota", entry)
+			}
+			quotas[parts[0]] = gb
+		}
+	}
+	return accounts, quotas, nil
+}
+
+// userForToken returns the user a token or password belongs to.
+func userForToken(token string) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(authToken)) == 1 {
+		return adminUser, true
+	}
+	for _, u := range userAccounts {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(u.Token)) == 1 {
+			return u.Name, true
+		}
+	}
+	return "", false
+}
+
+// tokenOf returns the token of user name. Protocols that only send a hash
+// of the password, like Subsonic, need it to check a login.
+func tokenOf(name string) (string, bool) {
+	if name == adminUser {
+		return authToken, true
+	}
+	for _, u := range userAccounts {
+		if u.Name == name {
+			return u.Token, true
+		}
+	}
+	return "", false
+}
+
+// requestUser is the user authMiddleware authenticated.
+func requestUser(r *http.Request) string {
+	name, _ := r.Context().Value(ctxUser).(string)
+	return name
+}
+
+// knownUser reports whether name is the admin or a USERS account.
+func knownUser(name string) bool {
+	if name == adminUser {
+		return true
+	}
+	for _, u := range userAccounts {
+		if u.Name == name {
+			return true
+		}
+	}
+	return false
+}
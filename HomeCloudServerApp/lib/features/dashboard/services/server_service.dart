@@ -91,11 +91,11 @@ class ServerService extends ChangeNotifier {
       final client = HttpClient();
       client.connectionTimeout = const Duration(seconds: 1);
       final request =
-          await client.getUrl(Uri.parse('http://localhost:$port/info'));
+          await client.getUrl(Uri.parse('http://localhost:$port/healthz'));
       final response = await request.close();
 
-      if (response.statusCode == 200 || response.statusCode == 401) {
-        // Server exists and is responding (even 401 means it's there)
+      if (response.statusCode == 200) {
+        // Server exists and is responding
         _status = ServerStatus.running;
         _startTime = DateTime.now(); // Estimate start time
         _addLog('[INFO] Found existing server instance running on port $port');